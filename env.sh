@@ -6,3 +6,121 @@ ISUCON_DB_NAME="isuride"
 
 # マッチング間隔（秒）
 ISUCON_MATCHING_INTERVAL=0.5
+
+# ランタイム・HTTPサーバーのチューニング（未設定ならデフォルト）
+# ISUCON_GOMAXPROCS=
+# ISUCON_GC_PERCENT=100
+# ISUCON_MAX_CONNS=
+# ISUCON_MAX_CONNS_PER_IP=
+# ISUCON_KEEP_ALIVE=true
+# ISUCON_IDLE_TIMEOUT=60s
+
+# 過負荷時にポーリング系APIを503で断る閾値（0なら無効）
+# ISUCON_SHED_MAX_INFLIGHT=0
+# ISUCON_SHED_MAX_DB_WAIT=0
+# ISUCON_SHED_RETRY_AFTER=1s
+
+# バッチマッチングをゾーン（座標の区画）ごとに行う（0なら分けない）
+# ISUCON_MATCHING_ZONE_SIZE=0
+# ISUCON_MATCHING_ZONE_PARALLEL=false
+# 配車位置からこれより遠い椅子は割り当てない（0なら制限しない）
+# ISUCON_MATCHING_MAX_PICKUP_DISTANCE=0
+
+# 割り当てた椅子が応答しないままのライドをマッチングに戻すまでの時間（0なら無効）
+# ISUCON_STALE_RIDE_TIMEOUT=0
+# ISUCON_STALE_RIDE_INTERVAL=5s
+
+# ライドを運んでいる椅子に次のライドを予約しておく（空かなければTTLで取り消す）
+# ISUCON_MATCHING_PREASSIGN=false
+# ISUCON_MATCHING_PREASSIGN_TTL=30s
+
+# 通知のポーリング間隔（負荷に応じてMINからMAXの間で伸ばす）
+# ISUCON_NOTIFICATION_RETRY_MIN=30ms
+# ISUCON_NOTIFICATION_RETRY_MAX=1s
+
+# 通知したステータスを確認応答(POST /api/{app,chair}/notification/ack)があるまで送り直す
+# ISUCON_NOTIFICATION_ACK=false
+# ISUCON_NOTIFICATION_ACK_TIMEOUT=3s
+
+# 椅子のWebSocket(/api/chair/ws)
+# ISUCON_WS_IDLE_TIMEOUT=1m
+# ISUCON_WS_WRITE_TIMEOUT=5s
+# ISUCON_WS_MAX_MESSAGE_SIZE=65536
+
+# 椅子の情報とセッションのキャッシュの有効期限（0なら期限なし）
+# ISUCON_CHAIR_CACHE_TTL=1m
+# ISUCON_SESSION_CACHE_TTL=10m
+# キャッシュの置き場所（memory か redis）。memoryでは期限切れを掃除する間隔（0なら掃除しない）
+# ISUCON_CACHE_BACKEND=memory
+# ISUCON_CACHE_SWEEP_INTERVAL=30s
+# ISUCON_REDIS_ADDR=127.0.0.1:6379
+# ISUCON_REDIS_POOL_SIZE=64
+# ISUCON_REDIS_TIMEOUT=1s
+# ISUCON_REDIS_PREFIX=isuride:
+# インメモリキャッシュのロックの分割数
+# ISUCON_CACHE_SHARDS=16
+
+# 椅子の座標の書き込みをまとめて行う（DBへの反映はINTERVALまで遅れる）
+# ISUCON_CHAIR_LOCATION_BATCH=false
+# ISUCON_CHAIR_LOCATION_BATCH_INTERVAL=20ms
+# ISUCON_CHAIR_LOCATION_BATCH_SIZE=500
+
+# ride_statusesの書き込みをまとめて行う（DBへの反映はINTERVALまで遅れる。書き込めた行数と速さは/api/internal/statsで見られる）
+# ISUCON_RIDE_STATUS_BATCH=false
+# ISUCON_RIDE_STATUS_BATCH_INTERVAL=20ms
+# ISUCON_RIDE_STATUS_BATCH_SIZE=500
+# 書き込みに失敗した行を書き直す回数の上限
+# ISUCON_RIDE_STATUS_BATCH_MAX_ATTEMPTS=5
+
+# 起動時に webapp/go/migrations の未適用のマイグレーションを適用する（./isuride migrate でも適用できる）
+# ISUCON_MIGRATE_ON_START=true
+# ISUCON_MIGRATE_LOCK_TIMEOUT=1m
+
+# 読み取り専用のクエリ（売上、椅子の統計、ライド検索）を流すレプリカ（未設定ならプライマリから読む）
+# ISUCON_DB_REPLICA_HOST=
+# ISUCON_DB_REPLICA_PORT=3306
+# ISUCON_DB_REPLICA_HEALTH_INTERVAL=1s
+# ISUCON_DB_REPLICA_HEALTH_TIMEOUT=500ms
+
+# DBのコネクションプールとタイムアウト（READ_TIMEOUTは0なら切らない）
+# ISUCON_DB_MAX_OPEN_CONNS=64
+# ISUCON_DB_MAX_IDLE_CONNS=64
+# ISUCON_DB_CONN_MAX_LIFETIME=5m
+# ISUCON_DB_CONN_MAX_IDLE_TIME=2m
+# ISUCON_DB_DIAL_TIMEOUT=3s
+# ISUCON_DB_READ_TIMEOUT=0
+# ISUCON_DB_WRITE_TIMEOUT=10s
+
+# THRESHOLDより遅いクエリをログに出し、遅い順にTOP件を /api/internal/slow-queries で見られるようにする
+# ISUCON_SLOW_QUERY_LOG=false
+# ISUCON_SLOW_QUERY_THRESHOLD=100ms
+# ISUCON_SLOW_QUERY_TOP=50
+
+# 予約したライドを予約日時のLEAD前になったら作成してマッチングに回す（INTERVALを0にすると止まる）
+# ISUCON_SCHEDULED_RIDE_LEAD=1m
+# ISUCON_SCHEDULED_RIDE_INTERVAL=1s
+# ISUCON_SCHEDULED_RIDE_BATCH_SIZE=100
+# ISUCON_SCHEDULED_RIDE_MAX_AHEAD=168h
+
+# ライド作成時に指定できる経由地の数の上限
+# ISUCON_RIDE_MAX_WAYPOINTS=5
+
+# 評価と一緒に送れるチップの上限
+# ISUCON_MAX_RIDE_TIP=10000
+
+# 乗車確認のPIN（有効にすると椅子はユーザーに通知したPINを送らないとCARRYINGにできない）
+# ISUCON_PICKUP_PIN=false
+# ISUCON_PICKUP_PIN_MAX_ATTEMPTS=5
+
+# オーナー向けの椅子の稼働状況を集計する間隔（0にすると集計しない）
+# ISUCON_CHAIR_UTILIZATION_INTERVAL=10s
+
+# オーナーがトークンを発行し直した後、前のトークンを受け付ける期間
+# ISUCON_OWNER_TOKEN_GRACE_PERIOD=10m
+
+# オーナーのWebhookを配信する間隔（0にすると配信しない）と、失敗したときの再送
+# ISUCON_OWNER_WEBHOOK_INTERVAL=1s
+# ISUCON_OWNER_WEBHOOK_BATCH_SIZE=100
+# ISUCON_OWNER_WEBHOOK_MAX_ATTEMPTS=8
+# ISUCON_OWNER_WEBHOOK_BACKOFF=1s
+# ISUCON_OWNER_WEBHOOK_MAX_BACKOFF=1h
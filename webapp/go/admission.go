@@ -0,0 +1,106 @@
+// webapp/go/admission.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 過負荷時の流量制御
+// 処理中のリクエスト数とDBコネクションプールの待ち時間を見て、閾値を超えたら
+// 再試行してもらっても困らないポーリング系のAPI(nearby-chairs・notification)だけ503で断る
+type admissionController struct {
+	// 0なら判定に使わない
+	maxInflight int64
+	maxDBWait   time.Duration
+	retryAfter  time.Duration
+
+	inflight atomic.Int64
+	// 直近のサンプリング間隔での1回あたりのコネクション待ち時間
+	dbWait atomic.Int64
+	shed   atomic.Int64
+}
+
+var admission = &admissionController{
+	maxInflight: int64(getEnvInt("ISUCON_SHED_MAX_INFLIGHT", 0)),
+	maxDBWait:   getEnvDuration("ISUCON_SHED_MAX_DB_WAIT", 0),
+	retryAfter:  getEnvDuration("ISUCON_SHED_RETRY_AFTER", time.Second),
+}
+
+// すべてのリクエストの処理中の数を数える
+func (a *admissionController) Track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 開きっぱなしのSSEやWebSocketの接続は処理中のリクエストに数えない
+		if wantsEventStream(r) || isWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		a.inflight.Add(1)
+		defer a.inflight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admissionController) overloaded() bool {
+	if a.maxInflight > 0 && a.inflight.Load() > a.maxInflight {
+		return true
+	}
+	if a.maxDBWait > 0 && time.Duration(a.dbWait.Load()) > a.maxDBWait {
+		return true
+	}
+	return false
+}
+
+// 過負荷なら503とRetry-Afterを返す。認証より前に置いてDBに触らずに断る
+func (a *admissionController) Shed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.overloaded() {
+			a.shed.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(a.retryAfter.Round(time.Second)/time.Second))))
+			w.Header().Set("X-Retry-After-Ms", strconv.FormatInt(a.retryAfter.Milliseconds(), 10))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DBのコネクション待ちを定期的にサンプリングする
+func (a *admissionController) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prev sql.DBStats
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stats := db.Stats()
+		waits := stats.WaitCount - prev.WaitCount
+		if waits > 0 {
+			a.dbWait.Store(int64((stats.WaitDuration - prev.WaitDuration) / time.Duration(waits)))
+		} else {
+			a.dbWait.Store(0)
+		}
+		prev = stats
+	}
+}
+
+type admissionStats struct {
+	Inflight int64 `json:"inflight"`
+	DBWaitMs int64 `json:"db_wait_ms"`
+	Shed     int64 `json:"shed"`
+}
+
+func (a *admissionController) Stats() admissionStats {
+	return admissionStats{
+		Inflight: a.inflight.Load(),
+		DBWaitMs: time.Duration(a.dbWait.Load()).Milliseconds(),
+		Shed:     a.shed.Load(),
+	}
+}
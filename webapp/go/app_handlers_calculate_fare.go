@@ -5,23 +5,121 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
 )
 
 func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
+	return calculateRouteFare(calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude))
 }
 
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
+// 経由地を含めた経路の距離に対する基本の倍率での運賃
+func calculateRouteFare(distance int) int {
+	return initialFare + calculateMeteredFare(defaultFareRate, distance)
+}
+
+// 距離に応じた運賃。rateは椅子モデルごとの倍率(%)
+func calculateMeteredFare(rate int, distance int) int {
+	return farePerDistance * distance * rate / 100
+}
+
+// 椅子モデルごとの運賃倍率(%)。chair_models.fare_rateをメモリに持っておく
+const defaultFareRate = 100
+
+type fareRateTable struct {
+	mu    sync.RWMutex
+	rates map[string]int
+}
+
+var fareRates = &fareRateTable{rates: map[string]int{}}
+
+func (t *fareRateTable) Load(ctx context.Context) error {
+	models := []ChairModel{}
+	if err := db.SelectContext(ctx, &models, "SELECT * FROM chair_models"); err != nil {
+		return err
+	}
+	rates := make(map[string]int, len(models))
+	for _, m := range models {
+		rates[m.Name] = m.FareRate
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rates = rates
+	return nil
+}
+
+func (t *fareRateTable) Get(model string) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if rate, ok := t.rates[model]; ok {
+		return rate
+	}
+	return defaultFareRate
+}
+
+func (t *fareRateTable) Set(model string, rate int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rates[model] = rate
+}
+
+// ライドに割り当てられた椅子のモデルの倍率。未割り当てなら基本の倍率
+func rideFareRate(ctx context.Context, tx *sqlx.Tx, ride *Ride) (int, error) {
+	if ride == nil || !ride.ChairID.Valid {
+		return defaultFareRate, nil
+	}
+	if model, ok := chairAvailability.ChairModel(ride.ChairID.String); ok {
+		return fareRates.Get(model), nil
+	}
+	model := ""
+	if err := tx.GetContext(ctx, &model, "SELECT model FROM chairs WHERE id = ?", ride.ChairID.String); err != nil {
+		return 0, err
+	}
+	return fareRates.Get(model), nil
+}
+
+// ライド完了時に確定する運賃
+type rideFare struct {
+	// 割引後の請求額
+	Fare int
+	// 割引前の運賃。オーナーの売上になる
+	GrossFare int
+}
+
+func calculateRideFare(ctx context.Context, tx *sqlx.Tx, ride *Ride) (rideFare, error) {
+	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, rideDistance(ride))
+	if err != nil {
+		return rideFare{}, err
+	}
+	rate, err := rideFareRate(ctx, tx, ride)
+	if err != nil {
+		return rideFare{}, err
+	}
+	return rideFare{
+		Fare:      fare,
+		GrossFare: initialFare + calculateMeteredFare(rate, rideDistance(ride)),
+	}, nil
+}
+
+// 完了したライドの請求額。保存されていなければ計算し直す
+func completedRideFare(ctx context.Context, tx *sqlx.Tx, ride *Ride) (int, error) {
+	if ride.Fare != nil {
+		return *ride.Fare, nil
+	}
+	f, err := calculateRideFare(ctx, tx, ride)
+	if err != nil {
+		return 0, err
+	}
+	return f.Fare, nil
+}
+
+// distanceは経由地を含めた経路の距離。rideがあればそのライドの経路を使う
+func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, distance int) (int, error) {
 	var coupon Coupon
 	discount := 0
 	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
+		distance = rideDistance(ride)
 
 		// すでにクーポンが紐づいているならそれの割引額を参照
 		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
@@ -51,7 +149,11 @@ func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ri
 		}
 	}
 
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+	rate, err := rideFareRate(ctx, tx, ride)
+	if err != nil {
+		return 0, err
+	}
+	meteredFare := calculateMeteredFare(rate, distance)
 	discountedMeteredFare := max(meteredFare-discount, 0)
 
 	return initialFare + discountedMeteredFare, nil
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// 完了時に保存した運賃があれば、クーポンや椅子を読まずにそれを使う
+func TestCompletedRideFareUsesStoredFare(t *testing.T) {
+	mock := setupMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	stored := 1234
+	ride := &Ride{ID: "ride-1", Fare: &stored, ChairID: sql.NullString{String: "chair-1", Valid: true}}
+	fare, err := completedRideFare(context.Background(), tx, ride)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fare != stored {
+		t.Errorf("fare = %d, want %d", fare, stored)
+	}
+}
+
+// 完了時に保存する運賃。請求額はクーポンで割り引き、オーナーの売上になる運賃は割り引かない
+func TestCalculateRideFare(t *testing.T) {
+	mock := setupMockDB(t)
+	fareRates.Set("fare-test-model", 150)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM coupons WHERE used_by = \?`).
+		WithArgs("ride-1").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "code", "discount"}).AddRow("user-1", "CP_TEST", 300))
+	mock.ExpectQuery(`SELECT model FROM chairs WHERE id = \?`).
+		WithArgs("fare-test-chair").
+		WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow("fare-test-model"))
+	mock.ExpectQuery(`SELECT model FROM chairs WHERE id = \?`).
+		WithArgs("fare-test-chair").
+		WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow("fare-test-model"))
+	mock.ExpectRollback()
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	distance := 10
+	ride := &Ride{ID: "ride-1", UserID: "user-1", RouteDistance: &distance, ChairID: sql.NullString{String: "fare-test-chair", Valid: true}}
+	fare, err := calculateRideFare(context.Background(), tx, ride)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 初乗り500 + 距離10 * 100 * 150%
+	want := rideFare{Fare: 500 + 1500 - 300, GrossFare: 500 + 1500}
+	if fare != want {
+		t.Errorf("fare = %+v, want %+v", fare, want)
+	}
+}
@@ -3,45 +3,39 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
-
-	"github.com/jmoiron/sqlx"
 )
 
-func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
+var chairStatsFlight flightGroup[appGetNotificationResponseChairStats]
+
+// 同じ椅子の統計を同時に求められたら1回だけ集計する。リクエストのトランザクションの外で読む
+func getSharedChairStats(ctx context.Context, chairID string) (appGetNotificationResponseChairStats, error) {
+	// 最初の呼び出しが切断されても待っている呼び出しのために集計は続ける
+	ctx = context.WithoutCancel(ctx)
+	return chairStatsFlight.Do(chairID, func() (appGetNotificationResponseChairStats, error) {
+		return getChairStats(ctx, readDB(), chairID)
+	})
+}
+
+// 評価を書き込むときにchair_statsへ足し込んであるので、1行読むだけで済む
+func getChairStats(ctx context.Context, tx executableGet, chairID string) (appGetNotificationResponseChairStats, error) {
 	stats := appGetNotificationResponseChairStats{}
 
-	// 1回のクエリで必要なデータをすべて取得
 	var result struct {
 		TotalRides      int     `db:"total_rides"`
 		TotalEvaluation float64 `db:"total_evaluation"`
 	}
-
-	err := tx.GetContext(
-		ctx,
-		&result,
-		`WITH completed_rides AS (
-			SELECT DISTINCT r.id, r.evaluation
-			FROM rides r
-			JOIN ride_statuses rs_completed ON r.id = rs_completed.ride_id
-			JOIN ride_statuses rs_arrived ON r.id = rs_arrived.ride_id
-			JOIN ride_statuses rs_carrying ON r.id = rs_carrying.ride_id
-			WHERE r.chair_id = ?
-			AND rs_completed.status = 'COMPLETED'
-			AND rs_arrived.status = 'ARRIVED'
-			AND rs_carrying.status = 'CARRYING'
-			AND r.evaluation IS NOT NULL
-		)
-		SELECT
-			COUNT(*) as total_rides,
-			COALESCE(SUM(evaluation), 0) as total_evaluation
-		FROM completed_rides`,
-		chairID,
-	)
-	if err != nil {
+	if err := tx.GetContext(ctx, &result, `SELECT total_rides, total_evaluation FROM chair_stats WHERE chair_id = ?`, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return stats, nil
+		}
 		return stats, err
 	}
 
@@ -63,13 +57,16 @@ type appGetNearbyChairsResponseChair struct {
 	Name              string     `json:"name"`
 	Model             string     `json:"model"`
 	CurrentCoordinate Coordinate `json:"current_coordinate"`
+	// 今の位置から指定した位置までモデルの速さで移動する見込み時間
+	EstimatedPickupSeconds int64 `json:"estimated_pickup_seconds"`
 }
 
 func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
 	latStr := r.URL.Query().Get("latitude")
 	lonStr := r.URL.Query().Get("longitude")
 	distanceStr := r.URL.Query().Get("distance")
+	limitStr := r.URL.Query().Get("limit")
+	sortBy := r.URL.Query().Get("sort")
 	if latStr == "" || lonStr == "" {
 		writeError(w, http.StatusBadRequest, errors.New("latitude or longitude is empty"))
 		return
@@ -96,57 +93,64 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	type nearbyChair struct {
-		ID        string `db:"id"`
-		Name      string `db:"name"`
-		Model     string `db:"model"`
-		Latitude  int    `db:"latitude"`
-		Longitude int    `db:"longitude"`
-	}
-
-	// 1つのクエリですべての情報を取得
-	query := `
-        SELECT
-            c.id,
-            c.name,
-            c.model,
-            cl.latitude,
-            cl.longitude
-        FROM chairs c
-        JOIN (
-            SELECT chair_id, latitude, longitude
-            FROM chair_locations cl1
-            WHERE created_at = (
-                SELECT MAX(created_at)
-                FROM chair_locations cl2
-                WHERE cl1.chair_id = cl2.chair_id
-            )
-        ) cl ON c.id = cl.chair_id
-        WHERE c.is_active = TRUE
-        AND NOT EXISTS (
-            SELECT 1
-            FROM rides r
-            JOIN ride_statuses rs ON r.id = rs.ride_id
-            WHERE r.chair_id = c.id
-            AND rs.status != 'COMPLETED'
-            AND rs.created_at = (
-                SELECT MAX(created_at)
-                FROM ride_statuses
-                WHERE ride_id = r.id
-            )
-        )
-        AND ABS(cl.latitude - ?) + ABS(cl.longitude - ?) <= ?
-    `
-
-	chairs := []nearbyChair{}
-	if err := db.SelectContext(ctx, &chairs, query, lat, lon, distance); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	// 0なら範囲内の椅子をすべて返す
+	limit := 0
+	if limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit is invalid"))
+			return
+		}
+	}
+
+	if sortBy != "" && sortBy != "eta" && sortBy != "distance" {
+		writeError(w, http.StatusBadRequest, errors.New("sort must be eta or distance"))
 		return
 	}
 
-	response := make([]appGetNearbyChairsResponseChair, len(chairs))
-	for i, chair := range chairs {
-		response[i] = appGetNearbyChairsResponseChair{
+	type nearbyChair struct {
+		availableChair
+		distance int
+		eta      time.Duration
+	}
+	nearby := []nearbyChair{}
+	for _, chair := range chairAvailability.AvailableWithin(lat, lon, distance) {
+		d := calculateDistance(chair.Latitude, chair.Longitude, lat, lon)
+		if d > distance {
+			continue
+		}
+		nearby = append(nearby, nearbyChair{
+			availableChair: chair,
+			distance:       d,
+			eta:            estimateTravelTime(chair.Latitude, chair.Longitude, lat, lon, chair.Speed),
+		})
+	}
+
+	// 同じ値の椅子はIDの順に並べて、並びが毎回変わらないようにする
+	sort.Slice(nearby, func(i, j int) bool {
+		a, b := nearby[i], nearby[j]
+		switch sortBy {
+		case "eta":
+			if a.eta != b.eta {
+				return a.eta < b.eta
+			}
+		case "distance":
+			if a.distance != b.distance {
+				return a.distance < b.distance
+			}
+		}
+		return a.ID < b.ID
+	})
+	if limit > 0 && len(nearby) > limit {
+		nearby = nearby[:limit]
+	}
+
+	// retrieved_atは毎回変わるので、椅子の一覧だけからETagを作る
+	h := fnv.New64a()
+	response := []appGetNearbyChairsResponseChair{}
+	for _, chair := range nearby {
+		fmt.Fprintf(h, "%s,%d,%d;", chair.ID, chair.Latitude, chair.Longitude)
+		response = append(response, appGetNearbyChairsResponseChair{
 			ID:    chair.ID,
 			Name:  chair.Name,
 			Model: chair.Model,
@@ -154,7 +158,12 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 				Latitude:  chair.Latitude,
 				Longitude: chair.Longitude,
 			},
-		}
+			EstimatedPickupSeconds: int64((chair.eta + time.Second - 1) / time.Second),
+		})
+	}
+
+	if checkETag(w, r, fmt.Sprintf(`W/"%x"`, h.Sum64())) {
+		return
 	}
 
 	writeJSON(w, http.StatusOK, &appGetNearbyChairsResponse{
@@ -162,3 +171,80 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 		RetrievedAt: time.Now().UnixMilli(),
 	})
 }
+
+type appGetRideChairPositionResponse struct {
+	RideID     string     `json:"ride_id"`
+	ChairID    string     `json:"chair_id"`
+	Status     string     `json:"status"`
+	Coordinate Coordinate `json:"coordinate"`
+	// 位置を記録した日時 (UNIXミリ秒)
+	LocatedAt int64 `json:"located_at"`
+	// ENROUTEなら配車位置、CARRYINGなら残りの経由地を回って目的地に着くまでの見込み時間
+	EstimatedArrivalMs int64 `json:"estimated_arrival_ms"`
+}
+
+// 乗車中・配車待ちのライドに割り当てられた椅子の今の位置。位置はDBではなくchairAvailabilityから読む
+func appGetRideChairPosition(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride, err := reposFrom(ctx).Rides.With(tx).Get(ctx, rideID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ride.UserID != user.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+	status := ride.LatestStatus.String
+	if status != "ENROUTE" && status != "CARRYING" {
+		writeError(w, http.StatusBadRequest, errors.New("chair position is available only while the ride is ENROUTE or CARRYING"))
+		return
+	}
+	chair, ok := chairAvailability.LastLocation(ride.ChairID.String)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("chair position is unknown"))
+		return
+	}
+
+	position := Coordinate{Latitude: chair.Latitude, Longitude: chair.Longitude}
+	pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	destination := Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+	distance := routeDistance(position, nil, pickup)
+	if status == "CARRYING" {
+		route, err := getRideRouteProgress(ctx, tx, ride)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		remaining := []Coordinate{}
+		if route != nil {
+			for _, waypoint := range route.Waypoints[route.CurrentLeg:] {
+				remaining = append(remaining, waypoint.Coordinate)
+			}
+		}
+		distance = routeDistance(position, remaining, destination)
+	}
+
+	writeJSON(w, http.StatusOK, &appGetRideChairPositionResponse{
+		RideID:             ride.ID,
+		ChairID:            chair.ID,
+		Status:             status,
+		Coordinate:         position,
+		LocatedAt:          chair.LocatedAt.UnixMilli(),
+		EstimatedArrivalMs: estimateDistanceTime(distance, chair.Speed).Milliseconds(),
+	})
+}
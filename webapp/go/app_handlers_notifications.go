@@ -2,14 +2,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"net/http"
+	"time"
 )
 
 type appGetNotificationResponse struct {
 	Data         *appGetNotificationResponseData `json:"data"`
 	RetryAfterMs int                             `json:"retry_after_ms"`
+	// If-None-Matchに入れて送ると、変化がなければ304が返る
+	Version string `json:"version,omitempty"`
 }
 
 type appGetNotificationResponseData struct {
@@ -18,9 +22,16 @@ type appGetNotificationResponseData struct {
 	DestinationCoordinate Coordinate                       `json:"destination_coordinate"`
 	Fare                  int                              `json:"fare"`
 	Status                string                           `json:"status"`
+	StatusMessage         string                           `json:"status_message"`
 	Chair                 *appGetNotificationResponseChair `json:"chair,omitempty"`
 	CreatedAt             int64                            `json:"created_at"`
 	UpdateAt              int64                            `json:"updated_at"`
+	// 確認応答(ISUCON_NOTIFICATION_ACK)を使うときに返すride_statusesのID
+	StatusID string `json:"status_id,omitempty"`
+	// 経由地のあるライドだけ
+	Route *rideRouteProgress `json:"route,omitempty"`
+	// 乗車確認のPIN。乗るまでの間だけ返す
+	PickupPin string `json:"pickup_pin,omitempty"`
 }
 
 type appGetNotificationResponseChair struct {
@@ -39,46 +50,75 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
 
+	if wantsEventStream(r) {
+		appStreamNotification(w, r, user)
+		return
+	}
+
+	serveNotification(w, r, userNotificationKey(user.ID), func(unchanged func(string) bool) (any, string, error) {
+		response, err := getAppNotification(ctx, user, unchanged)
+		if response == nil || err != nil {
+			return nil, "", err
+		}
+		return response, response.Version, nil
+	})
+}
+
+// ユーザーのライドの通知を組み立て、未通知のステータスを含めたら通知済みにする
+// unchangedが前回から変化がないと判断したらnilを返す
+func getAppNotification(ctx context.Context, user *User, unchanged func(version string) bool) (*appGetNotificationResponse, error) {
+	key := userNotificationKey(user.ID)
+	seq := notifications.Seq(key)
+
 	tx, err := db.Beginx()
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
 	}
 	defer tx.Rollback()
 
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
+	ride, err := reposFrom(ctx).Rides.With(tx).LatestByUser(ctx, user.ID)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &appGetNotificationResponse{
-				RetryAfterMs: 30,
-			})
-			return
+			return &appGetNotificationResponse{
+				RetryAfterMs: calculateRetryAfterMs(),
+			}, nil
 		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
 	}
 
 	yetSentRideStatus := RideStatus{}
 	status := ""
-	if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
+	if yetSentRideStatus, err = getUnsentRideStatus(ctx, tx, ride.ID, appNotificationTarget); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			status, err = getLatestRideStatus(ctx, tx, ride.ID)
 			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
+				return nil, err
 			}
 		} else {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, err
 		}
 	} else {
 		status = yetSentRideStatus.Status
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	// 未通知のステータスがなく前回から変化がなければ、運賃や椅子の統計を引き直さない
+	route, err := getRideRouteProgress(ctx, tx, ride)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
+	}
+	progress := notificationProgress(status, route)
+	version := notificationVersion(ride.ID, ride.ChairID.String, progress)
+	// 確認応答を待つ場合は、応答がないと送り直すのでDBを見に行かせる
+	if yetSentRideStatus.ID == "" && !notificationAckEnabled {
+		notifications.Delivered(key, seq, ride.ID, ride.ChairID.String, progress)
+	}
+	if yetSentRideStatus.ID == "" && unchanged(version) {
+		return nil, nil
+	}
+
+	fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, rideDistance(ride))
+	if err != nil {
+		return nil, err
 	}
 
 	response := &appGetNotificationResponse{
@@ -92,25 +132,35 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 				Latitude:  ride.DestinationLatitude,
 				Longitude: ride.DestinationLongitude,
 			},
-			Fare:      fare,
-			Status:    status,
-			CreatedAt: ride.CreatedAt.UnixMilli(),
-			UpdateAt:  ride.UpdatedAt.UnixMilli(),
+			Fare:          fare,
+			Status:        status,
+			StatusMessage: localize(langFromContext(ctx), "status."+status, status),
+			CreatedAt:     ride.CreatedAt.UnixMilli(),
+			UpdateAt:      ride.UpdatedAt.UnixMilli(),
+			StatusID:      ackStatusID(yetSentRideStatus.ID),
+			Route:         route,
 		},
-		RetryAfterMs: 30,
+		RetryAfterMs: calculateRetryAfterMs(),
+		Version:      version,
+	}
+	if ride.PickupPin.Valid && (status == "MATCHING" || status == "ENROUTE" || status == "PICKUP") {
+		response.Data.PickupPin = ride.PickupPin.String
 	}
 
 	if ride.ChairID.Valid {
-		chair := &Chair{}
-		if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+		chair, ok := chairCache.Load(ctx, ride.ChairID.String)
+		if !ok {
+			c, err := reposFrom(ctx).Chairs.With(tx).Get(ctx, ride.ChairID.String)
+			if err != nil {
+				return nil, err
+			}
+			chair = *c
+			chairCache.Store(ctx, c)
 		}
 
-		stats, err := getChairStats(ctx, tx, chair.ID)
+		stats, err := getSharedChairStats(ctx, chair.ID)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, err
 		}
 
 		response.Data.Chair = &appGetNotificationResponseChair{
@@ -122,17 +172,61 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if yetSentRideStatus.ID != "" {
-		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+		if err := markRideStatusSent(ctx, tx, yetSentRideStatus.ID, appNotificationTarget); err != nil {
+			return nil, err
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// ライドのステータスが変わるたびに通知を送り続ける
+func appStreamNotification(w http.ResponseWriter, r *http.Request, user *User) {
+	ctx := r.Context()
+	changed, cancel := notifications.Subscribe(userNotificationKey(user.ID))
+	defer cancel()
+
+	stream, err := startEventStream(w)
+	if err != nil {
 		return
 	}
+	ticker := time.NewTicker(sseFallbackInterval)
+	defer ticker.Stop()
+
+	lastVersion := ""
+	for {
+		// 未通知のステータスが溜まっていれば続けて送る
+		for {
+			if version, ok := notifications.Version(userNotificationKey(user.ID)); ok && version == lastVersion {
+				break
+			}
+			response, err := getAppNotification(ctx, user, func(version string) bool {
+				return version == lastVersion
+			})
+			if err != nil {
+				if ctx.Err() == nil {
+					stream.Send("error", map[string]string{"message": err.Error()})
+				}
+				return
+			}
+			if response == nil || response.Data == nil {
+				break
+			}
+			if err := stream.Send("notification", response); err != nil {
+				return
+			}
+			lastVersion = response.Version
+		}
 
-	writeJSON(w, http.StatusOK, response)
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
 }
@@ -0,0 +1,113 @@
+// webapp/go/app_handlers_receipt.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// 完了したライドの料金の内訳。クライアントが運賃のルールを持たずに領収書を描けるようにする
+// 金額は完了時に保存した運賃から組み立てるので、後からモデルの倍率が変わっても請求額と食い違わない
+type appGetRideReceiptResponse struct {
+	RideID string `json:"ride_id"`
+	// 初乗り運賃
+	BaseFare int `json:"base_fare"`
+	// 経由地を含めた経路の距離
+	Distance int `json:"distance"`
+	// 距離に応じた運賃(倍率をかける前)
+	DistanceFare int `json:"distance_fare"`
+	// 椅子のモデルごとの運賃倍率
+	SurgeMultiplier float64 `json:"surge_multiplier"`
+	// 倍率をかけた後の距離に応じた運賃
+	MeteredFare int `json:"metered_fare"`
+	// 割引前の運賃(base_fare + metered_fare)
+	GrossFare int `json:"gross_fare"`
+	// クーポンによる割引額
+	Discount   int    `json:"discount"`
+	CouponCode string `json:"coupon_code,omitempty"`
+	// 割引後の運賃
+	Fare  int `json:"fare"`
+	Tip   int `json:"tip"`
+	Total int `json:"total"`
+
+	Evaluation  int   `json:"evaluation"`
+	RequestedAt int64 `json:"requested_at"`
+	CompletedAt int64 `json:"completed_at"`
+}
+
+func appGetRideReceipt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride, err := reposFrom(ctx).Rides.With(tx).Get(ctx, rideID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ride.UserID != user.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+	if ride.LatestStatus.String != "COMPLETED" || ride.Evaluation == nil {
+		writeError(w, http.StatusBadRequest, newAPIError(errCodeInvalidStatusTransition, errors.New("ride is not completed yet")))
+		return
+	}
+
+	// 運賃を保存する前に完了したライドは計算し直す
+	fare := rideFare{}
+	if ride.Fare != nil && ride.GrossFare != nil {
+		fare = rideFare{Fare: *ride.Fare, GrossFare: *ride.GrossFare}
+	} else if fare, err = calculateRideFare(ctx, tx, ride); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	couponCode := ""
+	if err := tx.GetContext(ctx, &couponCode, `SELECT code FROM coupons WHERE used_by = ?`, ride.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	distance := rideDistance(ride)
+	distanceFare := farePerDistance * distance
+	meteredFare := fare.GrossFare - initialFare
+	surge := 1.0
+	if distanceFare > 0 {
+		surge = float64(meteredFare) / float64(distanceFare)
+	}
+	tip := 0
+	if ride.Tip != nil {
+		tip = *ride.Tip
+	}
+
+	writeJSON(w, http.StatusOK, &appGetRideReceiptResponse{
+		RideID:          ride.ID,
+		BaseFare:        initialFare,
+		Distance:        distance,
+		DistanceFare:    distanceFare,
+		SurgeMultiplier: surge,
+		MeteredFare:     meteredFare,
+		GrossFare:       fare.GrossFare,
+		Discount:        fare.GrossFare - fare.Fare,
+		CouponCode:      couponCode,
+		Fare:            fare.Fare,
+		Tip:             tip,
+		Total:           fare.Fare + tip,
+		Evaluation:      *ride.Evaluation,
+		RequestedAt:     ride.CreatedAt.UnixMilli(),
+		CompletedAt:     ride.UpdatedAt.UnixMilli(),
+	})
+}
@@ -5,14 +5,18 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
 type getAppRidesResponse struct {
-	Rides []getAppRidesResponseItem `json:"rides"`
+	Rides      []getAppRidesResponseItem `json:"rides"`
+	NextCursor string                    `json:"next_cursor,omitempty"`
 }
 
 type getAppRidesResponseItem struct {
@@ -37,41 +41,42 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
 
-	tx, err := db.Beginx()
+	page, err := parsePageParams(r, 100)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	defer tx.Rollback()
 
-	// JOIN を使用して1回のクエリで必要なデータを取得
-	type rideWithStatus struct {
-		Ride
-		Status string `db:"latest_status"`
+	repos := reposFrom(ctx)
+	tx, err := repos.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
+	defer tx.Rollback()
 
-	rides := []rideWithStatus{}
+	// ULIDは作成順に並ぶので、IDの降順で新しい順になる
+	// 保持期間を過ぎてrides_archiveに移したライドも履歴に含める。rides_archiveには完了済みのライドしか入らない
+	cursorCond, cursorArgs := page.cursorCondition("id", true)
+	args := append([]any{user.ID}, cursorArgs...)
+	args = append(args, user.ID)
+	args = append(args, cursorArgs...)
+	rides := []Ride{}
 	if err := tx.SelectContext(
 		ctx,
 		&rides,
-		`SELECT r.*, rs.status as latest_status
-         FROM rides r
-         JOIN (
-             SELECT ride_id, status
-             FROM ride_statuses rs1
-             WHERE created_at = (
-                 SELECT MAX(created_at)
-                 FROM ride_statuses rs2
-                 WHERE rs1.ride_id = rs2.ride_id
-             )
-         ) rs ON r.id = rs.ride_id
-         WHERE r.user_id = ?
-         ORDER BY r.created_at DESC`,
-		user.ID,
+		`SELECT r.* FROM (
+           SELECT * FROM rides WHERE user_id = ? AND latest_status = 'COMPLETED'`+cursorCond+`
+           UNION ALL
+           SELECT * FROM rides_archive WHERE user_id = ?`+cursorCond+`
+         ) r
+         ORDER BY r.id DESC`+page.limitClause(),
+		args...,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	rides, nextCursor := trimPage(page, rides, func(r Ride) string { return r.ID })
 
 	items := []getAppRidesResponseItem{}
 	// チェア情報を一括取得
@@ -122,11 +127,7 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, ride := range rides {
-		if ride.Status != "COMPLETED" {
-			continue
-		}
-
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride.Ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		fare, err := completedRideFare(ctx, tx, &ride)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
@@ -168,13 +169,16 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 	}
 
 	writeJSON(w, http.StatusOK, &getAppRidesResponse{
-		Rides: items,
+		Rides:      items,
+		NextCursor: nextCursor,
 	})
 }
 
 type appPostRidesRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// 配車位置と目的地の間に順に立ち寄る経由地
+	Waypoints []Coordinate `json:"waypoints"`
 }
 
 type appPostRidesResponse struct {
@@ -188,13 +192,35 @@ type executableGet interface {
 }
 
 func getLatestRideStatus(ctx context.Context, tx executableGet, rideID string) (string, error) {
+	// キャッシュはコミットしてから更新するので、コミットの直後はDBより古いことがある
+	// トランザクションの中では読んだステータスで次の書き込みを決めるので、キャッシュを使わずDBを読む
+	if _, inTx := tx.(*sqlx.Tx); !inTx {
+		if status, ok := rideStatusCache.Load(rideID); ok {
+			return status, nil
+		}
+	}
+
 	status := ""
-	if err := tx.GetContext(ctx, &status, `SELECT status FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, rideID); err != nil {
+	if err := tx.GetContext(ctx, &status, `SELECT latest_status FROM rides WHERE id = ? AND latest_status IS NOT NULL`, rideID); err != nil {
 		return "", err
 	}
 	return status, nil
 }
 
+// ユーザーが終了していないライドを持っているか
+func hasInProgressRide(ctx context.Context, tx *sqlx.Tx, userID string) (bool, error) {
+	inProgress := false
+	if err := tx.GetContext(
+		ctx,
+		&inProgress,
+		`SELECT EXISTS (SELECT 1 FROM rides WHERE user_id = ? AND latest_status NOT IN ('COMPLETED', 'CANCELED'))`,
+		userID,
+	); err != nil {
+		return false, err
+	}
+	return inProgress, nil
+}
+
 func appPostRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostRidesRequest{}
@@ -206,150 +232,278 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if err := validateWaypoints(req.Waypoints); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	user := ctx.Value("user").(*User)
 	rideID := ulid.Make().String()
 
-	tx, err := db.Beginx()
+	// 非同期モードではキューに積んだ時点で返す。キューが詰まっていれば同期で作る
+	if rideCreator != nil {
+		fare, err := rideCreator.Submit(ctx, rideID, user.ID, *req.PickupCoordinate, *req.DestinationCoordinate, req.Waypoints)
+		if err == nil {
+			writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
+				RideID: rideID,
+				Fare:   fare,
+			})
+			return
+		}
+		if errorCode(err) == errCodeRideAlreadyExists {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		if !errors.Is(err, errRideQueueFull) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	fare, err := createRide(ctx, rideID, user.ID, *req.PickupCoordinate, *req.DestinationCoordinate, req.Waypoints)
 	if err != nil {
+		if errorCode(err) == errCodeRideAlreadyExists {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
 
-	rides := []Ride{}
-	if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ?`, user.ID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
+		RideID: rideID,
+		Fare:   fare,
+	})
+}
+
+// ライドを作成し、割引後の運賃を返す
+// 進行中のライドがあればRIDE_ALREADY_EXISTSのエラーを返す
+func createRide(ctx context.Context, rideID, userID string, pickup, destination Coordinate, waypoints []Coordinate) (int, error) {
+	repos := reposFrom(ctx)
+	tx, err := repos.Beginx()
+	if err != nil {
+		return 0, err
 	}
+	defer rollbackTx(tx)
 
-	continuingRideCount := 0
-	for _, ride := range rides {
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "COMPLETED" {
-			continuingRideCount++
-		}
+	ride, fare, err := insertRide(ctx, tx, rideID, userID, pickup, destination, waypoints)
+	if err != nil {
+		return 0, err
 	}
 
-	if continuingRideCount > 0 {
-		writeError(w, http.StatusConflict, errors.New("ride already exists"))
-		return
+	if err := commitTx(tx); err != nil {
+		return 0, err
 	}
+	addPendingRide(ride)
 
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
-				  VALUES (?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	return fare, nil
+}
+
+// 呼び出し元のトランザクションでライドを作り、クーポンを紐づけて割引後の運賃を返す
+// コミットしたらaddPendingRideでマッチングの対象にする
+func insertRide(ctx context.Context, tx *sqlx.Tx, rideID, userID string, pickup, destination Coordinate, waypoints []Coordinate) (*Ride, int, error) {
+	// 同じユーザーの並行したライド作成をユーザー行のロックで直列化する
+	if _, err := tx.ExecContext(ctx, `SELECT id FROM users WHERE id = ? FOR UPDATE`, userID); err != nil {
+		return nil, 0, err
+	}
+
+	inProgress, err := hasInProgressRide(ctx, tx, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if inProgress {
+		return nil, 0, newAPIError(errCodeRideAlreadyExists, errors.New("ride already exists"))
 	}
 
+	// 経由地がなければroute_distanceはNULLにして、経由地を読まずに済ませる
+	var distance *int
+	if len(waypoints) > 0 {
+		d := routeDistance(pickup, waypoints, destination)
+		distance = &d
+	}
 	if _, err := tx.ExecContext(
 		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "MATCHING",
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, route_distance)
+				  VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rideID, userID, pickup.Latitude, pickup.Longitude, destination.Latitude, destination.Longitude, distance,
 	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, 0, err
+	}
+	if len(waypoints) > 0 {
+		if err := insertRideWaypoints(ctx, tx, rideID, waypoints); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := logRideEvent(ctx, tx, rideID, rideEventCreated, rideCreatedPayload{UserID: userID, Pickup: pickup, Destination: destination, Waypoints: waypoints}); err != nil {
+		return nil, 0, err
+	}
+
+	if err := updateRideStatus(ctx, tx, rideID, "MATCHING"); err != nil {
+		return nil, 0, err
 	}
 
 	var rideCount int
-	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, userID); err != nil {
+		return nil, 0, err
 	}
 
 	var coupon Coupon
 	if rideCount == 1 {
 		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", userID); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
+				return nil, 0, err
 			}
 
 			// 無ければ他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
+			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", userID); err != nil {
 				if !errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusInternalServerError, err)
-					return
+					return nil, 0, err
 				}
 			} else {
 				if _, err := tx.ExecContext(
 					ctx,
 					"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-					rideID, user.ID, coupon.Code,
+					rideID, userID, coupon.Code,
 				); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
+					return nil, 0, err
 				}
 			}
 		} else {
 			if _, err := tx.ExecContext(
 				ctx,
 				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = 'CP_NEW2024'",
-				rideID, user.ID,
+				rideID, userID,
 			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
+				return nil, 0, err
 			}
 		}
 	} else {
 		// 他のクーポンを付与された順番に使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", userID); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
+				return nil, 0, err
 			}
 		} else {
 			if _, err := tx.ExecContext(
 				ctx,
 				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-				rideID, user.ID, coupon.Code,
+				rideID, userID, coupon.Code,
 			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
+				return nil, 0, err
 			}
 		}
 	}
 
-	ride := Ride{}
-	if err := tx.GetContext(ctx, &ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	ride, err := reposFrom(ctx).Rides.With(tx).Get(ctx, rideID)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	fare, err := calculateDiscountedFare(ctx, tx, userID, ride, rideDistance(ride))
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		return nil, 0, err
+	}
+	return ride, fare, nil
+}
+
+func addPendingRide(ride *Ride) {
+	rideGrid.Add(&Ride{
+		ID:                   ride.ID,
+		PickupLatitude:       ride.PickupLatitude,
+		PickupLongitude:      ride.PickupLongitude,
+		DestinationLatitude:  ride.DestinationLatitude,
+		DestinationLongitude: ride.DestinationLongitude,
+	})
+	pendingRides.Add(ride)
+}
+
+type appGetRideResponse struct {
+	ID                    string     `json:"id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	// 非同期モードで作成待ちならPENDING
+	Status    string `json:"status"`
+	ChairID   string `json:"chair_id,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+}
+
+func appGetRide(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+
+	ride, err := reposFrom(ctx).Rides.GetByUser(ctx, rideID, user.ID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if rideCreator != nil {
+			pending, err := rideCreator.Lookup(rideID)
+			if pending {
+				writeJSON(w, http.StatusOK, &appGetRideResponse{ID: rideID, Status: "PENDING"})
+				return
+			}
+			if err != nil {
+				if errorCode(err) == errCodeRideAlreadyExists {
+					writeError(w, http.StatusConflict, err)
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
 		return
 	}
 
-	if err := tx.Commit(); err != nil {
+	status, err := getLatestRideStatus(ctx, reposFrom(ctx).db, ride.ID)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
-		RideID: rideID,
-		Fare:   fare,
+	writeJSON(w, http.StatusOK, &appGetRideResponse{
+		ID: ride.ID,
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Status:    status,
+		ChairID:   ride.ChairID.String,
+		CreatedAt: ride.CreatedAt.UnixMilli(),
 	})
 }
 
 type appPostRidesEstimatedFareRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate  `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate  `json:"destination_coordinate"`
+	Waypoints             []Coordinate `json:"waypoints"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
 	Fare     int `json:"fare"`
 	Discount int `json:"discount"`
+	// 今空いている椅子のうち最も早く配車位置に着くものの見込み時間。空いている椅子がなければnull
+	EstimatedPickupWaitMs *int64 `json:"estimated_pickup_wait_ms"`
+}
+
+// 配車位置の近くで空いている椅子から、最も早く着くものの見込み時間を求める
+func estimatePickupWait(latitude, longitude int) (time.Duration, bool) {
+	ride := &Ride{PickupLatitude: latitude, PickupLongitude: longitude}
+	var best time.Duration
+	found := false
+	for _, chair := range chairAvailability.AvailableNear(latitude, longitude) {
+		if eta := estimatePickupETA(chair, ride); !found || eta < best {
+			best, found = eta, true
+		}
+	}
+	return best, found
 }
 
 func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
@@ -364,16 +518,23 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateWaypoints(req.Waypoints); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
 	user := ctx.Value("user").(*User)
 
-	tx, err := db.Beginx()
+	repos := reposFrom(ctx)
+	tx, err := repos.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	distance := routeDistance(*req.PickupCoordinate, req.Waypoints, *req.DestinationCoordinate)
+	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, distance)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -384,10 +545,15 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
+	res := &appPostRidesEstimatedFareResponse{
 		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
-	})
+		Discount: calculateRouteFare(distance) - discounted,
+	}
+	if wait, ok := estimatePickupWait(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude); ok {
+		ms := wait.Milliseconds()
+		res.EstimatedPickupWaitMs = &ms
+	}
+	writeJSON(w, http.StatusOK, res)
 }
 
 // マンハッタン距離を求める
@@ -404,12 +570,31 @@ func abs(a int) int {
 
 type appPostRideEvaluationRequest struct {
 	Evaluation int `json:"evaluation"`
+	// 運賃に上乗せして決済し、割引せずにオーナーの売上に計上する
+	Tip int `json:"tip"`
 }
 
+// 1回のライドで送れるチップの上限
+var maxRideTip = getEnvInt("ISUCON_MAX_RIDE_TIP", 10000)
+
 type appPostRideEvaluationResponse struct {
 	CompletedAt int64 `json:"completed_at"`
 }
 
+// 決済ゲートウェイの決済と突き合わせるユーザーのライド。キャンセルしたライドは決済しないので数えない
+// 評価しているライドはまだCOMPLETEDになっていなくてもこれから決済するので含める
+// rides_archiveに移した完了済みのライドも決済済みなので数える
+func getPaidRides(ctx context.Context, q sqlx.QueryerContext, userID, rideID string) ([]Ride, error) {
+	rides := []Ride{}
+	if err := sqlx.SelectContext(ctx, q, &rides, `SELECT * FROM rides WHERE user_id = ? AND (latest_status = 'COMPLETED' OR id = ?)
+UNION ALL
+SELECT * FROM rides_archive WHERE user_id = ?
+ORDER BY created_at ASC`, userID, rideID, userID); err != nil {
+		return nil, err
+	}
+	return rides, nil
+}
+
 func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	rideID := r.PathValue("ride_id")
@@ -423,16 +608,22 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("evaluation must be between 1 and 5"))
 		return
 	}
+	if req.Tip < 0 || req.Tip > maxRideTip {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("tip must be between 0 and %d", maxRideTip))
+		return
+	}
 
-	tx, err := db.Beginx()
+	repos := reposFrom(ctx)
+	tx, err := repos.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
+	defer rollbackTx(tx)
 
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+	// 同じライドへの評価を直列化する
+	ride, err := repos.Rides.With(tx).GetForUpdate(ctx, rideID)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
@@ -446,15 +637,30 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if status != "ARRIVED" {
-		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
+	// リトライなどで評価済みのライドに再度送られてきたら、決済せずに最初の結果を返す
+	if status == "COMPLETED" && ride.Evaluation != nil {
+		writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
+			CompletedAt: ride.UpdatedAt.UnixMilli(),
+		})
+		return
+	}
+
+	if !isValidStatusTransition(status, "COMPLETED") {
+		writeError(w, http.StatusBadRequest, newAPIError(errCodeInvalidStatusTransition, errors.New("not arrived yet")))
+		return
+	}
+
+	// 請求額はここで確定させてライドに保存し、履歴や売上は保存した値を参照する
+	fare, err := calculateRideFare(ctx, tx, ride)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	result, err := tx.ExecContext(
 		ctx,
-		`UPDATE rides SET evaluation = ? WHERE id = ?`,
-		req.Evaluation, rideID)
+		`UPDATE rides SET evaluation = ?, fare = ?, gross_fare = ?, tip = ? WHERE id = ?`,
+		req.Evaluation, fare.Fare, fare.GrossFare, req.Tip, rideID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -467,16 +673,29 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.ExecContext(
+	// 同時に送られた評価が先に完了させていたら、こちらは決済せずに失敗させる
+	if err := updateRideStatus(ctx, tx, rideID, "COMPLETED"); err != nil {
+		if errors.Is(err, errInvalidStatusTransition) {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 椅子の統計に足し込む。ARRIVEDから完了したライドなのでCARRYINGとARRIVEDは必ず通っている
+	if _, err := tx.ExecContext(
 		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "COMPLETED")
-	if err != nil {
+		`INSERT INTO chair_stats (chair_id, total_rides, total_evaluation) VALUES (?, 1, ?)
+ON DUPLICATE KEY UPDATE total_rides = total_rides + 1, total_evaluation = total_evaluation + VALUES(total_evaluation)`,
+		ride.ChairID, req.Evaluation,
+	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+	ride, err = repos.Rides.With(tx).Get(ctx, rideID)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
@@ -485,6 +704,23 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sale, err := recordRideSale(ctx, tx, ride)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := repos.Webhooks.With(tx).Enqueue(ctx, sale.OwnerID, webhookEventRideCompleted, ride.ID, rideCompletedWebhookPayload{
+		RideID:      ride.ID,
+		ChairID:     sale.ChairID,
+		Sales:       sale.Sales,
+		Tip:         sale.Tips,
+		Evaluation:  req.Evaluation,
+		CompletedAt: sale.CompletedAt.UnixMilli(),
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	paymentToken := &PaymentToken{}
 	if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -495,13 +731,8 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
 	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
-		Amount: fare,
+		Amount: fare.Fare + req.Tip,
 	}
 
 	var paymentGatewayURL string
@@ -510,13 +741,13 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
-			return nil, err
-		}
-		return rides, nil
+	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, ride.ID, paymentGatewayRequest, func() ([]Ride, error) {
+		return getPaidRides(ctx, tx, ride.UserID, ride.ID)
 	}); err != nil {
+		// トランザクションはロールバックされるので失敗はトランザクションの外で記録する
+		if logErr := logRideEvent(ctx, repos.db, ride.ID, rideEventPaymentFailed, ridePaymentPayload{Amount: paymentGatewayRequest.Amount, Tip: req.Tip, Error: err.Error()}); logErr != nil {
+			slog.Error("failed to log ride event", "error", logErr)
+		}
 		if errors.Is(err, erroredUpstream) {
 			writeError(w, http.StatusBadGateway, err)
 			return
@@ -524,11 +755,29 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if err := logRideEvent(ctx, tx, ride.ID, rideEventPaymentSucceed, ridePaymentPayload{Amount: paymentGatewayRequest.Amount, Tip: req.Tip, Evaluation: req.Evaluation}); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	if err := tx.Commit(); err != nil {
+	if err := commitTx(tx); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	ownerSales.Add(sale)
+
+	deliverReceipt(&Receipt{
+		RideID:      ride.ID,
+		UserID:      ride.UserID,
+		ChairID:     ride.ChairID.String,
+		Fare:        fare.Fare,
+		GrossFare:   fare.GrossFare,
+		Tip:         req.Tip,
+		Evaluation:  req.Evaluation,
+		RequestedAt: ride.CreatedAt.UnixMilli(),
+		CompletedAt: ride.UpdatedAt.UnixMilli(),
+		Lang:        langFromContext(ctx),
+	})
 
 	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
 		CompletedAt: ride.UpdatedAt.UnixMilli(),
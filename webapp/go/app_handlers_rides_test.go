@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestAppGetRidesPaginatesByCursor(t *testing.T) {
+	mock := setupMockDB(t)
+	now := time.Now()
+	cursor := ulid.Make().String()
+	newer, older := "01J00000000000000000000002", "01J00000000000000000000001"
+
+	rideColumns := []string{"id", "user_id", "chair_id", "pickup_latitude", "pickup_longitude", "destination_latitude", "destination_longitude", "evaluation", "fare", "latest_status", "created_at", "updated_at"}
+	mock.ExpectBegin()
+	// 次のページがあるか判定するためにlimitより1件多く読む。rides_archiveに移したライドも含める
+	mock.ExpectQuery(`SELECT r\.\* FROM \( SELECT \* FROM rides WHERE user_id = \? AND latest_status = 'COMPLETED' AND id < \? UNION ALL SELECT \* FROM rides_archive WHERE user_id = \? AND id < \? \) r ORDER BY r\.id DESC LIMIT 2`).
+		WithArgs("user-1", cursor, "user-1", cursor).
+		WillReturnRows(sqlmock.NewRows(rideColumns).
+			AddRow(newer, "user-1", "chair-1", 0, 0, 10, 10, 5, 1500, "COMPLETED", now.Add(-time.Minute), now).
+			AddRow(older, "user-1", "chair-1", 0, 0, 20, 20, 4, 2500, "COMPLETED", now.Add(-time.Hour), now.Add(-time.Hour)))
+	mock.ExpectQuery(`SELECT \* FROM chairs WHERE id IN \(\?\)`).
+		WithArgs("chair-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "owner_id", "name", "model"}).AddRow("chair-1", "owner-1", "chair-name", "model-a"))
+	mock.ExpectQuery(`SELECT \* FROM owners WHERE id IN \(\?\)`).
+		WithArgs("owner-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("owner-1", "owner-name"))
+	mock.ExpectCommit()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/app/rides?limit=1&cursor="+cursor, nil)
+	r = r.WithContext(context.WithValue(mockRepoContext(r.Context()), "user", &User{ID: "user-1"}))
+	w := httptest.NewRecorder()
+	appGetRides(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+	res := getAppRidesResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Rides) != 1 || res.NextCursor != newer {
+		t.Fatalf("rides = %+v, next_cursor = %q", res.Rides, res.NextCursor)
+	}
+	got := res.Rides[0]
+	if got.ID != newer || got.Fare != 1500 || got.Evaluation != 5 || got.Chair.Owner != "owner-name" || got.Chair.Model != "model-a" {
+		t.Errorf("ride = %+v", got)
+	}
+	if got.RequestedAt != now.Add(-time.Minute).UnixMilli() || got.CompletedAt != now.UnixMilli() {
+		t.Errorf("requested_at = %d, completed_at = %d", got.RequestedAt, got.CompletedAt)
+	}
+}
+
+func TestParsePageParams(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    pageParams
+		wantErr bool
+	}{
+		{"", pageParams{}, false},
+		{"limit=20", pageParams{Limit: 20}, false},
+		{"limit=1000", pageParams{Limit: 100}, false},
+		{"limit=0", pageParams{}, true},
+		{"limit=abc", pageParams{}, true},
+		{"cursor=not-a-ulid", pageParams{}, true},
+		{"cursor=01J00000000000000000000001", pageParams{Cursor: "01J00000000000000000000001"}, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePageParams(httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil), 100)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePageParams(%q) = %+v, %v", tt.query, got, err)
+		}
+	}
+}
+
+func TestAppGetRideOnlyReturnsOwnRide(t *testing.T) {
+	repos := newFakeRepositories()
+	repos.Rides.(*fakeRideRepo).rides["ride-get"] = &Ride{ID: "ride-get", UserID: "user-1", PickupLatitude: 1, DestinationLatitude: 2}
+	rideStatusCache.Store("ride-get", "ENROUTE")
+	t.Cleanup(func() { rideStatusCache.Delete("ride-get") })
+
+	get := func(userID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/app/rides/ride-get", nil)
+		r = r.WithContext(context.WithValue(withRepositories(r.Context(), repos), "user", &User{ID: userID}))
+		r.SetPathValue("ride_id", "ride-get")
+		w := httptest.NewRecorder()
+		appGetRide(w, r)
+		return w
+	}
+
+	if w := get("user-2"); w.Code != http.StatusNotFound {
+		t.Fatalf("other user: status = %d, body = %s", w.Code, w.Body)
+	}
+	w := get("user-1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+	res := &appGetRideResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != "ride-get" || res.Status != "ENROUTE" || res.DestinationCoordinate.Latitude != 2 {
+		t.Fatalf("response = %+v", res)
+	}
+}
@@ -0,0 +1,176 @@
+// webapp/go/async_rides.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ライド作成の非同期モード
+// POST /api/app/ridesはキューに積んでride_idをすぐ返し、INSERTとマッチング対象への登録はワーカーが行う
+// 書き込みが集中したときにリクエストごとのトランザクションが競合するのを避けるために使う
+type rideCreationRequest struct {
+	RideID      string
+	UserID      string
+	Pickup      Coordinate
+	Destination Coordinate
+	Waypoints   []Coordinate
+}
+
+var errRideQueueFull = errors.New("ride creation queue is full")
+
+// 作成に失敗したライドを覚えておく時間。読まれたらその時点で忘れる
+const failedRideTTL = 5 * time.Minute
+
+type failedRide struct {
+	err      error
+	failedAt time.Time
+}
+
+type asyncRideCreator struct {
+	queue chan *rideCreationRequest
+
+	mu sync.Mutex
+	// キューに積まれてまだDBに書かれていないライド
+	pending       map[string]*rideCreationRequest
+	pendingByUser map[string]string
+	// ワーカーで作成に失敗したライド
+	failed map[string]failedRide
+}
+
+// 無効ならnil
+var rideCreator *asyncRideCreator
+
+func newAsyncRideCreator(queueSize int) *asyncRideCreator {
+	return &asyncRideCreator{
+		queue:         make(chan *rideCreationRequest, queueSize),
+		pending:       map[string]*rideCreationRequest{},
+		pendingByUser: map[string]string{},
+		failed:        map[string]failedRide{},
+	}
+}
+
+// キューに積んで、同期で作ったときと同じくクーポンの割引後の運賃を返す
+// 同じユーザーの進行中のライドか作成待ちがあればRIDE_ALREADY_EXISTS、キューが詰まっていればerrRideQueueFullを返す
+func (c *asyncRideCreator) Submit(ctx context.Context, rideID, userID string, pickup, destination Coordinate, waypoints []Coordinate) (int, error) {
+	fare, err := quoteRide(ctx, userID, routeDistance(pickup, waypoints, destination))
+	if err != nil {
+		return 0, err
+	}
+
+	req := &rideCreationRequest{
+		RideID:      rideID,
+		UserID:      userID,
+		Pickup:      pickup,
+		Destination: destination,
+		Waypoints:   waypoints,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pendingByUser[userID]; ok {
+		return 0, newAPIError(errCodeRideAlreadyExists, errors.New("ride already exists"))
+	}
+	select {
+	case c.queue <- req:
+	default:
+		return 0, errRideQueueFull
+	}
+	c.pending[rideID] = req
+	c.pendingByUser[userID] = rideID
+	return fare, nil
+}
+
+// 進行中のライドがないことを確かめて、作成時に使われるクーポンで割り引いた運賃を求める
+// ここからワーカーが書くまでの間に作られたライドやクーポンの変化は、ワーカーのinsertRideが改めて確かめる
+func quoteRide(ctx context.Context, userID string, distance int) (int, error) {
+	tx, err := reposFrom(ctx).Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer rollbackTx(tx)
+
+	inProgress, err := hasInProgressRide(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if inProgress {
+		return 0, newAPIError(errCodeRideAlreadyExists, errors.New("ride already exists"))
+	}
+	return calculateDiscountedFare(ctx, tx, userID, nil, distance)
+}
+
+// 作成待ちならtrue。失敗していればそのエラーを返す。エラーは1回だけ返し、次からは見つからない
+func (c *asyncRideCreator) Lookup(rideID string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pending[rideID]; ok {
+		return true, nil
+	}
+	f, ok := c.failed[rideID]
+	if !ok {
+		return false, nil
+	}
+	delete(c.failed, rideID)
+	return false, f.err
+}
+
+func (c *asyncRideCreator) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-c.queue:
+			c.process(ctx, req)
+		}
+	}
+}
+
+func (c *asyncRideCreator) process(ctx context.Context, req *rideCreationRequest) {
+	_, err := createRide(ctx, req.RideID, req.UserID, req.Pickup, req.Destination, req.Waypoints)
+	if err != nil {
+		slog.Error("failed to create ride", "ride_id", req.RideID, "error", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Resetで捨てられたものは記録しない
+	if c.pending[req.RideID] != req {
+		return
+	}
+	delete(c.pending, req.RideID)
+	delete(c.pendingByUser, req.UserID)
+	if err != nil {
+		c.recordFailure(req.RideID, err, time.Now())
+	}
+}
+
+// 読まれないまま残った失敗は、次に失敗したときにまとめて捨てる
+func (c *asyncRideCreator) recordFailure(rideID string, err error, now time.Time) {
+	for id, f := range c.failed {
+		if now.Sub(f.failedAt) > failedRideTTL {
+			delete(c.failed, id)
+		}
+	}
+	c.failed[rideID] = failedRide{err: err, failedAt: now}
+}
+
+// 初期化時に作成待ちを捨てる
+func (c *asyncRideCreator) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		select {
+		case <-c.queue:
+			continue
+		default:
+		}
+		break
+	}
+	c.pending = map[string]*rideCreationRequest{}
+	c.pendingByUser = map[string]string{}
+	c.failed = map[string]failedRide{}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAsyncRideCreatorForgetsFailures(t *testing.T) {
+	c := newAsyncRideCreator(1)
+	errBoom := errors.New("boom")
+	now := time.Now()
+
+	c.recordFailure("ride-1", errBoom, now)
+	if pending, err := c.Lookup("ride-1"); pending || err != errBoom {
+		t.Fatalf("pending = %v, err = %v", pending, err)
+	}
+	// 1回読んだら忘れる
+	if pending, err := c.Lookup("ride-1"); pending || err != nil {
+		t.Fatalf("pending = %v, err = %v", pending, err)
+	}
+
+	// 読まれないまま古くなった失敗は、次の失敗を記録するときに捨てる
+	c.recordFailure("ride-2", errBoom, now)
+	c.recordFailure("ride-3", errBoom, now.Add(failedRideTTL+time.Second))
+	if _, ok := c.failed["ride-2"]; ok {
+		t.Fatal("expired failure was kept")
+	}
+	if len(c.failed) != 1 {
+		t.Fatalf("failed = %v", c.failed)
+	}
+}
+
+func TestAsyncRideCreatorSubmitReturnsDiscountedFare(t *testing.T) {
+	mock := setupMockDB(t)
+	c := newAsyncRideCreator(1)
+	pickup := Coordinate{Latitude: 0, Longitude: 0}
+	destination := Coordinate{Latitude: 10, Longitude: 10}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT EXISTS`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery(`SELECT \* FROM coupons WHERE user_id = \? AND code = 'CP_NEW2024' AND used_by IS NULL`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "code", "discount"}).AddRow("user-1", "CP_NEW2024", 300))
+	mock.ExpectRollback()
+
+	fare, err := c.Submit(mockRepoContext(context.Background()), "ride-1", "user-1", pickup, destination, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同期で作ったときと同じく、クーポンの割引後の運賃を返す
+	if want := calculateRouteFare(routeDistance(pickup, nil, destination)) - 300; fare != want {
+		t.Fatalf("fare = %d, want %d", fare, want)
+	}
+	if pending, _ := c.Lookup("ride-1"); !pending {
+		t.Fatal("ride was not queued")
+	}
+}
+
+func TestAsyncRideCreatorSubmitRejectsInProgressRide(t *testing.T) {
+	mock := setupMockDB(t)
+	c := newAsyncRideCreator(1)
+
+	// 作成待ちはないが、DBに進行中のライドがある
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT EXISTS`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	_, err := c.Submit(mockRepoContext(context.Background()), "ride-1", "user-1", Coordinate{}, Coordinate{Latitude: 1}, nil)
+	if errorCode(err) != errCodeRideAlreadyExists {
+		t.Fatalf("err = %v", err)
+	}
+	if len(c.queue) != 0 || len(c.pending) != 0 {
+		t.Fatal("ride was queued")
+	}
+}
@@ -0,0 +1,476 @@
+// webapp/go/availability.go
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 割り当て可能な椅子(ACTIVE・位置がわかっている)をメモリ上で管理する
+// 椅子の登録・稼働状態の変更・位置の送信・マッチング・ライドのステータス遷移・COMPLETED/CANCELEDの通知で更新し、
+// マッチングとnearby-chairsはDBではなくここを参照する
+type availableChair struct {
+	ID        string
+	OwnerID   string
+	Name      string
+	Model     string
+	Speed     int
+	Version   string
+	Latitude  int
+	Longitude int
+	LocatedAt time.Time
+	// 最後にライドを割り当てた時刻。起動後に割り当てていなければゼロ値
+	LastAssignedAt time.Time
+	// 運んでいるライドを終えて空くまでの見込み時間。空いている椅子は0
+	FreeIn time.Duration
+}
+
+// 椅子の状態
+//
+//	INACTIVE --(activity: true)--> ACTIVE --(マッチング)--> ASSIGNED --(CARRYING)--> BUSY
+//	ACTIVE/INACTIVE <--(椅子にCOMPLETED/CANCELEDを通知)-- ASSIGNED/BUSY
+//
+// ライド中に稼働を止めても、ライドが終わるまではASSIGNED/BUSYのままにする
+type chairState string
+
+const (
+	chairStateActive   chairState = "ACTIVE"
+	chairStateAssigned chairState = "ASSIGNED"
+	chairStateBusy     chairState = "BUSY"
+	chairStateInactive chairState = "INACTIVE"
+)
+
+// ライドを持っていないときの状態
+func idleChairState(isActive bool) chairState {
+	if isActive {
+		return chairStateActive
+	}
+	return chairStateInactive
+}
+
+type chairAvailabilityState struct {
+	availableChair
+	// オーナー(椅子)が指定した稼働状態。ライドが終わったときにACTIVEとINACTIVEのどちらに戻るかを決める
+	IsActive    bool
+	HasLocation bool
+	State       chairState
+	// 最後に割り当てたライド
+	RideID string
+}
+
+type ChairAvailability struct {
+	mu     sync.RWMutex
+	chairs map[string]*chairAvailabilityState
+	speeds map[string]int
+	// 進行中のライドから割り当てた椅子を引く
+	rideChairs map[string]string
+	// 位置のわかっている椅子を格子で引けるようにしておく
+	grid *pointGrid
+	// 0なら位置情報の鮮度は見ない
+	locationTTL time.Duration
+	// オーナーごとの椅子の登録・稼働状態・位置の更新回数。ETagに使う
+	// ownerGenerationsはRebuildで作り直すので、epochも合わせて見る
+	epoch            int64
+	ownerGenerations map[string]uint64
+	// これより古いバージョンの椅子は割り当てない。空なら制限しない
+	minVersion string
+}
+
+func NewChairAvailability(locationTTL time.Duration) *ChairAvailability {
+	return &ChairAvailability{
+		chairs:      map[string]*chairAvailabilityState{},
+		speeds:      map[string]int{},
+		rideChairs:  map[string]string{},
+		grid:        newPointGrid(gridCellSize),
+		locationTTL: locationTTL,
+		// 再起動をまたいで同じETagにならないように起動時刻から始める
+		epoch:            time.Now().UnixNano(),
+		ownerGenerations: map[string]uint64{},
+	}
+}
+
+var chairAvailability = func() *ChairAvailability {
+	a := NewChairAvailability(getEnvDuration("ISUCON_CHAIR_LOCATION_TTL", 0))
+	a.minVersion = getEnv("ISUCON_CHAIR_MIN_VERSION", "")
+	return a
+}()
+
+func (a *ChairAvailability) isAvailable(s *chairAvailabilityState, now time.Time) bool {
+	if s.State != chairStateActive || !s.HasLocation {
+		return false
+	}
+	if !satisfiesMinVersion(s.Version, a.minVersion) {
+		return false
+	}
+	// フラグの更新漏れがあっても進行中のライドを持つ椅子は二重に割り当てない
+	if s.RideID != "" {
+		if status, ok := rideStatusCache.Load(s.RideID); ok && !isTerminalRideStatus(status) {
+			return false
+		}
+	}
+	if a.locationTTL > 0 && now.Sub(s.LocatedAt) > a.locationTTL {
+		return false
+	}
+	return true
+}
+
+func (a *ChairAvailability) AddChair(chair *Chair) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ownerGenerations[chair.OwnerID]++
+	a.chairs[chair.ID] = &chairAvailabilityState{
+		availableChair: availableChair{
+			ID:      chair.ID,
+			OwnerID: chair.OwnerID,
+			Name:    chair.Name,
+			Model:   chair.Model,
+			Speed:   a.speeds[chair.Model],
+			Version: chair.AppVersion.String,
+		},
+		IsActive: chair.IsActive,
+		State:    idleChairState(chair.IsActive),
+	}
+}
+
+func (a *ChairAvailability) SetActive(chairID string, active bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s, ok := a.chairs[chairID]; ok {
+		s.IsActive = active
+		if s.State == chairStateActive || s.State == chairStateInactive {
+			s.State = idleChairState(active)
+		}
+		a.ownerGenerations[s.OwnerID]++
+	}
+}
+
+func (a *ChairAvailability) SetLocation(chairID string, latitude, longitude int, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s, ok := a.chairs[chairID]; ok {
+		s.Latitude = latitude
+		s.Longitude = longitude
+		s.LocatedAt = at
+		s.HasLocation = true
+		a.grid.Move(chairID, latitude, longitude)
+		a.ownerGenerations[s.OwnerID]++
+	}
+}
+
+// オーナーの椅子の状態が変わるたびに変わる値
+func (a *ChairAvailability) OwnerGeneration(ownerID string) (int64, uint64) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.epoch, a.ownerGenerations[ownerID]
+}
+
+func (a *ChairAvailability) SetVersion(chairID, version string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s, ok := a.chairs[chairID]; ok {
+		s.Version = version
+		a.ownerGenerations[s.OwnerID]++
+	}
+}
+
+func (a *ChairAvailability) MinVersion() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.minVersion
+}
+
+func (a *ChairAvailability) SetMinVersion(version string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.minVersion = version
+}
+
+func (a *ChairAvailability) ChairModel(chairID string) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	s, ok := a.chairs[chairID]
+	if !ok {
+		return "", false
+	}
+	return s.Model, true
+}
+
+// 最後に受け取った位置
+func (a *ChairAvailability) LastLocation(chairID string) (availableChair, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	s, ok := a.chairs[chairID]
+	if !ok || !s.HasLocation {
+		return availableChair{}, false
+	}
+	return s.availableChair, true
+}
+
+// 割り当て可能であれば椅子をライドのために確保してtrueを返す
+func (a *ChairAvailability) Reserve(chairID, rideID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.chairs[chairID]
+	if !ok || !a.isAvailable(s, time.Now()) {
+		return false
+	}
+	s.State = chairStateAssigned
+	s.RideID = rideID
+	s.LastAssignedAt = time.Now()
+	a.rideChairs[rideID] = chairID
+	a.ownerGenerations[s.OwnerID]++
+	return true
+}
+
+// ライドのステータス遷移に合わせて割り当てた椅子の状態を進める
+func (a *ChairAvailability) OnRideStatus(rideID, status string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	chairID, ok := a.rideChairs[rideID]
+	if !ok {
+		return
+	}
+	s, ok := a.chairs[chairID]
+	if !ok || s.RideID != rideID {
+		return
+	}
+	switch status {
+	case "ENROUTE", "PICKUP":
+		s.State = chairStateAssigned
+	case "CARRYING", "ARRIVED", "COMPLETED":
+		s.State = chairStateBusy
+	default:
+		return
+	}
+	a.ownerGenerations[s.OwnerID]++
+}
+
+// ライドが終了(椅子にCOMPLETED/CANCELEDを通知)したら椅子を割り当て可能に戻す
+// 別のライドがすでに割り当てられていれば何もしない
+func (a *ChairAvailability) Release(chairID, rideID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.rideChairs, rideID)
+	if s, ok := a.chairs[chairID]; ok && s.RideID == rideID && (s.State == chairStateAssigned || s.State == chairStateBusy) {
+		s.State = idleChairState(s.IsActive)
+		a.ownerGenerations[s.OwnerID]++
+	}
+}
+
+// 椅子の現在の状態。ビューにまだ無い椅子はDBの稼働状態から決める
+func chairStateOf(chairID string, isActive bool) chairState {
+	if state, ok := chairAvailability.State(chairID); ok {
+		return state
+	}
+	return idleChairState(isActive)
+}
+
+// 椅子の現在の状態
+func (a *ChairAvailability) State(chairID string) (chairState, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	s, ok := a.chairs[chairID]
+	if !ok {
+		return "", false
+	}
+	return s.State, true
+}
+
+// ライドを運んでいる(BUSYの)椅子を、運んでいるライドの目的地にいるものとして返す
+// skipがtrueを返す椅子は除く
+func (a *ChairAvailability) Finishing(skip func(chairID string) bool) []availableChair {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	chairs := []availableChair{}
+	for _, s := range a.chairs {
+		if s.State != chairStateBusy || !s.HasLocation || !s.IsActive || skip(s.ID) {
+			continue
+		}
+		latitude, longitude, ok := rideGrid.Destination(s.RideID)
+		if !ok {
+			continue
+		}
+		chair := s.availableChair
+		chair.Latitude, chair.Longitude = latitude, longitude
+		// 目的地に着いていても支払いが終わるまでは空かないので、少なくとも1tickはかかるものとする
+		chair.FreeIn = max(estimateTravelTime(s.Latitude, s.Longitude, latitude, longitude, s.Speed), chairMoveTick)
+		chairs = append(chairs, chair)
+	}
+	return chairs
+}
+
+// 現在割り当て可能な椅子の数
+func (a *ChairAvailability) AvailableCount() int {
+	now := time.Now()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	n := 0
+	for _, s := range a.chairs {
+		if a.isAvailable(s, now) {
+			n++
+		}
+	}
+	return n
+}
+
+// 現在割り当て可能な椅子のスナップショットを返す
+func (a *ChairAvailability) Available() []availableChair {
+	now := time.Now()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	chairs := make([]availableChair, 0, len(a.chairs))
+	for _, s := range a.chairs {
+		if a.isAvailable(s, now) {
+			chairs = append(chairs, s.availableChair)
+		}
+	}
+	return chairs
+}
+
+// 指定した位置からの距離がdistance以下で割り当て可能な椅子。近くのセルだけを見る
+func (a *ChairAvailability) AvailableWithin(latitude, longitude, distance int) []availableChair {
+	now := time.Now()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	chairs := []availableChair{}
+	a.grid.Within(latitude-distance, latitude+distance, longitude-distance, longitude+distance, func(id string) {
+		s := a.chairs[id]
+		if s == nil || !a.isAvailable(s, now) {
+			return
+		}
+		if calculateDistance(s.Latitude, s.Longitude, latitude, longitude) <= distance {
+			chairs = append(chairs, s.availableChair)
+		}
+	})
+	return chairs
+}
+
+// 指定した位置の近くにいる割り当て可能な椅子
+// 中心のセルから外側へ広げ、外側のセルの椅子が見つかった椅子より近くなく、
+// 最も速いモデルでも見つかった椅子より(fairnessSlackを見込んでも)早く着けなくなったところで止める
+// マンハッタン距離で最も近い椅子も、遠くても速く着く椅子もこの範囲に必ず入る
+func (a *ChairAvailability) AvailableNear(latitude, longitude int) []availableChair {
+	now := time.Now()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	maxSpeed := 1
+	for _, speed := range a.speeds {
+		maxSpeed = max(maxSpeed, speed)
+	}
+	target := &Ride{PickupLatitude: latitude, PickupLongitude: longitude}
+	chairs := []availableChair{}
+	bestDistance, bestETA := -1, time.Duration(0)
+	seen := 0
+	for ring := 0; seen < a.grid.Len(); ring++ {
+		// ring個目のセルにいる椅子までの距離の下限
+		minDistance := 0
+		if ring > 0 {
+			minDistance = (ring-1)*a.grid.cellSize + 1
+		}
+		if bestDistance >= 0 && minDistance > bestDistance && estimateDistanceTime(minDistance, maxSpeed) > bestETA+fairnessSlack {
+			break
+		}
+		a.grid.Ring(latitude, longitude, ring, func(id string) {
+			seen++
+			s := a.chairs[id]
+			if s == nil || !a.isAvailable(s, now) {
+				return
+			}
+			chairs = append(chairs, s.availableChair)
+			distance := calculateDistance(s.Latitude, s.Longitude, latitude, longitude)
+			eta := estimatePickupETA(s.availableChair, target)
+			if bestDistance < 0 {
+				bestDistance, bestETA = distance, eta
+			}
+			bestDistance, bestETA = min(bestDistance, distance), min(bestETA, eta)
+		})
+	}
+	return chairs
+}
+
+// DBの内容からビューを作り直す。起動時と初期化時に呼ぶ
+func (a *ChairAvailability) Rebuild(ctx context.Context) error {
+	models := []ChairModel{}
+	if err := db.SelectContext(ctx, &models, "SELECT * FROM chair_models"); err != nil {
+		return err
+	}
+
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, "SELECT * FROM chairs"); err != nil {
+		return err
+	}
+
+	locations := []ChairLocation{}
+	if err := db.SelectContext(ctx, &locations, `SELECT cl.* FROM chair_locations cl
+JOIN (SELECT chair_id, MAX(created_at) AS created_at FROM chair_locations WHERE is_flagged = FALSE GROUP BY chair_id) latest
+  ON cl.chair_id = latest.chair_id AND cl.created_at = latest.created_at`); err != nil {
+		return err
+	}
+
+	// 椅子にCOMPLETED/CANCELEDが通知されていないライドを持っている椅子は割り当て不可
+	// 乗せた後(CARRYING以降)ならBUSY、それより前ならASSIGNED
+	busyRides := []struct {
+		ID       string `db:"id"`
+		ChairID  string `db:"chair_id"`
+		Carrying bool   `db:"carrying"`
+	}{}
+	if err := db.SelectContext(ctx, &busyRides, `SELECT r.id, r.chair_id,
+       r.latest_status IN ('CARRYING', 'ARRIVED', 'COMPLETED') AS carrying
+FROM rides r
+WHERE r.chair_id IS NOT NULL
+  AND NOT EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status IN ('COMPLETED', 'CANCELED') AND rs.chair_sent_at IS NOT NULL)`); err != nil {
+		return err
+	}
+
+	speeds := make(map[string]int, len(models))
+	for _, m := range models {
+		speeds[m.Name] = m.Speed
+	}
+	states := make(map[string]*chairAvailabilityState, len(chairs))
+	for _, c := range chairs {
+		states[c.ID] = &chairAvailabilityState{
+			availableChair: availableChair{
+				ID:      c.ID,
+				OwnerID: c.OwnerID,
+				Name:    c.Name,
+				Model:   c.Model,
+				Speed:   speeds[c.Model],
+				Version: c.AppVersion.String,
+			},
+			IsActive: c.IsActive,
+			State:    idleChairState(c.IsActive),
+		}
+	}
+	grid := newPointGrid(gridCellSize)
+	for _, l := range locations {
+		if s, ok := states[l.ChairID]; ok {
+			s.Latitude = l.Latitude
+			s.Longitude = l.Longitude
+			s.LocatedAt = l.CreatedAt
+			s.HasLocation = true
+			grid.Move(l.ChairID, l.Latitude, l.Longitude)
+		}
+	}
+	rideChairs := make(map[string]string, len(busyRides))
+	for _, r := range busyRides {
+		if s, ok := states[r.ChairID]; ok {
+			s.State = chairStateAssigned
+			if r.Carrying {
+				s.State = chairStateBusy
+			}
+			s.RideID = r.ID
+			rideChairs[r.ID] = r.ChairID
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.speeds = speeds
+	a.chairs = states
+	a.rideChairs = rideChairs
+	a.grid = grid
+	a.epoch++
+	a.ownerGenerations = map[string]uint64{}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// 列の順番を構造体のフィールドの順番と変えて返しても、列名どおりに読み込まれる
+// 位置や速さを別の列から読んでしまうと、マッチングの距離や見込み時間が黙って狂う
+func TestChairAvailabilityRebuildScansColumnsByName(t *testing.T) {
+	mock := setupMockDB(t)
+	now := time.Now()
+
+	mock.ExpectQuery(`SELECT \* FROM chair_models`).
+		WillReturnRows(sqlmock.NewRows([]string{"speed", "fare_rate", "name"}).
+			AddRow(7, 100, "model-a"))
+	mock.ExpectQuery(`SELECT \* FROM chairs`).
+		WillReturnRows(sqlmock.NewRows([]string{"model", "is_active", "name", "owner_id", "id", "access_token", "created_at", "updated_at"}).
+			AddRow("model-a", true, "chair-name", "owner-1", "chair-1", "token", now, now))
+	mock.ExpectQuery(`SELECT cl\.\* FROM chair_locations`).
+		WillReturnRows(sqlmock.NewRows([]string{"longitude", "created_at", "latitude", "is_flagged", "chair_id", "id"}).
+			AddRow(300, now, 100, false, "chair-1", "loc-1"))
+	mock.ExpectQuery(`SELECT r\.id, r\.chair_id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "chair_id", "carrying"}))
+
+	a := NewChairAvailability(0)
+	if err := a.Rebuild(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	chair, ok := a.LastLocation("chair-1")
+	if !ok {
+		t.Fatal("chair-1 is missing from the availability view")
+	}
+	want := availableChair{
+		ID:        "chair-1",
+		OwnerID:   "owner-1",
+		Name:      "chair-name",
+		Model:     "model-a",
+		Speed:     7,
+		Latitude:  100,
+		Longitude: 300,
+		LocatedAt: now,
+	}
+	if chair != want {
+		t.Errorf("chair = %+v, want %+v", chair, want)
+	}
+}
+
+var allRideStatuses = []string{"MATCHING", "ENROUTE", "PICKUP", "CARRYING", "ARRIVED", "COMPLETED", "CANCELED"}
+
+func newTestAvailability(chairID string) *ChairAvailability {
+	a := NewChairAvailability(0)
+	a.AddChair(&Chair{ID: chairID, OwnerID: "owner-1", Model: "model-a", IsActive: true})
+	a.SetLocation(chairID, 0, 0, time.Now())
+	return a
+}
+
+// 割り当てた椅子は、ライドのステータスがどこまで進んでも椅子に終了を通知するまでは候補に戻さない
+func TestChairAvailabilityKeepsAssignedChairsOutOfCandidates(t *testing.T) {
+	for _, status := range allRideStatuses {
+		t.Run(status, func(t *testing.T) {
+			a := newTestAvailability("chair-1")
+			if !a.Reserve("chair-1", "ride-"+status) {
+				t.Fatal("an idle chair should be reservable")
+			}
+			a.OnRideStatus("ride-"+status, status)
+			if chairs := a.Available(); len(chairs) != 0 {
+				t.Errorf("available chairs = %+v, want none", chairs)
+			}
+			if a.Reserve("chair-1", "other-ride") {
+				t.Error("a chair with an in-progress ride was reserved twice")
+			}
+
+			a.Release("chair-1", "ride-"+status)
+			if chairs := a.Available(); len(chairs) != 1 {
+				t.Errorf("available chairs after release = %+v, want chair-1", chairs)
+			}
+		})
+	}
+}
+
+// 状態の更新が漏れてACTIVEのままでも、最新ステータスが終わっていないライドを持つ椅子は候補にしない
+func TestChairAvailabilityChecksLatestRideStatus(t *testing.T) {
+	for _, status := range allRideStatuses {
+		t.Run(status, func(t *testing.T) {
+			rideID := "availability-test-ride-" + status
+			rideStatusCache.Store(rideID, status)
+			t.Cleanup(func() { rideStatusCache.Delete(rideID) })
+
+			a := newTestAvailability("chair-1")
+			a.chairs["chair-1"].RideID = rideID
+
+			want := isTerminalRideStatus(status)
+			if got := len(a.Available()) == 1; got != want {
+				t.Errorf("available = %v, want %v", got, want)
+			}
+			if got := a.Reserve("chair-1", "other-ride"); got != want {
+				t.Errorf("reserved = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// 遠くても速く着く椅子は、近くの遅い椅子より外側のセルにいても候補に入る
+func TestChairAvailabilityAvailableNearIncludesFasterDistantChairs(t *testing.T) {
+	a := NewChairAvailability(0)
+	a.speeds = map[string]int{"slow": 1, "fast": 100}
+	for _, c := range []struct {
+		id, model           string
+		latitude, longitude int
+	}{
+		{"slow-near", "slow", 10, 0},
+		{"fast-far", "fast", 500, 0},
+		// 最も速いモデルでも近くの椅子より遅くしか着けない
+		{"fast-too-far", "fast", 100000, 0},
+	} {
+		a.AddChair(&Chair{ID: c.id, OwnerID: "owner-1", Model: c.model, IsActive: true})
+		a.SetLocation(c.id, c.latitude, c.longitude, time.Now())
+	}
+
+	chairs := a.AvailableNear(0, 0)
+	got := map[string]bool{}
+	for _, chair := range chairs {
+		got[chair.ID] = true
+	}
+	if !got["slow-near"] || !got["fast-far"] || got["fast-too-far"] {
+		t.Fatalf("candidates = %v", got)
+	}
+	if best := chairs[pickBestChair(&Ride{}, chairs)]; best.ID != "fast-far" {
+		t.Fatalf("eta picked %s, want fast-far", best.ID)
+	}
+	if nearest := chairs[pickNearestChair(&Ride{}, chairs)]; nearest.ID != "slow-near" {
+		t.Fatalf("nearest picked %s, want slow-near", nearest.ID)
+	}
+}
@@ -0,0 +1,210 @@
+// webapp/go/cache.go
+package main
+
+import (
+	"context"
+	"hash/maphash"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// キーごとにロックを分けたマップ。キャッシュごとにRWMutexとマップを書かずに済ませ、高いQPSでも1つのロックに集中させない
+var cacheShards = getEnvInt("ISUCON_CACHE_SHARDS", 16)
+
+type cacheShard[K comparable, V any] struct {
+	mu sync.RWMutex
+	m  map[K]V
+}
+
+type Cache[K comparable, V any] struct {
+	shards []*cacheShard[K, V]
+	hash   func(K) uint64
+}
+
+// hashはキーをシャードに振り分けるのに使う。文字列のキーならhashStringを渡す
+func NewCache[K comparable, V any](shards int, hash func(K) uint64) *Cache[K, V] {
+	c := &Cache[K, V]{shards: make([]*cacheShard[K, V], max(shards, 1)), hash: hash}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard[K, V]{m: map[K]V{}}
+	}
+	return c
+}
+
+var cacheSeed = maphash.MakeSeed()
+
+func hashString(s string) uint64 {
+	return maphash.String(cacheSeed, s)
+}
+
+func (c *Cache[K, V]) shard(key K) *cacheShard[K, V] {
+	return c.shards[c.hash(key)%uint64(len(c.shards))]
+}
+
+func (c *Cache[K, V]) Load(key K) (V, bool) {
+	s := c.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.m[key]
+	return v, ok
+}
+
+func (c *Cache[K, V]) Store(key K, value V) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[key] = value
+}
+
+func (c *Cache[K, V]) Delete(keys ...K) {
+	for _, key := range keys {
+		s := c.shard(key)
+		s.mu.Lock()
+		delete(s.m, key)
+		s.mu.Unlock()
+	}
+}
+
+// fnがtrueを返したエントリを取り除き、取り除いた数を返す
+func (c *Cache[K, V]) DeleteFunc(fn func(K, V) bool) int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, v := range s.m {
+			if fn(k, v) {
+				delete(s.m, k)
+				n++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+func (c *Cache[K, V]) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.RLock()
+		n += len(s.m)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+func (c *Cache[K, V]) Clear() {
+	c.Replace(nil)
+}
+
+// 中身をentriesで置き換える
+func (c *Cache[K, V]) Replace(entries map[K]V) {
+	maps := make([]map[K]V, len(c.shards))
+	for i := range maps {
+		maps[i] = map[K]V{}
+	}
+	for k, v := range entries {
+		maps[c.hash(k)%uint64(len(c.shards))][k] = v
+	}
+	for i, s := range c.shards {
+		s.mu.Lock()
+		s.m = maps[i]
+		s.mu.Unlock()
+	}
+}
+
+// ライドごとの最新ステータスを保持する
+// updateRideStatusで更新し、起動時と初期化時にDBから作り直すので、最新ステータスはDBを引かずにここから読む
+type RideStatusCache struct {
+	*Cache[string, string]
+}
+
+func NewRideStatusCache() *RideStatusCache {
+	return &RideStatusCache{NewCache[string, string](cacheShards, hashString)}
+}
+
+// DBの内容から作り直す
+func (c *RideStatusCache) Rebuild(ctx context.Context) error {
+	rows := []struct {
+		RideID string `db:"ride_id"`
+		Status string `db:"status"`
+	}{}
+	if err := db.SelectContext(ctx, &rows, `SELECT id AS ride_id, latest_status AS status FROM rides WHERE latest_status IS NOT NULL`); err != nil {
+		return err
+	}
+	statuses := make(map[string]string, len(rows))
+	for _, row := range rows {
+		statuses[row.RideID] = row.Status
+	}
+	c.Replace(statuses)
+	return nil
+}
+
+var rideStatusCache = NewRideStatusCache()
+
+// 椅子のIDごとの椅子の情報と、アクセストークンから椅子IDへの索引
+// 椅子を書き換えたらRefreshで書き込んだ内容を読み直すので、認証やハンドラは椅子をここから引いてよい
+// cacheBackendに置くので、Redisを使えば複数台で同じ内容を共有する
+var chairCacheTTL = getEnvDuration("ISUCON_CHAIR_CACHE_TTL", time.Minute)
+
+type ChairCache struct {
+	defaultTTL time.Duration
+}
+
+func NewChairCache(defaultTTL time.Duration) *ChairCache {
+	return &ChairCache{defaultTTL: defaultTTL}
+}
+
+func chairCacheKey(chairID string) string {
+	return "chair:" + chairID
+}
+
+func chairTokenCacheKey(accessToken string) string {
+	return "chair-token:" + accessToken
+}
+
+func (c *ChairCache) Load(ctx context.Context, chairID string) (Chair, bool) {
+	chair := Chair{}
+	if !cacheGetJSON(ctx, chairCacheKey(chairID), &chair) {
+		return Chair{}, false
+	}
+	return chair, true
+}
+
+// デフォルトのTTLで保存する
+func (c *ChairCache) Store(ctx context.Context, chair *Chair) {
+	c.StoreWithTTL(ctx, chair, c.defaultTTL)
+}
+
+// ttlが0以下なら期限なしで保存する
+func (c *ChairCache) StoreWithTTL(ctx context.Context, chair *Chair, ttl time.Duration) {
+	cacheSetJSON(ctx, chairCacheKey(chair.ID), chair, ttl)
+	cacheSetJSON(ctx, chairTokenCacheKey(chair.AccessToken), chair.ID, ttl)
+}
+
+func (c *ChairCache) LoadByToken(ctx context.Context, accessToken string) (Chair, bool) {
+	chairID := ""
+	if !cacheGetJSON(ctx, chairTokenCacheKey(accessToken), &chairID) {
+		return Chair{}, false
+	}
+	chair, ok := c.Load(ctx, chairID)
+	if !ok || chair.AccessToken != accessToken {
+		return Chair{}, false
+	}
+	return chair, true
+}
+
+func (c *ChairCache) Delete(ctx context.Context, chairID string) {
+	cacheDelete(ctx, chairCacheKey(chairID))
+}
+
+// 書き換えた椅子をDBから読み直して保存する。読めなければ消して、次に引いたときにDBから読ませる
+func (c *ChairCache) Refresh(ctx context.Context, chairID string) {
+	chair, err := reposFrom(ctx).Chairs.Get(ctx, chairID)
+	if err != nil {
+		slog.Error("failed to refresh chair cache", "chair_id", chairID, "error", err)
+		c.Delete(ctx, chairID)
+		return
+	}
+	c.Store(ctx, chair)
+}
+
+var chairCache = NewChairCache(chairCacheTTL)
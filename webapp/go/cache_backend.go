@@ -0,0 +1,216 @@
+// webapp/go/cache_backend.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChairCacheやセッションの保存先。既定はプロセス内のメモリで、ISUCON_CACHE_BACKEND=redisにすると
+// 複数台で動かしてもnginxの後ろのどの台からも同じ内容が見える
+type CacheBackend interface {
+	// なければfalseを返す
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// ttlが0以下なら期限なし
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	// すべてのキーを消す。初期化時に呼ぶ
+	Clear(ctx context.Context) error
+}
+
+var cacheSweepInterval = getEnvDuration("ISUCON_CACHE_SWEEP_INTERVAL", 30*time.Second)
+
+var cacheBackend = newCacheBackend()
+
+func newCacheBackend() CacheBackend {
+	switch backend := getEnv("ISUCON_CACHE_BACKEND", "memory"); backend {
+	case "memory":
+		return newMemoryCacheBackend()
+	case "redis":
+		return &redisCacheBackend{
+			client: newRedisClient(
+				getEnv("ISUCON_REDIS_ADDR", "127.0.0.1:6379"),
+				getEnvInt("ISUCON_REDIS_POOL_SIZE", 64),
+				getEnvDuration("ISUCON_REDIS_TIMEOUT", time.Second),
+			),
+			prefix: getEnv("ISUCON_REDIS_PREFIX", "isuride:"),
+		}
+	default:
+		panic(fmt.Sprintf("unknown ISUCON_CACHE_BACKEND: %s", backend))
+	}
+}
+
+// JSONにして保存する。失敗してもキャッシュなので記録するだけにする
+func cacheSetJSON(ctx context.Context, key string, v any, ttl time.Duration) {
+	buf, err := json.Marshal(v)
+	if err == nil {
+		err = cacheBackend.Set(ctx, key, buf, ttl)
+	}
+	if err != nil {
+		slog.Warn("failed to store cache", "key", key, "error", err)
+	}
+}
+
+// 読めなかったときはなかったものとして扱う
+func cacheGetJSON(ctx context.Context, key string, v any) bool {
+	buf, ok, err := cacheBackend.Get(ctx, key)
+	if err == nil && ok {
+		err = json.Unmarshal(buf, v)
+	}
+	if err != nil {
+		slog.Warn("failed to load cache", "key", key, "error", err)
+		return false
+	}
+	return ok
+}
+
+func cacheDelete(ctx context.Context, keys ...string) {
+	if err := cacheBackend.Delete(ctx, keys...); err != nil {
+		slog.Error("failed to delete cache", "keys", keys, "error", err)
+	}
+}
+
+type memoryCacheValue struct {
+	value []byte
+	// ゼロ値なら期限なし
+	expiresAt time.Time
+}
+
+func (v memoryCacheValue) expired(now time.Time) bool {
+	return !v.expiresAt.IsZero() && !now.Before(v.expiresAt)
+}
+
+type memoryCacheBackend struct {
+	entries *Cache[string, memoryCacheValue]
+}
+
+func newMemoryCacheBackend() *memoryCacheBackend {
+	return &memoryCacheBackend{entries: NewCache[string, memoryCacheValue](cacheShards, hashString)}
+}
+
+func (b *memoryCacheBackend) Get(_ context.Context, key string) ([]byte, bool, error) {
+	v, ok := b.entries.Load(key)
+	if !ok || v.expired(time.Now()) {
+		return nil, false, nil
+	}
+	return v.value, true, nil
+}
+
+func (b *memoryCacheBackend) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	v := memoryCacheValue{value: value}
+	if ttl > 0 {
+		v.expiresAt = time.Now().Add(ttl)
+	}
+	b.entries.Store(key, v)
+	return nil
+}
+
+func (b *memoryCacheBackend) Delete(_ context.Context, keys ...string) error {
+	b.entries.Delete(keys...)
+	return nil
+}
+
+func (b *memoryCacheBackend) Clear(_ context.Context) error {
+	b.entries.Clear()
+	return nil
+}
+
+// 期限切れのエントリを取り除き、取り除いた数を返す
+func (b *memoryCacheBackend) Sweep(now time.Time) int {
+	return b.entries.DeleteFunc(func(_ string, v memoryCacheValue) bool {
+		return v.expired(now)
+	})
+}
+
+func (b *memoryCacheBackend) runSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			b.Sweep(now)
+		}
+	}
+}
+
+// 期限切れはRedisのPXに任せる。キーにはprefixを付け、Clearではprefixの付いたキーだけを消す
+type redisCacheBackend struct {
+	client *redisClient
+	prefix string
+}
+
+func (b *redisCacheBackend) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := b.client.Do(ctx, "GET", b.prefix+key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	return []byte(s), true, nil
+}
+
+func (b *redisCacheBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", b.prefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	_, err := b.client.Do(ctx, args...)
+	return err
+}
+
+func (b *redisCacheBackend) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]string, 0, len(keys)+1)
+	args = append(args, "DEL")
+	for _, key := range keys {
+		args = append(args, b.prefix+key)
+	}
+	_, err := b.client.Do(ctx, args...)
+	return err
+}
+
+func (b *redisCacheBackend) Clear(ctx context.Context) error {
+	cursor := "0"
+	for {
+		reply, err := b.client.Do(ctx, "SCAN", cursor, "MATCH", redisGlobEscape(b.prefix)+"*", "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		items, ok := reply.([]any)
+		if !ok || len(items) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply %v", reply)
+		}
+		cursor, _ = items[0].(string)
+		keys, _ := items[1].([]any)
+		if len(keys) > 0 {
+			args := make([]string, 0, len(keys)+1)
+			args = append(args, "DEL")
+			for _, key := range keys {
+				if s, ok := key.(string); ok {
+					args = append(args, s)
+				}
+			}
+			if _, err := b.client.Do(ctx, args...); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+func redisGlobEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
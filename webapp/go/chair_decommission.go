@@ -0,0 +1,72 @@
+// webapp/go/chair_decommission.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// オーナーが椅子を廃止する。行は残すので売上の履歴はそのまま集計できる
+// 廃止した椅子は稼働を止め、認証も通さないので、二度とマッチングや近くの椅子に出てこない
+// ライドを割り当てられている間は廃止できない
+func ownerDeleteChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	chair, err := reposFrom(ctx).Chairs.Get(ctx, chairID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.OwnerID != owner.ID || chair.DecommissionedAt.Valid {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
+	}
+
+	// 確かめている間に割り当てられないよう、先にビューで稼働を止めておく
+	chairAvailability.SetActive(chair.ID, false)
+	if err := decommissionChair(ctx, chair); err != nil {
+		chairAvailability.SetActive(chair.ID, chair.IsActive)
+		if errors.Is(err, errChairHasActiveRide) {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairCache.Refresh(ctx, chair.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errChairHasActiveRide = errors.New("chair has an in-progress ride")
+
+func decommissionChair(ctx context.Context, chair *Chair) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// active_chair_idはライドが終了するまで入っている
+	var rideID string
+	if err := tx.GetContext(ctx, &rideID, `SELECT id FROM rides WHERE active_chair_id = ? LIMIT 1`, chair.ID); err == nil {
+		return errChairHasActiveRide
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE chairs SET is_active = FALSE, decommissioned_at = NOW(6) WHERE id = ?`, chair.ID); err != nil {
+		return err
+	}
+	if err := enqueueChairDeactivatedWebhook(ctx, reposFrom(ctx).Webhooks.With(tx), chair, "decommissioned"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -2,10 +2,12 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/oklog/ulid/v2"
 )
@@ -14,6 +16,7 @@ type chairPostChairsRequest struct {
 	Name               string `json:"name"`
 	Model              string `json:"model"`
 	ChairRegisterToken string `json:"chair_register_token"`
+	Version            string `json:"version"`
 }
 
 type chairPostChairsResponse struct {
@@ -33,8 +36,9 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	owner := &Owner{}
-	if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
+	repos := reposFrom(ctx)
+	owner, err := repos.Owners.GetByChairRegisterToken(ctx, req.ChairRegisterToken)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
 			return
@@ -46,16 +50,29 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 	chairID := ulid.Make().String()
 	accessToken := secureRandomStr(32)
 
-	_, err := db.ExecContext(
-		ctx,
-		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, ?, ?)",
-		chairID, owner.ID, req.Name, req.Model, false, accessToken,
-	)
-	if err != nil {
+	if err := repos.Chairs.Create(ctx, &Chair{
+		ID:          chairID,
+		OwnerID:     owner.ID,
+		Name:        req.Name,
+		Model:       req.Model,
+		IsActive:    false,
+		AppVersion:  sql.NullString{String: req.Version, Valid: req.Version != ""},
+		AccessToken: accessToken,
+	}); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	chairAvailability.AddChair(&Chair{
+		ID:         chairID,
+		OwnerID:    owner.ID,
+		Name:       req.Name,
+		Model:      req.Model,
+		IsActive:   false,
+		AppVersion: sql.NullString{String: req.Version, Valid: req.Version != ""},
+	})
+	chairCache.Refresh(ctx, chairID)
+
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
 		Name:  "chair_session",
@@ -82,11 +99,31 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
+	// 稼働を止めたことと、その通知を積むことは同じトランザクションで行う
+	repos := reposFrom(ctx)
+	tx, err := repos.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer tx.Rollback()
+
+	if err := repos.Chairs.With(tx).SetActive(ctx, chair.ID, req.IsActive); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.IsActive && !req.IsActive {
+		if err := enqueueChairDeactivatedWebhook(ctx, repos.Webhooks.With(tx), chair, "activity"); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairAvailability.SetActive(chair.ID, req.IsActive)
+	chairCache.Refresh(ctx, chair.ID)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -104,67 +141,130 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	chair := ctx.Value("chair").(*Chair)
-
-	tx, err := db.Beginx()
+	location, err := recordChairCoordinate(ctx, chair, req)
 	if err != nil {
+		if code := errorCode(err); code == errCodeCoordinateOutOfRange || code == errCodeImpossibleMove {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
 
-	chairLocationID := ulid.Make().String()
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO chair_locations (id, chair_id, latitude, longitude) VALUES (?, ?, ?, ?)`,
-		chairLocationID, chair.ID, req.Latitude, req.Longitude,
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
+		RecordedAt: location.CreatedAt.UnixMilli(),
+	})
+}
+
+// 椅子の位置を記録し、乗車位置や目的地に着いていればライドのステータスを進める
+// POST /api/chair/coordinateと/api/chair/wsで共通
+func recordChairCoordinate(ctx context.Context, chair *Chair, req *Coordinate) (*ChairLocation, error) {
+	if err := validateCoordinate(req); err != nil {
+		return nil, err
 	}
 
-	location := &ChairLocation{}
-	if err := tx.GetContext(ctx, location, `SELECT * FROM chair_locations WHERE id = ?`, chairLocationID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	flagged := false
+	prev, hasPrev := chairAvailability.LastLocation(chair.ID)
+	if hasPrev && !isPossibleMove(prev, req, time.Now()) {
+		if rejectImpossibleMoves {
+			return nil, errImpossibleMove
+		}
+		flagged = true
 	}
 
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+	repos := reposFrom(ctx)
+	tx, err := repos.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer rollbackTx(tx)
+
+	// 記録時刻はアプリで決めて、挿入した行を読み直さない
+	// 椅子ごとの最新の位置はchairAvailabilityが持っていて、近くの椅子の検索やマッチングはそちらを読む
+	location := &ChairLocation{
+		ID:        ulid.Make().String(),
+		ChairID:   chair.ID,
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		IsFlagged: flagged,
+		CreatedAt: time.Now().Truncate(time.Microsecond),
+	}
+	// 除外しない位置なら、前回の位置からの移動距離を足し込む
+	if !flagged {
+		distance := 0
+		if hasPrev {
+			distance = calculateDistance(prev.Latitude, prev.Longitude, req.Latitude, req.Longitude)
+		}
+		if _, err := tx.ExecContext(
+			ctx,
+			`UPDATE chairs SET total_distance = total_distance + ?, total_distance_updated_at = ?, updated_at = updated_at WHERE id = ?`,
+			distance, location.CreatedAt, chair.ID,
+		); err != nil {
+			return nil, err
+		}
+	}
+	if chairLocationWriter == nil {
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO chair_locations (id, chair_id, latitude, longitude, is_flagged, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			location.ID, location.ChairID, location.Latitude, location.Longitude, location.IsFlagged, location.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	// 経由地に着いたら、ステータスは変わらないので進み具合をコミット後に知らせる
+	var progressedRide *Ride
+	var progressedRoute *rideRouteProgress
+	if ride, err := repos.Rides.With(tx).LatestByChair(ctx, chair.ID); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, err
 		}
 	} else {
 		status, err := getLatestRideStatus(ctx, tx, ride.ID)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, err
 		}
 		if status != "COMPLETED" && status != "CANCELED" {
 			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
+				// 同時に送られた座標で先に進んでいたら何もしない
+				if err := updateRideStatus(ctx, tx, ride.ID, "PICKUP"); err != nil && !errors.Is(err, errInvalidStatusTransition) {
+					return nil, err
 				}
 			}
 
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
+			if status == "CARRYING" {
+				route, remaining, err := arriveAtWaypoint(ctx, tx, ride, req, location.CreatedAt)
+				if err != nil {
+					return nil, err
+				}
+				// 経由地をすべて回るまでは目的地に着いてもARRIVEDにしない
+				if !remaining && req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude {
+					if err := updateRideStatus(ctx, tx, ride.ID, "ARRIVED"); err != nil && !errors.Is(err, errInvalidStatusTransition) {
+						return nil, err
+					}
+				} else if route != nil {
+					progressedRide, progressedRoute = ride, route
 				}
 			}
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	if err := commitTx(tx); err != nil {
+		return nil, err
 	}
-
-	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
-		RecordedAt: location.CreatedAt.UnixMilli(),
-	})
+	if progressedRide != nil {
+		progress := notificationProgress("CARRYING", progressedRoute)
+		notifications.Publish(userNotificationKey(progressedRide.UserID), progressedRide.ID, chair.ID, progress)
+		notifications.Publish(chairNotificationKey(chair.ID), progressedRide.ID, chair.ID, progress)
+	}
+	if chairLocationWriter != nil {
+		chairLocationWriter.enqueue(*location)
+	}
+	if !flagged {
+		chairAvailability.SetLocation(chair.ID, req.Latitude, req.Longitude, location.CreatedAt)
+	}
+	return location, nil
 }
 
 type simpleUser struct {
@@ -175,6 +275,8 @@ type simpleUser struct {
 type chairGetNotificationResponse struct {
 	Data         *chairGetNotificationResponseData `json:"data"`
 	RetryAfterMs int                               `json:"retry_after_ms"`
+	// If-None-Matchに入れて送ると、変化がなければ304が返る
+	Version string `json:"version,omitempty"`
 }
 
 type chairGetNotificationResponseData struct {
@@ -183,69 +285,114 @@ type chairGetNotificationResponseData struct {
 	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate Coordinate `json:"destination_coordinate"`
 	Status                string     `json:"status"`
+	StatusID              string     `json:"status_id,omitempty"`
+	// 経由地のあるライドだけ
+	Route *rideRouteProgress `json:"route,omitempty"`
 }
 
 func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	chair := ctx.Value("chair").(*Chair)
 
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	if wantsEventStream(r) {
+		chairStreamNotification(w, r, chair)
 		return
 	}
+
+	serveNotification(w, r, chairNotificationKey(chair.ID), func(unchanged func(string) bool) (any, string, error) {
+		response, err := getChairNotification(ctx, chair, unchanged)
+		if response == nil || err != nil {
+			return nil, "", err
+		}
+		return response, response.Version, nil
+	})
+}
+
+// 椅子に割り当てたライドの通知を組み立て、未通知のステータスを含めたら通知済みにする
+// unchangedが前回から変化がないと判断したらnilを返す
+func getChairNotification(ctx context.Context, chair *Chair, unchanged func(version string) bool) (*chairGetNotificationResponse, error) {
+	key := chairNotificationKey(chair.ID)
+	seq := notifications.Seq(key)
+
+	repos := reposFrom(ctx)
+	tx, err := repos.Beginx()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Rollback()
-	ride := &Ride{}
 	yetSentRideStatus := RideStatus{}
 	status := ""
 
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+	ride, err := repos.Rides.With(tx).LatestByChair(ctx, chair.ID)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-				RetryAfterMs: 30,
-			})
-			return
+			if !satisfiesMinVersion(chair.AppVersion.String, chairAvailability.MinVersion()) {
+				return nil, errChairVersionTooOld
+			}
+			return &chairGetNotificationResponse{
+				RetryAfterMs: calculateRetryAfterMs(),
+			}, nil
 		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
 	}
 
-	if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
+	if yetSentRideStatus, err = getUnsentRideStatus(ctx, tx, ride.ID, chairNotificationTarget); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			status, err = getLatestRideStatus(ctx, tx, ride.ID)
 			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
+				return nil, err
 			}
 		} else {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, err
 		}
 	} else {
 		status = yetSentRideStatus.Status
 	}
 
+	// 古いバージョンの椅子には進行中のライドがなくなった時点でアップデートを促す
+	if yetSentRideStatus.ID == "" && isTerminalRideStatus(status) && !satisfiesMinVersion(chair.AppVersion.String, chairAvailability.MinVersion()) {
+		return nil, errChairVersionTooOld
+	}
+
+	route, err := getRideRouteProgress(ctx, tx, ride)
+	if err != nil {
+		return nil, err
+	}
+	progress := notificationProgress(status, route)
+	version := notificationVersion(ride.ID, ride.ChairID.String, progress)
+	// 確認応答を待つ場合は、応答がないと送り直すのでDBを見に行かせる
+	if yetSentRideStatus.ID == "" && !notificationAckEnabled {
+		notifications.Delivered(key, seq, ride.ID, ride.ChairID.String, progress)
+	}
+	if yetSentRideStatus.ID == "" && unchanged(version) {
+		return nil, nil
+	}
+
 	user := &User{}
 	err = tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
 	}
 
 	if yetSentRideStatus.ID != "" {
-		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+		if err := markRideStatusSent(ctx, tx, yetSentRideStatus.ID, chairNotificationTarget); err != nil {
+			return nil, err
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
 	}
 
-	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+	// COMPLETED/CANCELEDを通知できたら次のライドを割り当てられる
+	if isTerminalRideStatus(yetSentRideStatus.Status) {
+		chairAvailability.Release(chair.ID, ride.ID)
+		if preassignEnabled {
+			dispatchQueuedRide(ctx, chair.ID)
+		}
+	}
+
+	return &chairGetNotificationResponse{
 		Data: &chairGetNotificationResponseData{
 			RideID: ride.ID,
 			User: simpleUser{
@@ -260,14 +407,71 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 				Latitude:  ride.DestinationLatitude,
 				Longitude: ride.DestinationLongitude,
 			},
-			Status: status,
+			Status:   status,
+			StatusID: ackStatusID(yetSentRideStatus.ID),
+			Route:    route,
 		},
-		RetryAfterMs: 30,
-	})
+		RetryAfterMs: calculateRetryAfterMs(),
+		Version:      version,
+	}, nil
+}
+
+// 新しいライドの割り当てとステータスの変化を送り続ける
+func chairStreamNotification(w http.ResponseWriter, r *http.Request, chair *Chair) {
+	stream, err := startEventStream(w)
+	if err != nil {
+		return
+	}
+	sendChairNotifications(r.Context(), chair, stream.Send)
+}
+
+// ctxが終わるかsendが失敗するまで、椅子への通知を変化があるたびにsendで送る
+// SSEとWebSocketで共通
+func sendChairNotifications(ctx context.Context, chair *Chair, send func(event string, data any) error) {
+	changed, cancel := notifications.Subscribe(chairNotificationKey(chair.ID))
+	defer cancel()
+
+	ticker := time.NewTicker(sseFallbackInterval)
+	defer ticker.Stop()
+
+	lastVersion := ""
+	for {
+		// 未通知のステータスが溜まっていれば続けて送る
+		for {
+			if version, ok := notifications.Version(chairNotificationKey(chair.ID)); ok && version == lastVersion {
+				break
+			}
+			response, err := getChairNotification(ctx, chair, func(version string) bool {
+				return version == lastVersion
+			})
+			if err != nil {
+				if ctx.Err() == nil {
+					send("error", map[string]string{"code": errorCode(err), "message": err.Error()})
+				}
+				return
+			}
+			if response == nil || response.Data == nil {
+				break
+			}
+			if err := send("notification", response); err != nil {
+				return
+			}
+			lastVersion = response.Version
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
 }
 
 type postChairRidesRideIDStatusRequest struct {
 	Status string `json:"status"`
+	// 乗車確認のPIN。CARRYINGにするときに付けると、確認用のエンドポイントを呼ばずに済む
+	Pin string `json:"pin,omitempty"`
 }
 
 func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
@@ -282,15 +486,23 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tx, err := db.Beginx()
+	if req.Status == "CARRYING" && req.Pin != "" {
+		if err := verifyPickupPin(ctx, chair.ID, rideID, req.Pin); err != nil {
+			writePickupPinError(w, err)
+			return
+		}
+	}
+
+	repos := reposFrom(ctx)
+	tx, err := repos.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
+	defer rollbackTx(tx)
 
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
+	ride, err := repos.Rides.With(tx).GetForUpdate(ctx, rideID)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
@@ -307,7 +519,11 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	switch req.Status {
 	// Acknowledge the ride
 	case "ENROUTE":
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ENROUTE"); err != nil {
+		if err := updateRideStatus(ctx, tx, ride.ID, "ENROUTE"); err != nil {
+			if errors.Is(err, errInvalidStatusTransition) {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -322,7 +538,11 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
 			return
 		}
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "CARRYING"); err != nil {
+		if err := updateRideStatus(ctx, tx, ride.ID, "CARRYING"); err != nil {
+			if errors.Is(err, errInvalidStatusTransition) || errors.Is(err, errPickupPinRequired) {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -330,7 +550,7 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
 	}
 
-	if err := tx.Commit(); err != nil {
+	if err := commitTx(tx); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChairPostChairs(t *testing.T) {
+	repos := newFakeRepositories()
+	repos.Owners.(*fakeOwnerRepo).owners["owner-1"] = &Owner{ID: "owner-1", ChairRegisterToken: "register-token"}
+	chairs := repos.Chairs.(*fakeChairRepo)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/chair/chairs", strings.NewReader(body))
+		r = r.WithContext(withRepositories(r.Context(), repos))
+		w := httptest.NewRecorder()
+		chairPostChairs(w, r)
+		return w
+	}
+
+	if w := post(`{"name": "chair", "model": "model", "chair_register_token": "wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("invalid token: status = %d, body = %s", w.Code, w.Body)
+	}
+	if len(chairs.chairs) != 0 {
+		t.Fatalf("chair was created with an invalid token")
+	}
+
+	w := post(`{"name": "chair", "model": "model", "chair_register_token": "register-token", "version": "1.2.0"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+	if len(chairs.chairs) != 1 {
+		t.Fatalf("created %d chairs", len(chairs.chairs))
+	}
+	cookies := w.Result().Cookies()
+	for _, chair := range chairs.chairs {
+		if chair.OwnerID != "owner-1" || chair.IsActive || chair.AppVersion.String != "1.2.0" {
+			t.Errorf("created %+v", chair)
+		}
+		if len(cookies) != 1 || cookies[0].Name != "chair_session" || cookies[0].Value != chair.AccessToken {
+			t.Errorf("cookies = %v, access token = %s", cookies, chair.AccessToken)
+		}
+	}
+}
+
+func TestChairPostActivityEnqueuesDeactivation(t *testing.T) {
+	mock := setupMockDB(t)
+	repos := newFakeRepositories()
+	chair := &Chair{ID: "chair-activity", OwnerID: "owner-1", IsActive: true}
+	repos.Chairs.(*fakeChairRepo).chairs[chair.ID] = chair
+	webhooks := repos.Webhooks.(*fakeOwnerWebhookRepo)
+
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+	r := httptest.NewRequest(http.MethodPost, "/api/chair/activity", strings.NewReader(`{"is_active": false}`))
+	r = r.WithContext(context.WithValue(withRepositories(r.Context(), repos), "chair", &Chair{ID: chair.ID, OwnerID: chair.OwnerID, IsActive: true}))
+	w := httptest.NewRecorder()
+	chairPostActivity(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+	if chair.IsActive {
+		t.Errorf("chair is still active")
+	}
+	if len(webhooks.enqueued) != 1 || !strings.HasPrefix(webhooks.enqueued[0], "owner-1:"+webhookEventChairDeactivate+":") {
+		t.Errorf("enqueued = %v", webhooks.enqueued)
+	}
+}
@@ -0,0 +1,89 @@
+// webapp/go/chair_location_writer.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// chair_locationsへのINSERTを短時間バッファリングしてまとめて書き込む
+// 椅子の座標の送信は最も多い書き込みなので、1リクエスト1INSERTをやめて複数行のINSERTにする
+// 最新の位置はchairAvailabilityにすぐ反映するので、近くの椅子の検索やマッチングは遅れない
+// NOTE: DBへの反映は最大flushInterval遅れ、プロセスが落ちるとバッファの分は失われる
+type chairLocationBatchWriter struct {
+	mu            sync.Mutex
+	buf           []ChairLocation
+	flushInterval time.Duration
+	maxBatchSize  int
+	kick          chan struct{}
+}
+
+// nilならバッファリングせずに都度INSERTする
+var chairLocationWriter *chairLocationBatchWriter
+
+func newChairLocationBatchWriter(flushInterval time.Duration, maxBatchSize int) *chairLocationBatchWriter {
+	return &chairLocationBatchWriter{
+		flushInterval: flushInterval,
+		maxBatchSize:  maxBatchSize,
+		kick:          make(chan struct{}, 1),
+	}
+}
+
+func (w *chairLocationBatchWriter) enqueue(location ChairLocation) {
+	w.mu.Lock()
+	w.buf = append(w.buf, location)
+	full := len(w.buf) >= w.maxBatchSize
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 初期化時などにまだ書き込んでいない行を捨てる
+func (w *chairLocationBatchWriter) discard() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = nil
+}
+
+func (w *chairLocationBatchWriter) run(ctx context.Context) {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			w.flush(context.Background())
+			return
+		case <-ticker.C:
+		case <-w.kick:
+		}
+		w.flush(ctx)
+	}
+}
+
+func (w *chairLocationBatchWriter) flush(ctx context.Context) {
+	w.mu.Lock()
+	rows := w.buf
+	w.buf = nil
+	w.mu.Unlock()
+	if len(rows) == 0 {
+		return
+	}
+
+	start := time.Now()
+	total := len(rows)
+	for len(rows) > 0 {
+		n := min(len(rows), w.maxBatchSize)
+		if _, err := db.NamedExecContext(ctx, `INSERT INTO chair_locations (id, chair_id, latitude, longitude, is_flagged, created_at) VALUES (:id, :chair_id, :latitude, :longitude, :is_flagged, :created_at)`, rows[:n]); err != nil {
+			slog.Error("failed to flush chair locations", "error", err, "rows", n)
+		}
+		rows = rows[n:]
+	}
+	slog.Debug("chair locations flushed", "rows", total, "elapsed", time.Since(start))
+}
@@ -0,0 +1,103 @@
+// webapp/go/chair_ride_queue.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ライドを運んでいる椅子に次のライドを予約しておき、今のライドが終わったらすぐに割り当てる
+// 椅子の位置は運んでいるライドの目的地として候補に入れ、空くまでの時間も配車位置までの見込み時間に足す
+// 予約中のライドはDB上は未割り当てのままで、待ち行列からは外しておく
+var (
+	preassignEnabled = getEnvBool("ISUCON_MATCHING_PREASSIGN", false)
+	// 予約した椅子がこの時間内に空かなければ、予約を取り消して待ち行列に戻す
+	preassignTTL = getEnvDuration("ISUCON_MATCHING_PREASSIGN_TTL", 30*time.Second)
+)
+
+type queuedRide struct {
+	ride     Ride
+	queuedAt time.Time
+}
+
+// 椅子ごとに次のライドを1件まで持つ
+type chairRideQueue struct {
+	mu   sync.Mutex
+	next map[string]queuedRide
+}
+
+var nextRides = &chairRideQueue{next: map[string]queuedRide{}}
+
+func (q *chairRideQueue) Has(chairID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.next[chairID]
+	return ok
+}
+
+// すでに次のライドを予約済みならfalseを返す
+func (q *chairRideQueue) Enqueue(chairID string, ride *Ride, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.next[chairID]; ok {
+		return false
+	}
+	q.next[chairID] = queuedRide{ride: *ride, queuedAt: now}
+	return true
+}
+
+func (q *chairRideQueue) Dequeue(chairID string) (Ride, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queued, ok := q.next[chairID]
+	if !ok {
+		return Ride{}, false
+	}
+	delete(q.next, chairID)
+	return queued.ride, true
+}
+
+// preassignTTLを過ぎた予約を取り消して、そのライドを返す
+func (q *chairRideQueue) Expire(now time.Time) []Ride {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rides := []Ride{}
+	for chairID, queued := range q.next {
+		if now.Sub(queued.queuedAt) > preassignTTL {
+			rides = append(rides, queued.ride)
+			delete(q.next, chairID)
+		}
+	}
+	return rides
+}
+
+func (q *chairRideQueue) Reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next = map[string]queuedRide{}
+}
+
+// 椅子が今のライドを終えたら、予約していた次のライドを割り当てる
+// 割り当てられなければ待ち行列に戻して通常のマッチングに任せる
+func dispatchQueuedRide(ctx context.Context, chairID string) {
+	ride, ok := nextRides.Dequeue(chairID)
+	if !ok {
+		return
+	}
+	chair, ok := chairAvailability.LastLocation(chairID)
+	if !ok || !chairAvailability.Reserve(chairID, ride.ID) {
+		pendingRides.Add(&ride)
+		return
+	}
+	assigned, err := commitAssignments(ctx, []matchingAssignment{{ride: &ride, chair: chair}})
+	if err != nil {
+		slog.Error("failed to dispatch queued ride", "ride_id", ride.ID, "chair_id", chairID, "error", err)
+	}
+	if err != nil || !assigned[0] {
+		// 割り当てられなかったら椅子の予約を解いてライドを待ち行列に戻す
+		chairAvailability.Release(chairID, ride.ID)
+		pendingRides.Add(&ride)
+	}
+}
@@ -0,0 +1,303 @@
+// webapp/go/chair_utilization.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 完了したライドから、椅子ごとの稼働時間(割り当てを受けてから完了するまで)・配車位置までの距離・評価を集める
+// 集計はバックグラウンドで定期的に進め、エンドポイントはメモリ上の結果から期間の分を足し合わせる
+// キャンセルされたライドは数えない
+type ChairUtilizationCache struct {
+	interval time.Duration
+
+	mu sync.RWMutex
+	// Resetしたら増やし、それより前に読み始めた集計は捨てる
+	generation uint64
+	// オーナーごとに完了日時の順
+	byOwner   map[string][]chairRideUsage
+	seen      map[string]struct{}
+	watermark time.Time
+}
+
+type chairRideUsage struct {
+	ChairID string
+	// 最後にENROUTEになった(割り当てを受けた)日時
+	BusyFrom    time.Time
+	CompletedAt time.Time
+	// 割り当てを受けたときの椅子の位置から配車位置までの距離。位置を記録していなければnil
+	PickupDistance *int
+	Evaluation     *int
+}
+
+// 完了のコミットが遅れたライドを取りこぼさないよう、前回の続きより少し遡って読む
+const chairUtilizationLag = 5 * time.Second
+
+func NewChairUtilizationCache() *ChairUtilizationCache {
+	return &ChairUtilizationCache{
+		interval: getEnvDuration("ISUCON_CHAIR_UTILIZATION_INTERVAL", 10*time.Second),
+		byOwner:  map[string][]chairRideUsage{},
+		seen:     map[string]struct{}{},
+	}
+}
+
+var chairUtilization = NewChairUtilizationCache()
+
+func (c *ChairUtilizationCache) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		if err := c.aggregate(ctx); err != nil {
+			slog.Error("failed to aggregate chair utilization", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 初期化でDBを作り直したら最初から集計し直す
+func (c *ChairUtilizationCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.byOwner = map[string][]chairRideUsage{}
+	c.seen = map[string]struct{}{}
+	c.watermark = time.Time{}
+}
+
+type completedRideRow struct {
+	ID              string    `db:"id"`
+	ChairID         string    `db:"chair_id"`
+	OwnerID         string    `db:"owner_id"`
+	PickupLatitude  int       `db:"pickup_latitude"`
+	PickupLongitude int       `db:"pickup_longitude"`
+	Evaluation      *int      `db:"evaluation"`
+	CompletedAt     time.Time `db:"completed_at"`
+}
+
+// 前回より後に完了したライドを集計に加える
+func (c *ChairUtilizationCache) aggregate(ctx context.Context) error {
+	c.mu.RLock()
+	generation, since := c.generation, c.watermark.Add(-chairUtilizationLag)
+	c.mu.RUnlock()
+
+	// 完了したライドのupdated_atは完了日時。rides_archiveには完了済みのライドしか入らない
+	rows := []completedRideRow{}
+	if err := db.SelectContext(ctx, &rows, `SELECT r.id, r.chair_id, c.owner_id, r.pickup_latitude, r.pickup_longitude, r.evaluation, r.updated_at AS completed_at
+FROM rides r JOIN chairs c ON c.id = r.chair_id
+WHERE r.latest_status = 'COMPLETED' AND r.updated_at >= ?
+UNION ALL
+SELECT r.id, r.chair_id, c.owner_id, r.pickup_latitude, r.pickup_longitude, r.evaluation, r.updated_at AS completed_at
+FROM rides_archive r JOIN chairs c ON c.id = r.chair_id
+WHERE r.updated_at >= ?
+ORDER BY completed_at`, since, since); err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	fresh := rows[:0]
+	for _, row := range rows {
+		if _, ok := c.seen[row.ID]; !ok {
+			fresh = append(fresh, row)
+		}
+	}
+	c.mu.RUnlock()
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	rideIDs := make([]string, 0, len(fresh))
+	for _, row := range fresh {
+		rideIDs = append(rideIDs, row.ID)
+	}
+	// 割り当てを外されて別の椅子に割り当て直したライドもあるので、最後のENROUTEを使う
+	query, args, err := sqlx.In(`SELECT ride_id, MAX(created_at) AS created_at FROM (
+  SELECT ride_id, created_at FROM ride_statuses WHERE status = 'ENROUTE' AND ride_id IN (?)
+  UNION ALL
+  SELECT ride_id, created_at FROM ride_statuses_archive WHERE status = 'ENROUTE' AND ride_id IN (?)
+) s GROUP BY ride_id`, rideIDs, rideIDs)
+	if err != nil {
+		return err
+	}
+	enroutes := []struct {
+		RideID    string    `db:"ride_id"`
+		CreatedAt time.Time `db:"created_at"`
+	}{}
+	if err := db.SelectContext(ctx, &enroutes, query, args...); err != nil {
+		return err
+	}
+	enrouteAt := make(map[string]time.Time, len(enroutes))
+	for _, e := range enroutes {
+		enrouteAt[e.RideID] = e.CreatedAt
+	}
+
+	usages := make([]chairRideUsage, 0, len(fresh))
+	for _, row := range fresh {
+		usage := chairRideUsage{
+			ChairID:     row.ChairID,
+			BusyFrom:    row.CompletedAt,
+			CompletedAt: row.CompletedAt,
+			Evaluation:  row.Evaluation,
+		}
+		if at, ok := enrouteAt[row.ID]; ok {
+			usage.BusyFrom = at
+			location := ChairLocation{}
+			if err := db.GetContext(ctx, &location, `SELECT * FROM chair_locations
+WHERE chair_id = ? AND is_flagged = FALSE AND created_at <= ?
+ORDER BY created_at DESC LIMIT 1`, row.ChairID, at); err == nil {
+				distance := calculateDistance(location.Latitude, location.Longitude, row.PickupLatitude, row.PickupLongitude)
+				usage.PickupDistance = &distance
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+		usages = append(usages, usage)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return nil
+	}
+	for i, row := range fresh {
+		c.seen[row.ID] = struct{}{}
+		usage := usages[i]
+		rides := c.byOwner[row.OwnerID]
+		j := sort.Search(len(rides), func(j int) bool { return rides[j].CompletedAt.After(usage.CompletedAt) })
+		rides = append(rides, chairRideUsage{})
+		copy(rides[j+1:], rides[j:])
+		rides[j] = usage
+		c.byOwner[row.OwnerID] = rides
+		if usage.CompletedAt.After(c.watermark) {
+			c.watermark = usage.CompletedAt
+		}
+	}
+	return nil
+}
+
+// オーナーの椅子のライドのうち、sinceより後に完了したもの
+func (c *ChairUtilizationCache) CompletedSince(ownerID string, since time.Time) []chairRideUsage {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	rides := c.byOwner[ownerID]
+	from := sort.Search(len(rides), func(i int) bool { return !rides[i].CompletedAt.Before(since) })
+	return append([]chairRideUsage{}, rides[from:]...)
+}
+
+type ownerGetChairUtilizationResponse struct {
+	Chairs []ownerGetChairUtilizationResponseChair `json:"chairs"`
+}
+
+type ownerGetChairUtilizationResponseChair struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// 期間のうち、ライドを割り当てられてから完了するまでの時間と、それ以外(登録前と現在より後は除く)の時間
+	BusyMs int64 `json:"busy_ms"`
+	IdleMs int64 `json:"idle_ms"`
+	// 期間内に完了したライドの数と、その配車位置までの距離・評価の平均。対象がなければ0
+	RidesCompleted        int     `json:"rides_completed"`
+	AveragePickupDistance float64 `json:"average_pickup_distance"`
+	AverageEvaluation     float64 `json:"average_evaluation"`
+}
+
+// オーナーの椅子ごとの期間内(since/until、UNIXミリ秒)の稼働状況
+// バックグラウンドの集計が追いつくまでは直近に完了したライドが含まれない
+func ownerGetChairUtilization(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	end := until.Add(time.Millisecond)
+	if now := time.Now(); end.After(now) {
+		end = now
+	}
+
+	chairs, err := reposFrom(ctx).Chairs.With(readDB()).ListByOwner(ctx, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	type chairTotal struct {
+		busy           time.Duration
+		rides          int
+		pickupRides    int
+		pickupDistance int
+		evaluatedRides int
+		evaluation     int
+	}
+	totals := map[string]*chairTotal{}
+	for _, chair := range chairs {
+		totals[chair.ID] = &chairTotal{}
+	}
+	for _, usage := range chairUtilization.CompletedSince(owner.ID, since) {
+		total, ok := totals[usage.ChairID]
+		if !ok || !usage.BusyFrom.Before(end) {
+			continue
+		}
+		from, to := usage.BusyFrom, usage.CompletedAt
+		if from.Before(since) {
+			from = since
+		}
+		if to.After(end) {
+			to = end
+		}
+		if to.After(from) {
+			total.busy += to.Sub(from)
+		}
+		if usage.CompletedAt.Before(end) {
+			total.rides++
+			if usage.PickupDistance != nil {
+				total.pickupRides++
+				total.pickupDistance += *usage.PickupDistance
+			}
+			if usage.Evaluation != nil {
+				total.evaluatedRides++
+				total.evaluation += *usage.Evaluation
+			}
+		}
+	}
+
+	res := &ownerGetChairUtilizationResponse{Chairs: []ownerGetChairUtilizationResponseChair{}}
+	for _, chair := range chairs {
+		total := totals[chair.ID]
+		start := since
+		if chair.CreatedAt.After(start) {
+			start = chair.CreatedAt
+		}
+		c := ownerGetChairUtilizationResponseChair{
+			ID:             chair.ID,
+			Name:           chair.Name,
+			BusyMs:         total.busy.Milliseconds(),
+			RidesCompleted: total.rides,
+		}
+		if end.After(start) {
+			c.IdleMs = max(end.Sub(start)-total.busy, 0).Milliseconds()
+		}
+		if total.pickupRides > 0 {
+			c.AveragePickupDistance = float64(total.pickupDistance) / float64(total.pickupRides)
+		}
+		if total.evaluatedRides > 0 {
+			c.AverageEvaluation = float64(total.evaluation) / float64(total.evaluatedRides)
+		}
+		res.Chairs = append(res.Chairs, c)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
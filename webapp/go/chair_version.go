@@ -0,0 +1,93 @@
+// webapp/go/chair_version.go
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 椅子のアプリ/ファームウェアのバージョン
+// 登録時のversionと、認証済みリクエストのX-Chair-Versionヘッダで報告される
+// 最低バージョンを設定すると、それより古い椅子はマッチング対象から外れる
+
+const chairVersionHeader = "X-Chair-Version"
+
+// ドット区切りの数値として比較する。数値でない部分は文字列として比較する
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < max(len(as), len(bs)); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		if xerr == nil && yerr == nil {
+			if xn != yn {
+				if xn < yn {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// 最低バージョンが未設定なら常にtrue。バージョンを報告していない椅子は古いものとして扱う
+func satisfiesMinVersion(version, minVersion string) bool {
+	if minVersion == "" {
+		return true
+	}
+	if version == "" {
+		return false
+	}
+	return compareVersions(version, minVersion) >= 0
+}
+
+var errChairVersionTooOld = newAPIError(errCodeChairVersionTooOld, errors.New("chair version is older than the minimum version"))
+
+// 報告されたバージョンが変わっていれば保存する
+func updateChairVersion(ctx context.Context, chair *Chair, version string) error {
+	if version == "" || version == chair.AppVersion.String {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE chairs SET app_version = ? WHERE id = ?", version, chair.ID); err != nil {
+		return err
+	}
+	chair.AppVersion.String = version
+	chair.AppVersion.Valid = true
+	chairAvailability.SetVersion(chair.ID, version)
+	chairCache.Refresh(ctx, chair.ID)
+	return nil
+}
+
+type internalChairMinVersion struct {
+	MinVersion string `json:"min_version"`
+}
+
+func internalGetChairMinVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &internalChairMinVersion{MinVersion: chairAvailability.MinVersion()})
+}
+
+// 空文字で最低バージョンの制限を外す
+func internalPutChairMinVersion(w http.ResponseWriter, r *http.Request) {
+	req := &internalChairMinVersion{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	chairAvailability.SetMinVersion(req.MinVersion)
+	writeJSON(w, http.StatusOK, req)
+}
@@ -0,0 +1,107 @@
+// webapp/go/chair_ws.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// GET /api/chair/ws
+// POST /api/chair/coordinateとGET /api/chair/notificationのポーリングを1本の接続にまとめる
+// 上り: {"type":"coordinate","data":{"latitude":0,"longitude":0}}
+// 下り: {"type":"coordinate","data":{"recorded_at":0}} / {"type":"notification","data":{...}} / {"type":"error","data":{"code":"","message":""}}
+var wsIdleTimeout = getEnvDuration("ISUCON_WS_IDLE_TIMEOUT", time.Minute)
+
+type chairWebSocketMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type chairWebSocketEvent struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+func chairWebSocket(w http.ResponseWriter, r *http.Request) {
+	chair := r.Context().Value("chair").(*Chair)
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	// 接続はリクエストのタイムアウトより長く使うので、切れるまでは自分で管理する
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+
+	send := func(event string, data any) error {
+		return conn.WriteJSON(chairWebSocketEvent{Type: event, Data: data})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sendChairNotifications(ctx, chair, send)
+		// 通知を送れなくなったら受信も止める。既に閉じていれば何もしない
+		conn.Close(wsCloseGoingAway)
+	}()
+
+	readChairWebSocket(ctx, conn, chair, send)
+	cancel()
+	<-done
+}
+
+// 椅子から送られてくるメッセージを、接続が切れるまで処理する
+func readChairWebSocket(ctx context.Context, conn *wsConn, chair *Chair, send func(event string, data any) error) error {
+	for {
+		conn.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		op, payload, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if op != wsOpText {
+			return conn.fail(wsCloseUnsupported, errors.New("only text messages are supported"))
+		}
+
+		msg := &chairWebSocketMessage{}
+		if err := json.Unmarshal(payload, msg); err != nil {
+			if err := sendWebSocketError(send, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch msg.Type {
+		case "coordinate":
+			req := &Coordinate{}
+			if err := json.Unmarshal(msg.Data, req); err != nil {
+				if err := sendWebSocketError(send, err); err != nil {
+					return err
+				}
+				continue
+			}
+			location, err := recordChairCoordinate(ctx, chair, req)
+			if err != nil {
+				if err := sendWebSocketError(send, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := send("coordinate", &chairPostCoordinateResponse{RecordedAt: location.CreatedAt.UnixMilli()}); err != nil {
+				return err
+			}
+		default:
+			if err := sendWebSocketError(send, errors.New("unknown message type")); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func sendWebSocketError(send func(event string, data any) error, err error) error {
+	slog.Error("error message sent", "error", err)
+	return send("error", map[string]string{"code": errorCode(err), "message": err.Error()})
+}
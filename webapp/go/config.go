@@ -0,0 +1,294 @@
+// webapp/go/config.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 競技中にコードを変えずにチューニングできるよう、ランタイムとHTTPサーバーの設定は環境変数から読む
+type runtimeConfig struct {
+	GoMaxProcs    int           `json:"gomaxprocs"`
+	GCPercent     int           `json:"gc_percent"`
+	MaxConns      int           `json:"max_conns"`
+	MaxConnsPerIP int           `json:"max_conns_per_ip"`
+	KeepAlive     bool          `json:"keep_alive"`
+	ReadTimeout   time.Duration `json:"read_timeout"`
+	WriteTimeout  time.Duration `json:"write_timeout"`
+	IdleTimeout   time.Duration `json:"idle_timeout"`
+	ListenAddr    string        `json:"listen_addr"`
+}
+
+var config runtimeConfig
+
+// /healthzやログで読めるように、時間は"15s"のような文字列にする
+func (c runtimeConfig) MarshalJSON() ([]byte, error) {
+	type plain runtimeConfig
+	return json.Marshal(struct {
+		plain
+		ReadTimeout  string `json:"read_timeout"`
+		WriteTimeout string `json:"write_timeout"`
+		IdleTimeout  string `json:"idle_timeout"`
+	}{plain(c), c.ReadTimeout.String(), c.WriteTimeout.String(), c.IdleTimeout.String()})
+}
+
+func loadRuntimeConfig() runtimeConfig {
+	return runtimeConfig{
+		GoMaxProcs:    getEnvInt("ISUCON_GOMAXPROCS", 0),
+		GCPercent:     getEnvInt("ISUCON_GC_PERCENT", 100),
+		MaxConns:      getEnvInt("ISUCON_MAX_CONNS", 0),
+		MaxConnsPerIP: getEnvInt("ISUCON_MAX_CONNS_PER_IP", 0),
+		KeepAlive:     getEnvBool("ISUCON_KEEP_ALIVE", true),
+		ReadTimeout:   getEnvDuration("ISUCON_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:  getEnvDuration("ISUCON_WRITE_TIMEOUT", 15*time.Second),
+		IdleTimeout:   getEnvDuration("ISUCON_IDLE_TIMEOUT", 60*time.Second),
+		ListenAddr:    getEnv("ISUCON_LISTEN_ADDR", ":8080"),
+	}
+}
+
+// GOMAXPROCSとGCの設定を反映する。実際に適用された値で上書きして返す
+func applyRuntimeConfig(c runtimeConfig) runtimeConfig {
+	if c.GoMaxProcs > 0 {
+		runtime.GOMAXPROCS(c.GoMaxProcs)
+	}
+	c.GoMaxProcs = runtime.GOMAXPROCS(0)
+	debug.SetGCPercent(c.GCPercent)
+	return c
+}
+
+func newServer(c runtimeConfig, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:      handler,
+		Addr:         c.ListenAddr,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		IdleTimeout:  c.IdleTimeout,
+	}
+	srv.SetKeepAlivesEnabled(c.KeepAlive)
+	return srv
+}
+
+func listen(c runtimeConfig) (net.Listener, error) {
+	l, err := net.Listen("tcp", c.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxConns > 0 || c.MaxConnsPerIP > 0 {
+		l = newLimitListener(l, c.MaxConns, c.MaxConnsPerIP)
+	}
+	return l, nil
+}
+
+// DBのコネクションプールとタイムアウト。プライマリとレプリカで共通
+// ドライバの既定(無制限に開いて2本しか残さない)だと高負荷時に接続を張り直し続けるので、残す数を開く数に揃える
+type dbPoolConfig struct {
+	MaxOpenConns    int           `json:"max_open_conns"`
+	MaxIdleConns    int           `json:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `json:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `json:"conn_max_idle_time"`
+	DialTimeout     time.Duration `json:"dial_timeout"`
+	// 0なら切らない。長い集計やマイグレーションがあるので読み込みは既定では切らず、リクエストのタイムアウトに任せる
+	ReadTimeout  time.Duration `json:"read_timeout"`
+	WriteTimeout time.Duration `json:"write_timeout"`
+}
+
+var dbPool = loadDBPoolConfig()
+
+func (c dbPoolConfig) MarshalJSON() ([]byte, error) {
+	type plain dbPoolConfig
+	return json.Marshal(struct {
+		plain
+		ConnMaxLifetime string `json:"conn_max_lifetime"`
+		ConnMaxIdleTime string `json:"conn_max_idle_time"`
+		DialTimeout     string `json:"dial_timeout"`
+		ReadTimeout     string `json:"read_timeout"`
+		WriteTimeout    string `json:"write_timeout"`
+	}{plain(c), c.ConnMaxLifetime.String(), c.ConnMaxIdleTime.String(), c.DialTimeout.String(), c.ReadTimeout.String(), c.WriteTimeout.String()})
+}
+
+func loadDBPoolConfig() dbPoolConfig {
+	maxOpen := getEnvInt("ISUCON_DB_MAX_OPEN_CONNS", 64)
+	return dbPoolConfig{
+		MaxOpenConns:    maxOpen,
+		MaxIdleConns:    getEnvInt("ISUCON_DB_MAX_IDLE_CONNS", maxOpen),
+		ConnMaxLifetime: getEnvDuration("ISUCON_DB_CONN_MAX_LIFETIME", 5*time.Minute),
+		ConnMaxIdleTime: getEnvDuration("ISUCON_DB_CONN_MAX_IDLE_TIME", 2*time.Minute),
+		DialTimeout:     getEnvDuration("ISUCON_DB_DIAL_TIMEOUT", 3*time.Second),
+		ReadTimeout:     getEnvDuration("ISUCON_DB_READ_TIMEOUT", 0),
+		WriteTimeout:    getEnvDuration("ISUCON_DB_WRITE_TIMEOUT", 10*time.Second),
+	}
+}
+
+type healthzResponse struct {
+	Status   string        `json:"status"`
+	Runtime  runtimeConfig `json:"runtime"`
+	Database dbPoolConfig  `json:"database"`
+}
+
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &healthzResponse{
+		Status:   "ok",
+		Runtime:  config,
+		Database: dbPool,
+	})
+}
+
+func getEnv(key, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		panic(fmt.Sprintf("failed to convert %s environment variable into int: %v", key, err))
+	}
+	return i
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		panic(fmt.Sprintf("failed to convert %s environment variable into float: %v", key, err))
+	}
+	return f
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		panic(fmt.Sprintf("failed to convert %s environment variable into bool: %v", key, err))
+	}
+	return b
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		panic(fmt.Sprintf("failed to convert %s environment variable into duration: %v", key, err))
+	}
+	return d
+}
+
+// 同時接続数(全体とIPごと)を制限するリスナー
+// 全体の上限に達している間はAcceptを止め、新しい接続はどれかが閉じるまでOSのバックログで待たせる
+// IPごとの上限を超えた接続はAcceptした直後に閉じる
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	perIP     int
+	mu        sync.Mutex
+	connsByIP map[string]int
+}
+
+func newLimitListener(l net.Listener, maxConns, maxConnsPerIP int) *limitListener {
+	ll := &limitListener{
+		Listener:  l,
+		perIP:     maxConnsPerIP,
+		connsByIP: map[string]int{},
+	}
+	if maxConns > 0 {
+		ll.sem = make(chan struct{}, maxConns)
+	}
+	return ll
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.sem != nil {
+			l.sem <- struct{}{}
+		}
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if l.sem != nil {
+				<-l.sem
+			}
+			return nil, err
+		}
+
+		ip := remoteIP(c)
+		if !l.acquireIP(ip) {
+			slog.Warn("too many connections from the same ip", "ip", ip)
+			c.Close()
+			if l.sem != nil {
+				<-l.sem
+			}
+			continue
+		}
+		return &limitListenerConn{Conn: c, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *limitListener) acquireIP(ip string) bool {
+	if l.perIP <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.connsByIP[ip] >= l.perIP {
+		return false
+	}
+	l.connsByIP[ip]++
+	return true
+}
+
+func (l *limitListener) release(ip string) {
+	if l.perIP > 0 {
+		l.mu.Lock()
+		l.connsByIP[ip]--
+		if l.connsByIP[ip] <= 0 {
+			delete(l.connsByIP, ip)
+		}
+		l.mu.Unlock()
+	}
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+func remoteIP(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
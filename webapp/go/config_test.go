@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetHealthzFormatsDurations(t *testing.T) {
+	prevConfig, prevPool := config, dbPool
+	t.Cleanup(func() { config, dbPool = prevConfig, prevPool })
+	config = runtimeConfig{MaxConns: 10, ReadTimeout: 15 * time.Second, WriteTimeout: 1500 * time.Millisecond, ListenAddr: ":8080"}
+	dbPool = dbPoolConfig{MaxOpenConns: 64, ConnMaxLifetime: 5 * time.Minute}
+
+	w := httptest.NewRecorder()
+	getHealthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	res := struct {
+		Runtime  map[string]any `json:"runtime"`
+		Database map[string]any `json:"database"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]any{
+		"read_timeout":  "15s",
+		"write_timeout": "1.5s",
+		"idle_timeout":  "0s",
+		"max_conns":     float64(10),
+		"listen_addr":   ":8080",
+	} {
+		if got := res.Runtime[key]; got != want {
+			t.Errorf("runtime.%s = %#v, want %#v", key, got, want)
+		}
+	}
+	for key, want := range map[string]any{
+		"conn_max_lifetime": "5m0s",
+		"read_timeout":      "0s",
+		"max_open_conns":    float64(64),
+	} {
+		if got := res.Database[key]; got != want {
+			t.Errorf("database.%s = %#v, want %#v", key, got, want)
+		}
+	}
+}
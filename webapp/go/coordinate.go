@@ -0,0 +1,38 @@
+// webapp/go/coordinate.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 椅子から送られてくる位置情報の検証
+// 1点でもおかしな座標が入るとtotal_distanceが壊れたままになるので、
+// 範囲外は弾き、モデルの速度ではありえない移動はフラグを立てて距離の集計から除外する
+var (
+	coordinateMin = getEnvInt("ISUCON_COORDINATE_MIN", -1000)
+	coordinateMax = getEnvInt("ISUCON_COORDINATE_MAX", 1000)
+	// 椅子がspeed分だけ移動するのにかかる最短の時間
+	chairMoveTick = getEnvDuration("ISUCON_CHAIR_MOVE_TICK", 10*time.Millisecond)
+	// trueならありえない移動を422で弾く。falseならフラグを立てて記録する
+	rejectImpossibleMoves = getEnvBool("ISUCON_REJECT_IMPOSSIBLE_MOVES", false)
+)
+
+func validateCoordinate(c *Coordinate) error {
+	if c.Latitude < coordinateMin || c.Latitude > coordinateMax || c.Longitude < coordinateMin || c.Longitude > coordinateMax {
+		return newAPIError(errCodeCoordinateOutOfRange, fmt.Errorf("coordinate must be between %d and %d", coordinateMin, coordinateMax))
+	}
+	return nil
+}
+
+// 前回の位置からの移動がモデルの速度で可能な範囲か
+func isPossibleMove(prev availableChair, c *Coordinate, at time.Time) bool {
+	if prev.Speed <= 0 {
+		return true
+	}
+	ticks := int(at.Sub(prev.LocatedAt)/chairMoveTick) + 1
+	return calculateDistance(prev.Latitude, prev.Longitude, c.Latitude, c.Longitude) <= prev.Speed*ticks
+}
+
+var errImpossibleMove = newAPIError(errCodeImpossibleMove, errors.New("moved farther than the chair model can travel"))
@@ -0,0 +1,79 @@
+// webapp/go/db_replica.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 読み取り専用のクエリ(売上、椅子の統計、オーナーのライド検索)を流すレプリカ
+// ISUCON_DB_REPLICA_HOSTを設定したときだけ使い、ヘルスチェックに通らない間はプライマリに流す
+// NOTE: レプリカは遅れうるので、書き込みと同じトランザクションで読むものや、直前の書き込みを読む必要があるものには使わない
+type replicaRouter struct {
+	db       *sqlx.DB
+	interval time.Duration
+	timeout  time.Duration
+
+	healthy atomic.Bool
+}
+
+var replica = newReplicaRouter()
+
+func newReplicaRouter() *replicaRouter {
+	r := &replicaRouter{
+		interval: getEnvDuration("ISUCON_DB_REPLICA_HEALTH_INTERVAL", time.Second),
+		timeout:  getEnvDuration("ISUCON_DB_REPLICA_HEALTH_TIMEOUT", 500*time.Millisecond),
+	}
+	host := getEnv("ISUCON_DB_REPLICA_HOST", "")
+	if host == "" {
+		return r
+	}
+	replicaDB, err := openDB(host, getEnv("ISUCON_DB_REPLICA_PORT", "3306"))
+	if err != nil {
+		slog.Error("failed to open replica, reading from primary", "error", err)
+		return r
+	}
+	r.db = replicaDB
+	return r
+}
+
+// 読み取りに使うDB。レプリカが使えなければプライマリを返す
+func readDB() *sqlx.DB {
+	if replica.db != nil && replica.healthy.Load() {
+		return replica.db
+	}
+	return db
+}
+
+func (r *replicaRouter) run(ctx context.Context) {
+	r.check(ctx)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.check(ctx)
+	}
+}
+
+func (r *replicaRouter) check(ctx context.Context) {
+	pingCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	err := r.db.PingContext(pingCtx)
+	cancel()
+	if err == nil {
+		if r.healthy.CompareAndSwap(false, true) {
+			slog.Info("replica is healthy, routing reads to replica")
+		}
+		return
+	}
+	if r.healthy.CompareAndSwap(true, false) {
+		slog.Error("replica health check failed, routing reads to primary", "error", err)
+	}
+}
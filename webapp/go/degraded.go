@@ -0,0 +1,190 @@
+// webapp/go/degraded.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DBに繋がらない間の縮退モード
+// ヘルスチェックが続けて失敗したら縮退し、ポーリング系のGETは直前に返したレスポンスをそのまま返す
+// それ以外のリクエストは再試行できるエラー(503)で断り、DBが戻ったら自動で通常に戻る
+type degradedMode struct {
+	enabled   bool
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+
+	degraded atomic.Bool
+	// 縮退に入った時刻(UNIXナノ秒)
+	since    atomic.Int64
+	failures int
+
+	mu      sync.RWMutex
+	cache   map[string]*cachedResponse
+	maxSize int
+}
+
+type cachedResponse struct {
+	contentType string
+	body        []byte
+	storedAt    time.Time
+}
+
+// 縮退中もキャッシュから返せるGET
+var degradedCacheablePaths = map[string]struct{}{
+	"/api/app/notification":   {},
+	"/api/app/nearby-chairs":  {},
+	"/api/chair/notification": {},
+	"/api/owner/chairs":       {},
+}
+
+var degraded = &degradedMode{
+	enabled:   getEnvBool("ISUCON_DEGRADED_MODE", false),
+	interval:  getEnvDuration("ISUCON_DB_HEALTH_INTERVAL", time.Second),
+	timeout:   getEnvDuration("ISUCON_DB_HEALTH_TIMEOUT", 500*time.Millisecond),
+	threshold: getEnvInt("ISUCON_DB_HEALTH_FAILURES", 3),
+	cache:     map[string]*cachedResponse{},
+	maxSize:   getEnvInt("ISUCON_DEGRADED_CACHE_SIZE", 100000),
+}
+
+var errDatabaseUnavailable = newAPIError(errCodeDatabaseUnavailable, errors.New("database is unavailable, retry later"))
+
+func (d *degradedMode) run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, d.timeout)
+		err := db.PingContext(pingCtx)
+		cancel()
+		d.observe(err)
+	}
+}
+
+func (d *degradedMode) observe(err error) {
+	if err == nil {
+		d.failures = 0
+		if d.degraded.CompareAndSwap(true, false) {
+			slog.Info("database recovered, leaving degraded mode")
+		}
+		return
+	}
+	d.failures++
+	if d.failures >= d.threshold && !d.degraded.Load() {
+		d.since.Store(time.Now().UnixNano())
+		d.degraded.Store(true)
+		slog.Error("database health check failed, entering degraded mode", "error", err)
+	}
+}
+
+// セッションごとに区別するためにCookieの値をキーに含める
+func degradedCacheKey(r *http.Request) string {
+	var session string
+	for _, name := range []string{"app_session", "owner_session", "chair_session"} {
+		if c, err := r.Cookie(name); err == nil {
+			session = name + "=" + c.Value
+			break
+		}
+	}
+	return session + " " + r.URL.RequestURI()
+}
+
+type capturingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *capturingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *capturingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (d *degradedMode) store(key string, w *capturingResponseWriter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.cache[key]; !ok && len(d.cache) >= d.maxSize {
+		return
+	}
+	d.cache[key] = &cachedResponse{
+		contentType: w.Header().Get("Content-Type"),
+		body:        bytes.Clone(w.body.Bytes()),
+		storedAt:    time.Now(),
+	}
+}
+
+func (d *degradedMode) load(key string) (*cachedResponse, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	res, ok := d.cache[key]
+	return res, ok
+}
+
+func (d *degradedMode) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cache = map[string]*cachedResponse{}
+}
+
+func (d *degradedMode) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !d.enabled || strings.HasPrefix(r.URL.Path, "/health") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_, cacheable := degradedCacheablePaths[r.URL.Path]
+		// SSEの応答は終わらないので溜めない
+		cacheable = cacheable && r.Method == http.MethodGet && !wantsEventStream(r)
+
+		if d.degraded.Load() {
+			if cacheable {
+				if res, ok := d.load(degradedCacheKey(r)); ok {
+					w.Header().Set("Content-Type", res.contentType)
+					w.Header().Set("X-Data-Staleness", strconv.FormatInt(int64(time.Since(res.storedAt)/time.Second), 10))
+					w.Header().Set("Warning", `110 - "Response is Stale"`)
+					w.WriteHeader(http.StatusOK)
+					w.Write(res.body)
+					return
+				}
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(d.interval/time.Second))))
+			writeError(w, http.StatusServiceUnavailable, errDatabaseUnavailable)
+			return
+		}
+
+		if !cacheable {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &capturingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if cw.status == http.StatusOK {
+			d.store(degradedCacheKey(r), cw)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+// webapp/go/errors.go
+package main
+
+import (
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// クライアントが機械的に判別できるように、エラーレスポンスにはcodeを付けられる
+const (
+	errCodeRideAlreadyExists       = "RIDE_ALREADY_EXISTS"
+	errCodeInvalidStatusTransition = "INVALID_STATUS_TRANSITION"
+	errCodeCoordinateOutOfRange    = "COORDINATE_OUT_OF_RANGE"
+	errCodeImpossibleMove          = "IMPOSSIBLE_MOVE"
+	errCodeChairVersionTooOld      = "CHAIR_VERSION_TOO_OLD"
+	errCodeInvalidPickupPin        = "INVALID_PICKUP_PIN"
+	errCodePickupPinLocked         = "PICKUP_PIN_LOCKED"
+	errCodeDatabaseUnavailable     = "DATABASE_UNAVAILABLE"
+	errCodeInternal                = "INTERNAL_ERROR"
+)
+
+type apiError struct {
+	code string
+	err  error
+}
+
+func newAPIError(code string, err error) error {
+	return &apiError{code: code, err: err}
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+func errorCode(err error) string {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.code
+	}
+	return ""
+}
+
+// ユニーク制約に違反したか
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
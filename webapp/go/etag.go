@@ -0,0 +1,33 @@
+// webapp/go/etag.go
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+)
+
+// ETagを付け、If-None-Matchと一致すれば304を返してtrueを返す
+// 呼び出し側はtrueならレスポンスを書かずに終える
+func checkETag(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// 通知の内容が変わったかを判定するバージョン。ライド・割り当てた椅子・ステータスから作る
+// DBを読まずにnotificationsが持っている状態からも同じ値を作れる
+func notificationVersion(rideID, chairID, status string) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%s|%s", rideID, status, chairID)
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// 通知に変化がなければ304を返してtrueを返す。304にはボディがないので再取得までの間隔はヘッダで返す
+func checkNotificationVersion(w http.ResponseWriter, r *http.Request, version string, retryAfterMs int) bool {
+	setRetryAfter(w, retryAfterMs)
+	return checkETag(w, r, version)
+}
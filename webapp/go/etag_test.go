@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{``, false},
+		{`"a"`, true},
+		{`"b"`, false},
+		{`W/"a"`, true},
+		{`"b", "a"`, true},
+		{`*`, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", tt.ifNoneMatch)
+		}
+		if got := etagMatches(r, `"a"`); got != tt.want {
+			t.Errorf("etagMatches(If-None-Match: %s) = %v, want %v", tt.ifNoneMatch, got, tt.want)
+		}
+	}
+}
+
+// 通知の組み立てを真似る。前回と同じバージョンならnilを返す
+func fakeNotificationBuilder(version string) notificationBuilder {
+	return func(unchanged func(string) bool) (any, string, error) {
+		if unchanged(version) {
+			return nil, version, nil
+		}
+		return map[string]string{"status": "ENROUTE"}, version, nil
+	}
+}
+
+func TestServeNotificationConditionalGet(t *testing.T) {
+	version := notificationVersion("ride-1", "chair-1", "ENROUTE")
+
+	w := httptest.NewRecorder()
+	serveNotification(w, httptest.NewRequest(http.MethodGet, "/api/app/notification", nil), "test:etag", fakeNotificationBuilder(version))
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != version || w.Body.Len() == 0 {
+		t.Fatalf("first poll: status = %d, etag = %q, body = %q", w.Code, w.Header().Get("ETag"), w.Body)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/app/notification", nil)
+	r.Header.Set("If-None-Match", version)
+	w = httptest.NewRecorder()
+	serveNotification(w, r, "test:etag", fakeNotificationBuilder(version))
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("unchanged poll: status = %d, body = %q", w.Code, w.Body)
+	}
+	if w.Header().Get("ETag") != version || w.Header().Get("Retry-After") == "" {
+		t.Errorf("unchanged poll headers = %v", w.Header())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/app/notification", nil)
+	r.Header.Set("If-None-Match", notificationVersion("ride-1", "chair-1", "MATCHING"))
+	w = httptest.NewRecorder()
+	serveNotification(w, r, "test:etag", fakeNotificationBuilder(version))
+	if w.Code != http.StatusOK {
+		t.Fatalf("changed poll: status = %d", w.Code)
+	}
+}
@@ -0,0 +1,83 @@
+// webapp/go/fairness.go
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// 椅子ごと・オーナーごとに割り当てたライドの数を数え、fairness戦略で少ない方に回す
+// 速い椅子や椅子の多いオーナーにばかり配車が集まらないようにする
+type fairnessTracker struct {
+	mu     sync.Mutex
+	chairs map[string]int
+	owners map[string]int
+}
+
+func newFairnessTracker() *fairnessTracker {
+	return &fairnessTracker{chairs: map[string]int{}, owners: map[string]int{}}
+}
+
+var fairness = newFairnessTracker()
+
+// ライドを割り当てたときに呼ぶ
+func (f *fairnessTracker) Served(chair availableChair) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chairs[chair.ID]++
+	f.owners[chair.OwnerID]++
+}
+
+func (f *fairnessTracker) counts(chair availableChair) (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.chairs[chair.ID], f.owners[chair.OwnerID]
+}
+
+// DBの割り当て済みライドから数え直す。起動時と初期化時に呼ぶ
+func (f *fairnessTracker) Rebuild(ctx context.Context) error {
+	rows := []struct {
+		ChairID string `db:"chair_id"`
+		OwnerID string `db:"owner_id"`
+		Count   int    `db:"count"`
+	}{}
+	if err := db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT rides.chair_id, chairs.owner_id, COUNT(*) AS count FROM rides JOIN chairs ON rides.chair_id = chairs.id GROUP BY rides.chair_id, chairs.owner_id`,
+	); err != nil {
+		return err
+	}
+	chairs := make(map[string]int, len(rows))
+	owners := map[string]int{}
+	for _, row := range rows {
+		chairs[row.ChairID] = row.Count
+		owners[row.OwnerID] += row.Count
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chairs = chairs
+	f.owners = owners
+	return nil
+}
+
+// 配車位置までの時間がfairnessSlack以内の椅子のうち、割り当てたライドが最も少ない椅子のインデックスを返す
+// 同数ならオーナーの割り当て数が少ない方、それも同じなら最後に割り当ててから長く空いている方を選ぶ
+func pickFairestChair(ride *Ride, chairs []availableChair) int {
+	bestETA := estimatePickupETA(chairs[pickBestChair(ride, chairs)], ride)
+	best, bestChairCount, bestOwnerCount := -1, 0, 0
+	for i, chair := range chairs {
+		if estimatePickupETA(chair, ride) > bestETA+fairnessSlack {
+			continue
+		}
+		chairCount, ownerCount := fairness.counts(chair)
+		if best < 0 ||
+			chairCount < bestChairCount ||
+			chairCount == bestChairCount && ownerCount < bestOwnerCount ||
+			chairCount == bestChairCount && ownerCount == bestOwnerCount && chair.LastAssignedAt.Before(chairs[best].LastAssignedAt) {
+			best, bestChairCount, bestOwnerCount = i, chairCount, ownerCount
+		}
+	}
+	return best
+}
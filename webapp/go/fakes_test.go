@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ハンドラのテストで使うメモリ上のリポジトリ
+// トランザクションは扱わないので、WithはDBを切り替えずに自分を返す
+func newFakeRepositories() *repositories {
+	return &repositories{
+		db:       db,
+		Rides:    &fakeRideRepo{rides: map[string]*Ride{}},
+		Chairs:   &fakeChairRepo{chairs: map[string]*Chair{}},
+		Owners:   &fakeOwnerRepo{owners: map[string]*Owner{}},
+		Webhooks: newFakeOwnerWebhookRepo(),
+	}
+}
+
+type fakeRideRepo struct {
+	rides map[string]*Ride
+}
+
+func (r *fakeRideRepo) With(sqlx.ExtContext) RideRepo { return r }
+
+func (r *fakeRideRepo) Get(_ context.Context, id string) (*Ride, error) {
+	if ride, ok := r.rides[id]; ok {
+		return ride, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *fakeRideRepo) GetByUser(ctx context.Context, id, userID string) (*Ride, error) {
+	ride, err := r.Get(ctx, id)
+	if err != nil || ride.UserID != userID {
+		return nil, sql.ErrNoRows
+	}
+	return ride, nil
+}
+
+func (r *fakeRideRepo) GetForUpdate(ctx context.Context, id string) (*Ride, error) {
+	return r.Get(ctx, id)
+}
+
+func (r *fakeRideRepo) LatestByUser(_ context.Context, userID string) (*Ride, error) {
+	return r.latest(func(ride *Ride) bool { return ride.UserID == userID })
+}
+
+func (r *fakeRideRepo) LatestByChair(_ context.Context, chairID string) (*Ride, error) {
+	return r.latest(func(ride *Ride) bool { return ride.ChairID.String == chairID })
+}
+
+func (r *fakeRideRepo) latest(match func(*Ride) bool) (*Ride, error) {
+	var latest *Ride
+	for _, ride := range r.rides {
+		if match(ride) && (latest == nil || ride.CreatedAt.After(latest.CreatedAt)) {
+			latest = ride
+		}
+	}
+	if latest == nil {
+		return nil, sql.ErrNoRows
+	}
+	return latest, nil
+}
+
+type fakeChairRepo struct {
+	chairs map[string]*Chair
+}
+
+func (r *fakeChairRepo) With(sqlx.ExtContext) ChairRepo { return r }
+
+func (r *fakeChairRepo) Get(_ context.Context, id string) (*Chair, error) {
+	if chair, ok := r.chairs[id]; ok {
+		return chair, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *fakeChairRepo) GetByAccessToken(_ context.Context, accessToken string) (*Chair, error) {
+	for _, chair := range r.chairs {
+		if chair.AccessToken == accessToken {
+			return chair, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *fakeChairRepo) ListByOwner(_ context.Context, ownerID string) ([]Chair, error) {
+	chairs := []Chair{}
+	for _, chair := range r.chairs {
+		if chair.OwnerID == ownerID {
+			chairs = append(chairs, *chair)
+		}
+	}
+	return chairs, nil
+}
+
+func (r *fakeChairRepo) Create(_ context.Context, chair *Chair) error {
+	c := *chair
+	r.chairs[chair.ID] = &c
+	return nil
+}
+
+func (r *fakeChairRepo) SetActive(_ context.Context, id string, active bool) error {
+	if chair, ok := r.chairs[id]; ok {
+		chair.IsActive = active
+	}
+	return nil
+}
+
+type fakeOwnerRepo struct {
+	owners map[string]*Owner
+}
+
+func (r *fakeOwnerRepo) With(sqlx.ExtContext) OwnerRepo { return r }
+
+func (r *fakeOwnerRepo) GetByAccessToken(_ context.Context, accessToken string) (*Owner, error) {
+	for _, owner := range r.owners {
+		if owner.AccessToken == accessToken {
+			return owner, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *fakeOwnerRepo) GetByChairRegisterToken(_ context.Context, token string) (*Owner, error) {
+	for _, owner := range r.owners {
+		if owner.ChairRegisterToken == token {
+			return owner, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+type fakeDelivery struct {
+	webhookDelivery
+	nextAttemptAt time.Time
+	lastError     string
+	delivered     bool
+	failed        bool
+}
+
+type fakeOwnerWebhookRepo struct {
+	mu         sync.Mutex
+	webhooks   map[string]*OwnerWebhook
+	deliveries map[string]*fakeDelivery
+	enqueued   []string
+}
+
+func newFakeOwnerWebhookRepo() *fakeOwnerWebhookRepo {
+	return &fakeOwnerWebhookRepo{
+		webhooks:   map[string]*OwnerWebhook{},
+		deliveries: map[string]*fakeDelivery{},
+	}
+}
+
+func (r *fakeOwnerWebhookRepo) With(sqlx.ExtContext) OwnerWebhookRepo { return r }
+
+func (r *fakeOwnerWebhookRepo) Create(_ context.Context, webhook *OwnerWebhook) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w := *webhook
+	r.webhooks[webhook.ID] = &w
+	return nil
+}
+
+func (r *fakeOwnerWebhookRepo) Delete(_ context.Context, ownerID, webhookID string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if w, ok := r.webhooks[webhookID]; !ok || w.OwnerID != ownerID {
+		return false, nil
+	}
+	delete(r.webhooks, webhookID)
+	return true, nil
+}
+
+func (r *fakeOwnerWebhookRepo) OwnerIDs(context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ownerIDs := []string{}
+	for _, w := range r.webhooks {
+		ownerIDs = append(ownerIDs, w.OwnerID)
+	}
+	return ownerIDs, nil
+}
+
+// 積んだイベントを "オーナー:イベント:dedupKey" で記録する
+func (r *fakeOwnerWebhookRepo) Enqueue(_ context.Context, ownerID, event, dedupKey string, _ any) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enqueued = append(r.enqueued, ownerID+":"+event+":"+dedupKey)
+	return nil
+}
+
+func (r *fakeOwnerWebhookRepo) DueDeliveries(_ context.Context, now time.Time, limit int) ([]webhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deliveries := []webhookDelivery{}
+	for _, d := range r.deliveries {
+		if !d.delivered && !d.failed && !d.nextAttemptAt.After(now) && len(deliveries) < limit {
+			deliveries = append(deliveries, d.webhookDelivery)
+		}
+	}
+	return deliveries, nil
+}
+
+func (r *fakeOwnerWebhookRepo) Lease(_ context.Context, id string, now, until time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := r.deliveries[id]
+	if d.nextAttemptAt.After(now) {
+		return false, nil
+	}
+	d.nextAttemptAt = until
+	return true, nil
+}
+
+func (r *fakeOwnerWebhookRepo) MarkDelivered(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deliveries[id].delivered = true
+	return nil
+}
+
+func (r *fakeOwnerWebhookRepo) MarkRetry(_ context.Context, id string, attempts int, lastError string, nextAttemptAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := r.deliveries[id]
+	d.Attempts, d.lastError, d.nextAttemptAt = attempts, lastError, nextAttemptAt
+	return nil
+}
+
+func (r *fakeOwnerWebhookRepo) MarkFailed(_ context.Context, id string, attempts int, lastError string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := r.deliveries[id]
+	d.Attempts, d.lastError, d.failed = attempts, lastError, true
+	return nil
+}
@@ -0,0 +1,55 @@
+// webapp/go/flight.go
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var errFlightPanicked = errors.New("shared call panicked")
+
+// 同じキーで同時に呼ばれた重い読み込みを1回にまとめる(golang.org/x/sync/singleflightと同じ考え方)
+// 最初の呼び出しだけがfnを実行し、実行中に来た呼び出しはその結果を待って受け取る
+// x/sync/singleflightは待っている呼び出しがあるときのpanicを別のgoroutineで投げ直してプロセスごと落とすので、
+// recoverMiddlewareで500にできるようにこちらを使う
+type flightCall[V any] struct {
+	wg  sync.WaitGroup
+	val V
+	err error
+	// 結果を待っている呼び出しの数
+	dups int
+}
+
+type flightGroup[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[V]
+}
+
+// 結果は待っていた呼び出しと共有するので、呼び出し側で書き換えない
+func (g *flightGroup[V]) Do(key string, fn func() (V, error)) (V, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall[V]{}
+	}
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &flightCall[V]{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	// fnがpanicしたら待っていた呼び出しにはエラーを返す
+	c.err = errFlightPanicked
+	c.val, c.err = fn()
+	return c.val, c.err
+}
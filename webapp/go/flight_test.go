@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fnを実行している間に来た同じキーの呼び出しは、fnを実行せずに結果を受け取る
+func TestFlightGroupSuppressesDuplicates(t *testing.T) {
+	var g flightGroup[int]
+	var calls atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	const n = 10
+	results := make(chan int, n)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v, _ := g.Do("key", func() (int, error) {
+			close(started)
+			calls.Add(1)
+			<-release
+			return 42, nil
+		})
+		results <- v
+	}()
+	<-started
+	for range n - 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, _ := g.Do("key", func() (int, error) {
+				calls.Add(1)
+				return -1, nil
+			})
+			results <- v
+		}()
+	}
+	// 後から来た呼び出しが待ち始めるまで待つ
+	waitFor(t, func() bool { return flightWaiters(&g, "key") == n-1 })
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if c := calls.Load(); c != 1 {
+		t.Fatalf("fn was called %d times", c)
+	}
+	for v := range results {
+		if v != 42 {
+			t.Fatalf("got %d", v)
+		}
+	}
+}
+
+func TestFlightGroupSharesError(t *testing.T) {
+	var g flightGroup[int]
+	errBoom := errors.New("boom")
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := g.Do("key", func() (int, error) {
+			close(started)
+			<-release
+			return 0, errBoom
+		})
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, err := g.Do("key", func() (int, error) { return 1, nil })
+		errs <- err
+	}()
+	waitFor(t, func() bool { return flightWaiters(&g, "key") == 1 })
+	close(release)
+	for range 2 {
+		if err := <-errs; err != errBoom {
+			t.Fatalf("err = %v", err)
+		}
+	}
+}
+
+// 終わった呼び出しの結果は覚えておかず、キーが違えば別々に実行する
+func TestFlightGroupDoesNotCache(t *testing.T) {
+	var g flightGroup[string]
+	var calls atomic.Int32
+	fn := func(v string) func() (string, error) {
+		return func() (string, error) {
+			calls.Add(1)
+			return v, nil
+		}
+	}
+	if v, _ := g.Do("a", fn("first")); v != "first" {
+		t.Fatalf("got %s", v)
+	}
+	if v, _ := g.Do("a", fn("second")); v != "second" {
+		t.Fatalf("got %s", v)
+	}
+	if v, _ := g.Do("b", fn("other")); v != "other" {
+		t.Fatalf("got %s", v)
+	}
+	if c := calls.Load(); c != 3 {
+		t.Fatalf("fn was called %d times", c)
+	}
+}
+
+// fnがpanicしたら、実行した呼び出しはpanicし、待っていた呼び出しはエラーを受け取る
+func TestFlightGroupPanic(t *testing.T) {
+	var g flightGroup[int]
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() { panicked <- recover() }()
+		g.Do("key", func() (int, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+	errs := make(chan error, 1)
+	go func() {
+		_, err := g.Do("key", func() (int, error) { return 1, nil })
+		errs <- err
+	}()
+	waitFor(t, func() bool { return flightWaiters(&g, "key") == 1 })
+	close(release)
+
+	if p := <-panicked; p != "boom" {
+		t.Fatalf("recovered %v", p)
+	}
+	if err := <-errs; err != errFlightPanicked {
+		t.Fatalf("err = %v", err)
+	}
+	// panicした後もキーは使える
+	if v, err := g.Do("key", func() (int, error) { return 7, nil }); v != 7 || err != nil {
+		t.Fatalf("got %d, %v", v, err)
+	}
+}
+
+// 実行中の呼び出しを待っている数
+func flightWaiters[V any](g *flightGroup[V], key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c.dups
+	}
+	return 0
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,219 @@
+// webapp/go/grid.go
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// ライドの配車位置・目的地を格子状に区切って引けるようにするインデックス
+// 範囲検索のたびにridesを全件なめないために使う
+type gridCell struct {
+	X int
+	Y int
+}
+
+type gridRide struct {
+	PickupLatitude       int
+	PickupLongitude      int
+	DestinationLatitude  int
+	DestinationLongitude int
+}
+
+type RideGridIndex struct {
+	mu       sync.RWMutex
+	cellSize int
+	cells    map[gridCell]map[string]struct{}
+	rides    map[string]gridRide
+}
+
+func NewRideGridIndex(cellSize int) *RideGridIndex {
+	return &RideGridIndex{
+		cellSize: cellSize,
+		cells:    map[gridCell]map[string]struct{}{},
+		rides:    map[string]gridRide{},
+	}
+}
+
+// 格子の1辺の長さ。ライドと椅子の両方のインデックスで使う
+var gridCellSize = getEnvInt("ISUCON_GRID_CELL_SIZE", 50)
+
+var rideGrid = NewRideGridIndex(gridCellSize)
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+func (g *RideGridIndex) cellOf(latitude, longitude int) gridCell {
+	return gridCell{X: floorDiv(latitude, g.cellSize), Y: floorDiv(longitude, g.cellSize)}
+}
+
+func (g *RideGridIndex) addLocked(rideID string, ride gridRide) {
+	g.rides[rideID] = ride
+	for _, c := range []gridCell{
+		g.cellOf(ride.PickupLatitude, ride.PickupLongitude),
+		g.cellOf(ride.DestinationLatitude, ride.DestinationLongitude),
+	} {
+		if g.cells[c] == nil {
+			g.cells[c] = map[string]struct{}{}
+		}
+		g.cells[c][rideID] = struct{}{}
+	}
+}
+
+func (g *RideGridIndex) Add(ride *Ride) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.addLocked(ride.ID, gridRide{
+		PickupLatitude:       ride.PickupLatitude,
+		PickupLongitude:      ride.PickupLongitude,
+		DestinationLatitude:  ride.DestinationLatitude,
+		DestinationLongitude: ride.DestinationLongitude,
+	})
+}
+
+// 配車位置か目的地がmatchを満たすライドのIDを返す
+// 範囲(両端を含む)に重なるセルだけを見る
+func (g *RideGridIndex) search(minLat, maxLat, minLon, maxLon int, match func(latitude, longitude int) bool) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	from := g.cellOf(minLat, minLon)
+	to := g.cellOf(maxLat, maxLon)
+	seen := map[string]struct{}{}
+	ids := []string{}
+	for x := from.X; x <= to.X; x++ {
+		for y := from.Y; y <= to.Y; y++ {
+			for id := range g.cells[gridCell{X: x, Y: y}] {
+				if _, ok := seen[id]; ok {
+					continue
+				}
+				seen[id] = struct{}{}
+				ride := g.rides[id]
+				if match(ride.PickupLatitude, ride.PickupLongitude) || match(ride.DestinationLatitude, ride.DestinationLongitude) {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	return ids
+}
+
+func (g *RideGridIndex) SearchBox(minLat, maxLat, minLon, maxLon int) []string {
+	return g.search(minLat, maxLat, minLon, maxLon, func(latitude, longitude int) bool {
+		return minLat <= latitude && latitude <= maxLat && minLon <= longitude && longitude <= maxLon
+	})
+}
+
+// 距離はcalculateDistanceと同じくマンハッタン距離
+func (g *RideGridIndex) SearchRadius(latitude, longitude, distance int) []string {
+	return g.search(latitude-distance, latitude+distance, longitude-distance, longitude+distance, func(lat, lon int) bool {
+		return calculateDistance(latitude, longitude, lat, lon) <= distance
+	})
+}
+
+// ライドの目的地
+func (g *RideGridIndex) Destination(rideID string) (int, int, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	ride, ok := g.rides[rideID]
+	if !ok {
+		return 0, 0, false
+	}
+	return ride.DestinationLatitude, ride.DestinationLongitude, true
+}
+
+// DBの内容からインデックスを作り直す。起動時と初期化時に呼ぶ
+func (g *RideGridIndex) Rebuild(ctx context.Context) error {
+	rides := []Ride{}
+	if err := db.SelectContext(ctx, &rides, "SELECT id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude FROM rides"); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cells = map[gridCell]map[string]struct{}{}
+	g.rides = make(map[string]gridRide, len(rides))
+	for _, ride := range rides {
+		g.addLocked(ride.ID, gridRide{
+			PickupLatitude:       ride.PickupLatitude,
+			PickupLongitude:      ride.PickupLongitude,
+			DestinationLatitude:  ride.DestinationLatitude,
+			DestinationLongitude: ride.DestinationLongitude,
+		})
+	}
+	return nil
+}
+
+// IDごとに1点を持つ格子。ロックは持たないので呼び出し側で守る
+type pointGrid struct {
+	cellSize int
+	cells    map[gridCell]map[string]struct{}
+	points   map[string]gridCell
+}
+
+func newPointGrid(cellSize int) *pointGrid {
+	return &pointGrid{
+		cellSize: cellSize,
+		cells:    map[gridCell]map[string]struct{}{},
+		points:   map[string]gridCell{},
+	}
+}
+
+func (g *pointGrid) cellOf(latitude, longitude int) gridCell {
+	return gridCell{X: floorDiv(latitude, g.cellSize), Y: floorDiv(longitude, g.cellSize)}
+}
+
+// 位置を更新する。セルが変わったときだけ付け替える
+func (g *pointGrid) Move(id string, latitude, longitude int) {
+	c := g.cellOf(latitude, longitude)
+	if prev, ok := g.points[id]; ok {
+		if prev == c {
+			return
+		}
+		delete(g.cells[prev], id)
+		if len(g.cells[prev]) == 0 {
+			delete(g.cells, prev)
+		}
+	}
+	if g.cells[c] == nil {
+		g.cells[c] = map[string]struct{}{}
+	}
+	g.cells[c][id] = struct{}{}
+	g.points[id] = c
+}
+
+func (g *pointGrid) Len() int {
+	return len(g.points)
+}
+
+// 範囲(両端を含む)に重なるセルのIDを返す
+func (g *pointGrid) Within(minLat, maxLat, minLon, maxLon int, fn func(id string)) {
+	from := g.cellOf(minLat, minLon)
+	to := g.cellOf(maxLat, maxLon)
+	for x := from.X; x <= to.X; x++ {
+		for y := from.Y; y <= to.Y; y++ {
+			for id := range g.cells[gridCell{X: x, Y: y}] {
+				fn(id)
+			}
+		}
+	}
+}
+
+// 中心のセルからring個離れたセルのIDを返す
+func (g *pointGrid) Ring(latitude, longitude, ring int, fn func(id string)) {
+	center := g.cellOf(latitude, longitude)
+	for x := center.X - ring; x <= center.X+ring; x++ {
+		for y := center.Y - ring; y <= center.Y+ring; y++ {
+			if max(abs(x-center.X), abs(y-center.Y)) != ring {
+				continue
+			}
+			for id := range g.cells[gridCell{X: x, Y: y}] {
+				fn(id)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+)
+
+// グローバルのdbをsqlmockに差し替える。テストが終わったら戻す
+func setupMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := db
+	db = sqlx.NewDb(mockDB, "mysql")
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+		db = prev
+	})
+	return mock
+}
+
+// sqlmockに差し替えたdbを使うリポジトリをcontextに入れる
+func mockRepoContext(ctx context.Context) context.Context {
+	return withRepositories(ctx, newRepositories(db))
+}
@@ -0,0 +1,97 @@
+// webapp/go/http_client.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// 外部へのHTTPリクエストはすべてこのクライアントを使う
+// http.DefaultClientはホストあたりのアイドルコネクションが2本しかなく、
+// 決済が集中するとコネクションを張り直し続けてエフェメラルポートを食い潰すため
+var httpClient = newHTTPClient()
+
+func newHTTPClient() *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          getEnvInt("ISUCON_HTTP_MAX_IDLE_CONNS", 512),
+		MaxIdleConnsPerHost:   getEnvInt("ISUCON_HTTP_MAX_IDLE_CONNS_PER_HOST", 256),
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   getEnvDuration("ISUCON_HTTP_CLIENT_TIMEOUT", 10*time.Second),
+	}
+}
+
+// オーナーが登録したWebhookのURLへ送るクライアント
+// 任意のURLにサーバーからリクエストを送ることになるので、内部のホスト(決済やDB、メタデータサーバーなど)には繋がない
+// 名前解決した後のIPを接続するときに確かめるので、DNSで内部のIPを返されても防げる。リダイレクトも追わない
+var webhookHTTPClient = newWebhookHTTPClient()
+
+func newWebhookHTTPClient() *http.Client {
+	transport := &http.Transport{
+		// プロキシを挟むと接続先のIPを確かめられないので使わない
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   webhookDialControl,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          getEnvInt("ISUCON_HTTP_MAX_IDLE_CONNS", 512),
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   getEnvDuration("ISUCON_HTTP_CLIENT_TIMEOUT", 10*time.Second),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+var errWebhookDestinationNotAllowed = errors.New("webhook destination is not allowed")
+
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !webhookDestinationAllowed(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errWebhookDestinationNotAllowed, addrPort.Addr())
+	}
+	return nil
+}
+
+// ループバック・プライベート・リンクローカルなど、外部のホストでないアドレスには送らない
+func webhookDestinationAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() &&
+		!addr.IsLoopback() &&
+		!addr.IsPrivate() &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast() &&
+		!addr.IsUnspecified() &&
+		!sharedAddressSpace.Contains(addr)
+}
+
+// キャリアグレードNAT(RFC 6598)のアドレス。プライベートアドレスと同じくクラウドの内部で使われる
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
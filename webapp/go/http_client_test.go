@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestWebhookDestinationAllowed(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.5", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := webhookDestinationAllowed(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("webhookDestinationAllowed(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookHTTPClientRefusesLoopback(t *testing.T) {
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer ts.Close()
+
+	_, err := webhookHTTPClient.Post(ts.URL, "application/json", nil)
+	if !errors.Is(err, errWebhookDestinationNotAllowed) {
+		t.Fatalf("err = %v, want %v", err, errWebhookDestinationNotAllowed)
+	}
+	if called {
+		t.Fatal("request reached the loopback server")
+	}
+}
+
+func TestWebhookHTTPClientDoesNotFollowRedirects(t *testing.T) {
+	if err := webhookHTTPClient.CheckRedirect(nil, nil); !errors.Is(err, http.ErrUseLastResponse) {
+		t.Fatalf("CheckRedirect = %v, want %v", err, http.ErrUseLastResponse)
+	}
+}
@@ -0,0 +1,159 @@
+// webapp/go/i18n.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// エラーコードと、通知・領収書に出すユーザー向けの文言のカタログ
+// 言語はリクエストのAccept-Languageで選び、対応していなければISUCON_DEFAULT_LANGを使う
+var defaultLang = getEnv("ISUCON_DEFAULT_LANG", "ja")
+
+var messageCatalog = map[string]map[string]string{
+	"ja": {
+		errCodeRideAlreadyExists:       "進行中のライドがあります",
+		errCodeInvalidStatusTransition: "この状態には変更できません",
+		errCodeCoordinateOutOfRange:    "座標が範囲外です",
+		errCodeImpossibleMove:          "移動速度が椅子の性能を超えています",
+		errCodeChairVersionTooOld:      "椅子のアプリを更新してください",
+		errCodeInvalidPickupPin:        "乗車確認のPINが正しくありません",
+		errCodePickupPinLocked:         "PINを間違えた回数が多すぎます",
+		errCodeDatabaseUnavailable:     "ただいま混み合っています。しばらくしてから再度お試しください",
+		errCodeInternal:                "サーバーでエラーが発生しました",
+
+		"status.MATCHING":  "椅子を探しています",
+		"status.ENROUTE":   "椅子が配車位置に向かっています",
+		"status.PICKUP":    "椅子が到着しました",
+		"status.CARRYING":  "目的地に向かっています",
+		"status.ARRIVED":   "目的地に到着しました",
+		"status.COMPLETED": "ご利用ありがとうございました",
+		"status.CANCELED":  "ライドはキャンセルされました",
+
+		"receipt.subject":      "ISURIDE 領収書 %s",
+		"receipt.ride":         "ライド: %s",
+		"receipt.fare":         "料金: %d円",
+		"receipt.tip":          "チップ: %d円",
+		"receipt.completed_at": "完了日時: %s",
+	},
+	"en": {
+		errCodeRideAlreadyExists:       "You already have a ride in progress",
+		errCodeInvalidStatusTransition: "The ride cannot move to this status",
+		errCodeCoordinateOutOfRange:    "The coordinate is out of range",
+		errCodeImpossibleMove:          "The move is faster than the chair can travel",
+		errCodeChairVersionTooOld:      "Please update the chair app",
+		errCodeInvalidPickupPin:        "The pickup PIN is incorrect",
+		errCodePickupPinLocked:         "Too many incorrect pickup PIN attempts",
+		errCodeDatabaseUnavailable:     "The service is temporarily unavailable. Please retry later",
+		errCodeInternal:                "An internal server error occurred",
+
+		"status.MATCHING":  "Looking for a chair",
+		"status.ENROUTE":   "Your chair is on its way",
+		"status.PICKUP":    "Your chair has arrived",
+		"status.CARRYING":  "Heading to your destination",
+		"status.ARRIVED":   "You have arrived",
+		"status.COMPLETED": "Thank you for riding",
+		"status.CANCELED":  "The ride was canceled",
+
+		"receipt.subject":      "ISURIDE receipt %s",
+		"receipt.ride":         "ride: %s",
+		"receipt.fare":         "fare: %d",
+		"receipt.tip":          "tip: %d",
+		"receipt.completed_at": "completed_at: %s",
+	},
+}
+
+// Accept-Languageから対応している言語を選ぶ
+func negotiateLang(acceptLanguage string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	candidates := []candidate{}
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		// en-USのような地域付きのタグは言語部分だけを見る
+		lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := messageCatalog[lang]; ok && q > 0 {
+			candidates = append(candidates, candidate{lang: lang, q: q})
+		}
+	}
+	if len(candidates) == 0 {
+		return defaultLang
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
+
+// カタログに無ければデフォルト言語、それも無ければfallbackを返す
+func localize(lang, key, fallback string, args ...any) string {
+	msg, ok := messageCatalog[lang][key]
+	if !ok {
+		msg, ok = messageCatalog[defaultLang][key]
+	}
+	if !ok {
+		return fallback
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// writeErrorからも言語を引けるようにResponseWriterに持たせる
+type localizedResponseWriter struct {
+	http.ResponseWriter
+	lang string
+}
+
+func (w *localizedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *localizedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func localeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lang := negotiateLang(r.Header.Get("Accept-Language"))
+		w.Header().Set("Content-Language", lang)
+		ctx := context.WithValue(r.Context(), "lang", lang)
+		next.ServeHTTP(&localizedResponseWriter{ResponseWriter: w, lang: lang}, r.WithContext(ctx))
+	})
+}
+
+func langFromContext(ctx context.Context) string {
+	if lang, ok := ctx.Value("lang").(string); ok {
+		return lang
+	}
+	return defaultLang
+}
+
+// 他のミドルウェアに包まれていても辿れるようにUnwrapしながら探す
+func langFromWriter(w http.ResponseWriter) string {
+	for {
+		switch rw := w.(type) {
+		case *localizedResponseWriter:
+			return rw.lang
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return defaultLang
+		}
+	}
+}
@@ -2,53 +2,373 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"errors"
+	"log/slog"
 	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
 )
 
+// 1回のマッチングの設定。GETでは現在の設定をそのまま使い、POSTでは呼び出しごとに上書きできる
+type matchingParams struct {
+	Mode     string
+	Strategy MatchingStrategy
+	// 割り当てるライドの件数の上限。0なら待っている全ライド
+	Limit int
+	// 配車位置からこれより遠い椅子は割り当てない。0なら制限しない
+	MaxDistance int64
+}
+
+func defaultMatchingParams() matchingParams {
+	return matchingParams{
+		Mode:        matchingMode,
+		Strategy:    currentMatchingStrategy(),
+		MaxDistance: maxPickupDistance.Load(),
+	}
+}
+
 // このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
+// POST /api/internal/matching の既定値で呼ぶのと同じ
 func internalGetMatching(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	// MEMO: 一旦最も待たせているリクエストに適当な空いている椅子マッチさせる実装とする。おそらくもっといい方法があるはず…
-	ride := &Ride{}
-	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at LIMIT 1`); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNoContent)
+	p := defaultMatchingParams()
+	// ?limit= で1回の呼び出しで割り当てるライドの件数を絞る
+	limit, err := parseMatchingLimit(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p.Limit = limit
+	if r.URL.Query().Get("mode") == "batch" {
+		p.Mode = "batch"
+	}
+
+	if err := matchRides(r.Context(), p); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type internalPostMatchingRequest struct {
+	Strategy    string `json:"strategy"`
+	MaxMatches  int    `json:"max_matches"`
+	MaxDistance *int64 `json:"max_distance"`
+}
+
+// 戦略・割り当て件数の上限・配車距離の上限をこの呼び出しだけ変えてマッチングする
+// 省略した項目は現在の設定を使う
+func internalPostMatching(w http.ResponseWriter, r *http.Request) {
+	req := &internalPostMatchingRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	p := defaultMatchingParams()
+	if req.Strategy != "" {
+		strategy, ok := matchingStrategies[req.Strategy]
+		if !ok {
+			writeError(w, http.StatusBadRequest, errors.New("unknown matching strategy"))
 			return
 		}
+		p.Strategy = strategy
+	}
+	if req.MaxMatches < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("max_matches must not be negative"))
+		return
+	}
+	p.Limit = req.MaxMatches
+	if req.MaxDistance != nil {
+		if *req.MaxDistance < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("max_distance must not be negative"))
+			return
+		}
+		p.MaxDistance = *req.MaxDistance
+	}
+
+	if err := matchRides(r.Context(), p); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func matchRides(ctx context.Context, p matchingParams) error {
+	if p.Mode == "batch" {
+		return matchBatch(ctx, p)
+	}
+
+	if preassignEnabled {
+		for _, ride := range nextRides.Expire(time.Now()) {
+			pendingRides.Add(&ride)
+		}
+	}
 
-	matched := &Chair{}
-	empty := false
-	for i := 0; i < 10; i++ {
-		if err := db.GetContext(ctx, matched, "SELECT * FROM chairs INNER JOIN (SELECT id FROM chairs WHERE is_active = TRUE ORDER BY RAND() LIMIT 1) AS tmp ON chairs.id = tmp.id LIMIT 1"); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				w.WriteHeader(http.StatusNoContent)
-				return
+	// 待ち時間と運賃で重み付けした優先度の高い順に、待っているライドをまとめて割り当てる
+	rides := pendingRides.Top(p.Limit)
+	if len(rides) == 0 {
+		return nil
+	}
+
+	assignments := []matchingAssignment{}
+	// assignmentsと同じ並びの判断。予約したものは別に持つ
+	decisions := []matchDecision{}
+	queued := []matchDecision{}
+	for i := range rides {
+		ride := &rides[i]
+		start := time.Now()
+		chairs := chairAvailability.AvailableNear(ride.PickupLatitude, ride.PickupLongitude)
+		if preassignEnabled {
+			chairs = append(chairs, chairAvailability.Finishing(nextRides.Has)...)
+		}
+		chairs = filterPickupDistance(ride, chairs, p.MaxDistance)
+
+		if shadow != nil {
+			shadow.Observe(ride, chairs)
+		}
+
+		// 他のマッチングに先に確保された椅子は候補から外して選び直す
+		candidates := len(chairs)
+		for len(chairs) > 0 {
+			j := p.Strategy.Pick(ride, chairs)
+			matched := chairs[j]
+			chairs = append(chairs[:j], chairs[j+1:]...)
+			now := time.Now()
+			decision := newMatchDecision(p.Strategy.Name(), ride, matched, candidates, now.Sub(start), now)
+			// ライドを運んでいる椅子なら次のライドとして予約する
+			if matched.FreeIn > 0 {
+				if nextRides.Enqueue(matched.ID, ride, now) {
+					pendingRides.Remove(ride.ID)
+					decision.Outcome = matchOutcomeQueued
+					queued = append(queued, decision)
+					break
+				}
+				continue
+			}
+			if chairAvailability.Reserve(matched.ID, ride.ID) {
+				assignments = append(assignments, matchingAssignment{ride: ride, chair: matched})
+				decisions = append(decisions, decision)
+				break
 			}
-			writeError(w, http.StatusInternalServerError, err)
 		}
+	}
 
-		if err := db.GetContext(ctx, &empty, "SELECT COUNT(*) = 0 FROM (SELECT COUNT(chair_sent_at) = 6 AS completed FROM ride_statuses WHERE ride_id IN (SELECT id FROM rides WHERE chair_id = ?) GROUP BY ride_id) is_completed WHERE completed = FALSE", matched.ID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+	assigned, err := commitAssignments(ctx, assignments)
+	if err != nil {
+		return err
+	}
+	for i := range decisions {
+		if assigned[i] {
+			decisions[i].Outcome = matchOutcomeAssigned
+		}
+	}
+	matchAudit.Record(decisions...)
+	matchAudit.Record(queued...)
+	if shadow != nil {
+		for i, a := range assignments {
+			if assigned[i] {
+				shadow.Compare(a.ride, a.chair)
+			}
 		}
-		if empty {
-			break
+	}
+	return nil
+}
+
+type matchingAssignment struct {
+	ride  *Ride
+	chair availableChair
+}
+
+// 予約済みの椅子をライドに割り当てて確定させる
+// 割り当てられなかった椅子の予約は解除し、割り当てたものは集計に記録する
+func commitAssignments(ctx context.Context, assignments []matchingAssignment) ([]bool, error) {
+	assigned, err := assignChairs(ctx, assignments)
+	now := time.Now()
+	for i, a := range assignments {
+		if err != nil || !assigned[i] {
+			chairAvailability.Release(a.chair.ID, a.ride.ID)
+			continue
 		}
+		matchLatency.Assigned(a.ride.ID, a.ride.CreatedAt, now)
+		matchingStats.Record(a.ride, a.chair, now)
+		fairness.Served(a.chair)
 	}
-	if !empty {
-		w.WriteHeader(http.StatusNoContent)
+	return assigned, err
+}
+
+// ライドに椅子を割り当て、同じトランザクションで割り当てイベントを積んでコミット後に配信する
+// 複数のライドをまとめて1つのトランザクションで割り当てる。配車位置までの見込み時間も一緒に記録する
+// 並行して他の椅子にマッチングされていたライドはfalseになる
+func assignChairs(ctx context.Context, assignments []matchingAssignment) ([]bool, error) {
+	assigned := make([]bool, len(assignments))
+	if len(assignments) == 0 {
+		return assigned, nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 椅子の選択はトランザクションの外で行っているので、候補の椅子の行をロックしてから進行中のライドがないか確かめる
+	// ロックの順序を揃えて並行したマッチング同士でデッドロックしないようにする
+	chairIDs := make([]string, 0, len(assignments))
+	for _, a := range assignments {
+		chairIDs = append(chairIDs, a.chair.ID)
+	}
+	query, args, err := sqlx.In("SELECT id FROM chairs WHERE id IN (?) ORDER BY id FOR UPDATE", chairIDs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, err
+	}
+	busy := []string{}
+	query, args, err = sqlx.In("SELECT active_chair_id FROM rides WHERE active_chair_id IN (?)", chairIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &busy, query, args...); err != nil {
+		return nil, err
+	}
+	busyChairs := map[string]struct{}{}
+	for _, chairID := range busy {
+		busyChairs[chairID] = struct{}{}
+	}
+
+	// 椅子が他のライドを持っていて割り当てなかったライドはMATCHINGのままなので、待ち行列に残す
+	chairBusy := make([]bool, len(assignments))
+	for i, a := range assignments {
+		if _, ok := busyChairs[a.chair.ID]; ok {
+			chairBusy[i] = true
+			continue
+		}
+		eta := estimatePickupETA(a.chair, a.ride)
+		// キャンセルされたライドは割り当てない
+		// active_chair_idのユニーク制約があるので、ロックをすり抜けても1つの椅子に2つのライドは割り当たらない
+		result, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ?, active_chair_id = ?, pickup_eta_ms = ?, pickup_pin = IFNULL(pickup_pin, ?) WHERE id = ? AND chair_id IS NULL AND latest_status = 'MATCHING'", a.chair.ID, a.chair.ID, eta.Milliseconds(), newPickupPin(), a.ride.ID)
+		if isDuplicateEntry(err) {
+			chairBusy[i] = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if count == 0 {
+			continue
+		}
+
+		if err := outbox.Enqueue(ctx, tx, a.ride.ID, a.chair.ID, "MATCHED"); err != nil {
+			return nil, err
+		}
+		if err := logRideEvent(ctx, tx, a.ride.ID, rideEventAssigned, rideAssignedPayload{ChairID: a.chair.ID, PickupETAMs: eta.Milliseconds()}); err != nil {
+			return nil, err
+		}
+		assigned[i] = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	// 0件更新だったライドは既に他の椅子が割り当てられたかMATCHINGでなくなっているので、どちらもキューから外す
+	for i, a := range assignments {
+		if chairBusy[i] {
+			pendingRides.Add(a.ride)
+			continue
+		}
+		pendingRides.Remove(a.ride.ID)
+		if assigned[i] {
+			// 割り当てるのはMATCHINGのライドだけ
+			notifications.Publish(chairNotificationKey(a.chair.ID), a.ride.ID, a.chair.ID, "MATCHING")
+			notifications.Publish(userNotificationKey(a.ride.UserID), a.ride.ID, a.chair.ID, "MATCHING")
+		}
+	}
+
+	// 配信に失敗しても割り当ては確定している。未配信分は次回のPublishで再送される
+	if err := outbox.Publish(ctx); err != nil {
+		slog.Error("failed to publish ride events", "error", err)
+	}
+	return assigned, nil
+}
+
+// 割り当て可能な椅子の一覧。DBではなくchairAvailabilityを参照する
+func getAvailableChairs(_ context.Context) ([]availableChair, error) {
+	return chairAvailability.Available(), nil
+}
+
+type internalGetChairModelsResponse struct {
+	Models []internalChairModel `json:"models"`
+}
+
+type internalChairModel struct {
+	Name     string `json:"name"`
+	Speed    int    `json:"speed"`
+	FareRate int    `json:"fare_rate"`
+}
+
+func internalGetChairModels(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	models := []ChairModel{}
+	if err := db.SelectContext(ctx, &models, "SELECT * FROM chair_models ORDER BY name"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := internalGetChairModelsResponse{Models: []internalChairModel{}}
+	for _, m := range models {
+		res.Models = append(res.Models, internalChairModel{
+			Name:     m.Name,
+			Speed:    m.Speed,
+			FareRate: m.FareRate,
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type internalPutChairModelFareRateRequest struct {
+	FareRate int `json:"fare_rate"`
+}
+
+// 椅子モデルの運賃倍率(%)を変更する。以降の見積もり・請求・売上に反映される
+func internalPutChairModelFareRate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	model := r.PathValue("model")
+	req := &internalPutChairModelFareRateRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.FareRate <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("fare_rate must be positive"))
 		return
 	}
 
-	if _, err := db.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", matched.ID, ride.ID); err != nil {
+	result, err := db.ExecContext(ctx, "UPDATE chair_models SET fare_rate = ? WHERE name = ?", req.FareRate, model)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
+	} else if count == 0 {
+		// 同じ値で更新した場合も0件になるので存在を確かめる
+		exists := false
+		if err := db.GetContext(ctx, &exists, "SELECT COUNT(*) > 0 FROM chair_models WHERE name = ?", model); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, errors.New("chair model not found"))
+			return
+		}
 	}
+	fareRates.Set(model, req.FareRate)
 
 	w.WriteHeader(http.StatusNoContent)
 }
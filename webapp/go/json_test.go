@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// ホットなレスポンスの例
+var (
+	benchNotification = &appGetNotificationResponse{
+		Data: &appGetNotificationResponseData{
+			RideID:                "01J00000000000000000000001",
+			PickupCoordinate:      Coordinate{Latitude: 10, Longitude: 20},
+			DestinationCoordinate: Coordinate{Latitude: 30, Longitude: 40},
+			Fare:                  3500,
+			Status:                "ENROUTE",
+			StatusMessage:         "椅子が向かっています <まもなく到着>",
+			Chair: &appGetNotificationResponseChair{
+				ID:    "01J00000000000000000000002",
+				Name:  "QC-L13-8361",
+				Model: "クエストチェア Lite",
+				Stats: appGetNotificationResponseChairStats{TotalRidesCount: 42, TotalEvaluationAvg: 4.5},
+			},
+			CreatedAt: 1733000000000,
+			UpdateAt:  1733000001000,
+		},
+		RetryAfterMs: 300,
+		Version:      `"8f3a"`,
+	}
+	benchNearbyChairs = func() *appGetNearbyChairsResponse {
+		res := &appGetNearbyChairsResponse{RetrievedAt: 1733000000000}
+		for i := range 50 {
+			res.Chairs = append(res.Chairs, appGetNearbyChairsResponseChair{
+				ID:                     "01J00000000000000000000003",
+				Name:                   "QC-L13-8361",
+				Model:                  "クエストチェア Lite",
+				CurrentCoordinate:      Coordinate{Latitude: i, Longitude: -i},
+				EstimatedPickupSeconds: int64(i * 10),
+			})
+		}
+		return res
+	}()
+)
+
+// ビルドタグによらず、json.Marshalと同じボディを書き出す
+func TestWriteJSONMatchesMarshal(t *testing.T) {
+	for _, v := range []any{benchNotification, benchNearbyChairs, map[string]string{"html": "<a>&</a>"}} {
+		want, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		writeJSON(w, http.StatusOK, v)
+		if !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("writeJSON body = %q, want %q", w.Body.Bytes(), want)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json;charset=utf-8" {
+			t.Errorf("Content-Type = %q", got)
+		}
+	}
+}
+
+// ボディを捨てるResponseWriter。記録する分のアロケーションを測らないようにする
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+func BenchmarkWriteJSON(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		v    any
+	}{
+		{"notification", benchNotification},
+		{"nearby_chairs", benchNearbyChairs},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			w := &discardResponseWriter{header: http.Header{}}
+			b.ReportAllocs()
+			for range b.N {
+				writeJSON(w, http.StatusOK, bm.v)
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+// webapp/go/loadgen.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/cookiejar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ベンチマーカーなしでマッチングや通知を負荷試験するため、
+// プロセス内のgoroutineで椅子とユーザーを動かして自分自身のAPIを叩く
+type loadgenRequest struct {
+	Chairs        int `json:"chairs"`
+	Users         int `json:"users"`
+	RideInterval  int `json:"ride_interval_ms"`
+	Duration      int `json:"duration_s"`
+	PollInterval  int `json:"poll_interval_ms"`
+	CoordinateMax int `json:"coordinate_max"`
+}
+
+type loadgenStats struct {
+	Running        bool  `json:"running"`
+	Chairs         int64 `json:"chairs"`
+	Users          int64 `json:"users"`
+	RidesRequested int64 `json:"rides_requested"`
+	RidesCompleted int64 `json:"rides_completed"`
+	Errors         int64 `json:"errors"`
+}
+
+type loadgen struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	// 停止後に再開したとき、前回の実行が今回の実行を止めないように世代を数える
+	generation int
+
+	chairs         atomic.Int64
+	users          atomic.Int64
+	ridesRequested atomic.Int64
+	ridesCompleted atomic.Int64
+	errors         atomic.Int64
+}
+
+var syntheticLoad = &loadgen{}
+
+func (g *loadgen) start(req loadgenRequest) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cancel != nil {
+		return errors.New("load generator is already running")
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if req.Duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(req.Duration)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	g.cancel = cancel
+	g.generation++
+	generation := g.generation
+	g.chairs.Store(0)
+	g.users.Store(0)
+	g.ridesRequested.Store(0)
+	g.ridesCompleted.Store(0)
+	g.errors.Store(0)
+
+	baseURL := getEnv("ISUCON_LOADGEN_BASE_URL", "http://127.0.0.1"+config.ListenAddr)
+	pollInterval := time.Duration(max(req.PollInterval, 10)) * time.Millisecond
+	rideInterval := time.Duration(max(req.RideInterval, 0)) * time.Millisecond
+	coordinateMax := req.CoordinateMax
+	if coordinateMax <= 0 {
+		coordinateMax = 100
+	}
+
+	go func() {
+		defer g.finish(generation)
+
+		owner := newSyntheticClient(baseURL)
+		registerToken, err := owner.registerOwner(ctx)
+		if err != nil {
+			slog.Error("loadgen: failed to register owner", "error", err)
+			return
+		}
+		models := []string{}
+		if err := db.SelectContext(ctx, &models, "SELECT name FROM chair_models"); err != nil || len(models) == 0 {
+			slog.Error("loadgen: failed to load chair models", "error", err)
+			return
+		}
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < req.Chairs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c := &syntheticChair{
+					client:       newSyntheticClient(baseURL),
+					pollInterval: pollInterval,
+					position:     randomCoordinate(coordinateMax),
+				}
+				if err := c.register(ctx, registerToken, models[rand.IntN(len(models))]); err != nil {
+					g.errors.Add(1)
+					return
+				}
+				g.chairs.Add(1)
+				c.run(ctx, coordinateMax, func(error) { g.errors.Add(1) })
+			}()
+		}
+		for i := 0; i < req.Users; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				u := &syntheticUser{
+					client:       newSyntheticClient(baseURL),
+					pollInterval: pollInterval,
+					rideInterval: rideInterval,
+				}
+				if err := u.register(ctx); err != nil {
+					g.errors.Add(1)
+					return
+				}
+				g.users.Add(1)
+				u.run(ctx, coordinateMax, g)
+			}()
+		}
+		wg.Wait()
+	}()
+	return nil
+}
+
+func (g *loadgen) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cancel != nil {
+		g.cancel()
+		g.cancel = nil
+	}
+}
+
+func (g *loadgen) finish(generation int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cancel != nil && g.generation == generation {
+		g.cancel()
+		g.cancel = nil
+	}
+}
+
+func (g *loadgen) stats() loadgenStats {
+	g.mu.Lock()
+	running := g.cancel != nil
+	g.mu.Unlock()
+	return loadgenStats{
+		Running:        running,
+		Chairs:         g.chairs.Load(),
+		Users:          g.users.Load(),
+		RidesRequested: g.ridesRequested.Load(),
+		RidesCompleted: g.ridesCompleted.Load(),
+		Errors:         g.errors.Load(),
+	}
+}
+
+func internalPostLoadgen(w http.ResponseWriter, r *http.Request) {
+	req := &loadgenRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Chairs < 0 || req.Users < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("chairs and users must not be negative"))
+		return
+	}
+	if err := syntheticLoad.start(*req); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, syntheticLoad.stats())
+}
+
+func internalGetLoadgen(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, syntheticLoad.stats())
+}
+
+func internalDeleteLoadgen(w http.ResponseWriter, r *http.Request) {
+	syntheticLoad.stop()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// クッキーでセッションを保持する合成クライアント
+type syntheticClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+func newSyntheticClient(baseURL string) *syntheticClient {
+	jar, _ := cookiejar.New(nil)
+	return &syntheticClient{
+		baseURL: baseURL,
+		http: &http.Client{
+			Transport: httpClient.Transport,
+			Timeout:   httpClient.Timeout,
+			Jar:       jar,
+		},
+	}
+}
+
+func (c *syntheticClient) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		b, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("[%s %s] unexpected status code (%d): %s", method, path, res.StatusCode, string(b))
+	}
+	if out != nil && res.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	io.Copy(io.Discard, res.Body)
+	return nil
+}
+
+func (c *syntheticClient) registerOwner(ctx context.Context) (string, error) {
+	res := &ownerPostOwnersResponse{}
+	if err := c.do(ctx, http.MethodPost, "/api/owner/owners", &ownerPostOwnersRequest{Name: "synthetic-" + secureRandomStr(8)}, res); err != nil {
+		return "", err
+	}
+	return res.ChairRegisterToken, nil
+}
+
+func randomCoordinate(coordinateMax int) Coordinate {
+	return Coordinate{
+		Latitude:  rand.IntN(coordinateMax*2+1) - coordinateMax,
+		Longitude: rand.IntN(coordinateMax*2+1) - coordinateMax,
+	}
+}
+
+// targetに向かってstepだけ進んだ座標
+func moveToward(from, target Coordinate, step int) Coordinate {
+	for i := 0; i < step; i++ {
+		switch {
+		case from.Latitude < target.Latitude:
+			from.Latitude++
+		case from.Latitude > target.Latitude:
+			from.Latitude--
+		case from.Longitude < target.Longitude:
+			from.Longitude++
+		case from.Longitude > target.Longitude:
+			from.Longitude--
+		}
+	}
+	return from
+}
+
+// 通知を受けてライドを進める合成の椅子
+type syntheticChair struct {
+	client       *syntheticClient
+	pollInterval time.Duration
+	speed        int
+	position     Coordinate
+}
+
+func (c *syntheticChair) register(ctx context.Context, registerToken, model string) error {
+	if err := db.GetContext(ctx, &c.speed, "SELECT speed FROM chair_models WHERE name = ?", model); err != nil {
+		return err
+	}
+	req := &chairPostChairsRequest{
+		Name:               "synthetic-" + secureRandomStr(4),
+		Model:              model,
+		ChairRegisterToken: registerToken,
+	}
+	if err := c.client.do(ctx, http.MethodPost, "/api/chair/chairs", req, nil); err != nil {
+		return err
+	}
+	if err := c.postCoordinate(ctx); err != nil {
+		return err
+	}
+	return c.client.do(ctx, http.MethodPost, "/api/chair/activity", &postChairActivityRequest{IsActive: true}, nil)
+}
+
+func (c *syntheticChair) postCoordinate(ctx context.Context) error {
+	return c.client.do(ctx, http.MethodPost, "/api/chair/coordinate", &c.position, nil)
+}
+
+func (c *syntheticChair) run(ctx context.Context, coordinateMax int, onError func(error)) {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	wander := randomCoordinate(coordinateMax)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.step(ctx, &wander, coordinateMax); err != nil && ctx.Err() == nil {
+			onError(err)
+		}
+	}
+}
+
+// 1tick分の動作。ライドがなければ歩き回り、あればステータスに応じて配車位置・目的地へ向かう
+func (c *syntheticChair) step(ctx context.Context, wander *Coordinate, coordinateMax int) error {
+	n := &chairGetNotificationResponse{}
+	if err := c.client.do(ctx, http.MethodGet, "/api/chair/notification", nil, n); err != nil {
+		return err
+	}
+
+	target := *wander
+	if n.Data != nil {
+		switch n.Data.Status {
+		case "MATCHING":
+			return c.client.do(ctx, http.MethodPost, "/api/chair/rides/"+n.Data.RideID+"/status", &postChairRidesRideIDStatusRequest{Status: "ENROUTE"}, nil)
+		case "PICKUP":
+			return c.client.do(ctx, http.MethodPost, "/api/chair/rides/"+n.Data.RideID+"/status", &postChairRidesRideIDStatusRequest{Status: "CARRYING"}, nil)
+		case "ENROUTE":
+			target = n.Data.PickupCoordinate
+		case "CARRYING":
+			target = n.Data.DestinationCoordinate
+		case "ARRIVED":
+			// ユーザーの評価待ち
+			return nil
+		}
+	}
+	if c.position == *wander {
+		*wander = randomCoordinate(coordinateMax)
+	}
+	if c.position == target {
+		return nil
+	}
+	c.position = moveToward(c.position, target, c.speed)
+	return c.postCoordinate(ctx)
+}
+
+// 一定間隔でライドを頼む合成のユーザー
+type syntheticUser struct {
+	client       *syntheticClient
+	pollInterval time.Duration
+	rideInterval time.Duration
+}
+
+func (u *syntheticUser) register(ctx context.Context) error {
+	req := &appPostUsersRequest{
+		Username:    "synthetic-" + secureRandomStr(8),
+		FirstName:   "Synthetic",
+		LastName:    "User",
+		DateOfBirth: "2000-01-01",
+	}
+	if err := u.client.do(ctx, http.MethodPost, "/api/app/users", req, nil); err != nil {
+		return err
+	}
+	return u.client.do(ctx, http.MethodPost, "/api/app/payment-methods", &appPostPaymentMethodsRequest{Token: secureRandomStr(16)}, nil)
+}
+
+func (u *syntheticUser) run(ctx context.Context, coordinateMax int, g *loadgen) {
+	for ctx.Err() == nil {
+		if err := u.ride(ctx, coordinateMax, g); err != nil && ctx.Err() == nil {
+			g.errors.Add(1)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(u.rideInterval):
+		}
+	}
+}
+
+// ライドを1回頼み、到着したら評価する
+func (u *syntheticUser) ride(ctx context.Context, coordinateMax int, g *loadgen) error {
+	pickup := randomCoordinate(coordinateMax)
+	destination := randomCoordinate(coordinateMax)
+	if err := u.client.do(ctx, http.MethodPost, "/api/app/rides", &appPostRidesRequest{PickupCoordinate: &pickup, DestinationCoordinate: &destination}, nil); err != nil {
+		return err
+	}
+	g.ridesRequested.Add(1)
+
+	ticker := time.NewTicker(u.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		n := &appGetNotificationResponse{}
+		if err := u.client.do(ctx, http.MethodGet, "/api/app/notification", nil, n); err != nil {
+			return err
+		}
+		if n.Data != nil && n.Data.Status == "ARRIVED" {
+			if err := u.client.do(ctx, http.MethodPost, "/api/app/rides/"+n.Data.RideID+"/evaluation", &appPostRideEvaluationRequest{Evaluation: rand.IntN(5) + 1}, nil); err != nil {
+				return err
+			}
+			g.ridesCompleted.Add(1)
+			return nil
+		}
+	}
+}
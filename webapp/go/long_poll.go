@@ -0,0 +1,110 @@
+// webapp/go/long_poll.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 通知APIに?wait=30sのように付けると、If-None-Matchの通知から変化するまで(最大waitの間)応答を待たせる
+// 30秒のリクエストタイムアウトより前に304で返せるように上限を設ける
+// サーバーのWriteTimeoutより長く待つこともあるので、待つリクエストは書き込みの期限を待つ分だけ延ばす
+var notificationMaxWait = getEnvDuration("ISUCON_NOTIFICATION_MAX_WAIT", 25*time.Second)
+
+func parseNotificationWait(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("wait")
+	if s == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(s)
+	if err != nil || wait < 0 {
+		return 0, errors.New("wait is invalid")
+	}
+	return min(wait, notificationMaxWait), nil
+}
+
+// If-None-Matchにetagが含まれるか
+func etagMatches(r *http.Request, etag string) bool {
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t != "" && strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// 通知の組み立て。unchangedが前回から変化がないと判断したらnilを返す
+type notificationBuilder func(unchanged func(version string) bool) (response any, version string, err error)
+
+// 通知APIのポーリングと長いポーリングの共通部分
+// 前回から変化がないとnotificationsでわかっていればDBを読まずに待ち、変化が知らされたら組み立て直す
+func serveNotification(w http.ResponseWriter, r *http.Request, key string, build notificationBuilder) {
+	ctx := r.Context()
+	wait, err := parseNotificationWait(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var changed <-chan struct{}
+	if wait > 0 {
+		if config.WriteTimeout > 0 {
+			if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + config.WriteTimeout)); err != nil {
+				// 期限を延ばせなければ、WriteTimeoutで応答が捨てられる前に返す
+				wait = min(wait, config.WriteTimeout*2/3)
+			}
+		}
+		ch, cancel := notifications.Subscribe(key)
+		defer cancel()
+		changed = ch
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		unchangedVersion := ""
+		if version, ok := notifications.Version(key); ok && etagMatches(r, version) {
+			unchangedVersion = version
+		} else {
+			response, version, err := build(func(version string) bool {
+				if etagMatches(r, version) {
+					unchangedVersion = version
+					return true
+				}
+				return false
+			})
+			if err != nil {
+				if errors.Is(err, errChairVersionTooOld) {
+					writeError(w, http.StatusUpgradeRequired, err)
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if response != nil {
+				if version != "" {
+					w.Header().Set("ETag", version)
+				}
+				setRetryAfter(w, calculateRetryAfterMs())
+				writeJSON(w, http.StatusOK, response)
+				return
+			}
+		}
+
+		if wait == 0 {
+			checkNotificationVersion(w, r, unchangedVersion, calculateRetryAfterMs())
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			checkNotificationVersion(w, r, unchangedVersion, calculateRetryAfterMs())
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
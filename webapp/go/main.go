@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -22,23 +23,41 @@ import (
 var db *sqlx.DB
 
 func main() {
+	// ./isuride migrate でマイグレーションだけを適用して終わる
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		db = connectDB()
+		count, err := migrate(context.Background(), db)
+		if err != nil {
+			slog.Error("Failed to migrate", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("migrated", "applied", count)
+		return
+	}
+
+	config = applyRuntimeConfig(loadRuntimeConfig())
+	slog.Info("runtime configured", "config", config, "database", dbPool)
+
 	mux := setup()
+	srv := newServer(config, mux)
+
+	l, err := listen(config)
+	if err != nil {
+		slog.Error("Failed to listen", "error", err)
+		return
+	}
 
-	srv := &http.Server{
-		Handler:      mux,
-		Addr:         ":8080",
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	if c := loadDevSimulatorConfig(); c.Chairs > 0 {
+		safeGo("dev-simulator", func() { startDevSimulator(context.Background(), c) })
 	}
 
-	slog.Info("Listening on :8080")
-	if err := srv.ListenAndServe(); err != nil {
+	slog.Info("Listening on " + config.ListenAddr)
+	if err := srv.Serve(l); err != nil {
 		slog.Error("Failed to start server", "error", err)
 	}
 }
 
-func setup() http.Handler {
+func connectDB() *sqlx.DB {
 	host := os.Getenv("ISUCON_DB_HOST")
 	if host == "" {
 		host = "127.0.0.1"
@@ -51,6 +70,19 @@ func setup() http.Handler {
 	if err != nil {
 		panic(fmt.Sprintf("failed to convert DB port number from ISUCON_DB_PORT environment variable into int: %v", err))
 	}
+
+	_db, err := openDB(host, port)
+	if err != nil {
+		panic(err)
+	}
+	if err := _db.Ping(); err != nil {
+		panic(err)
+	}
+	return _db
+}
+
+// 接続はまだ張らない。ユーザーやDB名はプライマリとレプリカで共通
+func openDB(host, port string) (*sqlx.DB, error) {
 	user := os.Getenv("ISUCON_DB_USER")
 	if user == "" {
 		user = "isucon"
@@ -74,32 +106,123 @@ func setup() http.Handler {
 	dbConfig.Collation = "utf8mb4_general_ci"
 	dbConfig.InterpolateParams = true
 	dbConfig.MaxAllowedPacket = 32 << 20 // 32MB
+	dbConfig.Timeout = dbPool.DialTimeout
+	dbConfig.ReadTimeout = dbPool.ReadTimeout
+	dbConfig.WriteTimeout = dbPool.WriteTimeout
 	dbConfig.Params = map[string]string{
 		"charset": "utf8mb4",
 	}
 
-	_db, err := sqlx.Connect("mysql", dbConfig.FormatDSN())
+	_db, err := sqlx.Open(dbDriverName(), dbConfig.FormatDSN())
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// コネクションプールの設定
-	_db.SetMaxOpenConns(25)
-	_db.SetMaxIdleConns(25)
-	_db.SetConnMaxLifetime(5 * time.Minute)
-	_db.SetConnMaxIdleTime(2 * time.Minute)
+	_db.SetMaxOpenConns(dbPool.MaxOpenConns)
+	_db.SetMaxIdleConns(dbPool.MaxIdleConns)
+	_db.SetConnMaxLifetime(dbPool.ConnMaxLifetime)
+	_db.SetConnMaxIdleTime(dbPool.ConnMaxIdleTime)
+
+	return _db, nil
+}
+
+func setup() http.Handler {
+	db = connectDB()
+	repos := newRepositories(db)
+	// バックグラウンドのジョブもハンドラと同じリポジトリを使う
+	bg := withRepositories(context.Background(), repos)
+
+	if getEnvBool("ISUCON_MIGRATE_ON_START", true) {
+		if _, err := migrate(context.Background(), db); err != nil {
+			panic(err)
+		}
+	}
+	if err := warmUpCaches(bg); err != nil {
+		panic(err)
+	}
+	// 前回のプロセスで配信できなかったイベントを再送する
+	if err := outbox.Publish(bg); err != nil {
+		panic(err)
+	}
+
+	if getEnvBool("ISUCON_RIDE_STATUS_BATCH", false) {
+		rideStatusWriter = newRideStatusBatchWriter(
+			getEnvDuration("ISUCON_RIDE_STATUS_BATCH_INTERVAL", 20*time.Millisecond),
+			getEnvInt("ISUCON_RIDE_STATUS_BATCH_SIZE", 500),
+			getEnvInt("ISUCON_RIDE_STATUS_BATCH_MAX_ATTEMPTS", 5),
+		)
+		safeGo("ride-status-writer", func() { rideStatusWriter.run(bg) })
+	}
 
-	db = _db
+	if getEnvBool("ISUCON_CHAIR_LOCATION_BATCH", false) {
+		chairLocationWriter = newChairLocationBatchWriter(
+			getEnvDuration("ISUCON_CHAIR_LOCATION_BATCH_INTERVAL", 20*time.Millisecond),
+			getEnvInt("ISUCON_CHAIR_LOCATION_BATCH_SIZE", 500),
+		)
+		safeGo("chair-location-writer", func() { chairLocationWriter.run(bg) })
+	}
+
+	if degraded.enabled {
+		safeGo("db-health", func() { degraded.run(bg) })
+	}
+
+	if replica.db != nil {
+		safeGo("replica-health", func() { replica.run(bg) })
+	}
+
+	if sweeper := newRetentionSweeper(); sweeper.retention > 0 {
+		safeGo("retention-sweeper", func() { sweeper.run(bg) })
+	}
+
+	if b, ok := cacheBackend.(*memoryCacheBackend); ok && cacheSweepInterval > 0 {
+		safeGo("cache-sweeper", func() { b.runSweeper(bg, cacheSweepInterval) })
+	}
+
+	if reassigner := newStaleRideReassigner(); reassigner.timeout > 0 {
+		safeGo("stale-ride-reassigner", func() { reassigner.run(bg) })
+	}
+
+	if deliverer := newWebhookDeliverer(repos.Webhooks, repos.Chairs); deliverer.interval > 0 {
+		safeGo("owner-webhooks", func() { deliverer.run(bg) })
+	}
+
+	if chairUtilization.interval > 0 {
+		safeGo("chair-utilization", func() { chairUtilization.run(bg) })
+	}
+
+	if scheduler := newRideScheduler(); scheduler.interval > 0 {
+		safeGo("ride-scheduler", func() { scheduler.run(bg) })
+	}
+
+	if getEnvBool("ISUCON_ASYNC_RIDES", false) {
+		rideCreator = newAsyncRideCreator(getEnvInt("ISUCON_ASYNC_RIDES_QUEUE", 1024))
+		for range getEnvInt("ISUCON_ASYNC_RIDES_WORKERS", 4) {
+			safeGo("ride-creator", func() { rideCreator.run(bg) })
+		}
+	}
+
+	if admission.maxDBWait > 0 {
+		safeGo("admission-sampler", func() {
+			admission.run(bg, getEnvDuration("ISUCON_SHED_SAMPLE_INTERVAL", time.Second))
+		})
+	}
 
 	mux := chi.NewRouter()
+	mux.Use(repos.Middleware)
+	mux.Use(admission.Track)
+	mux.Use(middleware.RequestID)
 	mux.Use(middleware.Logger)
-	mux.Use(middleware.Recoverer)
-	mux.Use(middleware.Timeout(30 * time.Second))
+	mux.Use(localeMiddleware)
+	mux.Use(recoverMiddleware)
+	mux.Use(requestTimeout(30 * time.Second))
+	mux.Use(degraded.Middleware)
 
 	// ヘルスチェックエンポイント
 	mux.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
+	mux.Get("/healthz", getHealthz)
 
 	mux.HandleFunc("POST /api/initialize", postInitialize)
 
@@ -111,10 +234,19 @@ func setup() http.Handler {
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
+		authedMux.HandleFunc("POST /api/app/rides/scheduled", appPostScheduledRides)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}", appGetRide)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
-		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
-		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/cancel", appPostRideCancel)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/receipt", appGetRideReceipt)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/chair-position", appGetRideChairPosition)
+		authedMux.HandleFunc("POST /api/app/notification/ack", appPostNotificationAck)
+
+		// 過負荷時は503で断ってよいポーリング系
+		sheddableMux := mux.With(admission.Shed, appAuthMiddleware)
+		sheddableMux.HandleFunc("GET /api/app/notification", appGetNotification)
+		sheddableMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
 	}
 
 	// owner handlers
@@ -122,8 +254,23 @@ func setup() http.Handler {
 		mux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
 
 		authedMux := mux.With(ownerAuthMiddleware)
+		authedMux.HandleFunc("POST /api/owner/token/rotate", ownerPostTokenRotate)
+		authedMux.HandleFunc("GET /api/owner/dashboard", ownerGetDashboard)
+		authedMux.HandleFunc("POST /api/owner/webhooks", ownerPostWebhook)
+		authedMux.HandleFunc("DELETE /api/owner/webhooks/{webhook_id}", ownerDeleteWebhook)
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
+		authedMux.HandleFunc("GET /api/owner/sales/compare", ownerGetSalesCompare)
+		authedMux.HandleFunc("GET /api/owner/payouts", ownerGetPayouts)
+		authedMux.HandleFunc("GET /api/owner/rides/search", ownerSearchRides)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("DELETE /api/owner/chairs/{chair_id}", ownerDeleteChair)
+		authedMux.HandleFunc("GET /api/owner/chairs/utilization", ownerGetChairUtilization)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/locations", ownerGetChairLocations)
+		authedMux.HandleFunc("POST /api/owner/organization", ownerPostOrganization)
+		authedMux.HandleFunc("GET /api/owner/organization", ownerGetOrganization)
+		authedMux.HandleFunc("POST /api/owner/organization/join", ownerPostOrganizationJoin)
+		authedMux.HandleFunc("GET /api/owner/organization/sales", ownerGetOrganizationSales)
+		authedMux.HandleFunc("GET /api/owner/organization/chairs", ownerGetOrganizationChairs)
 	}
 
 	// chair handlers
@@ -133,13 +280,36 @@ func setup() http.Handler {
 		authedMux := mux.With(chairAuthMiddleware)
 		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
 		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
-		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
+		authedMux.HandleFunc("GET /api/chair/ws", chairWebSocket)
+		mux.With(admission.Shed, chairAuthMiddleware).HandleFunc("GET /api/chair/notification", chairGetNotification)
 		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/cancel", chairPostRideCancel)
+		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/pickup-verification", chairPostRidePickupVerification)
+		authedMux.HandleFunc("POST /api/chair/notification/ack", chairPostNotificationAck)
 	}
 
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
+		mux.HandleFunc("POST /api/internal/matching", internalPostMatching)
+		mux.HandleFunc("GET /api/internal/stats", internalGetStats)
+		mux.HandleFunc("GET /api/internal/slow-queries", internalGetSlowQueries)
+		mux.HandleFunc("GET /api/internal/matching/preview", internalGetMatchingPreview)
+		mux.HandleFunc("GET /api/internal/matching/stats", internalGetMatchingStats)
+		mux.HandleFunc("GET /api/internal/matching/events", internalGetMatchingEvents)
+		mux.HandleFunc("GET /api/internal/matching/max-pickup-distance", internalGetMaxPickupDistance)
+		mux.HandleFunc("PUT /api/internal/matching/max-pickup-distance", internalPutMaxPickupDistance)
+		mux.HandleFunc("GET /api/internal/matching/shadow", internalGetShadowMatching)
+		mux.HandleFunc("GET /api/internal/matching/strategy", internalGetMatchingStrategy)
+		mux.HandleFunc("PUT /api/internal/matching/strategy", internalPutMatchingStrategy)
+		mux.HandleFunc("GET /api/internal/rides/{ride_id}/events", internalGetRideEvents)
+		mux.HandleFunc("GET /api/internal/chair-models", internalGetChairModels)
+		mux.HandleFunc("PUT /api/internal/chair-models/{model}/fare-rate", internalPutChairModelFareRate)
+		mux.HandleFunc("GET /api/internal/chair-min-version", internalGetChairMinVersion)
+		mux.HandleFunc("PUT /api/internal/chair-min-version", internalPutChairMinVersion)
+		mux.HandleFunc("POST /api/internal/loadgen", internalPostLoadgen)
+		mux.HandleFunc("GET /api/internal/loadgen", internalGetLoadgen)
+		mux.HandleFunc("DELETE /api/internal/loadgen", internalDeleteLoadgen)
 	}
 
 	return mux
@@ -162,16 +332,53 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if rideStatusWriter != nil {
+		rideStatusWriter.discard()
+	}
+	if chairLocationWriter != nil {
+		chairLocationWriter.discard()
+	}
+	rideStatusCache.Clear()
+	if err := cacheBackend.Clear(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if rideCreator != nil {
+		rideCreator.Reset()
+	}
+	outbox.Reset()
+	matchLatency.Reset()
+	matchingStats.Reset()
+	nextRides.Reset()
+	matchAudit.Reset()
+	notifications.Reset()
+	degraded.Reset()
+	slowQueries.Reset()
+	if shadow != nil {
+		shadow.Reset()
+	}
+
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to initialize: %s: %w", string(out), err))
 		return
 	}
+	if _, err := migrate(ctx, db); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	if _, err := db.ExecContext(ctx, "UPDATE settings SET value = ? WHERE name = 'payment_gateway_url'", req.PaymentServer); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	if err := warmUpCaches(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 作り直したDBから集計し直す。集計はバックグラウンドで進む
+	chairUtilization.Reset()
+
 	writeJSON(w, http.StatusOK, postInitializeResponse{Language: "go"})
 }
 
@@ -184,21 +391,15 @@ func bindJSON(r *http.Request, v interface{}) error {
 	return json.NewDecoder(r.Body).Decode(v)
 }
 
-func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
-	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	buf, err := json.Marshal(v)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(statusCode)
-	w.Write(buf)
-}
-
 func writeError(w http.ResponseWriter, statusCode int, err error) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(statusCode)
-	buf, marshalError := json.Marshal(map[string]string{"message": err.Error()})
+	body := map[string]string{"message": err.Error()}
+	if code := errorCode(err); code != "" {
+		body["code"] = code
+		body["message"] = localize(langFromWriter(w), code, err.Error())
+	}
+	buf, marshalError := json.Marshal(body)
 	if marshalError != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(`{"error":"marshaling error failed"}`))
@@ -206,7 +407,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", "error", err)
 }
 
 func secureRandomStr(b int) string {
@@ -0,0 +1,139 @@
+// webapp/go/match_audit.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// マッチングでライドに椅子を選んだ判断を直近N件だけメモリに残す
+// ベンチマークの後で、おかしな割り当てがどの戦略・候補数・スコアで選ばれたのかを調べるために使う
+type matchDecision struct {
+	RideID   string `json:"ride_id"`
+	ChairID  string `json:"chair_id"`
+	Strategy string `json:"strategy"`
+	// 距離の上限で絞った後の候補の椅子の数
+	Candidates int   `json:"candidates"`
+	Score      int64 `json:"score"`
+	// assigned: 割り当てた, queued: 運んでいる椅子に次のライドとして予約した, conflict: 並行したマッチングに先を越された
+	Outcome string `json:"outcome"`
+	// 候補を集めて椅子を選ぶまでにかかった時間
+	ElapsedUs int64 `json:"elapsed_us"`
+	At        int64 `json:"at"`
+}
+
+const (
+	matchOutcomeAssigned = "assigned"
+	matchOutcomeQueued   = "queued"
+	matchOutcomeConflict = "conflict"
+)
+
+type matchAuditLog struct {
+	mu      sync.Mutex
+	entries []matchDecision
+	next    int
+	full    bool
+}
+
+// 0なら記録しない
+var matchAudit = newMatchAuditLog(getEnvInt("ISUCON_MATCH_AUDIT_SIZE", 4096))
+
+func newMatchAuditLog(size int) *matchAuditLog {
+	return &matchAuditLog{entries: make([]matchDecision, max(size, 0))}
+}
+
+// 選択の指標。nearestとbatchは距離、それ以外は配車位置までの見込み時間(ミリ秒)で、小さいほど良い
+func matchingScore(strategy string, ride *Ride, chair availableChair) int64 {
+	if strategy == "nearest" || strategy == "batch" {
+		return int64(calculateDistance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude))
+	}
+	return estimatePickupETA(chair, ride).Milliseconds()
+}
+
+func newMatchDecision(strategy string, ride *Ride, chair availableChair, candidates int, elapsed time.Duration, at time.Time) matchDecision {
+	return matchDecision{
+		RideID:     ride.ID,
+		ChairID:    chair.ID,
+		Strategy:   strategy,
+		Candidates: candidates,
+		Score:      matchingScore(strategy, ride, chair),
+		Outcome:    matchOutcomeConflict,
+		ElapsedUs:  elapsed.Microseconds(),
+		At:         at.UnixMilli(),
+	}
+}
+
+func (l *matchAuditLog) Record(decisions ...matchDecision) {
+	if len(l.entries) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range decisions {
+		l.entries[l.next] = d
+		l.next++
+		if l.next == len(l.entries) {
+			l.next = 0
+			l.full = true
+		}
+	}
+}
+
+// 新しい順にmatchを満たすものを最大limit件返す
+func (l *matchAuditLog) Recent(match func(matchDecision) bool, limit int) []matchDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+	decisions := []matchDecision{}
+	for i := range n {
+		d := l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+		if !match(d) {
+			continue
+		}
+		decisions = append(decisions, d)
+		if len(decisions) == limit {
+			break
+		}
+	}
+	return decisions
+}
+
+func (l *matchAuditLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = make([]matchDecision, len(l.entries))
+	l.next = 0
+	l.full = false
+}
+
+type internalGetMatchingEventsResponse struct {
+	Events []matchDecision `json:"events"`
+}
+
+// ?ride_id= ?chair_id= ?outcome= で絞り込める。件数は?limit=(既定100)
+func internalGetMatchingEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 100
+	if s := query.Get("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit is invalid"))
+			return
+		}
+		limit = l
+	}
+	rideID, chairID, outcome := query.Get("ride_id"), query.Get("chair_id"), query.Get("outcome")
+
+	events := matchAudit.Recent(func(d matchDecision) bool {
+		return (rideID == "" || d.RideID == rideID) &&
+			(chairID == "" || d.ChairID == chairID) &&
+			(outcome == "" || d.Outcome == outcome)
+	}, limit)
+	writeJSON(w, http.StatusOK, &internalGetMatchingEventsResponse{Events: events})
+}
@@ -0,0 +1,105 @@
+// webapp/go/matching_batch.go
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// singleなら1回の呼び出しで最も待たせているライドを1件ずつマッチングする
+// batchなら待っているライドと空いている椅子をまとめて読み、配車距離の合計が小さくなるように割り当てる
+var matchingMode = getEnv("ISUCON_MATCHING_MODE", "single")
+
+type matchingPair struct {
+	ride     int
+	chair    int
+	distance int
+}
+
+// 全ライド×全椅子の組を距離の短い順に見て、どちらもまだ割り当てていなければ採用する
+// 厳密な最適解ではないが、ライドごとに貪欲に選ぶより遠い椅子を掴みにくい
+func solveAssignments(rides []Ride, chairs []availableChair, maxDistance int64) []matchingPair {
+	pairs := make([]matchingPair, 0, len(rides)*len(chairs))
+	for i, ride := range rides {
+		for j, chair := range chairs {
+			distance := calculateDistance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude)
+			if !withinPickupDistance(distance, maxDistance) {
+				continue
+			}
+			pairs = append(pairs, matchingPair{ride: i, chair: j, distance: distance})
+		}
+	}
+	// 距離が同じなら待たせているライドを優先する
+	sort.Slice(pairs, func(a, b int) bool {
+		if pairs[a].distance != pairs[b].distance {
+			return pairs[a].distance < pairs[b].distance
+		}
+		return pairs[a].ride < pairs[b].ride
+	})
+
+	rideAssigned := make([]bool, len(rides))
+	chairAssigned := make([]bool, len(chairs))
+	assignments := []matchingPair{}
+	for _, p := range pairs {
+		if rideAssigned[p.ride] || chairAssigned[p.chair] {
+			continue
+		}
+		rideAssigned[p.ride] = true
+		chairAssigned[p.chair] = true
+		assignments = append(assignments, p)
+		if len(assignments) == min(len(rides), len(chairs)) {
+			break
+		}
+	}
+	return assignments
+}
+
+// p.Limitが0なら待っている全ライドを対象にする
+func matchBatch(ctx context.Context, p matchingParams) error {
+	rides := pendingRides.Top(p.Limit)
+	if len(rides) == 0 {
+		return nil
+	}
+	chairs, err := getAvailableChairs(ctx)
+	if err != nil {
+		return err
+	}
+	if matchingZoneSize > 0 {
+		return matchZones(ctx, rides, chairs, p.MaxDistance)
+	}
+	return applyAssignments(ctx, rides, chairs, p.MaxDistance)
+}
+
+// ridesとchairsの中で割り当てを決めて確定させる
+func applyAssignments(ctx context.Context, rides []Ride, chairs []availableChair, maxDistance int64) error {
+	start := time.Now()
+	pairs := solveAssignments(rides, chairs, maxDistance)
+	now := time.Now()
+
+	assignments := []matchingAssignment{}
+	decisions := []matchDecision{}
+	for _, p := range pairs {
+		ride := &rides[p.ride]
+		chair := chairs[p.chair]
+		decision := newMatchDecision("batch", ride, chair, len(chairs), now.Sub(start), now)
+		// 他のマッチングに先に確保されていたら次の呼び出しに回す
+		if !chairAvailability.Reserve(chair.ID, ride.ID) {
+			matchAudit.Record(decision)
+			continue
+		}
+		assignments = append(assignments, matchingAssignment{ride: ride, chair: chair})
+		decisions = append(decisions, decision)
+	}
+	assigned, err := commitAssignments(ctx, assignments)
+	if err != nil {
+		return err
+	}
+	for i := range decisions {
+		if assigned[i] {
+			decisions[i].Outcome = matchOutcomeAssigned
+		}
+	}
+	matchAudit.Record(decisions...)
+	return nil
+}
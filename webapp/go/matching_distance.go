@@ -0,0 +1,57 @@
+// webapp/go/matching_distance.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// 配車位置からこれより遠い椅子は割り当てない。0なら制限しない
+// 候補がなければライドは次のマッチングまで待たせる
+var maxPickupDistance atomic.Int64
+
+func init() {
+	maxPickupDistance.Store(int64(getEnvInt("ISUCON_MATCHING_MAX_PICKUP_DISTANCE", 0)))
+}
+
+// limitが0なら制限しない
+func withinPickupDistance(distance int, limit int64) bool {
+	return limit <= 0 || int64(distance) <= limit
+}
+
+// 配車位置からlimitより遠い椅子を候補から外す
+func filterPickupDistance(ride *Ride, chairs []availableChair, limit int64) []availableChair {
+	if limit <= 0 {
+		return chairs
+	}
+	filtered := make([]availableChair, 0, len(chairs))
+	for _, chair := range chairs {
+		if withinPickupDistance(calculateDistance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude), limit) {
+			filtered = append(filtered, chair)
+		}
+	}
+	return filtered
+}
+
+type internalMaxPickupDistance struct {
+	MaxPickupDistance int64 `json:"max_pickup_distance"`
+}
+
+func internalGetMaxPickupDistance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &internalMaxPickupDistance{MaxPickupDistance: maxPickupDistance.Load()})
+}
+
+func internalPutMaxPickupDistance(w http.ResponseWriter, r *http.Request) {
+	req := &internalMaxPickupDistance{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.MaxPickupDistance < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("max_pickup_distance must not be negative"))
+		return
+	}
+	maxPickupDistance.Store(req.MaxPickupDistance)
+	writeJSON(w, http.StatusOK, req)
+}
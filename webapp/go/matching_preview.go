@@ -0,0 +1,133 @@
+// webapp/go/matching_preview.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// マッチングを確定させずに、今呼び出したらどのライドにどの椅子を割り当てるかを返す
+// 特定の椅子がいつまでも選ばれない原因を調べるために使う
+type internalGetMatchingPreviewResponse struct {
+	Mode        string                    `json:"mode"`
+	Strategy    string                    `json:"strategy"`
+	Assignments []matchingPreviewProposal `json:"assignments"`
+	// 候補の椅子が見つからなかったライド
+	Unassigned []string `json:"unassigned"`
+}
+
+type matchingPreviewProposal struct {
+	RideID         string `json:"ride_id"`
+	ChairID        string `json:"chair_id"`
+	ChairModel     string `json:"chair_model"`
+	Candidates     int    `json:"candidates"`
+	PickupDistance int    `json:"pickup_distance"`
+	PickupETAMs    int64  `json:"pickup_eta_ms"`
+	// matchingScoreの値。小さいほど良い
+	Score int64 `json:"score"`
+}
+
+// ?limit= で対象にするライドの件数を絞る。0か未指定なら待っている全ライド
+func parseMatchingLimit(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 0 {
+		return 0, errors.New("limit is invalid")
+	}
+	return limit, nil
+}
+
+func newMatchingPreviewProposal(strategy string, ride *Ride, chair availableChair, candidates int) matchingPreviewProposal {
+	return matchingPreviewProposal{
+		RideID:         ride.ID,
+		ChairID:        chair.ID,
+		ChairModel:     chair.Model,
+		Candidates:     candidates,
+		PickupDistance: calculateDistance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude),
+		PickupETAMs:    estimatePickupETA(chair, ride).Milliseconds(),
+		Score:          matchingScore(strategy, ride, chair),
+	}
+}
+
+func internalGetMatchingPreview(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseMatchingLimit(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	p := defaultMatchingParams()
+	p.Limit = limit
+	if r.URL.Query().Get("mode") == "batch" {
+		p.Mode = "batch"
+	}
+
+	res := internalGetMatchingPreviewResponse{
+		Mode:     p.Mode,
+		Strategy: p.Strategy.Name(),
+	}
+	rides := pendingRides.Top(p.Limit)
+	if p.Mode == "batch" {
+		res.Assignments, res.Unassigned = previewBatch(rides, p)
+	} else {
+		res.Assignments, res.Unassigned = previewSingle(rides, p)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 優先度順にライドを見て、現在の戦略で椅子を選ぶ。選んだ椅子は以降の候補から外す
+func previewSingle(rides []Ride, p matchingParams) ([]matchingPreviewProposal, []string) {
+	strategy := p.Strategy
+	proposals := []matchingPreviewProposal{}
+	unassigned := []string{}
+	taken := map[string]struct{}{}
+	for i := range rides {
+		ride := &rides[i]
+		chairs := []availableChair{}
+		for _, chair := range filterPickupDistance(ride, chairAvailability.AvailableNear(ride.PickupLatitude, ride.PickupLongitude), p.MaxDistance) {
+			if _, ok := taken[chair.ID]; !ok {
+				chairs = append(chairs, chair)
+			}
+		}
+		if len(chairs) == 0 {
+			unassigned = append(unassigned, ride.ID)
+			continue
+		}
+		chair := chairs[strategy.Pick(ride, chairs)]
+		taken[chair.ID] = struct{}{}
+		proposals = append(proposals, newMatchingPreviewProposal(strategy.Name(), ride, chair, len(chairs)))
+	}
+	return proposals, unassigned
+}
+
+func previewBatch(rides []Ride, p matchingParams) ([]matchingPreviewProposal, []string) {
+	proposals := []matchingPreviewProposal{}
+	assigned := map[string]struct{}{}
+	solve := func(rides []Ride, chairs []availableChair) {
+		for _, pair := range solveAssignments(rides, chairs, p.MaxDistance) {
+			assigned[rides[pair.ride].ID] = struct{}{}
+			proposals = append(proposals, newMatchingPreviewProposal("batch", &rides[pair.ride], chairs[pair.chair], len(chairs)))
+		}
+	}
+
+	chairs := chairAvailability.Available()
+	if matchingZoneSize > 0 {
+		for _, z := range partitionZones(rides, chairs) {
+			solve(z.rides, z.chairs)
+		}
+	} else {
+		solve(rides, chairs)
+	}
+
+	unassigned := []string{}
+	for _, ride := range rides {
+		if _, ok := assigned[ride.ID]; !ok {
+			unassigned = append(unassigned, ride.ID)
+		}
+	}
+	return proposals, unassigned
+}
@@ -0,0 +1,108 @@
+// webapp/go/matching_shadow.go
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 別のマッチングアルゴリズムを本番と同じ入力で走らせ、割り当てはせずに結果だけ記録するシャドーモード
+// 本番の割り当てと比べることで、負荷をかけたまま安全にアルゴリズムを比較できる
+
+type shadowAssignment struct {
+	ChairID  string
+	Distance int
+	ETA      time.Duration
+}
+
+type shadowMatcher struct {
+	strategy MatchingStrategy
+
+	mu sync.Mutex
+	// ライドごとにシャドーが選んだ椅子。本番の割り当てが決まったら比較して消す
+	pending map[string]shadowAssignment
+	report  shadowReport
+}
+
+type shadowReport struct {
+	Matcher  string `json:"matcher"`
+	Compared int    `json:"compared"`
+	// 本番と同じ椅子を選んだ数
+	Agreed int `json:"agreed"`
+	// 見込みの配車距離・時間の合計
+	LiveDistance   int   `json:"live_distance"`
+	ShadowDistance int   `json:"shadow_distance"`
+	LiveETAMs      int64 `json:"live_eta_ms"`
+	ShadowETAMs    int64 `json:"shadow_eta_ms"`
+}
+
+// 無効ならnil
+var shadow = newShadowMatcher(getEnv("ISUCON_SHADOW_MATCHER", ""))
+
+func newShadowMatcher(name string) *shadowMatcher {
+	strategy, ok := matchingStrategies[name]
+	if !ok {
+		return nil
+	}
+	return &shadowMatcher{
+		strategy: strategy,
+		pending:  map[string]shadowAssignment{},
+		report:   shadowReport{Matcher: name},
+	}
+}
+
+// 本番の選択の前に、同じ候補でシャドーの選択を記録する
+func (s *shadowMatcher) Observe(ride *Ride, chairs []availableChair) {
+	if len(chairs) == 0 {
+		return
+	}
+	chair := chairs[s.strategy.Pick(ride, chairs)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[ride.ID] = shadowAssignment{
+		ChairID:  chair.ID,
+		Distance: calculateDistance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude),
+		ETA:      estimatePickupETA(chair, ride),
+	}
+}
+
+// 本番で割り当てた椅子とシャドーの選択を比べる
+func (s *shadowMatcher) Compare(ride *Ride, live availableChair) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shadowed, ok := s.pending[ride.ID]
+	if !ok {
+		return
+	}
+	delete(s.pending, ride.ID)
+	s.report.Compared++
+	if shadowed.ChairID == live.ID {
+		s.report.Agreed++
+	}
+	s.report.LiveDistance += calculateDistance(live.Latitude, live.Longitude, ride.PickupLatitude, ride.PickupLongitude)
+	s.report.ShadowDistance += shadowed.Distance
+	s.report.LiveETAMs += estimatePickupETA(live, ride).Milliseconds()
+	s.report.ShadowETAMs += shadowed.ETA.Milliseconds()
+}
+
+func (s *shadowMatcher) Report() shadowReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.report
+}
+
+func (s *shadowMatcher) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = map[string]shadowAssignment{}
+	s.report = shadowReport{Matcher: s.strategy.Name()}
+}
+
+func internalGetShadowMatching(w http.ResponseWriter, r *http.Request) {
+	if shadow == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, shadow.Report())
+}
@@ -0,0 +1,95 @@
+// webapp/go/matching_stats.go
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 負荷試験中にマッチングの調子を見るための集計
+// 割り当て件数は起動(初期化)からの累計、割り当て速度と平均は直近matchingStatsWindowの割り当てから出す
+var matchingStatsWindow = getEnvDuration("ISUCON_MATCHING_STATS_WINDOW", time.Minute)
+
+type matchingSample struct {
+	at       time.Time
+	distance int
+	wait     time.Duration
+}
+
+type matchingStatsTracker struct {
+	mu      sync.Mutex
+	window  time.Duration
+	total   int64
+	samples []matchingSample
+}
+
+var matchingStats = &matchingStatsTracker{window: matchingStatsWindow}
+
+func (t *matchingStatsTracker) pruneLocked(now time.Time) {
+	i := 0
+	for i < len(t.samples) && now.Sub(t.samples[i].at) > t.window {
+		i++
+	}
+	t.samples = t.samples[i:]
+}
+
+// ライドに椅子を割り当てたときに呼ぶ
+func (t *matchingStatsTracker) Record(ride *Ride, chair availableChair, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total++
+	t.samples = append(t.samples, matchingSample{
+		at:       at,
+		distance: calculateDistance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude),
+		wait:     at.Sub(ride.CreatedAt),
+	})
+	t.pruneLocked(at)
+}
+
+func (t *matchingStatsTracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total = 0
+	t.samples = nil
+}
+
+type matchingStatsSummary struct {
+	WindowSec         float64 `json:"window_sec"`
+	MatchesTotal      int64   `json:"matches_total"`
+	MatchesPerSec     float64 `json:"matches_per_sec"`
+	AvgPickupDistance float64 `json:"avg_pickup_distance"`
+	AvgWaitMs         float64 `json:"avg_wait_ms"`
+	// まだ椅子が割り当てられていないライドの数
+	Backlog int `json:"backlog"`
+}
+
+func (t *matchingStatsTracker) Summary(now time.Time) matchingStatsSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pruneLocked(now)
+
+	s := matchingStatsSummary{
+		WindowSec:    t.window.Seconds(),
+		MatchesTotal: t.total,
+		Backlog:      pendingRides.Len(),
+	}
+	if len(t.samples) == 0 {
+		return s
+	}
+	var distance int
+	var wait time.Duration
+	for _, sample := range t.samples {
+		distance += sample.distance
+		wait += sample.wait
+	}
+	n := float64(len(t.samples))
+	s.MatchesPerSec = n / t.window.Seconds()
+	s.AvgPickupDistance = float64(distance) / n
+	s.AvgWaitMs = float64(wait) / float64(time.Millisecond) / n
+	return s
+}
+
+func internalGetMatchingStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, matchingStats.Summary(time.Now()))
+}
@@ -0,0 +1,140 @@
+// webapp/go/matching_strategy.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 候補の椅子からライドに割り当てる椅子を選ぶ戦略
+// ISUCON_MATCHING_STRATEGYで選び、ベンチマーク中も内部APIで切り替えられる
+type MatchingStrategy interface {
+	Name() string
+	// 候補の椅子のインデックスを返す。chairsは空でない
+	Pick(ride *Ride, chairs []availableChair) int
+}
+
+type matchingStrategyFunc struct {
+	name string
+	pick func(ride *Ride, chairs []availableChair) int
+}
+
+func (s matchingStrategyFunc) Name() string { return s.name }
+
+func (s matchingStrategyFunc) Pick(ride *Ride, chairs []availableChair) int {
+	return s.pick(ride, chairs)
+}
+
+var matchingStrategies = map[string]MatchingStrategy{
+	"nearest":  matchingStrategyFunc{name: "nearest", pick: pickNearestChair},
+	"eta":      matchingStrategyFunc{name: "eta", pick: pickBestChair},
+	"fairness": matchingStrategyFunc{name: "fairness", pick: pickFairestChair},
+}
+
+var matchingStrategy atomic.Pointer[MatchingStrategy]
+
+func init() {
+	name := getEnv("ISUCON_MATCHING_STRATEGY", "eta")
+	strategy, ok := matchingStrategies[name]
+	if !ok {
+		panic("unknown matching strategy: " + name)
+	}
+	matchingStrategy.Store(&strategy)
+}
+
+func currentMatchingStrategy() MatchingStrategy {
+	return *matchingStrategy.Load()
+}
+
+// 配車位置に最も早く着く椅子のインデックスを返す
+// 距離をモデルの速度で割るので、遠くても速い椅子が近くの遅い椅子に勝つことがある
+func pickBestChair(ride *Ride, chairs []availableChair) int {
+	best := 0
+	var bestETA time.Duration = -1
+	for i, chair := range chairs {
+		eta := estimatePickupETA(chair, ride)
+		if bestETA < 0 || eta < bestETA {
+			best = i
+			bestETA = eta
+		}
+	}
+	return best
+}
+
+// 配車位置に最も近い椅子のインデックスを返す
+func pickNearestChair(ride *Ride, chairs []availableChair) int {
+	best := 0
+	bestDistance := -1
+	for i, chair := range chairs {
+		distance := calculateDistance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude)
+		if bestDistance < 0 || distance < bestDistance {
+			best = i
+			bestDistance = distance
+		}
+	}
+	return best
+}
+
+// 椅子が配車位置に着くまでの見込み時間。運んでいるライドがあればそれを終えるまでの時間も足す
+func estimatePickupETA(chair availableChair, ride *Ride) time.Duration {
+	return chair.FreeIn + estimateTravelTime(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude, chair.Speed)
+}
+
+// 2点間を移動する見込み時間。1tickでモデルのspeed分だけ進む
+func estimateTravelTime(fromLatitude, fromLongitude, toLatitude, toLongitude, speed int) time.Duration {
+	return estimateDistanceTime(calculateDistance(fromLatitude, fromLongitude, toLatitude, toLongitude), speed)
+}
+
+// 距離を移動する見込み時間
+func estimateDistanceTime(distance, speed int) time.Duration {
+	if speed <= 0 {
+		return time.Duration(distance) * chairMoveTick
+	}
+	return time.Duration((distance+speed-1)/speed) * chairMoveTick
+}
+
+// fairnessで、最も早く着く椅子と同等とみなす配車位置までの時間の差
+var fairnessSlack = getEnvDuration("ISUCON_MATCHING_FAIRNESS_SLACK", 200*time.Millisecond)
+
+type internalMatchingStrategyResponse struct {
+	Strategy  string   `json:"strategy"`
+	Available []string `json:"available"`
+}
+
+func writeMatchingStrategy(w http.ResponseWriter) {
+	available := make([]string, 0, len(matchingStrategies))
+	for name := range matchingStrategies {
+		available = append(available, name)
+	}
+	sort.Strings(available)
+	writeJSON(w, http.StatusOK, &internalMatchingStrategyResponse{
+		Strategy:  currentMatchingStrategy().Name(),
+		Available: available,
+	})
+}
+
+func internalGetMatchingStrategy(w http.ResponseWriter, r *http.Request) {
+	writeMatchingStrategy(w)
+}
+
+type internalPutMatchingStrategyRequest struct {
+	Strategy string `json:"strategy"`
+}
+
+func internalPutMatchingStrategy(w http.ResponseWriter, r *http.Request) {
+	req := &internalPutMatchingStrategyRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	strategy, ok := matchingStrategies[req.Strategy]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errors.New("unknown matching strategy"))
+		return
+	}
+	matchingStrategy.Store(&strategy)
+	writeMatchingStrategy(w)
+}
@@ -0,0 +1,82 @@
+// webapp/go/matching_zone.go
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// バッチマッチングを地域(ゾーン)ごとに分けて行う
+// ゾーンは座標を matchingZoneSize 四方で区切ったもので、ライドは配車位置、椅子は現在地で振り分ける
+// 椅子が増えても1回の割り当て計算で扱う組み合わせを小さく保てる。0なら分けない
+var (
+	matchingZoneSize     = getEnvInt("ISUCON_MATCHING_ZONE_SIZE", 0)
+	matchingZoneParallel = getEnvBool("ISUCON_MATCHING_ZONE_PARALLEL", false)
+)
+
+type matchingZone struct {
+	rides  []Ride
+	chairs []availableChair
+}
+
+func zoneOf(latitude, longitude int) gridCell {
+	return gridCell{X: floorDiv(latitude, matchingZoneSize), Y: floorDiv(longitude, matchingZoneSize)}
+}
+
+// 椅子のいないゾーンのライドは次の呼び出しまで待たせる
+func partitionZones(rides []Ride, chairs []availableChair) map[gridCell]*matchingZone {
+	zones := map[gridCell]*matchingZone{}
+	zone := func(c gridCell) *matchingZone {
+		if zones[c] == nil {
+			zones[c] = &matchingZone{}
+		}
+		return zones[c]
+	}
+	for _, ride := range rides {
+		z := zone(zoneOf(ride.PickupLatitude, ride.PickupLongitude))
+		z.rides = append(z.rides, ride)
+	}
+	for _, chair := range chairs {
+		z := zone(zoneOf(chair.Latitude, chair.Longitude))
+		z.chairs = append(z.chairs, chair)
+	}
+	for c, z := range zones {
+		if len(z.rides) == 0 || len(z.chairs) == 0 {
+			delete(zones, c)
+		}
+	}
+	return zones
+}
+
+func matchZones(ctx context.Context, rides []Ride, chairs []availableChair, maxDistance int64) error {
+	zones := partitionZones(rides, chairs)
+	if !matchingZoneParallel {
+		for _, z := range zones {
+			if err := applyAssignments(ctx, z.rides, z.chairs, maxDistance); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// ゾーン間で椅子もライドも重ならないので、そのまま並行に割り当てられる
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, z := range zones {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := applyAssignments(ctx, z.rides, z.chairs, maxDistance); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,138 @@
+// webapp/go/metrics.go
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 直近N件の所要時間からパーセンタイルを出す
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, size)}
+}
+
+func (w *latencyWindow) Add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = d
+	w.next++
+	if w.next == len(w.samples) {
+		w.next = 0
+		w.full = true
+	}
+}
+
+type latencySummary struct {
+	Count int     `json:"count"`
+	P50Ms float64 `json:"p50_ms"`
+	P90Ms float64 `json:"p90_ms"`
+	P99Ms float64 `json:"p99_ms"`
+	MaxMs float64 `json:"max_ms"`
+}
+
+func (w *latencyWindow) Summary() latencySummary {
+	w.mu.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	sorted := slices.Clone(w.samples[:n])
+	w.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return latencySummary{}
+	}
+	slices.Sort(sorted)
+	at := func(p float64) float64 {
+		i := min(int(float64(len(sorted))*p), len(sorted)-1)
+		return float64(sorted[i]) / float64(time.Millisecond)
+	}
+	return latencySummary{
+		Count: len(sorted),
+		P50Ms: at(0.5),
+		P90Ms: at(0.9),
+		P99Ms: at(0.99),
+		MaxMs: float64(sorted[len(sorted)-1]) / float64(time.Millisecond),
+	}
+}
+
+// ライドごとに、リクエストから椅子の割り当てまでと、割り当てから椅子がENROUTEにするまでの時間を計る
+type matchLatencyTracker struct {
+	mu              sync.Mutex
+	assignedAt      map[string]time.Time
+	waitToAssign    *latencyWindow
+	assignToEnroute *latencyWindow
+}
+
+func newMatchLatencyTracker(windowSize int) *matchLatencyTracker {
+	return &matchLatencyTracker{
+		assignedAt:      map[string]time.Time{},
+		waitToAssign:    newLatencyWindow(windowSize),
+		assignToEnroute: newLatencyWindow(windowSize),
+	}
+}
+
+var matchLatency = newMatchLatencyTracker(getEnvInt("ISUCON_METRICS_WINDOW_SIZE", 4096))
+
+func (t *matchLatencyTracker) Assigned(rideID string, requestedAt, at time.Time) {
+	t.mu.Lock()
+	t.assignedAt[rideID] = at
+	window := t.waitToAssign
+	t.mu.Unlock()
+	window.Add(at.Sub(requestedAt))
+}
+
+func (t *matchLatencyTracker) Enroute(rideID string, at time.Time) {
+	t.mu.Lock()
+	assignedAt, ok := t.assignedAt[rideID]
+	delete(t.assignedAt, rideID)
+	window := t.assignToEnroute
+	t.mu.Unlock()
+	if ok {
+		window.Add(at.Sub(assignedAt))
+	}
+}
+
+func (t *matchLatencyTracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.assignedAt = map[string]time.Time{}
+	t.waitToAssign = newLatencyWindow(len(t.waitToAssign.samples))
+	t.assignToEnroute = newLatencyWindow(len(t.assignToEnroute.samples))
+}
+
+type internalGetStatsResponse struct {
+	MatchLatency struct {
+		WaitToAssign    latencySummary `json:"wait_to_assign"`
+		AssignToEnroute latencySummary `json:"assign_to_enroute"`
+	} `json:"match_latency"`
+	Admission admissionStats `json:"admission"`
+	Panics    int64          `json:"panics"`
+	// ISUCON_RIDE_STATUS_BATCHが有効なときだけ
+	RideStatusWriter *rideStatusWriterStats `json:"ride_status_writer,omitempty"`
+}
+
+func internalGetStats(w http.ResponseWriter, r *http.Request) {
+	res := internalGetStatsResponse{}
+	matchLatency.mu.Lock()
+	waitToAssign, assignToEnroute := matchLatency.waitToAssign, matchLatency.assignToEnroute
+	matchLatency.mu.Unlock()
+	res.MatchLatency.WaitToAssign = waitToAssign.Summary()
+	res.MatchLatency.AssignToEnroute = assignToEnroute.Summary()
+	res.Admission = admission.Stats()
+	res.Panics = panicCount.Load()
+	if rideStatusWriter != nil {
+		stats := rideStatusWriter.Stats()
+		res.RideStatusWriter = &stats
+	}
+	writeJSON(w, http.StatusOK, res)
+}
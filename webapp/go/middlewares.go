@@ -6,8 +6,36 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
 )
 
+// リクエストのタイムアウト。WebSocketは接続を引き取ってから自分で期限を管理するので外す
+func requestTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withTimeout := middleware.Timeout(timeout)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			withTimeout.ServeHTTP(w, r)
+		})
+	}
+}
+
+// アクセストークンから引いたユーザーとオーナーはcacheBackendに置く。どちらも登録後に変わらない
+var sessionCacheTTL = getEnvDuration("ISUCON_SESSION_CACHE_TTL", 10*time.Minute)
+
+func userSessionKey(accessToken string) string {
+	return "session:user:" + accessToken
+}
+
+func ownerSessionKey(accessToken string) string {
+	return "session:owner:" + accessToken
+}
+
 func appAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -18,14 +46,17 @@ func appAuthMiddleware(next http.Handler) http.Handler {
 		}
 		accessToken := c.Value
 		user := &User{}
-		err = db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+		if !cacheGetJSON(ctx, userSessionKey(accessToken), user) {
+			err = db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			cacheSetJSON(ctx, userSessionKey(accessToken), user, sessionCacheTTL)
 		}
 
 		ctx = context.WithValue(ctx, "user", user)
@@ -43,12 +74,22 @@ func ownerAuthMiddleware(next http.Handler) http.Handler {
 		}
 		accessToken := c.Value
 		owner := &Owner{}
-		if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", accessToken); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+		if !cacheGetJSON(ctx, ownerSessionKey(accessToken), owner) {
+			owner, err = reposFrom(ctx).Owners.GetByAccessToken(ctx, accessToken)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
-			writeError(w, http.StatusInternalServerError, err)
+			cacheSetJSON(ctx, ownerSessionKey(accessToken), owner, sessionCacheTTL)
+		}
+		// 発行し直す前のトークンは、キャッシュしていても期限を過ぎたら受け付けない
+		if accessToken != owner.AccessToken && (accessToken != owner.PreviousAccessToken.String || !owner.PreviousTokensExpireAt.Valid || time.Now().After(owner.PreviousTokensExpireAt.Time)) {
+			cacheDelete(ctx, ownerSessionKey(accessToken))
+			writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
 			return
 		}
 
@@ -67,12 +108,26 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 		}
 		accessToken := c.Value
 		chair := &Chair{}
-		err = db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ?", accessToken)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+		if cached, ok := chairCache.LoadByToken(ctx, accessToken); ok {
+			*chair = cached
+		} else {
+			chair, err = reposFrom(ctx).Chairs.GetByAccessToken(ctx, accessToken)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
+			chairCache.Store(ctx, chair)
+		}
+		if chair.DecommissionedAt.Valid {
+			writeError(w, http.StatusForbidden, errors.New("chair is decommissioned"))
+			return
+		}
+
+		if err := updateChairVersion(ctx, chair, r.Header.Get(chairVersionHeader)); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -0,0 +1,142 @@
+// webapp/go/migrate.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 初期データの投入後に足すカラムやテーブル。migrations/NNNN_名前.sql を番号順に1回ずつ適用する
+// 初期データはカラム指定なしのINSERTなので、既存のテーブルへの追加はここで行う
+// NOTE: rides/ride_statusesにカラムを足すときは、退避先の*_archiveにも同じカラムを足す
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const migrationLockName = "isuride_migrate"
+
+var migrationLockTimeout = getEnvDuration("ISUCON_MIGRATE_LOCK_TIMEOUT", time.Minute)
+
+type migration struct {
+	version    string
+	statements []string
+}
+
+func loadMigrations() ([]migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	migrations := make([]migration, 0, len(names))
+	for _, name := range names {
+		buf, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{
+			version:    strings.TrimSuffix(path.Base(name), ".sql"),
+			statements: splitSQLStatements(string(buf)),
+		})
+	}
+	return migrations, nil
+}
+
+// 行末の;で文を区切る。--で始まる行は読み飛ばす
+func splitSQLStatements(src string) []string {
+	var statements []string
+	var sb strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(src))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+		if strings.HasSuffix(line, ";") {
+			if s := strings.TrimSpace(sb.String()); s != ";" {
+				statements = append(statements, s)
+			}
+			sb.Reset()
+		}
+	}
+	if s := strings.TrimSpace(sb.String()); s != "" {
+		statements = append(statements, s)
+	}
+	return statements
+}
+
+// まだ適用していないマイグレーションを適用し、適用した数を返す
+// 複数台から同時に呼ばれても1台ずつ適用するように、MySQLの名前付きロックを取ってから進める
+func migrate(ctx context.Context, db *sqlx.DB) (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.GetContext(ctx, &locked, "SELECT GET_LOCK(?, ?)", migrationLockName, int(migrationLockTimeout.Seconds())); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, fmt.Errorf("failed to acquire migration lock within %s", migrationLockTimeout)
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "SELECT RELEASE_LOCK(?)", migrationLockName)
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+  version    VARCHAR(255) NOT NULL COMMENT 'マイグレーションのファイル名',
+  applied_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '適用日時',
+  PRIMARY KEY (version)
+)
+  COMMENT = '適用済みのマイグレーションテーブル'`); err != nil {
+		return 0, err
+	}
+	appliedVersions := []string{}
+	if err := conn.SelectContext(ctx, &appliedVersions, "SELECT version FROM schema_migrations"); err != nil {
+		return 0, err
+	}
+	applied := make(map[string]struct{}, len(appliedVersions))
+	for _, v := range appliedVersions {
+		applied[v] = struct{}{}
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		start := time.Now()
+		// DDLは暗黙にコミットされるのでトランザクションにはまとめられない
+		// 途中で失敗したら記録しないので、直してから手で戻すか初期化し直す
+		for _, stmt := range m.statements {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return count, fmt.Errorf("migration %s: %w", m.version, err)
+			}
+		}
+		if _, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES (?)", m.version); err != nil {
+			return count, err
+		}
+		slog.Info("migration applied", "version", m.version, "elapsed", time.Since(start))
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,10 @@
+-- 完了時に確定した請求額(fare)と割引前の運賃(gross_fare)
+ALTER TABLE rides
+  ADD COLUMN fare       INTEGER NULL COMMENT '請求額(割引後)' AFTER evaluation,
+  ADD COLUMN gross_fare INTEGER NULL COMMENT '運賃(割引前)' AFTER fare;
+
+UPDATE rides r
+  LEFT JOIN coupons c ON c.used_by = r.id
+SET r.gross_fare = 500 + 100 * (ABS(r.pickup_latitude - r.destination_latitude) + ABS(r.pickup_longitude - r.destination_longitude)),
+    r.fare       = 500 + GREATEST(100 * (ABS(r.pickup_latitude - r.destination_latitude) + ABS(r.pickup_longitude - r.destination_longitude)) - IFNULL(c.discount, 0), 0)
+WHERE EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status = 'COMPLETED');
@@ -0,0 +1,3 @@
+-- 速度的にありえない移動をした位置。距離の集計から除外する
+ALTER TABLE chair_locations
+  ADD COLUMN is_flagged TINYINT(1) NOT NULL DEFAULT 0 COMMENT 'ありえない移動として除外するか' AFTER longitude;
@@ -0,0 +1,3 @@
+-- マッチング時に見積もった椅子が配車位置に着くまでの時間
+ALTER TABLE rides
+  ADD COLUMN pickup_eta_ms INTEGER NULL COMMENT '配車位置までの見込み時間(ミリ秒)' AFTER gross_fare;
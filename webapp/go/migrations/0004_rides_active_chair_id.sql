@@ -0,0 +1,11 @@
+-- 完了していないライドの椅子ID。ユニーク制約で1つの椅子に進行中のライドが2つできないようにする
+ALTER TABLE rides
+  ADD COLUMN active_chair_id VARCHAR(26) NULL COMMENT '進行中のライドの椅子ID' AFTER pickup_eta_ms;
+
+UPDATE rides r
+SET r.active_chair_id = r.chair_id
+WHERE r.chair_id IS NOT NULL
+  AND NOT EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status = 'COMPLETED');
+
+ALTER TABLE rides
+  ADD UNIQUE INDEX uniq_rides_active_chair_id (active_chair_id);
@@ -0,0 +1,11 @@
+-- 最新のステータス。updateRideStatusがride_statusesへの追加と同じトランザクションで更新する
+ALTER TABLE rides
+  ADD COLUMN latest_status ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED') NULL COMMENT '最新のステータス' AFTER active_chair_id,
+  ADD INDEX idx_rides_user_id_latest_status (user_id, latest_status);
+
+UPDATE rides r
+  JOIN ride_statuses rs ON rs.ride_id = r.id
+  JOIN (SELECT ride_id, MAX(created_at) AS created_at FROM ride_statuses GROUP BY ride_id) latest
+    ON latest.ride_id = rs.ride_id AND latest.created_at = rs.created_at
+SET r.latest_status = rs.status,
+    r.updated_at    = r.updated_at;
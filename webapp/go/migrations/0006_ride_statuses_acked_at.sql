@@ -0,0 +1,4 @@
+-- 通知したステータスをクライアントが受け取ったと確認応答した日時
+ALTER TABLE ride_statuses
+  ADD COLUMN app_acked_at   DATETIME(6) NULL COMMENT 'ユーザーからの確認応答日時' AFTER chair_sent_at,
+  ADD COLUMN chair_acked_at DATETIME(6) NULL COMMENT '椅子からの確認応答日時' AFTER app_acked_at;
@@ -0,0 +1,16 @@
+-- 保持期間を過ぎた終了済みライドの退避先。rides/ride_statusesと同じ構造
+DROP TABLE IF EXISTS ride_statuses_archive;
+CREATE TABLE ride_statuses_archive LIKE ride_statuses;
+DROP TABLE IF EXISTS rides_archive;
+CREATE TABLE rides_archive LIKE rides;
+
+-- 退避したライドの分の椅子の統計
+DROP TABLE IF EXISTS chair_stats_archive;
+CREATE TABLE chair_stats_archive
+(
+  chair_id         VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  total_rides      INTEGER     NOT NULL DEFAULT 0 COMMENT '評価済みの完了ライド数',
+  total_evaluation INTEGER     NOT NULL DEFAULT 0 COMMENT '評価の合計',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = '退避したライドの椅子ごとの集計テーブル';
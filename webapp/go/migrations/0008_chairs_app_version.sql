@@ -0,0 +1,3 @@
+-- 椅子のアプリ/ファームウェアのバージョン。登録時とリクエストごとのヘッダで報告される
+ALTER TABLE chairs
+  ADD COLUMN app_version VARCHAR(30) NULL COMMENT '椅子のアプリのバージョン' AFTER is_active;
@@ -0,0 +1,20 @@
+-- 完了したライドの売上。オーナーの売上の集計はここ(とメモリ上のownerSales)から行う
+DROP TABLE IF EXISTS ride_sales;
+CREATE TABLE ride_sales
+(
+  ride_id      VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  owner_id     VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  chair_id     VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  model        TEXT        NOT NULL COMMENT '椅子のモデル',
+  sales        INTEGER     NOT NULL COMMENT '売上(割引前の運賃)',
+  completed_at DATETIME(6) NOT NULL COMMENT '完了日時',
+  PRIMARY KEY (ride_id),
+  INDEX idx_ride_sales_owner_id (owner_id, completed_at)
+)
+  COMMENT = '完了したライドの売上テーブル';
+
+INSERT INTO ride_sales (ride_id, owner_id, chair_id, model, sales, completed_at)
+SELECT r.id, c.owner_id, c.id, c.model, r.gross_fare, r.updated_at
+FROM rides r
+  JOIN chairs c ON c.id = r.chair_id
+WHERE EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status = 'COMPLETED');
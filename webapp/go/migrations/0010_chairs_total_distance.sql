@@ -0,0 +1,19 @@
+-- 除外していない位置の間の移動距離の合計。座標を記録するたびに足し込む
+ALTER TABLE chairs
+  ADD COLUMN total_distance            INTEGER     NOT NULL DEFAULT 0 COMMENT '移動距離の合計',
+  ADD COLUMN total_distance_updated_at DATETIME(6) NULL COMMENT '最後に位置を記録した日時';
+
+UPDATE chairs c
+  JOIN (SELECT chair_id,
+               SUM(IFNULL(distance, 0)) AS total_distance,
+               MAX(created_at)          AS total_distance_updated_at
+        FROM (SELECT chair_id,
+                     created_at,
+                     ABS(latitude - LAG(latitude) OVER (PARTITION BY chair_id ORDER BY created_at)) +
+                     ABS(longitude - LAG(longitude) OVER (PARTITION BY chair_id ORDER BY created_at)) AS distance
+              FROM chair_locations
+              WHERE is_flagged = FALSE) tmp
+        GROUP BY chair_id) d ON d.chair_id = c.id
+SET c.total_distance            = d.total_distance,
+    c.total_distance_updated_at = d.total_distance_updated_at,
+    c.updated_at                = c.updated_at;
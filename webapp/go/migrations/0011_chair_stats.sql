@@ -0,0 +1,25 @@
+-- 椅子の統計(評価済みの完了ライド数と評価の合計)。評価を書き込むトランザクションで足し込む
+DROP TABLE IF EXISTS chair_stats;
+CREATE TABLE chair_stats
+(
+  chair_id         VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  total_rides      INTEGER     NOT NULL DEFAULT 0 COMMENT '評価済みの完了ライド数',
+  total_evaluation INTEGER     NOT NULL DEFAULT 0 COMMENT '評価の合計',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = '椅子ごとの統計テーブル';
+
+INSERT INTO chair_stats (chair_id, total_rides, total_evaluation)
+SELECT chair_id, SUM(total_rides), SUM(total_evaluation)
+FROM (SELECT r.chair_id, COUNT(*) AS total_rides, SUM(r.evaluation) AS total_evaluation
+      FROM rides r
+      WHERE r.chair_id IS NOT NULL
+        AND r.evaluation IS NOT NULL
+        AND r.latest_status = 'COMPLETED'
+      GROUP BY r.chair_id
+      UNION ALL
+      SELECT chair_id, total_rides, total_evaluation FROM chair_stats_archive) s
+GROUP BY chair_id;
+
+-- 退避したライドの分もchair_statsに含まれるので、退避時の足し込み先は要らなくなった
+DROP TABLE chair_stats_archive;
@@ -0,0 +1,5 @@
+-- ライドのキャンセル。CANCELEDはCOMPLETEDと同じく終了状態
+ALTER TABLE ride_statuses MODIFY status ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態';
+ALTER TABLE ride_statuses_archive MODIFY status ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態';
+ALTER TABLE rides MODIFY latest_status ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NULL COMMENT '最新のステータス';
+ALTER TABLE rides_archive MODIFY latest_status ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NULL COMMENT '最新のステータス';
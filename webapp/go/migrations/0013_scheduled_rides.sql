@@ -0,0 +1,17 @@
+-- 日時を指定したライドの予約。予約日時の少し前にスケジューラがridesに作ってマッチングに回す
+DROP TABLE IF EXISTS scheduled_rides;
+CREATE TABLE scheduled_rides
+(
+  id                    VARCHAR(26) NOT NULL COMMENT '予約ID',
+  user_id               VARCHAR(26) NOT NULL COMMENT 'ユーザーID',
+  pickup_latitude       INTEGER     NOT NULL COMMENT '配車位置(経度)',
+  pickup_longitude      INTEGER     NOT NULL COMMENT '配車位置(緯度)',
+  destination_latitude  INTEGER     NOT NULL COMMENT '目的地(経度)',
+  destination_longitude INTEGER     NOT NULL COMMENT '目的地(緯度)',
+  scheduled_at          DATETIME(6) NOT NULL COMMENT '予約日時',
+  ride_id               VARCHAR(26) NULL     COMMENT '作成したライドのID',
+  created_at            DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '予約受付日時',
+  PRIMARY KEY (id),
+  INDEX idx_scheduled_rides_ride_id_scheduled_at (ride_id, scheduled_at)
+)
+  COMMENT = 'ライド予約テーブル';
@@ -0,0 +1,17 @@
+-- 経由地つきのライド。経由地がなければroute_distanceはNULLのまま
+ALTER TABLE rides
+  ADD COLUMN route_distance INTEGER NULL COMMENT '経由地を含めた経路の距離';
+ALTER TABLE rides_archive
+  ADD COLUMN route_distance INTEGER NULL COMMENT '経由地を含めた経路の距離';
+
+DROP TABLE IF EXISTS ride_waypoints;
+CREATE TABLE ride_waypoints
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  seq        INTEGER     NOT NULL COMMENT '経由する順番(0始まり)',
+  latitude   INTEGER     NOT NULL COMMENT '経由地(経度)',
+  longitude  INTEGER     NOT NULL COMMENT '経由地(緯度)',
+  arrived_at DATETIME(6) NULL COMMENT '椅子が経由地に着いた日時',
+  PRIMARY KEY (ride_id, seq)
+)
+  COMMENT = 'ライドの経由地テーブル';
@@ -0,0 +1,7 @@
+-- 評価と一緒に送られたチップ。運賃とは別にオーナーの売上に計上する
+ALTER TABLE rides
+  ADD COLUMN tip INTEGER NULL COMMENT 'チップ';
+ALTER TABLE rides_archive
+  ADD COLUMN tip INTEGER NULL COMMENT 'チップ';
+ALTER TABLE ride_sales
+  ADD COLUMN tips INTEGER NOT NULL DEFAULT 0 COMMENT 'チップ' AFTER sales;
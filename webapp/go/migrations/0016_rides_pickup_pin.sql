@@ -0,0 +1,9 @@
+-- 乗車確認のPIN。マッチングで付け、椅子がPICKUPからCARRYINGに進める前に確かめる
+ALTER TABLE rides
+  ADD COLUMN pickup_pin          CHAR(4)     NULL COMMENT '乗車確認のPIN',
+  ADD COLUMN pickup_pin_attempts INTEGER     NOT NULL DEFAULT 0 COMMENT 'PINを間違えた回数',
+  ADD COLUMN pickup_verified_at  DATETIME(6) NULL COMMENT 'PINを確かめた日時';
+ALTER TABLE rides_archive
+  ADD COLUMN pickup_pin          CHAR(4)     NULL COMMENT '乗車確認のPIN',
+  ADD COLUMN pickup_pin_attempts INTEGER     NOT NULL DEFAULT 0 COMMENT 'PINを間違えた回数',
+  ADD COLUMN pickup_verified_at  DATETIME(6) NULL COMMENT 'PINを確かめた日時';
@@ -0,0 +1,3 @@
+-- オーナーが椅子を廃止した日時。売上の履歴を残すため行は消さない
+ALTER TABLE chairs
+  ADD COLUMN decommissioned_at DATETIME(6) NULL COMMENT '廃止した日時';
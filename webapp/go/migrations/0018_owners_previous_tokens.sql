@@ -0,0 +1,7 @@
+-- トークンを発行し直した後も、猶予期間が終わるまでは前のトークンを受け付ける
+ALTER TABLE owners
+  ADD COLUMN previous_access_token         VARCHAR(255) NULL COMMENT '前のアクセストークン',
+  ADD COLUMN previous_chair_register_token VARCHAR(255) NULL COMMENT '前の椅子登録トークン',
+  ADD COLUMN previous_tokens_expire_at     DATETIME(6)  NULL COMMENT '前のトークンを受け付ける期限',
+  ADD UNIQUE (previous_access_token),
+  ADD UNIQUE (previous_chair_register_token);
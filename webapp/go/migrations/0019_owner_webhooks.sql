@@ -0,0 +1,33 @@
+-- オーナーが登録したWebhookと、その配信待ちのイベント
+DROP TABLE IF EXISTS owner_webhooks;
+CREATE TABLE owner_webhooks
+(
+  id         VARCHAR(26)   NOT NULL COMMENT 'WebhookID',
+  owner_id   VARCHAR(26)   NOT NULL COMMENT 'オーナーID',
+  url        VARCHAR(2048) NOT NULL COMMENT '送り先のURL',
+  secret     VARCHAR(255)  NOT NULL COMMENT '署名の鍵',
+  created_at DATETIME(6)   NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id),
+  INDEX idx_owner_webhooks_owner_id (owner_id)
+)
+  COMMENT = 'オーナーのWebhookテーブル';
+
+DROP TABLE IF EXISTS owner_webhook_deliveries;
+CREATE TABLE owner_webhook_deliveries
+(
+  id              VARCHAR(26)  NOT NULL COMMENT '配信ID',
+  webhook_id      VARCHAR(26)  NOT NULL COMMENT 'WebhookID',
+  event           VARCHAR(64)  NOT NULL COMMENT 'イベントの種類',
+  dedup_key       VARCHAR(255) NOT NULL COMMENT '同じイベントを二重に積まないためのキー',
+  payload         JSON         NOT NULL COMMENT 'イベントの内容',
+  attempts        INTEGER      NOT NULL DEFAULT 0 COMMENT '送信に失敗した回数',
+  next_attempt_at DATETIME(6)  NOT NULL COMMENT '次に送る日時',
+  last_error      TEXT         NULL COMMENT '最後に失敗した理由',
+  delivered_at    DATETIME(6)  NULL COMMENT '送信に成功した日時',
+  failed_at       DATETIME(6)  NULL COMMENT '再送をあきらめた日時',
+  created_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT 'イベントの発生日時',
+  PRIMARY KEY (id),
+  UNIQUE (webhook_id, dedup_key),
+  INDEX idx_owner_webhook_deliveries_pending (delivered_at, failed_at, next_attempt_at)
+)
+  COMMENT = 'Webhookの配信テーブル';
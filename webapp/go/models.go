@@ -7,19 +7,26 @@ import (
 )
 
 type Chair struct {
-	ID          string    `db:"id"`
-	OwnerID     string    `db:"owner_id"`
-	Name        string    `db:"name"`
-	Model       string    `db:"model"`
-	IsActive    bool      `db:"is_active"`
-	AccessToken string    `db:"access_token"`
-	CreatedAt   time.Time `db:"created_at"`
-	UpdatedAt   time.Time `db:"updated_at"`
+	ID          string         `db:"id"`
+	OwnerID     string         `db:"owner_id"`
+	Name        string         `db:"name"`
+	Model       string         `db:"model"`
+	IsActive    bool           `db:"is_active"`
+	AppVersion  sql.NullString `db:"app_version"`
+	AccessToken string         `db:"access_token"`
+	CreatedAt   time.Time      `db:"created_at"`
+	UpdatedAt   time.Time      `db:"updated_at"`
+	// 除外していない位置の間の移動距離の合計と、最後に位置を記録した日時
+	TotalDistance          int          `db:"total_distance"`
+	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+	// オーナーが廃止した日時
+	DecommissionedAt sql.NullTime `db:"decommissioned_at"`
 }
 
 type ChairModel struct {
-	Name  string `db:"name"`
-	Speed int    `db:"speed"`
+	Name     string `db:"name"`
+	Speed    int    `db:"speed"`
+	FareRate int    `db:"fare_rate"`
 }
 
 type ChairLocation struct {
@@ -27,6 +34,7 @@ type ChairLocation struct {
 	ChairID   string    `db:"chair_id"`
 	Latitude  int       `db:"latitude"`
 	Longitude int       `db:"longitude"`
+	IsFlagged bool      `db:"is_flagged"`
 	CreatedAt time.Time `db:"created_at"`
 }
 
@@ -57,17 +65,37 @@ type Ride struct {
 	DestinationLatitude  int            `db:"destination_latitude"`
 	DestinationLongitude int            `db:"destination_longitude"`
 	Evaluation           *int           `db:"evaluation"`
+	Fare                 *int           `db:"fare"`
+	GrossFare            *int           `db:"gross_fare"`
+	PickupETAMs          *int64         `db:"pickup_eta_ms"`
+	ActiveChairID        sql.NullString `db:"active_chair_id"`
+	LatestStatus         sql.NullString `db:"latest_status"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
+	RouteDistance        *int           `db:"route_distance"`
+	Tip                  *int           `db:"tip"`
+	PickupPin            sql.NullString `db:"pickup_pin"`
+	PickupPinAttempts    int            `db:"pickup_pin_attempts"`
+	PickupVerifiedAt     sql.NullTime   `db:"pickup_verified_at"`
+}
+
+type RideWaypoint struct {
+	RideID    string     `db:"ride_id"`
+	Seq       int        `db:"seq"`
+	Latitude  int        `db:"latitude"`
+	Longitude int        `db:"longitude"`
+	ArrivedAt *time.Time `db:"arrived_at"`
 }
 
 type RideStatus struct {
-	ID          string     `db:"id"`
-	RideID      string     `db:"ride_id"`
-	Status      string     `db:"status"`
-	CreatedAt   time.Time  `db:"created_at"`
-	AppSentAt   *time.Time `db:"app_sent_at"`
-	ChairSentAt *time.Time `db:"chair_sent_at"`
+	ID           string     `db:"id"`
+	RideID       string     `db:"ride_id"`
+	Status       string     `db:"status"`
+	CreatedAt    time.Time  `db:"created_at"`
+	AppSentAt    *time.Time `db:"app_sent_at"`
+	ChairSentAt  *time.Time `db:"chair_sent_at"`
+	AppAckedAt   *time.Time `db:"app_acked_at"`
+	ChairAckedAt *time.Time `db:"chair_acked_at"`
 }
 
 type Owner struct {
@@ -77,6 +105,10 @@ type Owner struct {
 	ChairRegisterToken string    `db:"chair_register_token"`
 	CreatedAt          time.Time `db:"created_at"`
 	UpdatedAt          time.Time `db:"updated_at"`
+	// トークンを発行し直す前のトークンと、それを受け付ける期限
+	PreviousAccessToken        sql.NullString `db:"previous_access_token"`
+	PreviousChairRegisterToken sql.NullString `db:"previous_chair_register_token"`
+	PreviousTokensExpireAt     sql.NullTime   `db:"previous_tokens_expire_at"`
 }
 
 type Coupon struct {
@@ -86,3 +118,23 @@ type Coupon struct {
 	CreatedAt time.Time `db:"created_at"`
 	UsedBy    *string   `db:"used_by"`
 }
+
+type Organization struct {
+	ID          string    `db:"id"`
+	Name        string    `db:"name"`
+	InviteToken string    `db:"invite_token"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+type ScheduledRide struct {
+	ID                   string         `db:"id"`
+	UserID               string         `db:"user_id"`
+	PickupLatitude       int            `db:"pickup_latitude"`
+	PickupLongitude      int            `db:"pickup_longitude"`
+	DestinationLatitude  int            `db:"destination_latitude"`
+	DestinationLongitude int            `db:"destination_longitude"`
+	ScheduledAt          time.Time      `db:"scheduled_at"`
+	RideID               sql.NullString `db:"ride_id"`
+	CreatedAt            time.Time      `db:"created_at"`
+}
@@ -0,0 +1,118 @@
+// webapp/go/notification_ack.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 通知に含めたステータスを、クライアントが受け取ったと確認応答するまで未達として扱う
+// 有効なら、送ってからnotificationAckTimeoutの間に確認応答のないステータスを送り直す
+// 無効なら従来どおり、レスポンスに含めた時点で届いたものとする
+var (
+	notificationAckEnabled = getEnvBool("ISUCON_NOTIFICATION_ACK", false)
+	notificationAckTimeout = getEnvDuration("ISUCON_NOTIFICATION_ACK_TIMEOUT", 3*time.Second)
+)
+
+// 通知の宛先ごとのride_statusesのカラム
+type notificationTarget struct {
+	sentColumn  string
+	ackedColumn string
+}
+
+var (
+	appNotificationTarget   = notificationTarget{sentColumn: "app_sent_at", ackedColumn: "app_acked_at"}
+	chairNotificationTarget = notificationTarget{sentColumn: "chair_sent_at", ackedColumn: "chair_acked_at"}
+)
+
+// 次に通知すべきステータスを古い順に1件読む。なければsql.ErrNoRowsを返す
+func getUnsentRideStatus(ctx context.Context, tx *sqlx.Tx, rideID string, target notificationTarget) (RideStatus, error) {
+	status := RideStatus{}
+	if !notificationAckEnabled {
+		err := tx.GetContext(ctx, &status, fmt.Sprintf(`SELECT * FROM ride_statuses WHERE ride_id = ? AND %s IS NULL ORDER BY created_at ASC LIMIT 1`, target.sentColumn), rideID)
+		return status, err
+	}
+	err := tx.GetContext(
+		ctx,
+		&status,
+		fmt.Sprintf(`SELECT * FROM ride_statuses WHERE ride_id = ? AND %[2]s IS NULL AND (%[1]s IS NULL OR %[1]s < ?) ORDER BY created_at ASC LIMIT 1`, target.sentColumn, target.ackedColumn),
+		rideID, time.Now().Add(-notificationAckTimeout),
+	)
+	return status, err
+}
+
+func markRideStatusSent(ctx context.Context, tx *sqlx.Tx, statusID string, target notificationTarget) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`UPDATE ride_statuses SET %s = CURRENT_TIMESTAMP(6) WHERE id = ?`, target.sentColumn), statusID)
+	return err
+}
+
+// 確認応答を使うときだけ通知にステータスIDを含める
+func ackStatusID(statusID string) string {
+	if !notificationAckEnabled {
+		return ""
+	}
+	return statusID
+}
+
+type postNotificationAckRequest struct {
+	StatusID string `json:"status_id"`
+}
+
+// 確認応答を記録する。ownerColumnのライドの持ち主がownerIDでなければ404にする
+func ackRideStatus(w http.ResponseWriter, r *http.Request, target notificationTarget, ownerColumn, ownerID string) {
+	ctx := r.Context()
+	req := &postNotificationAckRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.StatusID == "" {
+		writeError(w, http.StatusBadRequest, errors.New("status_id is required"))
+		return
+	}
+
+	owner := ""
+	if err := db.GetContext(
+		ctx,
+		&owner,
+		fmt.Sprintf(`SELECT IFNULL(rides.%s, '') FROM ride_statuses JOIN rides ON rides.id = ride_statuses.ride_id WHERE ride_statuses.id = ?`, ownerColumn),
+		req.StatusID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride status not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if owner != ownerID {
+		writeError(w, http.StatusNotFound, errors.New("ride status not found"))
+		return
+	}
+
+	if _, err := db.ExecContext(
+		ctx,
+		fmt.Sprintf(`UPDATE ride_statuses SET %[1]s = IFNULL(%[1]s, CURRENT_TIMESTAMP(6)), %[2]s = IFNULL(%[2]s, CURRENT_TIMESTAMP(6)) WHERE id = ?`, target.sentColumn, target.ackedColumn),
+		req.StatusID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func appPostNotificationAck(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	ackRideStatus(w, r, appNotificationTarget, "user_id", user.ID)
+}
+
+func chairPostNotificationAck(w http.ResponseWriter, r *http.Request) {
+	chair := r.Context().Value("chair").(*Chair)
+	ackRideStatus(w, r, chairNotificationTarget, "chair_id", chair.ID)
+}
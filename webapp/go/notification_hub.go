@@ -0,0 +1,131 @@
+// webapp/go/notification_hub.go
+package main
+
+import "sync"
+
+// 通知の対象(ユーザー・椅子)ごとに最新のライドとステータスを持ち、変化を待っている接続へ知らせる
+// ステータスの追加と椅子の割り当てで更新する。ポーリングとSSEはここを見て、
+// 前回の通知から変化がなければDBを読まずに済ませる
+type notificationHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+	states      map[string]*notificationState
+}
+
+type notificationState struct {
+	rideID  string
+	chairID string
+	status  string
+	// Publishのたびに進める
+	seq uint64
+	// 未通知のステータスが残っているかもしれない間はtrue。DBから未通知がないことを確かめたらfalseにする
+	pending bool
+}
+
+func newNotificationHub() *notificationHub {
+	return &notificationHub{
+		subscribers: map[string]map[chan struct{}]struct{}{},
+		states:      map[string]*notificationState{},
+	}
+}
+
+var notifications = newNotificationHub()
+
+func userNotificationKey(userID string) string {
+	return "user:" + userID
+}
+
+func chairNotificationKey(chairID string) string {
+	return "chair:" + chairID
+}
+
+// 返したチャネルには変化のたびに(取りこぼしてもよいように1つだけ溜めて)送る。使い終わったらcancelを呼ぶ
+func (h *notificationHub) Subscribe(key string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.subscribers[key] == nil {
+		h.subscribers[key] = map[chan struct{}]struct{}{}
+	}
+	h.subscribers[key][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[key], ch)
+		if len(h.subscribers[key]) == 0 {
+			delete(h.subscribers, key)
+		}
+	}
+}
+
+// ステータスの追加と椅子の割り当てで呼ぶ
+func (h *notificationHub) Publish(key, rideID, chairID, status string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := h.states[key]
+	if state == nil {
+		state = &notificationState{}
+		h.states[key] = state
+	}
+	state.rideID, state.chairID, state.status = rideID, chairID, status
+	state.seq++
+	state.pending = true
+
+	for ch := range h.subscribers[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// DBから通知を組み立て始める前に呼び、結果をDeliveredに渡す
+func (h *notificationHub) Seq(key string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state := h.states[key]; state != nil {
+		return state.seq
+	}
+	return 0
+}
+
+// DBから組み立てた通知に未通知のステータスがなかったときに呼ぶ
+// 読んでいる間にPublishされていたり、コミット前のPublishで状態が先に進んでいたりしたら何もしない
+func (h *notificationHub) Delivered(key string, seq uint64, rideID, chairID, status string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := h.states[key]
+	if state == nil {
+		h.states[key] = &notificationState{rideID: rideID, chairID: chairID, status: status, seq: seq}
+		return
+	}
+	if state.seq != seq || state.rideID != rideID || state.chairID != chairID || state.status != status {
+		return
+	}
+	state.pending = false
+}
+
+// 未通知のステータスがないとわかっていれば、最新の通知のバージョンを返す
+func (h *notificationHub) Version(key string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := h.states[key]
+	if state == nil || state.pending {
+		return "", false
+	}
+	return notificationVersion(state.rideID, state.chairID, state.status), true
+}
+
+// 状態がわからなくなったときに呼び、次の通知はDBから組み立てさせる
+func (h *notificationHub) Forget(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.states, key)
+}
+
+func (h *notificationHub) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.states = map[string]*notificationState{}
+}
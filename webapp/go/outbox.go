@@ -0,0 +1,88 @@
+// webapp/go/outbox.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// マッチングなどのイベントは割り当てと同じトランザクションでride_event_outboxに書き、
+// コミット後に購読者へ配信する。配信前に落ちても起動時に未配信分を再送する
+type RideEvent struct {
+	ID          string     `db:"id"`
+	RideID      string     `db:"ride_id"`
+	ChairID     string     `db:"chair_id"`
+	Event       string     `db:"event"`
+	CreatedAt   time.Time  `db:"created_at"`
+	PublishedAt *time.Time `db:"published_at"`
+}
+
+type rideEventOutbox struct {
+	mu          sync.Mutex
+	subscribers []func(RideEvent)
+	// 同じイベントをプロセス内で二重に配信しないために配信済みIDを覚えておく
+	delivered map[string]struct{}
+}
+
+var outbox = &rideEventOutbox{
+	delivered: map[string]struct{}{},
+}
+
+func (o *rideEventOutbox) Subscribe(f func(RideEvent)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.subscribers = append(o.subscribers, f)
+}
+
+// 呼び出し元のトランザクション内でイベントを積む
+func (o *rideEventOutbox) Enqueue(ctx context.Context, tx *sqlx.Tx, rideID, chairID, event string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO ride_event_outbox (id, ride_id, chair_id, event) VALUES (?, ?, ?, ?)",
+		ulid.Make().String(), rideID, chairID, event,
+	)
+	return err
+}
+
+// 未配信のイベントを配信して配信済みにする。コミット直後と起動時に呼ぶ
+func (o *rideEventOutbox) Publish(ctx context.Context) error {
+	events := []RideEvent{}
+	if err := db.SelectContext(ctx, &events, "SELECT * FROM ride_event_outbox WHERE published_at IS NULL ORDER BY id"); err != nil {
+		return err
+	}
+
+	for _, ev := range events {
+		o.deliver(ev)
+		if _, err := db.ExecContext(ctx, "UPDATE ride_event_outbox SET published_at = CURRENT_TIMESTAMP(6) WHERE id = ?", ev.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *rideEventOutbox) deliver(ev RideEvent) {
+	o.mu.Lock()
+	if _, ok := o.delivered[ev.ID]; ok {
+		o.mu.Unlock()
+		return
+	}
+	o.delivered[ev.ID] = struct{}{}
+	subscribers := o.subscribers
+	o.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(ev)
+	}
+	slog.Debug("ride event published", "event", ev.Event, "ride_id", ev.RideID, "chair_id", ev.ChairID)
+}
+
+func (o *rideEventOutbox) Reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.delivered = map[string]struct{}{}
+}
@@ -0,0 +1,97 @@
+// webapp/go/owner_chair_locations.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultChairLocationsLimit = 1000
+	maxChairLocationsLimit     = 10000
+)
+
+type ownerGetChairLocationsResponse struct {
+	ChairID string `json:"chair_id"`
+	// 期間内に記録した位置の数。locationsはこれをlimit件以下に間引いたもの
+	Total     int                                      `json:"total"`
+	Locations []ownerGetChairLocationsResponseLocation `json:"locations"`
+}
+
+type ownerGetChairLocationsResponseLocation struct {
+	Coordinate Coordinate `json:"coordinate"`
+	RecordedAt int64      `json:"recorded_at"`
+}
+
+// オーナーの椅子が期間内(since/until、UNIXミリ秒)に記録した位置を古い順に返す
+// limit件を超えるときは等間隔に間引く。除外した位置は含めない
+func ownerGetChairLocations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit := defaultChairLocationsLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit is invalid"))
+			return
+		}
+		limit = min(limit, maxChairLocationsLimit)
+	}
+
+	q := readDB()
+	chair, err := reposFrom(ctx).Chairs.With(q).Get(ctx, chairID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.OwnerID != owner.ID {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
+	}
+
+	res := &ownerGetChairLocationsResponse{
+		ChairID:   chair.ID,
+		Locations: []ownerGetChairLocationsResponseLocation{},
+	}
+	const period = `chair_id = ? AND is_flagged = FALSE AND created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND`
+	if err := q.GetContext(ctx, &res.Total, `SELECT COUNT(*) FROM chair_locations WHERE `+period, chair.ID, since, until); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if res.Total == 0 {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	// step件ごとに1件(先頭から)残す
+	step := (res.Total + limit - 1) / limit
+	locations := []ChairLocation{}
+	if err := q.SelectContext(ctx, &locations, `SELECT id, chair_id, latitude, longitude, is_flagged, created_at
+FROM (SELECT *, ROW_NUMBER() OVER (ORDER BY created_at) AS rn FROM chair_locations WHERE `+period+`) t
+WHERE MOD(rn - 1, ?) = 0
+ORDER BY created_at`, chair.ID, since, until, step); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, location := range locations {
+		res.Locations = append(res.Locations, ownerGetChairLocationsResponseLocation{
+			Coordinate: Coordinate{Latitude: location.Latitude, Longitude: location.Longitude},
+			RecordedAt: location.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,81 @@
+// webapp/go/owner_dashboard.go
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type ownerGetDashboardResponse struct {
+	// 今日(UTC)の売上とチップ
+	TodaySales int `json:"today_sales"`
+	TodayTips  int `json:"today_tips"`
+	// 稼働中で、ライドを割り当てられていない椅子の数
+	IdleChairs int `json:"idle_chairs"`
+	// 評価のついたライドがなければ0
+	AverageEvaluation float64                         `json:"average_evaluation"`
+	TotalDistance     int                             `json:"total_distance"`
+	ActiveRides       []ownerGetDashboardResponseRide `json:"active_rides"`
+}
+
+type ownerGetDashboardResponseRide struct {
+	ChairID   string `json:"chair_id"`
+	ChairName string `json:"chair_name"`
+	RideID    string `json:"ride_id"`
+	Status    string `json:"status"`
+}
+
+// オーナー画面の最初に出す集計をまとめて返す
+func ownerGetDashboard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	q := readDB()
+
+	chairs, err := reposFrom(ctx).Chairs.With(q).ListByOwner(ctx, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &ownerGetDashboardResponse{ActiveRides: []ownerGetDashboardResponseRide{}}
+
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for _, total := range ownerSales.SalesByChair(owner.ID, today, now) {
+		res.TodaySales += total.Sales
+		res.TodayTips += total.Tips
+	}
+
+	for _, chair := range chairs {
+		if chairStateOf(chair.ID, chair.IsActive) == chairStateActive {
+			res.IdleChairs++
+		}
+		res.TotalDistance += chair.TotalDistance
+	}
+
+	// 評価を書き込むときにchair_statsへ足し込んである
+	var stats struct {
+		TotalRides      int     `db:"total_rides"`
+		TotalEvaluation float64 `db:"total_evaluation"`
+	}
+	if err := q.GetContext(ctx, &stats, `SELECT IFNULL(SUM(chair_stats.total_rides), 0) AS total_rides, IFNULL(SUM(chair_stats.total_evaluation), 0) AS total_evaluation
+FROM chair_stats JOIN chairs ON chair_stats.chair_id = chairs.id
+WHERE chairs.owner_id = ?`, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if stats.TotalRides > 0 {
+		res.AverageEvaluation = stats.TotalEvaluation / float64(stats.TotalRides)
+	}
+
+	// active_chair_idは椅子がライドを終えるまで入っている
+	if err := q.SelectContext(ctx, &res.ActiveRides, `SELECT chairs.id AS chair_id, chairs.name AS chair_name, rides.id AS ride_id, rides.latest_status AS status
+FROM rides JOIN chairs ON rides.active_chair_id = chairs.id
+WHERE chairs.owner_id = ?
+ORDER BY chairs.id`, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -2,12 +2,16 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -63,122 +67,273 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// salesにはチップを含めず、tipsとして別に返す
 type chairSales struct {
 	ID    string `json:"id"`
 	Name  string `json:"name"`
 	Sales int    `json:"sales"`
+	Tips  int    `json:"tips"`
 }
 
 type modelSales struct {
 	Model string `json:"model"`
 	Sales int    `json:"sales"`
+	Tips  int    `json:"tips"`
 }
 
 type ownerGetSalesResponse struct {
 	TotalSales int          `json:"total_sales"`
+	TotalTips  int          `json:"total_tips"`
 	Chairs     []chairSales `json:"chairs"`
 	Models     []modelSales `json:"models"`
+	// group_byを指定したときだけ返す
+	Buckets []salesBucket `json:"buckets,omitempty"`
 }
 
-func ownerGetSales(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	since := time.Unix(0, 0)
+// group_byで区切った期間の売上。売上のあった区切り・椅子・モデルだけを返す
+type salesBucket struct {
+	// 区切りの開始日時 (UNIXミリ秒)
+	Start      int64        `json:"start"`
+	TotalSales int          `json:"total_sales"`
+	TotalTips  int          `json:"total_tips"`
+	Chairs     []chairSales `json:"chairs"`
+	Models     []modelSales `json:"models"`
+}
+
+// since/untilクエリ(UNIXミリ秒)を読む
+// DBのDATETIMEはUTCで比較するのでUTCに正規化する
+// 期間は両端を含む。untilはミリ秒単位なので、untilのミリ秒内(+999マイクロ秒)に完了したライドも含める
+func parseSalesPeriod(r *http.Request) (time.Time, time.Time, error) {
+	since := time.Unix(0, 0).UTC()
 	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 	if r.URL.Query().Get("since") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return time.Time{}, time.Time{}, errors.New("since is invalid")
 		}
-		since = time.UnixMilli(parsed)
+		since = time.UnixMilli(parsed).UTC()
 	}
 	if r.URL.Query().Get("until") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return time.Time{}, time.Time{}, errors.New("until is invalid")
 		}
-		until = time.UnixMilli(parsed)
+		until = time.UnixMilli(parsed).UTC()
+	}
+	if until.Before(since) {
+		return time.Time{}, time.Time{}, errors.New("until must be greater than or equal to since")
+	}
+	return since, until, nil
+}
+
+func ownerGetSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	groupBy := r.URL.Query().Get("group_by")
+	if groupBy != "" && groupBy != "hour" && groupBy != "day" && groupBy != "week" {
+		writeError(w, http.StatusBadRequest, errors.New("group_by must be hour, day or week"))
+		return
 	}
 
 	owner := r.Context().Value("owner").(*Owner)
 
-	tx, err := db.Beginx()
+	res, err := getSharedOwnerSales(ctx, owner.ID, since, until, groupBy)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
 
-	chairs := []Chair{}
-	if err := tx.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	writeJSON(w, http.StatusOK, res)
+}
+
+var ownerSalesFlight flightGroup[*ownerGetSalesResponse]
+
+// 同じオーナー・期間の売上を同時に求められたら1回だけ集計する
+func getSharedOwnerSales(ctx context.Context, ownerID string, since, until time.Time, groupBy string) (*ownerGetSalesResponse, error) {
+	ctx = context.WithoutCancel(ctx)
+	key := fmt.Sprintf("%s|%d|%d|%s", ownerID, since.UnixMilli(), until.UnixMilli(), groupBy)
+	return ownerSalesFlight.Do(key, func() (*ownerGetSalesResponse, error) {
+		chairs, err := reposFrom(ctx).Chairs.With(readDB()).ListByOwner(ctx, ownerID)
+		if err != nil {
+			return nil, err
+		}
+		res := summarizeOwnerSales(chairs, ownerSales.SalesByChair(ownerID, since, until))
+		if groupBy != "" {
+			res.Buckets = bucketOwnerSales(chairs, ownerSales.SalesByChairPerPeriod(ownerID, since, until, groupBy))
+		}
+		return res, nil
+	})
+}
+
+func getOwnerSales(ctx context.Context, q sqlx.ExtContext, ownerID string, since, until time.Time) (*ownerGetSalesResponse, error) {
+	chairs, err := reposFrom(ctx).Chairs.With(q).ListByOwner(ctx, ownerID)
+	if err != nil {
+		return nil, err
 	}
+	return summarizeOwnerSales(chairs, ownerSales.SalesByChair(ownerID, since, until)), nil
+}
 
-	res := ownerGetSalesResponse{
+// 椅子ごとの売上を全体・椅子ごと・モデルごとにまとめる
+func summarizeOwnerSales(chairs []Chair, salesByChair map[string]salesTotal) *ownerGetSalesResponse {
+	res := &ownerGetSalesResponse{
 		TotalSales: 0,
 	}
 
-	modelSalesByModel := map[string]int{}
+	modelSalesByModel := map[string]salesTotal{}
 	for _, chair := range chairs {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, "SELECT rides.* FROM rides JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", chair.ID, since, until); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		sales := sumSales(rides)
-		res.TotalSales += sales
+		total := salesByChair[chair.ID]
+		res.TotalSales += total.Sales
+		res.TotalTips += total.Tips
 
 		res.Chairs = append(res.Chairs, chairSales{
 			ID:    chair.ID,
 			Name:  chair.Name,
-			Sales: sales,
+			Sales: total.Sales,
+			Tips:  total.Tips,
 		})
 
-		modelSalesByModel[chair.Model] += sales
+		modelTotal := modelSalesByModel[chair.Model]
+		modelTotal.Sales += total.Sales
+		modelTotal.Tips += total.Tips
+		modelSalesByModel[chair.Model] = modelTotal
 	}
 
 	models := []modelSales{}
-	for model, sales := range modelSalesByModel {
+	for model, total := range modelSalesByModel {
 		models = append(models, modelSales{
 			Model: model,
-			Sales: sales,
+			Sales: total.Sales,
+			Tips:  total.Tips,
 		})
 	}
 	res.Models = models
 
-	writeJSON(w, http.StatusOK, res)
+	return res
 }
 
-func sumSales(rides []Ride) int {
-	sale := 0
-	for _, ride := range rides {
-		sale += calculateSale(ride)
+// 区切りごとの売上を開始日時の順に並べる。椅子・モデルはIDと名前の順
+func bucketOwnerSales(chairs []Chair, salesByPeriod map[time.Time]map[string]salesTotal) []salesBucket {
+	starts := make([]time.Time, 0, len(salesByPeriod))
+	for start := range salesByPeriod {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	buckets := make([]salesBucket, 0, len(starts))
+	for _, start := range starts {
+		salesByChair := salesByPeriod[start]
+		sold := []Chair{}
+		for _, chair := range chairs {
+			if _, ok := salesByChair[chair.ID]; ok {
+				sold = append(sold, chair)
+			}
+		}
+		sort.Slice(sold, func(i, j int) bool { return sold[i].ID < sold[j].ID })
+		summary := summarizeOwnerSales(sold, salesByChair)
+		sort.Slice(summary.Models, func(i, j int) bool { return summary.Models[i].Model < summary.Models[j].Model })
+		buckets = append(buckets, salesBucket{
+			Start:      start.UnixMilli(),
+			TotalSales: summary.TotalSales,
+			TotalTips:  summary.TotalTips,
+			Chairs:     summary.Chairs,
+			Models:     summary.Models,
+		})
 	}
-	return sale
+	return buckets
 }
 
-func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+// 期間内に完了したオーナーの椅子のライド。COMPLETEDのステータスを持つライドだけを1回ずつ数える
+// rides_archiveには完了済みのライドしか入らない
+func getOwnerCompletedRides(ctx context.Context, tx *sqlx.Tx, ownerID string, since, until time.Time) ([]Ride, error) {
+	rides := []Ride{}
+	if err := tx.SelectContext(ctx, &rides, `SELECT rides.* FROM rides
+JOIN chairs ON rides.chair_id = chairs.id
+WHERE chairs.owner_id = ?
+  AND rides.latest_status = 'COMPLETED'
+  AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+UNION ALL
+SELECT rides_archive.* FROM rides_archive
+JOIN chairs ON rides_archive.chair_id = chairs.id
+WHERE chairs.owner_id = ?
+  AND rides_archive.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+ORDER BY updated_at`, ownerID, since, until, ownerID, since, until); err != nil {
+		return nil, err
+	}
+	return rides, nil
+}
+
+type ownerGetSalesCompareResponse struct {
+	Current  *ownerGetSalesResponse `json:"current"`
+	Previous *ownerGetSalesResponse `json:"previous"`
+	// 直前の期間の売上が0なら変化率は出せないのでnull
+	TotalSalesChangePercent *float64 `json:"total_sales_change_percent"`
+}
+
+// 指定期間と、その直前の同じ長さの期間の売上を並べて返す
+func ownerGetSalesCompare(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.URL.Query().Get("since") == "" || r.URL.Query().Get("until") == "" {
+		writeError(w, http.StatusBadRequest, errors.New("since and until are required"))
+		return
+	}
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// 期間は両端を含むので、直前の期間はsinceの1ミリ秒前で終わる
+	prevUntil := since.Add(-time.Millisecond)
+	prevSince := prevUntil.Add(-until.Sub(since))
+
+	owner := ctx.Value("owner").(*Owner)
+
+	tx, err := readDB().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	current, err := getOwnerSales(ctx, tx, owner.ID, since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	previous, err := getOwnerSales(ctx, tx, owner.ID, prevSince, prevUntil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &ownerGetSalesCompareResponse{
+		Current:  current,
+		Previous: previous,
+	}
+	if previous.TotalSales > 0 {
+		change := float64(current.TotalSales-previous.TotalSales) / float64(previous.TotalSales) * 100
+		res.TotalSalesChangePercent = &change
+	}
+
+	writeJSON(w, http.StatusOK, res)
 }
 
-type chairWithDetail struct {
-	ID                     string       `db:"id"`
-	OwnerID                string       `db:"owner_id"`
-	Name                   string       `db:"name"`
-	AccessToken            string       `db:"access_token"`
-	Model                  string       `db:"model"`
-	IsActive               bool         `db:"is_active"`
-	CreatedAt              time.Time    `db:"created_at"`
-	UpdatedAt              time.Time    `db:"updated_at"`
-	TotalDistance          int          `db:"total_distance"`
-	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+// 売上は割引前の運賃。完了時に保存した値を使う
+func calculateSale(ride Ride) int {
+	if ride.GrossFare != nil {
+		return *ride.GrossFare
+	}
+	return calculateRouteFare(rideDistance(&ride))
 }
 
 type ownerGetChairResponse struct {
-	Chairs []ownerGetChairResponseChair `json:"chairs"`
+	Chairs     []ownerGetChairResponseChair `json:"chairs"`
+	NextCursor string                       `json:"next_cursor,omitempty"`
+	// 絞り込み条件に合う椅子の数。ページに関係なく数える
+	Total int `json:"total"`
 }
 
 type ownerGetChairResponseChair struct {
@@ -186,49 +341,89 @@ type ownerGetChairResponseChair struct {
 	Name                   string `json:"name"`
 	Model                  string `json:"model"`
 	Active                 bool   `json:"active"`
+	Version                string `json:"version,omitempty"`
+	Availability           string `json:"availability"`
 	RegisteredAt           int64  `json:"registered_at"`
 	TotalDistance          int    `json:"total_distance"`
 	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
+	DecommissionedAt       *int64 `json:"decommissioned_at,omitempty"`
 }
 
 func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	owner := ctx.Value("owner").(*Owner)
 
-	chairs := []chairWithDetail{}
-	if err := db.SelectContext(ctx, &chairs, `SELECT id,
-       owner_id,
-       name,
-       access_token,
-       model,
-       is_active,
-       created_at,
-       updated_at,
-       IFNULL(total_distance, 0) AS total_distance,
-       total_distance_updated_at
-FROM chairs
-       LEFT JOIN (SELECT chair_id,
-                          SUM(IFNULL(distance, 0)) AS total_distance,
-                          MAX(created_at)          AS total_distance_updated_at
-                   FROM (SELECT chair_id,
-                                created_at,
-                                ABS(latitude - LAG(latitude) OVER (PARTITION BY chair_id ORDER BY created_at)) +
-                                ABS(longitude - LAG(longitude) OVER (PARTITION BY chair_id ORDER BY created_at)) AS distance
-                         FROM chair_locations) tmp
-                   GROUP BY chair_id) distance_table ON distance_table.chair_id = chairs.id
-WHERE owner_id = ?
-`, owner.ID); err != nil {
+	page, err := parsePageParams(r, 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	filterCond := ""
+	filterArgs := []any{owner.ID}
+	model := r.URL.Query().Get("model")
+	if model != "" {
+		filterCond += " AND model = ?"
+		filterArgs = append(filterArgs, model)
+	}
+	active := r.URL.Query().Get("active")
+	if active != "" {
+		isActive, err := strconv.ParseBool(active)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("active must be true or false"))
+			return
+		}
+		filterCond += " AND is_active = ?"
+		filterArgs = append(filterArgs, isActive)
+	}
+	// IDはULIDなので、IDの順が登録順になる
+	sortOrder := r.URL.Query().Get("sort")
+	if sortOrder == "" {
+		sortOrder = "registered_at"
+	}
+	if sortOrder != "registered_at" && sortOrder != "-registered_at" {
+		writeError(w, http.StatusBadRequest, errors.New("sort must be registered_at or -registered_at"))
+		return
+	}
+	desc := sortOrder == "-registered_at"
+
+	// 椅子の登録・稼働状態・位置が変わらなければ一覧も変わらない
+	epoch, generation := chairAvailability.OwnerGeneration(owner.ID)
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%s|%s|%s|%d", model, active, sortOrder, page.Cursor, page.Limit)
+	if checkETag(w, r, fmt.Sprintf(`W/"%d-%d-%x"`, epoch, generation, h.Sum64())) {
+		return
+	}
+
+	total := 0
+	if err := db.GetContext(ctx, &total, `SELECT COUNT(*) FROM chairs WHERE owner_id = ?`+filterCond, filterArgs...); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	res := ownerGetChairResponse{}
+	cursorCond, cursorArgs := page.cursorCondition("chairs.id", desc)
+	orderBy := " ORDER BY chairs.id"
+	if desc {
+		orderBy += " DESC"
+	}
+
+	// 移動距離の合計は座標を記録するたびにchairsに足し込んである
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, `SELECT * FROM chairs
+WHERE owner_id = ?`+filterCond+cursorCond+orderBy+page.limitClause(), append(filterArgs, cursorArgs...)...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairs, nextCursor := trimPage(page, chairs, func(c Chair) string { return c.ID })
+
+	res := ownerGetChairResponse{NextCursor: nextCursor, Total: total}
 	for _, chair := range chairs {
 		c := ownerGetChairResponseChair{
 			ID:            chair.ID,
 			Name:          chair.Name,
 			Model:         chair.Model,
 			Active:        chair.IsActive,
+			Version:       chair.AppVersion.String,
+			Availability:  string(chairStateOf(chair.ID, chair.IsActive)),
 			RegisteredAt:  chair.CreatedAt.UnixMilli(),
 			TotalDistance: chair.TotalDistance,
 		}
@@ -236,6 +431,10 @@ WHERE owner_id = ?
 			t := chair.TotalDistanceUpdatedAt.Time.UnixMilli()
 			c.TotalDistanceUpdatedAt = &t
 		}
+		if chair.DecommissionedAt.Valid {
+			t := chair.DecommissionedAt.Time.UnixMilli()
+			c.DecommissionedAt = &t
+		}
 		res.Chairs = append(res.Chairs, c)
 	}
 	writeJSON(w, http.StatusOK, res)
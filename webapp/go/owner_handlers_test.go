@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseSalesPeriod(t *testing.T) {
+	since := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 11, 1, 23, 59, 59, 999_000_000, time.UTC)
+	ms := func(t time.Time) string { return strconv.FormatInt(t.UnixMilli(), 10) }
+
+	tests := []struct {
+		name      string
+		query     string
+		wantSince time.Time
+		wantUntil time.Time
+		wantErr   bool
+	}{
+		{"defaults", "", time.Unix(0, 0).UTC(), time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC), false},
+		{"range", "since=" + ms(since) + "&until=" + ms(until), since, until, false},
+		{"same instant", "since=" + ms(since) + "&until=" + ms(since), since, since, false},
+		{"until before since", "since=" + ms(until) + "&until=" + ms(since), time.Time{}, time.Time{}, true},
+		{"invalid since", "since=yesterday", time.Time{}, time.Time{}, true},
+		{"invalid until", "until=1.5", time.Time{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotSince, gotUntil, err := parseSalesPeriod(httptest.NewRequest(http.MethodGet, "/api/owner/sales?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !gotSince.Equal(tt.wantSince) || !gotUntil.Equal(tt.wantUntil) {
+				t.Errorf("period = %s - %s, want %s - %s", gotSince, gotUntil, tt.wantSince, tt.wantUntil)
+			}
+			if err == nil && (gotSince.Location() != time.UTC || gotUntil.Location() != time.UTC) {
+				t.Errorf("period is not normalized to UTC: %s - %s", gotSince, gotUntil)
+			}
+		})
+	}
+}
+
+// 期間は両端を含み、untilはそのミリ秒の終わりまで含む
+func TestOwnerSalesPeriodBoundaries(t *testing.T) {
+	since := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 11, 1, 23, 59, 59, 999_000_000, time.UTC)
+
+	jst := time.FixedZone("JST", 9*60*60)
+
+	c := NewOwnerSalesCache()
+	for i, at := range []time.Time{
+		since.Add(-time.Microsecond),             // 含まない
+		since,                                    // 含む
+		until,                                    // 含む
+		until.Add(999 * time.Microsecond),        // 含む
+		until.Add(time.Millisecond),              // 含まない
+		time.Date(2024, 11, 2, 8, 59, 0, 0, jst), // UTCでは11/1なので含む
+		time.Date(2024, 11, 2, 9, 0, 0, 0, jst),  // UTCでは11/2なので含まない
+	} {
+		c.Add(RideSale{RideID: strconv.Itoa(i), OwnerID: "owner-1", ChairID: "chair-1", Sales: 1 << i, CompletedAt: at})
+	}
+
+	got := c.SalesByChair("owner-1", since, until)["chair-1"].Sales
+	if want := 1<<1 | 1<<2 | 1<<3 | 1<<5; got != want {
+		t.Errorf("sales = %b, want %b", got, want)
+	}
+}
+
+// 時/日/週の区切りはUTCで決める。日の境目の前後のライドは別の日に入る
+func TestOwnerSalesPerPeriodSplitsAtUTCBoundaries(t *testing.T) {
+	// 2024-11-03は日曜日なので、週の区切り(月曜始まり)もこの境目になる
+	midnight := time.Date(2024, 11, 4, 0, 0, 0, 0, time.UTC)
+	jst := time.FixedZone("JST", 9*60*60)
+
+	c := NewOwnerSalesCache()
+	c.Add(RideSale{RideID: "before", OwnerID: "owner-1", ChairID: "chair-1", Sales: 100, CompletedAt: midnight.Add(-time.Millisecond).In(jst)})
+	c.Add(RideSale{RideID: "at", OwnerID: "owner-1", ChairID: "chair-1", Sales: 200, CompletedAt: midnight.In(jst)})
+
+	for _, group := range []string{"hour", "day", "week"} {
+		t.Run(group, func(t *testing.T) {
+			byPeriod := c.SalesByChairPerPeriod("owner-1", midnight.Add(-time.Hour), midnight.Add(time.Hour), group)
+			if got := byPeriod[midnight]["chair-1"].Sales; got != 200 {
+				t.Errorf("sales from %s = %d, want 200", midnight, got)
+			}
+			previous := truncateSalesPeriod(midnight.Add(-time.Millisecond), group)
+			if got := byPeriod[previous]["chair-1"].Sales; got != 100 || previous.Location() != time.UTC {
+				t.Errorf("sales from %s = %d, want 100", previous, got)
+			}
+		})
+	}
+}
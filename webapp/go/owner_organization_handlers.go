@@ -0,0 +1,327 @@
+// webapp/go/owner_organization_handlers.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 複数のオーナー(ブランド)をまとめた組織
+// 売上と椅子は組織単位でまとめて見られるが、トークンと椅子の登録はオーナーごとのまま
+
+type ownerPostOrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+type ownerOrganizationResponse struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// 他のオーナーを参加させるためのトークン
+	InviteToken string                    `json:"invite_token"`
+	Owners      []ownerOrganizationMember `json:"owners"`
+}
+
+type ownerOrganizationMember struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+var errNotInOrganization = errors.New("owner does not belong to any organization")
+
+func getOwnerOrganization(ctx context.Context, q sqlx.QueryerContext, ownerID string) (*Organization, error) {
+	org := &Organization{}
+	if err := sqlx.GetContext(ctx, q, org, `SELECT organizations.* FROM organizations
+JOIN organization_owners ON organization_owners.organization_id = organizations.id
+WHERE organization_owners.owner_id = ?`, ownerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errNotInOrganization
+		}
+		return nil, err
+	}
+	return org, nil
+}
+
+func getOrganizationOwners(ctx context.Context, q sqlx.QueryerContext, organizationID string) ([]Owner, error) {
+	owners := []Owner{}
+	if err := sqlx.SelectContext(ctx, q, &owners, `SELECT owners.* FROM owners
+JOIN organization_owners ON organization_owners.owner_id = owners.id
+WHERE organization_owners.organization_id = ?
+ORDER BY owners.id`, organizationID); err != nil {
+		return nil, err
+	}
+	return owners, nil
+}
+
+func writeOrganization(w http.ResponseWriter, ctx context.Context, status int, org *Organization) {
+	owners, err := getOrganizationOwners(ctx, db, org.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res := &ownerOrganizationResponse{
+		ID:          org.ID,
+		Name:        org.Name,
+		InviteToken: org.InviteToken,
+		Owners:      []ownerOrganizationMember{},
+	}
+	for _, owner := range owners {
+		res.Owners = append(res.Owners, ownerOrganizationMember{ID: owner.ID, Name: owner.Name})
+	}
+	writeJSON(w, status, res)
+}
+
+// 組織を作り、リクエストしたオーナーを最初のメンバーにする
+func ownerPostOrganization(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	req := &ownerPostOrganizationRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("some of required fields(name) are empty"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := getOwnerOrganization(ctx, tx, owner.ID); err == nil {
+		writeError(w, http.StatusConflict, errors.New("owner already belongs to an organization"))
+		return
+	} else if !errors.Is(err, errNotInOrganization) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	org := &Organization{
+		ID:          ulid.Make().String(),
+		Name:        req.Name,
+		InviteToken: secureRandomStr(32),
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO organizations (id, name, invite_token) VALUES (?, ?, ?)", org.ID, org.Name, org.InviteToken); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO organization_owners (owner_id, organization_id) VALUES (?, ?)", owner.ID, org.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeOrganization(w, ctx, http.StatusCreated, org)
+}
+
+type ownerPostOrganizationJoinRequest struct {
+	InviteToken string `json:"invite_token"`
+}
+
+// 招待トークンで組織に参加する。オーナーが所属できる組織は1つだけ
+func ownerPostOrganizationJoin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	req := &ownerPostOrganizationJoinRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.InviteToken == "" {
+		writeError(w, http.StatusBadRequest, errors.New("some of required fields(invite_token) are empty"))
+		return
+	}
+
+	org := &Organization{}
+	if err := db.GetContext(ctx, org, "SELECT * FROM organizations WHERE invite_token = ?", req.InviteToken); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("organization not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "INSERT IGNORE INTO organization_owners (owner_id, organization_id) VALUES (?, ?)", owner.ID, org.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		current, err := getOwnerOrganization(ctx, db, owner.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if current.ID != org.ID {
+			writeError(w, http.StatusConflict, errors.New("owner already belongs to another organization"))
+			return
+		}
+	}
+
+	writeOrganization(w, ctx, http.StatusOK, org)
+}
+
+func ownerGetOrganization(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	org, err := getOwnerOrganization(ctx, db, owner.ID)
+	if err != nil {
+		if errors.Is(err, errNotInOrganization) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeOrganization(w, ctx, http.StatusOK, org)
+}
+
+type ownerSalesByOwner struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Sales int    `json:"sales"`
+	Tips  int    `json:"tips"`
+}
+
+type ownerGetOrganizationSalesResponse struct {
+	TotalSales int                 `json:"total_sales"`
+	TotalTips  int                 `json:"total_tips"`
+	Owners     []ownerSalesByOwner `json:"owners"`
+	Chairs     []chairSales        `json:"chairs"`
+	Models     []modelSales        `json:"models"`
+}
+
+// 組織に所属するオーナー全員の売上をまとめて返す。期間の指定は/api/owner/salesと同じ
+func ownerGetOrganizationSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := readDB().Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	org, err := getOwnerOrganization(ctx, tx, owner.ID)
+	if err != nil {
+		if errors.Is(err, errNotInOrganization) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	owners, err := getOrganizationOwners(ctx, tx, org.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &ownerGetOrganizationSalesResponse{
+		Owners: []ownerSalesByOwner{},
+		Chairs: []chairSales{},
+		Models: []modelSales{},
+	}
+	modelSalesByModel := map[string]salesTotal{}
+	for _, o := range owners {
+		sales, err := getOwnerSales(ctx, tx, o.ID, since, until)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		res.TotalSales += sales.TotalSales
+		res.TotalTips += sales.TotalTips
+		res.Owners = append(res.Owners, ownerSalesByOwner{ID: o.ID, Name: o.Name, Sales: sales.TotalSales, Tips: sales.TotalTips})
+		res.Chairs = append(res.Chairs, sales.Chairs...)
+		for _, m := range sales.Models {
+			total := modelSalesByModel[m.Model]
+			total.Sales += m.Sales
+			total.Tips += m.Tips
+			modelSalesByModel[m.Model] = total
+		}
+	}
+	for model, total := range modelSalesByModel {
+		res.Models = append(res.Models, modelSales{Model: model, Sales: total.Sales, Tips: total.Tips})
+	}
+	sort.Slice(res.Models, func(i, j int) bool { return res.Models[i].Model < res.Models[j].Model })
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerGetOrganizationChairsResponse struct {
+	Chairs []ownerGetOrganizationChairsResponseChair `json:"chairs"`
+}
+
+type ownerGetOrganizationChairsResponseChair struct {
+	ID           string `json:"id"`
+	OwnerID      string `json:"owner_id"`
+	Name         string `json:"name"`
+	Model        string `json:"model"`
+	Active       bool   `json:"active"`
+	Availability string `json:"availability"`
+	RegisteredAt int64  `json:"registered_at"`
+}
+
+// 組織に所属するオーナー全員の椅子を返す
+func ownerGetOrganizationChairs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	org, err := getOwnerOrganization(ctx, db, owner.ID)
+	if err != nil {
+		if errors.Is(err, errNotInOrganization) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, `SELECT chairs.* FROM chairs
+JOIN organization_owners ON organization_owners.owner_id = chairs.owner_id
+WHERE organization_owners.organization_id = ?
+ORDER BY chairs.id`, org.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &ownerGetOrganizationChairsResponse{Chairs: []ownerGetOrganizationChairsResponseChair{}}
+	for _, chair := range chairs {
+		res.Chairs = append(res.Chairs, ownerGetOrganizationChairsResponseChair{
+			ID:           chair.ID,
+			OwnerID:      chair.OwnerID,
+			Name:         chair.Name,
+			Model:        chair.Model,
+			Active:       chair.IsActive,
+			Availability: string(chairStateOf(chair.ID, chair.IsActive)),
+			RegisteredAt: chair.CreatedAt.UnixMilli(),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,183 @@
+// webapp/go/owner_payouts.go
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 売上から差し引くプラットフォーム手数料(%)
+var platformFeePercent = getEnvInt("ISUCON_PLATFORM_FEE_PERCENT", 10)
+
+type payoutPeriod struct {
+	// 期間の開始(UNIXミリ秒、UTC)
+	Start  int64         `json:"start"`
+	Chairs []chairPayout `json:"chairs"`
+	// 期間内の全椅子の合計
+	GrossSales  int `json:"gross_sales"`
+	PlatformFee int `json:"platform_fee"`
+	Tips        int `json:"tips"`
+	NetPayout   int `json:"net_payout"`
+}
+
+type chairPayout struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	GrossSales  int    `json:"gross_sales"`
+	PlatformFee int    `json:"platform_fee"`
+	// チップには手数料をかけず、そのまま支払額に足す
+	Tips      int `json:"tips"`
+	NetPayout int `json:"net_payout"`
+}
+
+type ownerGetPayoutsResponse struct {
+	Group              string         `json:"group"`
+	PlatformFeePercent int            `json:"platform_fee_percent"`
+	Periods            []payoutPeriod `json:"periods"`
+}
+
+// 期間の開始時刻。週は月曜始まり
+func truncateSalesPeriod(t time.Time, group string) time.Time {
+	if group == "hour" {
+		return t.Truncate(time.Hour)
+	}
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if group == "week" {
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	}
+	return day
+}
+
+func platformFee(gross int) int {
+	return gross * platformFeePercent / 100
+}
+
+// 日/週ごと・椅子ごとの売上と手数料、支払額を返す
+// format=csvならCSVで返す
+func ownerGetPayouts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		group = "day"
+	}
+	if group != "day" && group != "week" {
+		writeError(w, http.StatusBadRequest, errors.New("group must be day or week"))
+		return
+	}
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	owner := ctx.Value("owner").(*Owner)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chairs, err := reposFrom(ctx).Chairs.With(tx).ListByOwner(ctx, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairNames := make(map[string]string, len(chairs))
+	for _, chair := range chairs {
+		chairNames[chair.ID] = chair.Name
+	}
+
+	rides, err := getOwnerCompletedRides(ctx, tx, owner.ID, since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	salesByPeriod := map[time.Time]map[string]salesTotal{}
+	for _, ride := range rides {
+		start := truncateSalesPeriod(ride.UpdatedAt.UTC(), group)
+		if salesByPeriod[start] == nil {
+			salesByPeriod[start] = map[string]salesTotal{}
+		}
+		total := salesByPeriod[start][ride.ChairID.String]
+		total.Sales += calculateSale(ride)
+		if ride.Tip != nil {
+			total.Tips += *ride.Tip
+		}
+		salesByPeriod[start][ride.ChairID.String] = total
+	}
+
+	starts := make([]time.Time, 0, len(salesByPeriod))
+	for start := range salesByPeriod {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	res := &ownerGetPayoutsResponse{
+		Group:              group,
+		PlatformFeePercent: platformFeePercent,
+		Periods:            []payoutPeriod{},
+	}
+	for _, start := range starts {
+		period := payoutPeriod{
+			Start:  start.UnixMilli(),
+			Chairs: []chairPayout{},
+		}
+		for chairID, total := range salesByPeriod[start] {
+			gross := total.Sales
+			fee := platformFee(gross)
+			net := gross - fee + total.Tips
+			period.Chairs = append(period.Chairs, chairPayout{
+				ID:          chairID,
+				Name:        chairNames[chairID],
+				GrossSales:  gross,
+				PlatformFee: fee,
+				Tips:        total.Tips,
+				NetPayout:   net,
+			})
+			period.GrossSales += gross
+			period.PlatformFee += fee
+			period.Tips += total.Tips
+			period.NetPayout += net
+		}
+		sort.Slice(period.Chairs, func(i, j int) bool { return period.Chairs[i].ID < period.Chairs[j].ID })
+		res.Periods = append(res.Periods, period)
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		writePayoutsCSV(w, res)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func writePayoutsCSV(w http.ResponseWriter, res *ownerGetPayoutsResponse) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="payouts.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"period_start", "chair_id", "chair_name", "gross_sales", "platform_fee", "tips", "net_payout"})
+	for _, period := range res.Periods {
+		start := time.UnixMilli(period.Start).UTC().Format(time.DateOnly)
+		for _, chair := range period.Chairs {
+			cw.Write([]string{
+				start,
+				chair.ID,
+				chair.Name,
+				strconv.Itoa(chair.GrossSales),
+				strconv.Itoa(chair.PlatformFee),
+				strconv.Itoa(chair.Tips),
+				strconv.Itoa(chair.NetPayout),
+			})
+		}
+	}
+	cw.Flush()
+}
@@ -0,0 +1,112 @@
+// webapp/go/owner_rides.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type ownerSearchRidesResponse struct {
+	Rides      []ownerSearchRidesResponseRide `json:"rides"`
+	NextCursor string                         `json:"next_cursor,omitempty"`
+}
+
+type ownerSearchRidesResponseRide struct {
+	ID                    string     `json:"id"`
+	ChairID               string     `json:"chair_id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	CreatedAt             int64      `json:"created_at"`
+}
+
+func queryInts(r *http.Request, names ...string) ([]int, error) {
+	values := make([]int, 0, len(names))
+	for _, name := range names {
+		v, err := strconv.Atoi(r.URL.Query().Get(name))
+		if err != nil {
+			return nil, errors.New(name + " is invalid")
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// オーナーの椅子が担当したライドのうち、配車位置か目的地が指定範囲に入るものを新しい順に返す
+// latitude/longitude/distanceで円(マンハッタン距離)、min_latitude/max_latitude/min_longitude/max_longitudeで矩形を指定する
+func ownerSearchRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	page, err := parsePageParams(r, 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var rideIDs []string
+	if r.URL.Query().Get("distance") != "" {
+		v, err := queryInts(r, "latitude", "longitude", "distance")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if v[2] < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("distance is invalid"))
+			return
+		}
+		rideIDs = rideGrid.SearchRadius(v[0], v[1], v[2])
+	} else {
+		v, err := queryInts(r, "min_latitude", "max_latitude", "min_longitude", "max_longitude")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if v[0] > v[1] || v[2] > v[3] {
+			writeError(w, http.StatusBadRequest, errors.New("min must be less than or equal to max"))
+			return
+		}
+		rideIDs = rideGrid.SearchBox(v[0], v[1], v[2], v[3])
+	}
+
+	res := ownerSearchRidesResponse{Rides: []ownerSearchRidesResponseRide{}}
+	if len(rideIDs) == 0 {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	cursorCond, cursorArgs := page.cursorCondition("rides.id", true)
+	query, args, err := sqlx.In(`SELECT rides.* FROM rides
+JOIN chairs ON rides.chair_id = chairs.id
+WHERE chairs.owner_id = ? AND rides.id IN (?)`+cursorCond+`
+ORDER BY rides.id DESC`+page.limitClause(), append([]any{owner.ID, rideIDs}, cursorArgs...)...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rides := []Ride{}
+	if err := readDB().SelectContext(ctx, &rides, query, args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rides, res.NextCursor = trimPage(page, rides, func(ride Ride) string { return ride.ID })
+
+	for _, ride := range rides {
+		res.Rides = append(res.Rides, ownerSearchRidesResponseRide{
+			ID:      ride.ID,
+			ChairID: ride.ChairID.String,
+			PickupCoordinate: Coordinate{
+				Latitude:  ride.PickupLatitude,
+				Longitude: ride.PickupLongitude,
+			},
+			DestinationCoordinate: Coordinate{
+				Latitude:  ride.DestinationLatitude,
+				Longitude: ride.DestinationLongitude,
+			},
+			CreatedAt: ride.CreatedAt.UnixMilli(),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
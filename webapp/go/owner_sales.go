@@ -0,0 +1,125 @@
+// webapp/go/owner_sales.go
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 完了したライドの売上。ride_salesの1行
+type RideSale struct {
+	RideID      string    `db:"ride_id"`
+	OwnerID     string    `db:"owner_id"`
+	ChairID     string    `db:"chair_id"`
+	Model       string    `db:"model"`
+	Sales       int       `db:"sales"`
+	Tips        int       `db:"tips"`
+	CompletedAt time.Time `db:"completed_at"`
+}
+
+// 椅子ごとの売上(割引前の運賃)とチップの合計
+type salesTotal struct {
+	Sales int
+	Tips  int
+}
+
+// オーナーごとの売上を完了日時の順に持ち、期間の売上をDBを集計せずに返す
+// ライドが完了するとride_salesに書き、コミット後にAddする
+type OwnerSalesCache struct {
+	mu      sync.RWMutex
+	byOwner map[string][]RideSale
+}
+
+func NewOwnerSalesCache() *OwnerSalesCache {
+	return &OwnerSalesCache{byOwner: map[string][]RideSale{}}
+}
+
+var ownerSales = NewOwnerSalesCache()
+
+func (c *OwnerSalesCache) Add(sale RideSale) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sales := c.byOwner[sale.OwnerID]
+	// ほとんどは末尾に足すだけで済む
+	i := sort.Search(len(sales), func(i int) bool { return sales[i].CompletedAt.After(sale.CompletedAt) })
+	sales = append(sales, RideSale{})
+	copy(sales[i+1:], sales[i:])
+	sales[i] = sale
+	c.byOwner[sale.OwnerID] = sales
+}
+
+// 期間内(両端を含み、untilはミリ秒の終わりまで)の売上。c.muを持って呼ぶ
+func (c *OwnerSalesCache) salesIn(ownerID string, since, until time.Time) []RideSale {
+	end := until.Add(time.Millisecond)
+	sales := c.byOwner[ownerID]
+	from := sort.Search(len(sales), func(i int) bool { return !sales[i].CompletedAt.Before(since) })
+	to := sort.Search(len(sales), func(i int) bool { return !sales[i].CompletedAt.Before(end) })
+	return sales[from:max(from, to)]
+}
+
+// 期間内の椅子ごとの売上
+func (c *OwnerSalesCache) SalesByChair(ownerID string, since, until time.Time) map[string]salesTotal {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	byChair := map[string]salesTotal{}
+	for _, sale := range c.salesIn(ownerID, since, until) {
+		total := byChair[sale.ChairID]
+		total.Sales += sale.Sales
+		total.Tips += sale.Tips
+		byChair[sale.ChairID] = total
+	}
+	return byChair
+}
+
+// 期間内の売上を、完了日時で時/日/週に区切った開始日時(UTC)ごと・椅子ごとに集計する
+func (c *OwnerSalesCache) SalesByChairPerPeriod(ownerID string, since, until time.Time, group string) map[time.Time]map[string]salesTotal {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	byPeriod := map[time.Time]map[string]salesTotal{}
+	for _, sale := range c.salesIn(ownerID, since, until) {
+		start := truncateSalesPeriod(sale.CompletedAt.UTC(), group)
+		if byPeriod[start] == nil {
+			byPeriod[start] = map[string]salesTotal{}
+		}
+		total := byPeriod[start][sale.ChairID]
+		total.Sales += sale.Sales
+		total.Tips += sale.Tips
+		byPeriod[start][sale.ChairID] = total
+	}
+	return byPeriod
+}
+
+// DBの内容から作り直す。起動時と初期化時に呼ぶ
+func (c *OwnerSalesCache) Rebuild(ctx context.Context) error {
+	sales := []RideSale{}
+	if err := db.SelectContext(ctx, &sales, `SELECT * FROM ride_sales ORDER BY completed_at`); err != nil {
+		return err
+	}
+	byOwner := map[string][]RideSale{}
+	for _, sale := range sales {
+		byOwner[sale.OwnerID] = append(byOwner[sale.OwnerID], sale)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byOwner = byOwner
+	return nil
+}
+
+// 完了したライドの売上をride_salesに書き、コミット後にownerSales.Addするための値を返す
+func recordRideSale(ctx context.Context, tx *sqlx.Tx, ride *Ride) (RideSale, error) {
+	sale := RideSale{}
+	if err := tx.GetContext(ctx, &sale, `SELECT r.id AS ride_id, c.owner_id, c.id AS chair_id, c.model, IFNULL(r.gross_fare, 0) AS sales, IFNULL(r.tip, 0) AS tips, r.updated_at AS completed_at
+FROM rides r JOIN chairs c ON c.id = r.chair_id
+WHERE r.id = ?`, ride.ID); err != nil {
+		return RideSale{}, err
+	}
+	if _, err := tx.NamedExecContext(ctx, `INSERT INTO ride_sales (ride_id, owner_id, chair_id, model, sales, tips, completed_at) VALUES (:ride_id, :owner_id, :chair_id, :model, :sales, :tips, :completed_at)`, sale); err != nil {
+		return RideSale{}, err
+	}
+	return sale, nil
+}
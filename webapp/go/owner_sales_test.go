@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// 着いていないライドに評価を送っても完了させず、ride_salesにも書かない
+// sqlmockは期待していないクエリを失敗させるので、ride_salesへのINSERTがあればテストが落ちる
+func TestEvaluationRecordsSalesOnlyForArrivedRides(t *testing.T) {
+	for _, status := range []string{"MATCHING", "ENROUTE", "PICKUP", "CARRYING", "CANCELED"} {
+		t.Run(status, func(t *testing.T) {
+			mock := setupMockDB(t)
+			rideID := "sales-test-ride-" + status
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT \* FROM rides WHERE id = \? FOR UPDATE`).
+				WithArgs(rideID).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "chair_id", "latest_status"}).
+					AddRow(rideID, "user-1", "chair-1", status))
+			mock.ExpectQuery(`SELECT latest_status FROM rides WHERE id = \?`).
+				WithArgs(rideID).
+				WillReturnRows(sqlmock.NewRows([]string{"latest_status"}).AddRow(status))
+			mock.ExpectRollback()
+
+			r := httptest.NewRequest(http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", strings.NewReader(`{"evaluation": 5}`))
+			r = r.WithContext(mockRepoContext(r.Context()))
+			r.SetPathValue("ride_id", rideID)
+			w := httptest.NewRecorder()
+			appPostRideEvaluatation(w, r)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// ride_salesには完了したライドしか入らないので、Rebuildした集計は完了したライドの売上とチップだけの合計になる
+func TestOwnerSalesCacheRebuildSumsCompletedRides(t *testing.T) {
+	mock := setupMockDB(t)
+	base := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT \* FROM ride_sales ORDER BY completed_at`).
+		WillReturnRows(sqlmock.NewRows([]string{"ride_id", "owner_id", "chair_id", "model", "sales", "tips", "completed_at"}).
+			AddRow("ride-1", "owner-1", "chair-1", "model-a", 1000, 100, base).
+			AddRow("ride-2", "owner-1", "chair-1", "model-a", 2000, 0, base.Add(time.Hour)).
+			AddRow("ride-3", "owner-1", "chair-2", "model-b", 3000, 300, base.Add(2*time.Hour)).
+			AddRow("ride-4", "owner-2", "chair-3", "model-a", 9000, 0, base.Add(time.Hour)))
+
+	c := NewOwnerSalesCache()
+	if err := c.Rebuild(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := c.SalesByChair("owner-1", base, base.Add(2*time.Hour))
+	want := map[string]salesTotal{
+		"chair-1": {Sales: 3000, Tips: 100},
+		"chair-2": {Sales: 3000, Tips: 300},
+	}
+	if len(got) != len(want) || got["chair-1"] != want["chair-1"] || got["chair-2"] != want["chair-2"] {
+		t.Errorf("sales = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,74 @@
+// webapp/go/owner_token.go
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// トークンを発行し直した後、前のトークンを受け付ける期間
+var ownerTokenGracePeriod = getEnvDuration("ISUCON_OWNER_TOKEN_GRACE_PERIOD", 10*time.Minute)
+
+type ownerPostTokenRotateResponse struct {
+	ChairRegisterToken string `json:"chair_register_token"`
+	// 前のアクセストークン・椅子登録トークンを受け付ける期限 (UNIXミリ秒)
+	PreviousTokensExpireAt int64 `json:"previous_tokens_expire_at"`
+}
+
+// アクセストークンと椅子登録トークンを発行し直し、セッションのクッキーを新しいトークンにする
+// 前のトークンは猶予期間が終わると使えなくなる。もう一度発行し直すと、その前のトークンはすぐに使えなくなる
+func ownerPostTokenRotate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	accessToken := secureRandomStr(32)
+	chairRegisterToken := secureRandomStr(32)
+	expireAt := time.Now().Add(ownerTokenGracePeriod)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// キャッシュしたオーナーは古いことがあるので、退かせるトークンはDBから読む
+	current := &Owner{}
+	if err := tx.GetContext(ctx, current, `SELECT * FROM owners WHERE id = ? FOR UPDATE`, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 代入は左から順に行われるので、previous_*には発行し直す前の値が入る
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE owners SET previous_access_token = access_token, previous_chair_register_token = chair_register_token, previous_tokens_expire_at = ?, access_token = ?, chair_register_token = ? WHERE id = ?`,
+		expireAt, accessToken, chairRegisterToken, owner.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// どのトークンでキャッシュしたオーナーも前のトークンの期限を古いまま持っているので、
+	// 前のトークンにするものも、もう使えなくなるその前のトークンもキャッシュから消す
+	keys := []string{ownerSessionKey(current.AccessToken)}
+	if current.PreviousAccessToken.Valid {
+		keys = append(keys, ownerSessionKey(current.PreviousAccessToken.String))
+	}
+	if c, err := r.Cookie("owner_session"); err == nil && c.Value != current.AccessToken {
+		keys = append(keys, ownerSessionKey(c.Value))
+	}
+	cacheDelete(ctx, keys...)
+
+	http.SetCookie(w, &http.Cookie{
+		Path:  "/",
+		Name:  "owner_session",
+		Value: accessToken,
+	})
+	writeJSON(w, http.StatusOK, &ownerPostTokenRotateResponse{
+		ChairRegisterToken:     chairRegisterToken,
+		PreviousTokensExpireAt: expireAt.UnixMilli(),
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestOwnerPostTokenRotateEvictsRetiredTokens(t *testing.T) {
+	mock := setupMockDB(t)
+	ctx := context.Background()
+	if err := cacheBackend.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1回目の発行し直しの後、前のトークン(token-a)で引いたオーナーがキャッシュに残っている
+	owner := &Owner{
+		ID:                     "owner-1",
+		AccessToken:            "token-b",
+		PreviousAccessToken:    sql.NullString{String: "token-a", Valid: true},
+		PreviousTokensExpireAt: sql.NullTime{Time: time.Now().Add(time.Minute), Valid: true},
+	}
+	cacheSetJSON(ctx, ownerSessionKey("token-a"), owner, time.Minute)
+	cacheSetJSON(ctx, ownerSessionKey("token-b"), owner, time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM owners WHERE id = \? FOR UPDATE`).
+		WithArgs("owner-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "access_token", "previous_access_token"}).
+			AddRow("owner-1", "token-b", "token-a"))
+	mock.ExpectExec(`UPDATE owners SET previous_access_token = access_token`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/owner/token/rotate", nil)
+	r.AddCookie(&http.Cookie{Name: "owner_session", Value: "token-b"})
+	r = r.WithContext(context.WithValue(ctx, "owner", owner))
+	w := httptest.NewRecorder()
+	ownerPostTokenRotate(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+	for _, token := range []string{"token-a", "token-b"} {
+		if cacheGetJSON(ctx, ownerSessionKey(token), &Owner{}) {
+			t.Errorf("session cache for %s was not evicted", token)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// webapp/go/owner_webhooks.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// オーナーが登録したURLに、椅子のイベントを署名付きのJSONでPOSTする
+// イベントは発生したトランザクションでowner_webhook_deliveriesに積み、配信ワーカーが送る
+// 失敗したら指数バックオフで再送し、maxAttempts回失敗したらあきらめる
+// 署名はX-Isuride-Signatureに "sha256=" + hex(HMAC-SHA256(secret, タイムスタンプ + "." + ボディ)) を入れる
+const (
+	webhookEventRideCompleted   = "ride.completed"
+	webhookEventChairDeactivate = "chair.deactivated"
+	webhookEventDailySummary    = "daily_summary"
+)
+
+type OwnerWebhook struct {
+	ID        string    `db:"id"`
+	OwnerID   string    `db:"owner_id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type rideCompletedWebhookPayload struct {
+	RideID      string `json:"ride_id"`
+	ChairID     string `json:"chair_id"`
+	Sales       int    `json:"sales"`
+	Tip         int    `json:"tip"`
+	Evaluation  int    `json:"evaluation"`
+	CompletedAt int64  `json:"completed_at"`
+}
+
+type chairDeactivatedWebhookPayload struct {
+	ChairID string `json:"chair_id"`
+	// activity(椅子が稼働を止めた)・timed_out(応答しなくなった)・decommissioned(オーナーが廃止した)
+	Reason string `json:"reason"`
+}
+
+type dailySummaryWebhookPayload struct {
+	// 集計した日(UTC)
+	Date       string       `json:"date"`
+	TotalSales int          `json:"total_sales"`
+	TotalTips  int          `json:"total_tips"`
+	Chairs     []chairSales `json:"chairs"`
+}
+
+func enqueueChairDeactivatedWebhook(ctx context.Context, webhooks OwnerWebhookRepo, chair *Chair, reason string) error {
+	return webhooks.Enqueue(ctx, chair.OwnerID, webhookEventChairDeactivate, ulid.Make().String(), chairDeactivatedWebhookPayload{
+		ChairID: chair.ID,
+		Reason:  reason,
+	})
+}
+
+type webhookDeliverer struct {
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	webhooks OwnerWebhookRepo
+	chairs   ChairRepo
+	client   *http.Client
+
+	// 最後に日次の集計を積んだ日。プロセスを立ち上げ直しても積み直すだけで、dedup_keyで二重には積まれない
+	summarizedDate string
+}
+
+func newWebhookDeliverer(webhooks OwnerWebhookRepo, chairs ChairRepo) *webhookDeliverer {
+	return &webhookDeliverer{
+		interval:    getEnvDuration("ISUCON_OWNER_WEBHOOK_INTERVAL", time.Second),
+		batchSize:   getEnvInt("ISUCON_OWNER_WEBHOOK_BATCH_SIZE", 100),
+		maxAttempts: getEnvInt("ISUCON_OWNER_WEBHOOK_MAX_ATTEMPTS", 8),
+		backoff:     getEnvDuration("ISUCON_OWNER_WEBHOOK_BACKOFF", time.Second),
+		maxBackoff:  getEnvDuration("ISUCON_OWNER_WEBHOOK_MAX_BACKOFF", time.Hour),
+		webhooks:    webhooks,
+		chairs:      chairs,
+		client:      webhookHTTPClient,
+	}
+}
+
+func (d *webhookDeliverer) run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		if err := d.summarize(ctx, now); err != nil {
+			slog.Error("failed to enqueue daily summary webhooks", "error", err)
+		}
+		if err := d.deliverDue(ctx, now); err != nil {
+			slog.Error("failed to deliver webhooks", "error", err)
+		}
+	}
+}
+
+// 日が変わったら、Webhookを登録しているオーナーに前日(UTC)の売上を積む
+func (d *webhookDeliverer) summarize(ctx context.Context, now time.Time) error {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	date := today.AddDate(0, 0, -1).Format(time.DateOnly)
+	if d.summarizedDate == date {
+		return nil
+	}
+
+	ownerIDs, err := d.webhooks.OwnerIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ownerID := range ownerIDs {
+		chairs, err := d.chairs.ListByOwner(ctx, ownerID)
+		if err != nil {
+			return err
+		}
+		sales := summarizeOwnerSales(chairs, ownerSales.SalesByChair(ownerID, today.AddDate(0, 0, -1), today.Add(-time.Millisecond)))
+		if err := d.webhooks.Enqueue(ctx, ownerID, webhookEventDailySummary, webhookEventDailySummary+":"+date, dailySummaryWebhookPayload{
+			Date:       date,
+			TotalSales: sales.TotalSales,
+			TotalTips:  sales.TotalTips,
+			Chairs:     sales.Chairs,
+		}); err != nil {
+			return err
+		}
+	}
+	d.summarizedDate = date
+	return nil
+}
+
+type webhookDelivery struct {
+	ID        string    `db:"id"`
+	Event     string    `db:"event"`
+	Payload   []byte    `db:"payload"`
+	Attempts  int       `db:"attempts"`
+	CreatedAt time.Time `db:"created_at"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+}
+
+// 送る時刻になったイベントを送る
+func (d *webhookDeliverer) deliverDue(ctx context.Context, now time.Time) error {
+	deliveries, err := d.webhooks.DueDeliveries(ctx, now, d.batchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		// 他のサーバーが同じイベントを送らないように、送っている間は次に送る日時を先に延ばしておく
+		if leased, err := d.webhooks.Lease(ctx, delivery.ID, now, now.Add(d.client.Timeout+d.interval)); err != nil {
+			return err
+		} else if !leased {
+			continue
+		}
+
+		if err := d.send(ctx, delivery, time.Now()); err != nil {
+			attempts := delivery.Attempts + 1
+			if attempts >= d.maxAttempts {
+				slog.Warn("gave up delivering webhook", "delivery_id", delivery.ID, "event", delivery.Event, "error", err)
+				err = d.webhooks.MarkFailed(ctx, delivery.ID, attempts, err.Error())
+			} else {
+				err = d.webhooks.MarkRetry(ctx, delivery.ID, attempts, err.Error(), time.Now().Add(d.backoffAfter(attempts)))
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.webhooks.MarkDelivered(ctx, delivery.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attempts回失敗した後に待つ時間。backoff, 2*backoff, 4*backoff, ...でmaxBackoffまで
+func (d *webhookDeliverer) backoffAfter(attempts int) time.Duration {
+	wait := d.backoff
+	for range attempts - 1 {
+		wait *= 2
+		if wait >= d.maxBackoff {
+			return d.maxBackoff
+		}
+	}
+	return wait
+}
+
+type webhookEnvelope struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt int64           `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func (d *webhookDeliverer) send(ctx context.Context, delivery webhookDelivery, now time.Time) error {
+	b, err := json.Marshal(&webhookEnvelope{
+		ID:        delivery.ID,
+		Event:     delivery.Event,
+		CreatedAt: delivery.CreatedAt.UnixMilli(),
+		Data:      json.RawMessage(delivery.Payload),
+	})
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(delivery.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(b)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Isuride-Event", delivery.Event)
+	req.Header.Set("X-Isuride-Delivery", delivery.ID)
+	req.Header.Set("X-Isuride-Timestamp", timestamp)
+	req.Header.Set("X-Isuride-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("[POST %s] unexpected status code (%d)", delivery.URL, res.StatusCode)
+	}
+	return nil
+}
+
+type ownerPostWebhookRequest struct {
+	URL string `json:"url"`
+}
+
+type ownerPostWebhookResponse struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// 署名の検証に使う鍵。登録したときにしか返さない
+	Secret string `json:"secret"`
+}
+
+func ownerPostWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostWebhookRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(req.URL) > 2048 {
+		writeError(w, http.StatusBadRequest, errors.New("url must be an absolute http(s) URL"))
+		return
+	}
+	// ホスト名は送るときに名前解決したIPで確かめる。IPを直接書いたものはここで断る
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !webhookDestinationAllowed(addr) {
+		writeError(w, http.StatusBadRequest, errWebhookDestinationNotAllowed)
+		return
+	}
+
+	webhook := &OwnerWebhook{
+		ID:      ulid.Make().String(),
+		OwnerID: owner.ID,
+		URL:     req.URL,
+		Secret:  secureRandomStr(32),
+	}
+	if err := reposFrom(ctx).Webhooks.Create(ctx, webhook); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &ownerPostWebhookResponse{
+		ID:     webhook.ID,
+		URL:    webhook.URL,
+		Secret: webhook.Secret,
+	})
+}
+
+// Webhookと、まだ送っていないイベントを消す
+func ownerDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	webhookID := r.PathValue("webhook_id")
+
+	repos := reposFrom(ctx)
+	tx, err := repos.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	deleted, err := repos.Webhooks.With(tx).Delete(ctx, owner.ID, webhookID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, errors.New("webhook not found"))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
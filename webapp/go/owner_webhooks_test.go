@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOwnerPostWebhook(t *testing.T) {
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"https://example.com/hook", http.StatusCreated},
+		{"http://example.com:8080/hook", http.StatusCreated},
+		{"ftp://example.com/hook", http.StatusBadRequest},
+		{"/hook", http.StatusBadRequest},
+		{"http://127.0.0.1/hook", http.StatusBadRequest},
+		{"http://[::1]/hook", http.StatusBadRequest},
+		{"http://169.254.169.254/latest/meta-data", http.StatusBadRequest},
+		{"http://10.0.0.1/hook", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		repos := newFakeRepositories()
+		webhooks := repos.Webhooks.(*fakeOwnerWebhookRepo)
+		r := httptest.NewRequest(http.MethodPost, "/api/owner/webhooks", strings.NewReader(`{"url": "`+tt.url+`"}`))
+		r = r.WithContext(context.WithValue(withRepositories(r.Context(), repos), "owner", &Owner{ID: "owner-1"}))
+		w := httptest.NewRecorder()
+		ownerPostWebhook(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d, body = %s", tt.url, w.Code, tt.want, w.Body)
+		}
+		stored := len(webhooks.webhooks)
+		if want := map[bool]int{true: 1, false: 0}[tt.want == http.StatusCreated]; stored != want {
+			t.Errorf("%s: stored %d webhooks, want %d", tt.url, stored, want)
+		}
+		for _, webhook := range webhooks.webhooks {
+			if webhook.OwnerID != "owner-1" || webhook.URL != tt.url || len(webhook.Secret) == 0 {
+				t.Errorf("%s: stored %+v", tt.url, webhook)
+			}
+		}
+	}
+}
+
+func TestOwnerDeleteWebhookOnlyDeletesOwnWebhook(t *testing.T) {
+	mock := setupMockDB(t)
+	repos := newFakeRepositories()
+	webhooks := repos.Webhooks.(*fakeOwnerWebhookRepo)
+	webhooks.webhooks["webhook-1"] = &OwnerWebhook{ID: "webhook-1", OwnerID: "owner-1"}
+
+	del := func(ownerID string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/api/owner/webhooks/webhook-1", nil)
+		r = r.WithContext(context.WithValue(withRepositories(r.Context(), repos), "owner", &Owner{ID: ownerID}))
+		r.SetPathValue("webhook_id", "webhook-1")
+		w := httptest.NewRecorder()
+		ownerDeleteWebhook(w, r)
+		return w.Code
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	if code := del("owner-2"); code != http.StatusNotFound {
+		t.Fatalf("other owner: status = %d, want %d", code, http.StatusNotFound)
+	}
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+	if code := del("owner-1"); code != http.StatusNoContent {
+		t.Fatalf("owner: status = %d, want %d", code, http.StatusNoContent)
+	}
+	if len(webhooks.webhooks) != 0 {
+		t.Fatalf("webhook was not deleted")
+	}
+}
+
+func TestWebhookDelivererDeliverDue(t *testing.T) {
+	const secret = "test-secret"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("X-Isuride-Timestamp") + "."))
+		mac.Write(body)
+		if r.Header.Get("X-Isuride-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	webhooks := newFakeOwnerWebhookRepo()
+	add := func(id, path, secret string, attempts int) {
+		webhooks.deliveries[id] = &fakeDelivery{
+			webhookDelivery: webhookDelivery{ID: id, Event: webhookEventRideCompleted, Payload: []byte(`{}`), Attempts: attempts, CreatedAt: now, URL: srv.URL + path, Secret: secret},
+			nextAttemptAt:   now,
+		}
+	}
+	add("ok", "/ok", secret, 0)
+	add("retry", "/fail", secret, 1)
+	add("give-up", "/fail", secret, 2)
+	add("bad-signature", "/ok", "wrong-secret", 0)
+	add("later", "/ok", secret, 0)
+	webhooks.deliveries["later"].nextAttemptAt = now.Add(time.Minute)
+
+	d := &webhookDeliverer{
+		interval:    time.Second,
+		batchSize:   10,
+		maxAttempts: 3,
+		backoff:     time.Second,
+		maxBackoff:  time.Minute,
+		webhooks:    webhooks,
+		client:      srv.Client(),
+	}
+	if err := d.deliverDue(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := webhooks.deliveries["ok"]; !got.delivered {
+		t.Errorf("ok: not delivered: %+v", got)
+	}
+	// 2回目の失敗なのでbackoffの2倍待つ
+	if got := webhooks.deliveries["retry"]; got.delivered || got.failed || got.Attempts != 2 || got.nextAttemptAt.Before(now.Add(2*time.Second)) || got.lastError == "" {
+		t.Errorf("retry: %+v", got)
+	}
+	if got := webhooks.deliveries["give-up"]; !got.failed || got.Attempts != 3 {
+		t.Errorf("give-up: %+v", got)
+	}
+	if got := webhooks.deliveries["bad-signature"]; got.delivered || got.Attempts != 1 {
+		t.Errorf("bad-signature: %+v", got)
+	}
+	if got := webhooks.deliveries["later"]; got.delivered || got.Attempts != 0 {
+		t.Errorf("later: sent before next_attempt_at: %+v", got)
+	}
+}
+
+func TestWebhookDelivererSummarizesOncePerDay(t *testing.T) {
+	repos := newFakeRepositories()
+	webhooks := repos.Webhooks.(*fakeOwnerWebhookRepo)
+	webhooks.webhooks["webhook-1"] = &OwnerWebhook{ID: "webhook-1", OwnerID: "owner-1"}
+	d := &webhookDeliverer{webhooks: webhooks, chairs: repos.Chairs}
+
+	now := time.Date(2024, 11, 2, 0, 0, 1, 0, time.UTC)
+	for range 2 {
+		if err := d.summarize(context.Background(), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "owner-1:" + webhookEventDailySummary + ":" + webhookEventDailySummary + ":2024-11-01"
+	if len(webhooks.enqueued) != 1 || webhooks.enqueued[0] != want {
+		t.Fatalf("enqueued = %v, want [%s]", webhooks.enqueued, want)
+	}
+}
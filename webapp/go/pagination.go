@@ -0,0 +1,66 @@
+// webapp/go/pagination.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// ULIDのIDをカーソルにしたキーセットページング
+// OFFSETを使わずIDの大小で続きを取るので、途中で行が追加されても取りこぼしや重複が起きない
+type pageParams struct {
+	Cursor string
+	// 0なら全件返す
+	Limit int
+}
+
+// ?cursor=&limit= を読む。limitはmaxLimitで頭打ちにする
+func parsePageParams(r *http.Request, maxLimit int) (pageParams, error) {
+	p := pageParams{Cursor: r.URL.Query().Get("cursor")}
+	if p.Cursor != "" {
+		if _, err := ulid.ParseStrict(p.Cursor); err != nil {
+			return pageParams{}, errors.New("cursor is invalid")
+		}
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return pageParams{}, errors.New("limit is invalid")
+		}
+		p.Limit = min(limit, maxLimit)
+	}
+	return p, nil
+}
+
+// カーソルより後ろの行に絞る条件。descならIDの降順で読み進める
+func (p pageParams) cursorCondition(column string, desc bool) (string, []any) {
+	if p.Cursor == "" {
+		return "", nil
+	}
+	op := ">"
+	if desc {
+		op = "<"
+	}
+	return fmt.Sprintf(" AND %s %s ?", column, op), []any{p.Cursor}
+}
+
+// 次のページがあるか判定するために1件多く取る
+func (p pageParams) limitClause() string {
+	if p.Limit == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" LIMIT %d", p.Limit+1)
+}
+
+// 1件多く取った結果をページに切り詰め、次のページのカーソルを返す
+func trimPage[T any](p pageParams, items []T, idOf func(T) string) ([]T, string) {
+	if p.Limit == 0 || len(items) <= p.Limit {
+		return items, ""
+	}
+	items = items[:p.Limit]
+	return items, idOf(items[len(items)-1])
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// POSTが失敗しても決済が済んでいれば、決済の数と決済したライドの数が合うので成功として扱う
+// キャンセルしたライドは決済しないので、履歴にあっても数えない
+func TestPaymentGatewayRetryIgnoresCanceledRides(t *testing.T) {
+	mock := setupMockDB(t)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// rides_archiveに移したride-0、以前に完了したride-1、いま評価しているride-3の決済
+		json.NewEncoder(w).Encode([]paymentGatewayGetPaymentsResponseOne{
+			{Amount: 800, Status: "captured"},
+			{Amount: 1000, Status: "captured"},
+			{Amount: 1500, Status: "captured"},
+		})
+	}))
+	defer gateway.Close()
+
+	// ride-2はキャンセルしたので決済していない。ride-0はrides_archiveから読む
+	now := time.Now()
+	mock.ExpectQuery(`SELECT \* FROM rides WHERE user_id = \? AND \(latest_status = 'COMPLETED' OR id = \?\) UNION ALL SELECT \* FROM rides_archive WHERE user_id = \? ORDER BY created_at ASC`).
+		WithArgs("user-1", "ride-3", "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "latest_status", "created_at"}).
+			AddRow("ride-0", "user-1", "COMPLETED", now.Add(-90*24*time.Hour)).
+			AddRow("ride-1", "user-1", "COMPLETED", now.Add(-2*time.Hour)).
+			AddRow("ride-3", "user-1", "ARRIVED", now))
+
+	ctx := context.Background()
+	err := requestPaymentGatewayPostPayment(ctx, gateway.URL, "token", "ride-3", &paymentGatewayPostPaymentRequest{Amount: 1500}, func() ([]Ride, error) {
+		return getPaidRides(ctx, db, "user-1", "ride-3")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,134 @@
+// webapp/go/pending_rides.go
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// 椅子が割り当てられていないライドの優先度付きキュー
+// 優先度は 待ち時間(秒)×waitWeight + 見込み運賃×fareWeight で、長く待っているライドと高いライドを先に割り当てる
+// 待ち時間はどのライドも同じ速さで増えるので、順序は fare×fareWeight - 作成時刻×waitWeight で決まり時間で変わらない
+var (
+	pendingWaitWeight = getEnvFloat("ISUCON_PENDING_WAIT_WEIGHT", 1)
+	pendingFareWeight = getEnvFloat("ISUCON_PENDING_FARE_WEIGHT", 0.001)
+)
+
+type pendingRide struct {
+	ride  Ride
+	key   float64
+	index int
+}
+
+type pendingRideHeap []*pendingRide
+
+func (h pendingRideHeap) Len() int           { return len(h) }
+func (h pendingRideHeap) Less(i, j int) bool { return h[i].key > h[j].key }
+func (h pendingRideHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *pendingRideHeap) Push(x any) {
+	item := x.(*pendingRide)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *pendingRideHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+type PendingRideQueue struct {
+	mu    sync.Mutex
+	heap  pendingRideHeap
+	items map[string]*pendingRide
+}
+
+func NewPendingRideQueue() *PendingRideQueue {
+	return &PendingRideQueue{items: map[string]*pendingRide{}}
+}
+
+var pendingRides = NewPendingRideQueue()
+
+func pendingRideKey(ride *Ride) float64 {
+	fare := calculateRouteFare(rideDistance(ride))
+	return float64(fare)*pendingFareWeight - float64(ride.CreatedAt.UnixMilli())/1000*pendingWaitWeight
+}
+
+func (q *PendingRideQueue) Add(ride *Ride) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.items[ride.ID]; ok {
+		return
+	}
+	item := &pendingRide{ride: *ride, key: pendingRideKey(ride)}
+	q.items[ride.ID] = item
+	heap.Push(&q.heap, item)
+}
+
+func (q *PendingRideQueue) Remove(rideID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, ok := q.items[rideID]
+	if !ok {
+		return
+	}
+	heap.Remove(&q.heap, item.index)
+	delete(q.items, rideID)
+}
+
+// 優先度の高い順に最大limit件(0なら全件)を返す
+func (q *PendingRideQueue) Top(limit int) []Ride {
+	q.mu.Lock()
+	// キューのインデックスを壊さないように複製したヒープから取り出す
+	tmp := make(pendingRideHeap, 0, len(q.heap))
+	for _, item := range q.heap {
+		tmp = append(tmp, &pendingRide{ride: item.ride, key: item.key})
+	}
+	q.mu.Unlock()
+
+	heap.Init(&tmp)
+	if limit <= 0 || limit > len(tmp) {
+		limit = len(tmp)
+	}
+	rides := make([]Ride, 0, limit)
+	for len(rides) < limit {
+		rides = append(rides, heap.Pop(&tmp).(*pendingRide).ride)
+	}
+	return rides
+}
+
+func (q *PendingRideQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.heap)
+}
+
+// DBの内容からキューを作り直す。起動時と初期化時に呼ぶ
+func (q *PendingRideQueue) Rebuild(ctx context.Context) error {
+	rides := []Ride{}
+	if err := db.SelectContext(ctx, &rides, "SELECT * FROM rides WHERE chair_id IS NULL AND latest_status = 'MATCHING'"); err != nil {
+		return err
+	}
+	h := make(pendingRideHeap, 0, len(rides))
+	items := make(map[string]*pendingRide, len(rides))
+	for i := range rides {
+		item := &pendingRide{ride: rides[i], key: pendingRideKey(&rides[i]), index: len(h)}
+		h = append(h, item)
+		items[rides[i].ID] = item
+	}
+	heap.Init(&h)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.heap = h
+	q.items = items
+	return nil
+}
@@ -0,0 +1,123 @@
+// webapp/go/pickup_pin.go
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+)
+
+// 乗車確認のPIN
+// 有効にするとマッチングでライドに4桁のPINを付けてユーザーへの通知で返し、
+// 椅子はPICKUPからCARRYINGに進める前にPINを送って確かめる(ステータスの更新に付けるか、確認用のエンドポイントで)
+// PINが付いていないライド(無効にしていたときに割り当てたもの)は確かめない
+var (
+	pickupPinEnabled = getEnvBool("ISUCON_PICKUP_PIN", false)
+	// 間違えられる回数。使い切ったらユーザーにキャンセルしてもらう
+	pickupPinMaxAttempts = getEnvInt("ISUCON_PICKUP_PIN_MAX_ATTEMPTS", 5)
+)
+
+var (
+	errPickupPinRequired = newAPIError(errCodeInvalidPickupPin, errors.New("pickup pin has not been verified"))
+	errInvalidPickupPin  = newAPIError(errCodeInvalidPickupPin, errors.New("pickup pin is invalid"))
+	errPickupPinLocked   = newAPIError(errCodePickupPinLocked, errors.New("too many invalid pickup pin attempts"))
+)
+
+// マッチングでライドに付けるPIN。無効ならnil
+func newPickupPin() *string {
+	if !pickupPinEnabled {
+		return nil
+	}
+	n, err := crand.Int(crand.Reader, big.NewInt(10000))
+	if err != nil {
+		panic(err)
+	}
+	pin := fmt.Sprintf("%04d", n.Int64())
+	return &pin
+}
+
+// PICKUPのライドのPINを確かめる。間違えた回数を残すので、独立したトランザクションで行う
+func verifyPickupPin(ctx context.Context, chairID, rideID, pin string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ride, err := reposFrom(ctx).Rides.With(tx).GetForUpdate(ctx, rideID)
+	if err != nil {
+		return err
+	}
+	if ride.ChairID.String != chairID {
+		return errRideNotOwned
+	}
+	if !ride.PickupPin.Valid || ride.PickupVerifiedAt.Valid {
+		return nil
+	}
+	if ride.LatestStatus.String != "PICKUP" {
+		return errInvalidStatusTransition
+	}
+	if ride.PickupPinAttempts >= pickupPinMaxAttempts {
+		return errPickupPinLocked
+	}
+	if subtle.ConstantTimeCompare([]byte(pin), []byte(ride.PickupPin.String)) != 1 {
+		if _, err := tx.ExecContext(ctx, `UPDATE rides SET pickup_pin_attempts = pickup_pin_attempts + 1, updated_at = updated_at WHERE id = ?`, rideID); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return errInvalidPickupPin
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE rides SET pickup_verified_at = NOW(6), updated_at = updated_at WHERE id = ?`, rideID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ステータスの更新でCARRYINGにする前にPINを確かめられていなければエラーにする
+func checkPickupVerified(status string, pin sql.NullString, verifiedAt sql.NullTime) error {
+	if status == "CARRYING" && pin.Valid && !verifiedAt.Valid {
+		return errPickupPinRequired
+	}
+	return nil
+}
+
+func writePickupPinError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, errRideNotOwned):
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+	case errors.Is(err, errPickupPinLocked):
+		writeError(w, http.StatusTooManyRequests, err)
+	case errors.Is(err, errInvalidPickupPin), errors.Is(err, errPickupPinRequired), errors.Is(err, errInvalidStatusTransition):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+type chairPostRidePickupVerificationRequest struct {
+	Pin string `json:"pin"`
+}
+
+func chairPostRidePickupVerification(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	chair := ctx.Value("chair").(*Chair)
+
+	req := &chairPostRidePickupVerificationRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := verifyPickupPin(ctx, chair.ID, rideID, req.Pin); err != nil {
+		writePickupPinError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
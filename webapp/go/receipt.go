@@ -0,0 +1,128 @@
+// webapp/go/receipt.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// ライド完了時に領収書を外部に送る
+// 送り先はISUCON_RECEIPT_DELIVERYで切り替え、完了処理のコードは変えずに済むようにする
+type Receipt struct {
+	RideID      string `json:"ride_id"`
+	UserID      string `json:"user_id"`
+	ChairID     string `json:"chair_id"`
+	Fare        int    `json:"fare"`
+	GrossFare   int    `json:"gross_fare"`
+	Tip         int    `json:"tip"`
+	Evaluation  int    `json:"evaluation"`
+	RequestedAt int64  `json:"requested_at"`
+	CompletedAt int64  `json:"completed_at"`
+	// 文面の言語。ライドを完了させたリクエストのAccept-Languageから決める
+	Lang string `json:"lang"`
+}
+
+type ReceiptDeliverer interface {
+	Deliver(ctx context.Context, receipt *Receipt) error
+}
+
+type noopReceiptDeliverer struct{}
+
+func (noopReceiptDeliverer) Deliver(context.Context, *Receipt) error {
+	return nil
+}
+
+// 領収書をJSONでPOSTする
+type webhookReceiptDeliverer struct {
+	url string
+}
+
+func (d *webhookReceiptDeliverer) Deliver(ctx context.Context, receipt *Receipt) error {
+	b, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("[POST %s] unexpected status code (%d)", d.url, res.StatusCode)
+	}
+	return nil
+}
+
+// 領収書をメールで送る
+type smtpReceiptDeliverer struct {
+	addr string
+	from string
+	to   string
+	auth smtp.Auth
+}
+
+func (d *smtpReceiptDeliverer) Deliver(_ context.Context, receipt *Receipt) error {
+	body := strings.Join([]string{
+		"From: " + d.from,
+		"To: " + d.to,
+		"Subject: " + mime.BEncoding.Encode("UTF-8", localize(receipt.Lang, "receipt.subject", "", receipt.RideID)),
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		localize(receipt.Lang, "receipt.ride", "", receipt.RideID),
+		localize(receipt.Lang, "receipt.fare", "", receipt.Fare),
+		localize(receipt.Lang, "receipt.tip", "", receipt.Tip),
+		localize(receipt.Lang, "receipt.completed_at", "", time.UnixMilli(receipt.CompletedAt).UTC().Format(time.RFC3339)),
+	}, "\r\n")
+	return smtp.SendMail(d.addr, d.auth, d.from, []string{d.to}, []byte(body))
+}
+
+func newReceiptDeliverer() ReceiptDeliverer {
+	switch getEnv("ISUCON_RECEIPT_DELIVERY", "none") {
+	case "webhook":
+		return &webhookReceiptDeliverer{url: getEnv("ISUCON_RECEIPT_WEBHOOK_URL", "")}
+	case "smtp":
+		d := &smtpReceiptDeliverer{
+			addr: getEnv("ISUCON_RECEIPT_SMTP_ADDR", "127.0.0.1:25"),
+			from: getEnv("ISUCON_RECEIPT_SMTP_FROM", "noreply@isuride.example.com"),
+			to:   getEnv("ISUCON_RECEIPT_SMTP_TO", ""),
+		}
+		if user := getEnv("ISUCON_RECEIPT_SMTP_USER", ""); user != "" {
+			host, _, _ := strings.Cut(d.addr, ":")
+			d.auth = smtp.PlainAuth("", user, getEnv("ISUCON_RECEIPT_SMTP_PASSWORD", ""), host)
+		}
+		return d
+	default:
+		return noopReceiptDeliverer{}
+	}
+}
+
+var receiptDeliverer = newReceiptDeliverer()
+
+// 完了処理のレスポンスを遅らせないように非同期で送る
+func deliverReceipt(receipt *Receipt) {
+	if _, ok := receiptDeliverer.(noopReceiptDeliverer); ok {
+		return
+	}
+	safeGo("receipt", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := receiptDeliverer.Deliver(ctx, receipt); err != nil {
+			slog.Error("failed to deliver receipt", "error", err, "ride_id", receipt.RideID)
+		}
+	})
+}
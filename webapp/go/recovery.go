@@ -0,0 +1,70 @@
+// webapp/go/recovery.go
+package main
+
+import (
+	"encoding/json"
+
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// ハンドラやバックグラウンドのgoroutineで起きたpanicを拾う
+// リクエストはrequest_id付きの500にし、スタックをslogに出してpanicの回数を数える
+
+var panicCount atomic.Int64
+
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// クライアントの切断などで意図的に中断されたものはそのまま伝える
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			panicCount.Add(1)
+			requestID := middleware.GetReqID(r.Context())
+			slog.Error("panic recovered",
+				"request_id", requestID,
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(rec),
+				"stack", string(debug.Stack()),
+			)
+
+			body, _ := json.Marshal(map[string]string{
+				"message":    localize(langFromWriter(w), errCodeInternal, "internal server error"),
+				"code":       errCodeInternal,
+				"request_id": requestID,
+			})
+			w.Header().Set("Content-Type", "application/json;charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(body)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// バックグラウンドのgoroutineを起動する。panicしてもプロセスや他のgoroutineを巻き込まない
+func safeGo(name string, fn func()) {
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				panicCount.Add(1)
+				slog.Error("panic recovered in goroutine",
+					"goroutine", name,
+					"panic", fmt.Sprint(rec),
+					"stack", string(debug.Stack()),
+				)
+			}
+		}()
+		fn()
+	}()
+}
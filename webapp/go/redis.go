@@ -0,0 +1,158 @@
+// webapp/go/redis.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// キャッシュのバックエンドに使う最小限のRedisクライアント(RESP2)
+// GET/SET/DEL/SCANのようにコマンドを送って1つの応答を読むだけで、パイプラインやPub/Subには対応しない
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+type redisConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+}
+
+type redisClient struct {
+	addr    string
+	timeout time.Duration
+	// 使い終わった接続を置いておく。溢れた分は閉じる
+	idle chan *redisConn
+}
+
+func newRedisClient(addr string, poolSize int, timeout time.Duration) *redisClient {
+	return &redisClient{addr: addr, timeout: timeout, idle: make(chan *redisConn, max(poolSize, 1))}
+}
+
+func (c *redisClient) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	d := net.Dialer{Timeout: c.timeout}
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{conn: conn, br: bufio.NewReader(conn), bw: bufio.NewWriter(conn)}, nil
+}
+
+func (c *redisClient) put(conn *redisConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// コマンドを送って応答を返す。応答はstring、int64、[]any、nil(Null)のいずれか
+func (c *redisClient) Do(ctx context.Context, args ...string) (any, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.conn.SetDeadline(deadline)
+
+	reply, err := conn.do(args)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		// 通信の途中で失敗した接続は応答の区切りがわからないので使い回さない
+		conn.conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return reply, err
+}
+
+func (c *redisConn) do(args []string) (any, error) {
+	fmt.Fprintf(c.bw, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.bw, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.bw.Flush(); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis: malformed reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		// エラー応答のあとも接続は使える。応答を読み切ってから返す
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.br, buf); err != nil {
+			return nil, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, errors.New("redis: malformed reply")
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			item, err := c.readReply()
+			var rerr redisError
+			if err != nil && !errors.As(err, &rerr) {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply %q", line)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRedisConnReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  any
+		err   error
+	}{
+		{"simple string", "+OK\r\n", "OK", nil},
+		{"error", "-ERR wrong type\r\n", nil, redisError("ERR wrong type")},
+		{"integer", ":-42\r\n", int64(-42), nil},
+		{"bulk string", "$12\r\nhello\r\nworld\r\n", "hello\r\nworld", nil},
+		{"empty bulk string", "$0\r\n\r\n", "", nil},
+		{"nil bulk string", "$-1\r\n", nil, nil},
+		{"nil array", "*-1\r\n", nil, nil},
+		{"empty array", "*0\r\n", []any{}, nil},
+		{"array", "*3\r\n$1\r\na\r\n$-1\r\n:1\r\n", []any{"a", nil, int64(1)}, nil},
+		// 配列の中のエラーは要素をnilにして読み進める
+		{"error in array", "*2\r\n-ERR x\r\n+OK\r\n", []any{nil, "OK"}, nil},
+		{"nested array", "*2\r\n$1\r\n0\r\n*2\r\n$1\r\na\r\n$1\r\nb\r\n", []any{"0", []any{"a", "b"}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &redisConn{br: bufio.NewReader(strings.NewReader(tt.reply))}
+			got, err := c.readReply()
+			if !reflect.DeepEqual(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisConnRejectsMalformedReply(t *testing.T) {
+	for _, reply := range []string{
+		"+OK\n",
+		"\r\n",
+		"?what\r\n",
+		":abc\r\n",
+		"$x\r\n",
+		"$5\r\nhel",
+		"$3\r\nabcde\r\n",
+		"*2\r\n+OK\r\n",
+	} {
+		c := &redisConn{br: bufio.NewReader(strings.NewReader(reply))}
+		got, err := c.readReply()
+		var rerr redisError
+		if err == nil || errors.As(err, &rerr) {
+			t.Errorf("%q: got %#v, err = %v, want a protocol error", reply, got, err)
+		}
+	}
+}
+
+// エラー応答を読んだ後も、次の応答を続けて読める
+func TestRedisConnReadsPastErrorReply(t *testing.T) {
+	c := &redisConn{br: bufio.NewReader(strings.NewReader("-ERR first\r\n+second\r\n"))}
+	if _, err := c.readReply(); err != redisError("ERR first") {
+		t.Fatalf("err = %v", err)
+	}
+	if got, err := c.readReply(); err != nil || got != "second" {
+		t.Fatalf("got %#v, err = %v", got, err)
+	}
+}
+
+func TestRedisConnEncodesCommandAsBulkStrings(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		want := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$6\r\na\r\nb c\r\n"
+		buf := make([]byte, len(want))
+		io.ReadFull(server, buf)
+		received <- string(buf)
+		server.Write([]byte("+OK\r\n"))
+	}()
+
+	c := &redisConn{conn: client, br: bufio.NewReader(client), bw: bufio.NewWriter(client)}
+	got, err := c.do([]string{"SET", "key", "a\r\nb c"})
+	if err != nil || got != "OK" {
+		t.Fatalf("got %#v, err = %v", got, err)
+	}
+	if cmd := <-received; cmd != "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$6\r\na\r\nb c\r\n" {
+		t.Fatalf("sent %q", cmd)
+	}
+}
+
+// コマンドの名前で応答を決める偽のRedisサーバー
+func startFakeRedis(t *testing.T, replies map[string]string) (addr string, accepted *atomic.Int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	accepted = &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					args, err := readFakeRedisCommand(br)
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(replies[args[0]]))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), accepted
+}
+
+func readFakeRedisCommand(br *bufio.Reader) ([]string, error) {
+	c := &redisConn{br: br}
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(line, "*"))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		arg, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		args[i] = arg.(string)
+	}
+	return args, nil
+}
+
+func TestRedisClientConnectionReuse(t *testing.T) {
+	addr, accepted := startFakeRedis(t, map[string]string{
+		"PING":    "+PONG\r\n",
+		"BAD":     "-ERR bad command\r\n",
+		"GARBAGE": "!garbage\r\n",
+	})
+	c := newRedisClient(addr, 1, time.Second)
+	ctx := context.Background()
+
+	if got, err := c.Do(ctx, "PING"); err != nil || got != "PONG" {
+		t.Fatalf("got %#v, err = %v", got, err)
+	}
+	// エラー応答は応答として読み切れているので、接続を使い回す
+	if _, err := c.Do(ctx, "BAD"); err != redisError("ERR bad command") {
+		t.Fatalf("err = %v", err)
+	}
+	if got, err := c.Do(ctx, "PING"); err != nil || got != "PONG" {
+		t.Fatalf("got %#v, err = %v", got, err)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Fatalf("dialed %d times, want 1", n)
+	}
+
+	// 読めない応答の後は区切りがわからないので、接続を捨ててつなぎ直す
+	if _, err := c.Do(ctx, "GARBAGE"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got, err := c.Do(ctx, "PING"); err != nil || got != "PONG" {
+		t.Fatalf("got %#v, err = %v", got, err)
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Fatalf("dialed %d times, want 2", n)
+	}
+}
+
+func TestRedisClientTimesOut(t *testing.T) {
+	// 応答を返さないサーバー
+	addr, _ := startFakeRedis(t, map[string]string{})
+	c := newRedisClient(addr, 1, 50*time.Millisecond)
+	start := time.Now()
+	if _, err := c.Do(context.Background(), "PING"); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("took %s", elapsed)
+	}
+}
@@ -0,0 +1,307 @@
+// webapp/go/repository.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// ハンドラのあちこちで使うrides/chairs/ownersなどのクエリをまとめたもの
+// setupでDBを渡して作り、ミドルウェアでリクエストのcontextに入れる。ハンドラはreposFromで取り出す
+// テストでは偽物を入れたcontextでハンドラを呼べる
+// トランザクション(やレプリカ)で読むときはWithで読み先を切り替える
+// 見つからなければsql.ErrNoRowsを返す
+type repositories struct {
+	db       *sqlx.DB
+	Rides    RideRepo
+	Chairs   ChairRepo
+	Owners   OwnerRepo
+	Webhooks OwnerWebhookRepo
+}
+
+func newRepositories(db *sqlx.DB) *repositories {
+	return &repositories{
+		db:       db,
+		Rides:    &sqlRideRepo{q: db},
+		Chairs:   &sqlChairRepo{q: db},
+		Owners:   &sqlOwnerRepo{q: db},
+		Webhooks: &sqlOwnerWebhookRepo{q: db},
+	}
+}
+
+// リポジトリと同じDBでトランザクションを始める
+func (r *repositories) Beginx() (*sqlx.Tx, error) {
+	return r.db.Beginx()
+}
+
+type repositoriesKey struct{}
+
+func withRepositories(ctx context.Context, repos *repositories) context.Context {
+	return context.WithValue(ctx, repositoriesKey{}, repos)
+}
+
+// setupで作ったものをcontextから取り出す。入れ忘れはプログラムの誤りなのでpanicする
+func reposFrom(ctx context.Context) *repositories {
+	repos, ok := ctx.Value(repositoriesKey{}).(*repositories)
+	if !ok {
+		panic("repositories are not set in the context")
+	}
+	return repos
+}
+
+func (r *repositories) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(withRepositories(req.Context(), r)))
+	})
+}
+
+type RideRepo interface {
+	With(q sqlx.ExtContext) RideRepo
+	Get(ctx context.Context, id string) (*Ride, error)
+	GetByUser(ctx context.Context, id, userID string) (*Ride, error)
+	// 同じライドを更新する処理を直列化するために行をロックして読む
+	GetForUpdate(ctx context.Context, id string) (*Ride, error)
+	LatestByUser(ctx context.Context, userID string) (*Ride, error)
+	LatestByChair(ctx context.Context, chairID string) (*Ride, error)
+}
+
+type ChairRepo interface {
+	With(q sqlx.ExtContext) ChairRepo
+	Get(ctx context.Context, id string) (*Chair, error)
+	GetByAccessToken(ctx context.Context, accessToken string) (*Chair, error)
+	ListByOwner(ctx context.Context, ownerID string) ([]Chair, error)
+	Create(ctx context.Context, chair *Chair) error
+	SetActive(ctx context.Context, id string, active bool) error
+}
+
+type OwnerRepo interface {
+	With(q sqlx.ExtContext) OwnerRepo
+	GetByAccessToken(ctx context.Context, accessToken string) (*Owner, error)
+	GetByChairRegisterToken(ctx context.Context, token string) (*Owner, error)
+}
+
+// オーナーのWebhookと、送るイベント(owner_webhook_deliveries)
+type OwnerWebhookRepo interface {
+	With(q sqlx.ExtContext) OwnerWebhookRepo
+	Create(ctx context.Context, webhook *OwnerWebhook) error
+	// Webhookとまだ送っていないイベントを消す。オーナーのWebhookがなければfalseを返す
+	Delete(ctx context.Context, ownerID, webhookID string) (bool, error)
+	// Webhookを登録しているオーナー
+	OwnerIDs(ctx context.Context) ([]string, error)
+	// オーナーのWebhookすべてにイベントを積む。dedupKeyが同じイベントは1回しか積まない
+	Enqueue(ctx context.Context, ownerID, event, dedupKey string, payload any) error
+	// 送る時刻になったイベントを古い順にlimit件
+	DueDeliveries(ctx context.Context, now time.Time, limit int) ([]webhookDelivery, error)
+	// 送る時刻がnow以前のイベントの次に送る時刻をuntilに延ばす。他が先に延ばしていたらfalseを返す
+	Lease(ctx context.Context, id string, now, until time.Time) (bool, error)
+	MarkDelivered(ctx context.Context, id string) error
+	MarkRetry(ctx context.Context, id string, attempts int, lastError string, nextAttemptAt time.Time) error
+	MarkFailed(ctx context.Context, id string, attempts int, lastError string) error
+}
+
+type sqlRideRepo struct {
+	q sqlx.ExtContext
+}
+
+func (r *sqlRideRepo) With(q sqlx.ExtContext) RideRepo {
+	return &sqlRideRepo{q: q}
+}
+
+func (r *sqlRideRepo) get(ctx context.Context, query string, args ...any) (*Ride, error) {
+	ride := &Ride{}
+	if err := sqlx.GetContext(ctx, r.q, ride, query, args...); err != nil {
+		return nil, err
+	}
+	return ride, nil
+}
+
+func (r *sqlRideRepo) Get(ctx context.Context, id string) (*Ride, error) {
+	return r.get(ctx, `SELECT * FROM rides WHERE id = ?`, id)
+}
+
+func (r *sqlRideRepo) GetByUser(ctx context.Context, id, userID string) (*Ride, error) {
+	return r.get(ctx, `SELECT * FROM rides WHERE id = ? AND user_id = ?`, id, userID)
+}
+
+func (r *sqlRideRepo) GetForUpdate(ctx context.Context, id string) (*Ride, error) {
+	return r.get(ctx, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, id)
+}
+
+func (r *sqlRideRepo) LatestByUser(ctx context.Context, userID string) (*Ride, error) {
+	return r.get(ctx, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, userID)
+}
+
+func (r *sqlRideRepo) LatestByChair(ctx context.Context, chairID string) (*Ride, error) {
+	return r.get(ctx, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chairID)
+}
+
+type sqlChairRepo struct {
+	q sqlx.ExtContext
+}
+
+func (r *sqlChairRepo) With(q sqlx.ExtContext) ChairRepo {
+	return &sqlChairRepo{q: q}
+}
+
+func (r *sqlChairRepo) get(ctx context.Context, query string, args ...any) (*Chair, error) {
+	chair := &Chair{}
+	if err := sqlx.GetContext(ctx, r.q, chair, query, args...); err != nil {
+		return nil, err
+	}
+	return chair, nil
+}
+
+func (r *sqlChairRepo) Get(ctx context.Context, id string) (*Chair, error) {
+	return r.get(ctx, `SELECT * FROM chairs WHERE id = ?`, id)
+}
+
+func (r *sqlChairRepo) GetByAccessToken(ctx context.Context, accessToken string) (*Chair, error) {
+	return r.get(ctx, `SELECT * FROM chairs WHERE access_token = ?`, accessToken)
+}
+
+func (r *sqlChairRepo) ListByOwner(ctx context.Context, ownerID string) ([]Chair, error) {
+	chairs := []Chair{}
+	if err := sqlx.SelectContext(ctx, r.q, &chairs, `SELECT * FROM chairs WHERE owner_id = ?`, ownerID); err != nil {
+		return nil, err
+	}
+	return chairs, nil
+}
+
+func (r *sqlChairRepo) Create(ctx context.Context, chair *Chair) error {
+	_, err := r.q.ExecContext(
+		ctx,
+		"INSERT INTO chairs (id, owner_id, name, model, is_active, app_version, access_token) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		chair.ID, chair.OwnerID, chair.Name, chair.Model, chair.IsActive, chair.AppVersion, chair.AccessToken,
+	)
+	return err
+}
+
+func (r *sqlChairRepo) SetActive(ctx context.Context, id string, active bool) error {
+	_, err := r.q.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", active, id)
+	return err
+}
+
+type sqlOwnerRepo struct {
+	q sqlx.ExtContext
+}
+
+func (r *sqlOwnerRepo) With(q sqlx.ExtContext) OwnerRepo {
+	return &sqlOwnerRepo{q: q}
+}
+
+func (r *sqlOwnerRepo) get(ctx context.Context, query string, args ...any) (*Owner, error) {
+	owner := &Owner{}
+	if err := sqlx.GetContext(ctx, r.q, owner, query, args...); err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+// 発行し直す前のトークンも期限までは受け付ける
+func (r *sqlOwnerRepo) GetByAccessToken(ctx context.Context, accessToken string) (*Owner, error) {
+	return r.get(ctx, `SELECT * FROM owners WHERE access_token = ? OR (previous_access_token = ? AND previous_tokens_expire_at > NOW(6))`, accessToken, accessToken)
+}
+
+func (r *sqlOwnerRepo) GetByChairRegisterToken(ctx context.Context, token string) (*Owner, error) {
+	return r.get(ctx, `SELECT * FROM owners WHERE chair_register_token = ? OR (previous_chair_register_token = ? AND previous_tokens_expire_at > NOW(6))`, token, token)
+}
+
+type sqlOwnerWebhookRepo struct {
+	q sqlx.ExtContext
+}
+
+func (r *sqlOwnerWebhookRepo) With(q sqlx.ExtContext) OwnerWebhookRepo {
+	return &sqlOwnerWebhookRepo{q: q}
+}
+
+func (r *sqlOwnerWebhookRepo) Create(ctx context.Context, webhook *OwnerWebhook) error {
+	_, err := sqlx.NamedExecContext(ctx, r.q, `INSERT INTO owner_webhooks (id, owner_id, url, secret) VALUES (:id, :owner_id, :url, :secret)`, webhook)
+	return err
+}
+
+func (r *sqlOwnerWebhookRepo) Delete(ctx context.Context, ownerID, webhookID string) (bool, error) {
+	result, err := r.q.ExecContext(ctx, `DELETE FROM owner_webhooks WHERE id = ? AND owner_id = ?`, webhookID, ownerID)
+	if err != nil {
+		return false, err
+	}
+	if count, err := result.RowsAffected(); err != nil || count == 0 {
+		return false, err
+	}
+	if _, err := r.q.ExecContext(ctx, `DELETE FROM owner_webhook_deliveries WHERE webhook_id = ?`, webhookID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *sqlOwnerWebhookRepo) OwnerIDs(ctx context.Context) ([]string, error) {
+	ownerIDs := []string{}
+	if err := sqlx.SelectContext(ctx, r.q, &ownerIDs, `SELECT DISTINCT owner_id FROM owner_webhooks`); err != nil {
+		return nil, err
+	}
+	return ownerIDs, nil
+}
+
+func (r *sqlOwnerWebhookRepo) Enqueue(ctx context.Context, ownerID, event, dedupKey string, payload any) error {
+	webhookIDs := []string{}
+	if err := sqlx.SelectContext(ctx, r.q, &webhookIDs, `SELECT id FROM owner_webhooks WHERE owner_id = ?`, ownerID); err != nil {
+		return err
+	}
+	if len(webhookIDs) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for _, webhookID := range webhookIDs {
+		if _, err := r.q.ExecContext(
+			ctx,
+			`INSERT IGNORE INTO owner_webhook_deliveries (id, webhook_id, event, dedup_key, payload, next_attempt_at) VALUES (?, ?, ?, ?, ?, NOW(6))`,
+			ulid.Make().String(), webhookID, event, dedupKey, b,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sqlOwnerWebhookRepo) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]webhookDelivery, error) {
+	deliveries := []webhookDelivery{}
+	if err := sqlx.SelectContext(ctx, r.q, &deliveries, `SELECT d.id, d.event, d.payload, d.attempts, d.created_at, w.url, w.secret
+FROM owner_webhook_deliveries d JOIN owner_webhooks w ON w.id = d.webhook_id
+WHERE d.delivered_at IS NULL AND d.failed_at IS NULL AND d.next_attempt_at <= ?
+ORDER BY d.next_attempt_at
+LIMIT ?`, now, limit); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (r *sqlOwnerWebhookRepo) Lease(ctx context.Context, id string, now, until time.Time) (bool, error) {
+	result, err := r.q.ExecContext(ctx, `UPDATE owner_webhook_deliveries SET next_attempt_at = ? WHERE id = ? AND next_attempt_at <= ?`, until, id, now)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+func (r *sqlOwnerWebhookRepo) MarkDelivered(ctx context.Context, id string) error {
+	_, err := r.q.ExecContext(ctx, `UPDATE owner_webhook_deliveries SET delivered_at = NOW(6) WHERE id = ?`, id)
+	return err
+}
+
+func (r *sqlOwnerWebhookRepo) MarkRetry(ctx context.Context, id string, attempts int, lastError string, nextAttemptAt time.Time) error {
+	_, err := r.q.ExecContext(ctx, `UPDATE owner_webhook_deliveries SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?`, attempts, lastError, nextAttemptAt, id)
+	return err
+}
+
+func (r *sqlOwnerWebhookRepo) MarkFailed(ctx context.Context, id string, attempts int, lastError string) error {
+	_, err := r.q.ExecContext(ctx, `UPDATE owner_webhook_deliveries SET attempts = ?, last_error = ?, failed_at = NOW(6) WHERE id = ?`, attempts, lastError, id)
+	return err
+}
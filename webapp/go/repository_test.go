@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestChairRepoScansColumnsByName(t *testing.T) {
+	mock := setupMockDB(t)
+	mock.ExpectQuery(`SELECT \* FROM chairs WHERE access_token = \?`).
+		WithArgs("token").
+		WillReturnRows(sqlmock.NewRows([]string{"access_token", "total_distance", "model", "owner_id", "id", "name", "is_active"}).
+			AddRow("token", 42, "model-a", "owner-1", "chair-1", "chair-name", true))
+
+	chair, err := (&sqlChairRepo{q: db}).GetByAccessToken(context.Background(), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chair.ID != "chair-1" || chair.OwnerID != "owner-1" || chair.Name != "chair-name" || chair.Model != "model-a" || !chair.IsActive || chair.TotalDistance != 42 {
+		t.Errorf("chair = %+v", chair)
+	}
+}
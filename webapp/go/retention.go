@@ -0,0 +1,137 @@
+// webapp/go/retention.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 保持期間を過ぎた終了済みライドのステータスをアーカイブテーブルに移し、ホットなテーブルを小さく保つ
+// 集計(椅子の統計・売上・履歴)に使うCARRYING/ARRIVED/COMPLETEDは残し、それ以外のステータスだけを移す
+// archiveRidesが有効ならライドと全ステータスを移す。椅子の統計は評価時にchair_statsへ足し込み済みで、
+// 売上・稼働率・アプリのライド履歴・決済の突き合わせはrides_archiveも合わせて読む
+// それ以外のライドごとのAPI(ライドの詳細・領収書・キャンセルなど)からは、移したライドは見つからなくなる
+type retentionSweeper struct {
+	retention    time.Duration
+	interval     time.Duration
+	batchSize    int
+	archiveRides bool
+}
+
+func newRetentionSweeper() *retentionSweeper {
+	return &retentionSweeper{
+		retention:    time.Duration(getEnvInt("ISUCON_RETENTION_DAYS", 0)) * 24 * time.Hour,
+		interval:     getEnvDuration("ISUCON_RETENTION_INTERVAL", time.Hour),
+		batchSize:    getEnvInt("ISUCON_RETENTION_BATCH_SIZE", 1000),
+		archiveRides: getEnvBool("ISUCON_RETENTION_ARCHIVE_RIDES", false),
+	}
+}
+
+func (s *retentionSweeper) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			n, err := s.sweep(ctx, time.Now().Add(-s.retention))
+			if err != nil {
+				slog.Error("failed to sweep rides", "error", err)
+				break
+			}
+			if n < s.batchSize {
+				break
+			}
+		}
+	}
+}
+
+// cutoffより前に更新された終了済みライドを1バッチ分移し、対象にしたライドの数を返す
+// 終了済みは、COMPLETEDを持ち、すべてのステータスがアプリと椅子の両方に通知済みのもの
+func (s *retentionSweeper) sweep(ctx context.Context, cutoff time.Time) (int, error) {
+	query := `SELECT id FROM rides
+WHERE updated_at < ?
+  AND rides.latest_status = 'COMPLETED'
+  AND NOT EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = rides.id AND (rs.app_sent_at IS NULL OR rs.chair_sent_at IS NULL))`
+	if !s.archiveRides {
+		query += `
+  AND EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = rides.id AND rs.status NOT IN ('CARRYING', 'ARRIVED', 'COMPLETED'))`
+	}
+	query += `
+ORDER BY updated_at
+LIMIT ?`
+
+	rideIDs := []string{}
+	if err := db.SelectContext(ctx, &rideIDs, query, cutoff, s.batchSize); err != nil {
+		return 0, err
+	}
+	if len(rideIDs) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if s.archiveRides {
+		if err := archiveRides(ctx, tx, rideIDs); err != nil {
+			return 0, err
+		}
+	} else {
+		if err := archiveRideStatuses(ctx, tx, rideIDs, " AND status NOT IN ('CARRYING', 'ARRIVED', 'COMPLETED')"); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if s.archiveRides {
+		rideStatusCache.Delete(rideIDs...)
+	}
+	return len(rideIDs), nil
+}
+
+func archiveRideStatuses(ctx context.Context, tx *sqlx.Tx, rideIDs []string, cond string) error {
+	for _, q := range []string{
+		"INSERT INTO ride_statuses_archive SELECT * FROM ride_statuses WHERE ride_id IN (?)" + cond,
+		"DELETE FROM ride_statuses WHERE ride_id IN (?)" + cond,
+	} {
+		query, args, err := sqlx.In(q, rideIDs)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func archiveRides(ctx context.Context, tx *sqlx.Tx, rideIDs []string) error {
+	if err := archiveRideStatuses(ctx, tx, rideIDs, ""); err != nil {
+		return err
+	}
+
+	for _, q := range []string{
+		"INSERT INTO rides_archive SELECT * FROM rides WHERE id IN (?)",
+		"DELETE FROM rides WHERE id IN (?)",
+	} {
+		query, args, err := sqlx.In(q, rideIDs)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
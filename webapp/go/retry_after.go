@@ -0,0 +1,56 @@
+// webapp/go/retry_after.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 通知のポーリング間隔を負荷に合わせて伸ばす
+// 待っているライドが空いている椅子より多いときや、処理中のリクエストが多いときは、早く聞き直しても結果は変わらないので間隔を空けさせる
+// DBを数えずにメモリ上の件数から出し、retryAfterCacheTTLの間は同じ値を使い回す
+var (
+	notificationRetryMin = getEnvDuration("ISUCON_NOTIFICATION_RETRY_MIN", 30*time.Millisecond)
+	notificationRetryMax = getEnvDuration("ISUCON_NOTIFICATION_RETRY_MAX", time.Second)
+)
+
+const retryAfterCacheTTL = 100 * time.Millisecond
+
+var retryAfter struct {
+	mu         sync.Mutex
+	value      int
+	computedAt time.Time
+}
+
+func calculateRetryAfterMs() int {
+	retryAfter.mu.Lock()
+	defer retryAfter.mu.Unlock()
+	now := time.Now()
+	if now.Sub(retryAfter.computedAt) < retryAfterCacheTTL {
+		return retryAfter.value
+	}
+
+	factor := 1.0
+	// 空いている椅子1台あたりの待っているライドの数だけ伸ばす
+	if backlog := pendingRides.Len(); backlog > 0 {
+		factor += float64(backlog) / float64(chairAvailability.AvailableCount()+1)
+	}
+	// 処理中のリクエストが過負荷の閾値に近づくほど伸ばす
+	if admission.maxInflight > 0 {
+		factor *= 1 + float64(admission.inflight.Load())/float64(admission.maxInflight)
+	}
+	ms := math.Min(float64(notificationRetryMin.Milliseconds())*factor, float64(notificationRetryMax.Milliseconds()))
+
+	retryAfter.value = int(ms)
+	retryAfter.computedAt = now
+	return retryAfter.value
+}
+
+// 秒単位のRetry-Afterと、ミリ秒単位のX-Retry-After-Msを付ける
+func setRetryAfter(w http.ResponseWriter, retryAfterMs int) {
+	w.Header().Set("Retry-After", strconv.Itoa((retryAfterMs+999)/1000))
+	w.Header().Set("X-Retry-After-Ms", strconv.Itoa(retryAfterMs))
+}
@@ -0,0 +1,78 @@
+// webapp/go/ride_cancel.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// ライドのキャンセル。乗せる前(MATCHING/ENROUTE/PICKUP)ならユーザーからも割り当てられた椅子からもできる
+// CANCELEDは終了状態なので決済はしない。椅子はCANCELEDを通知できたら次のライドを割り当てられるようになる
+// ライドを作ったときに紐づけたクーポンは使われなかったので、次のライドで使えるように戻す
+var errRideNotOwned = errors.New("not your ride")
+
+func cancelRide(ctx context.Context, rideID string, owns func(ride *Ride) bool) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer rollbackTx(tx)
+
+	ride, err := reposFrom(ctx).Rides.With(tx).GetForUpdate(ctx, rideID)
+	if err != nil {
+		return err
+	}
+	if !owns(ride) {
+		return errRideNotOwned
+	}
+	if err := updateRideStatus(ctx, tx, ride.ID, "CANCELED"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE coupons SET used_by = NULL WHERE used_by = ?`, ride.ID); err != nil {
+		return err
+	}
+	if err := commitTx(tx); err != nil {
+		return err
+	}
+
+	// まだ割り当てられていなければ待ち行列から外す。予約中の椅子への割り当てはMATCHINGでないので失敗する
+	pendingRides.Remove(ride.ID)
+	return nil
+}
+
+func writeCancelRideError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, errRideNotOwned):
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+	case errors.Is(err, errInvalidStatusTransition):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func appPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+
+	if err := cancelRide(ctx, rideID, func(ride *Ride) bool { return ride.UserID == user.ID }); err != nil {
+		writeCancelRideError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func chairPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	chair := ctx.Value("chair").(*Chair)
+
+	if err := cancelRide(ctx, rideID, func(ride *Ride) bool { return ride.ChairID.String == chair.ID }); err != nil {
+		writeCancelRideError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,177 @@
+// webapp/go/ride_event_log.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// ライドの作成・割り当て・各ステータス・決済結果をすべて記録し、後から1件のライドの経過を再現できるようにする
+// 書き込みが増えるのでISUCON_RIDE_EVENT_LOGで有効にしたときだけ記録する
+var rideEventLogEnabled = getEnvBool("ISUCON_RIDE_EVENT_LOG", false)
+
+const (
+	rideEventCreated        = "CREATED"
+	rideEventAssigned       = "ASSIGNED"
+	rideEventUnassigned     = "UNASSIGNED"
+	rideEventStatus         = "STATUS"
+	rideEventPaymentSucceed = "PAYMENT_SUCCEEDED"
+	rideEventPaymentFailed  = "PAYMENT_FAILED"
+)
+
+type RideLifecycleEvent struct {
+	ID        string          `db:"id" json:"id"`
+	RideID    string          `db:"ride_id" json:"ride_id"`
+	Event     string          `db:"event" json:"event"`
+	Payload   json.RawMessage `db:"payload" json:"payload"`
+	CreatedAt time.Time       `db:"created_at" json:"-"`
+}
+
+type rideCreatedPayload struct {
+	UserID      string       `json:"user_id"`
+	Pickup      Coordinate   `json:"pickup_coordinate"`
+	Destination Coordinate   `json:"destination_coordinate"`
+	Waypoints   []Coordinate `json:"waypoints,omitempty"`
+}
+
+type rideAssignedPayload struct {
+	ChairID     string `json:"chair_id"`
+	PickupETAMs int64  `json:"pickup_eta_ms"`
+}
+
+type rideUnassignedPayload struct {
+	ChairID string `json:"chair_id"`
+	Reason  string `json:"reason"`
+}
+
+type rideStatusPayload struct {
+	Status string `json:"status"`
+}
+
+type ridePaymentPayload struct {
+	Amount     int    `json:"amount"`
+	Tip        int    `json:"tip,omitempty"`
+	Evaluation int    `json:"evaluation,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// 記録はイベントを起こした処理と同じトランザクションで行う
+func logRideEvent(ctx context.Context, q sqlx.ExecerContext, rideID, event string, payload any) error {
+	if !rideEventLogEnabled {
+		return nil
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, "INSERT INTO ride_event_log (id, ride_id, event, payload) VALUES (?, ?, ?, ?)", ulid.Make().String(), rideID, event, b)
+	return err
+}
+
+type replayedRideStatus struct {
+	Status string `json:"status"`
+	At     int64  `json:"at"`
+}
+
+type replayedRide struct {
+	RideID        string               `json:"ride_id"`
+	UserID        string               `json:"user_id"`
+	Pickup        Coordinate           `json:"pickup_coordinate"`
+	Destination   Coordinate           `json:"destination_coordinate"`
+	ChairID       string               `json:"chair_id,omitempty"`
+	Status        string               `json:"status"`
+	Statuses      []replayedRideStatus `json:"statuses"`
+	PaidAmount    *int                 `json:"paid_amount,omitempty"`
+	Evaluation    *int                 `json:"evaluation,omitempty"`
+	PaymentErrors []string             `json:"payment_errors,omitempty"`
+}
+
+// イベントを順に適用してライドの状態を組み立て直す
+func replayRideEvents(rideID string, events []RideLifecycleEvent) (*replayedRide, error) {
+	ride := &replayedRide{RideID: rideID, Statuses: []replayedRideStatus{}}
+	for _, e := range events {
+		switch e.Event {
+		case rideEventCreated:
+			p := rideCreatedPayload{}
+			if err := json.Unmarshal(e.Payload, &p); err != nil {
+				return nil, err
+			}
+			ride.UserID = p.UserID
+			ride.Pickup = p.Pickup
+			ride.Destination = p.Destination
+		case rideEventAssigned:
+			p := rideAssignedPayload{}
+			if err := json.Unmarshal(e.Payload, &p); err != nil {
+				return nil, err
+			}
+			ride.ChairID = p.ChairID
+		case rideEventUnassigned:
+			ride.ChairID = ""
+		case rideEventStatus:
+			p := rideStatusPayload{}
+			if err := json.Unmarshal(e.Payload, &p); err != nil {
+				return nil, err
+			}
+			ride.Status = p.Status
+			ride.Statuses = append(ride.Statuses, replayedRideStatus{Status: p.Status, At: e.CreatedAt.UnixMilli()})
+		case rideEventPaymentSucceed:
+			p := ridePaymentPayload{}
+			if err := json.Unmarshal(e.Payload, &p); err != nil {
+				return nil, err
+			}
+			ride.PaidAmount = &p.Amount
+			ride.Evaluation = &p.Evaluation
+		case rideEventPaymentFailed:
+			p := ridePaymentPayload{}
+			if err := json.Unmarshal(e.Payload, &p); err != nil {
+				return nil, err
+			}
+			ride.PaymentErrors = append(ride.PaymentErrors, p.Error)
+		}
+	}
+	return ride, nil
+}
+
+type internalGetRideEventsResponseEvent struct {
+	RideLifecycleEvent
+	At int64 `json:"at"`
+}
+
+type internalGetRideEventsResponse struct {
+	Events []internalGetRideEventsResponseEvent `json:"events"`
+	Ride   *replayedRide                        `json:"ride"`
+}
+
+// ライドのイベント列と、それを再生して得た状態を返す
+func internalGetRideEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	events := []RideLifecycleEvent{}
+	if err := db.SelectContext(ctx, &events, "SELECT * FROM ride_event_log WHERE ride_id = ? ORDER BY id", rideID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(events) == 0 {
+		writeError(w, http.StatusNotFound, errors.New("no events recorded for the ride"))
+		return
+	}
+
+	ride, err := replayRideEvents(rideID, events)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &internalGetRideEventsResponse{Ride: ride}
+	for _, e := range events {
+		res.Events = append(res.Events, internalGetRideEventsResponseEvent{RideLifecycleEvent: e, At: e.CreatedAt.UnixMilli()})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
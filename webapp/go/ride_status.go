@@ -0,0 +1,262 @@
+// webapp/go/ride_status.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// ride_statusesへのINSERTを短時間バッファリングしてまとめて書き込む
+// 有効時は最新ステータスをrideStatusCacheで同期的に管理し、DBへの反映は最大flushInterval遅れる
+// 行は呼び出し元のトランザクションがコミットしてから積むので、ロールバックしたステータスは書き込まれない
+// 書き込みに失敗した行は次のflushで書き直し、maxAttempts回失敗したら捨てて数える
+type rideStatusRow struct {
+	ID        string    `db:"id"`
+	RideID    string    `db:"ride_id"`
+	Status    string    `db:"status"`
+	CreatedAt time.Time `db:"created_at"`
+	attempts  int
+}
+
+type rideStatusBatchWriter struct {
+	mu            sync.Mutex
+	buf           []rideStatusRow
+	flushInterval time.Duration
+	maxBatchSize  int
+	maxAttempts   int
+	kick          chan struct{}
+
+	// スループットを/api/internal/statsで見るための集計
+	flushedRows  atomic.Int64
+	retriedRows  atomic.Int64
+	droppedRows  atomic.Int64
+	flushElapsed atomic.Int64 // ナノ秒
+	batchLatency *latencyWindow
+}
+
+// nilならバッファリングせずに都度INSERTする
+var rideStatusWriter *rideStatusBatchWriter
+
+func newRideStatusBatchWriter(flushInterval time.Duration, maxBatchSize, maxAttempts int) *rideStatusBatchWriter {
+	return &rideStatusBatchWriter{
+		flushInterval: flushInterval,
+		maxBatchSize:  maxBatchSize,
+		maxAttempts:   maxAttempts,
+		kick:          make(chan struct{}, 1),
+		batchLatency:  newLatencyWindow(getEnvInt("ISUCON_METRICS_WINDOW_SIZE", 4096)),
+	}
+}
+
+func (w *rideStatusBatchWriter) enqueue(rows ...rideStatusRow) {
+	w.mu.Lock()
+	w.buf = append(w.buf, rows...)
+	full := len(w.buf) >= w.maxBatchSize
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 初期化時などにまだ書き込んでいない行を捨てる
+func (w *rideStatusBatchWriter) discard() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = nil
+}
+
+func (w *rideStatusBatchWriter) run(ctx context.Context) {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			w.flush(context.Background())
+			return
+		case <-ticker.C:
+		case <-w.kick:
+		}
+		w.flush(ctx)
+	}
+}
+
+func (w *rideStatusBatchWriter) flush(ctx context.Context) {
+	w.mu.Lock()
+	rows := w.buf
+	w.buf = nil
+	w.mu.Unlock()
+	if len(rows) == 0 {
+		return
+	}
+
+	start := time.Now()
+	flushed := 0
+	retry := []rideStatusRow{}
+	for len(rows) > 0 {
+		n := min(len(rows), w.maxBatchSize)
+		batch := rows[:n]
+		rows = rows[n:]
+
+		batchStart := time.Now()
+		// 書き直す行は前回の書き込みが実は反映されていたことがある。同じ文の新しい行まで巻き込んで
+		// 失敗させないように、既にある行は読み飛ばす
+		_, err := db.NamedExecContext(ctx, `INSERT INTO ride_statuses (id, ride_id, status, created_at) VALUES (:id, :ride_id, :status, :created_at) ON DUPLICATE KEY UPDATE id = id`, batch)
+		if err == nil {
+			w.batchLatency.Add(time.Since(batchStart))
+			flushed += n
+			continue
+		}
+		slog.Error("failed to flush ride statuses", "error", err, "rows", n)
+		for _, row := range batch {
+			row.attempts++
+			if row.attempts >= w.maxAttempts {
+				w.droppedRows.Add(1)
+				slog.Error("dropped ride status", "ride_id", row.RideID, "status", row.Status, "attempts", row.attempts)
+				continue
+			}
+			retry = append(retry, row)
+		}
+	}
+	w.flushedRows.Add(int64(flushed))
+	w.flushElapsed.Add(int64(time.Since(start)))
+	if len(retry) > 0 {
+		w.retriedRows.Add(int64(len(retry)))
+		// 後から積まれた行より先に書く
+		w.mu.Lock()
+		w.buf = append(retry, w.buf...)
+		w.mu.Unlock()
+	}
+	slog.Debug("ride statuses flushed", "rows", flushed, "retry", len(retry), "elapsed", time.Since(start))
+}
+
+type rideStatusWriterStats struct {
+	Pending     int   `json:"pending"`
+	FlushedRows int64 `json:"flushed_rows"`
+	RetriedRows int64 `json:"retried_rows"`
+	DroppedRows int64 `json:"dropped_rows"`
+	// 書き込みにかかった時間あたりの行数
+	RowsPerSec float64        `json:"rows_per_sec"`
+	Batch      latencySummary `json:"batch"`
+}
+
+func (w *rideStatusBatchWriter) Stats() rideStatusWriterStats {
+	w.mu.Lock()
+	pending := len(w.buf)
+	w.mu.Unlock()
+	stats := rideStatusWriterStats{
+		Pending:     pending,
+		FlushedRows: w.flushedRows.Load(),
+		RetriedRows: w.retriedRows.Load(),
+		DroppedRows: w.droppedRows.Load(),
+		Batch:       w.batchLatency.Summary(),
+	}
+	if elapsed := time.Duration(w.flushElapsed.Load()); elapsed > 0 {
+		stats.RowsPerSec = float64(stats.FlushedRows) / elapsed.Seconds()
+	}
+	return stats
+}
+
+// これ以上遷移しないステータスか
+func isTerminalRideStatus(status string) bool {
+	return status == "COMPLETED" || status == "CANCELED"
+}
+
+// ステータスの遷移先として許されるもの
+// 椅子が応答しなくなったライドはMATCHING/ENROUTEからマッチングをやり直す
+// キャンセルできるのは乗せる前まで
+var rideStatusTransitions = map[string][]string{
+	"":         {"MATCHING"},
+	"MATCHING": {"ENROUTE", "MATCHING", "CANCELED"},
+	"ENROUTE":  {"PICKUP", "MATCHING", "CANCELED"},
+	"PICKUP":   {"CARRYING", "CANCELED"},
+	"CARRYING": {"ARRIVED"},
+	"ARRIVED":  {"COMPLETED"},
+}
+
+func isValidStatusTransition(from, to string) bool {
+	for _, next := range rideStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+var errInvalidStatusTransition = newAPIError(errCodeInvalidStatusTransition, errors.New("invalid ride status transition"))
+
+// ライドのステータスを追加する。呼び出し元のトランザクションの中で使い、commitTxでコミットする
+// ライドの行をロックしてから今のステータスを読むので、同じライドを並行して進めようとしても
+// 遷移できるのは1つだけで、残りはerrInvalidStatusTransitionになる
+func updateRideStatus(ctx context.Context, tx *sqlx.Tx, rideID, status string) error {
+	target := struct {
+		UserID           string         `db:"user_id"`
+		ChairID          sql.NullString `db:"chair_id"`
+		LatestStatus     sql.NullString `db:"latest_status"`
+		PickupPin        sql.NullString `db:"pickup_pin"`
+		PickupVerifiedAt sql.NullTime   `db:"pickup_verified_at"`
+	}{}
+	if err := tx.GetContext(ctx, &target, `SELECT user_id, chair_id, latest_status, pickup_pin, pickup_verified_at FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+		return err
+	}
+	if !isValidStatusTransition(target.LatestStatus.String, status) {
+		return errInvalidStatusTransition
+	}
+	if err := checkPickupVerified(status, target.PickupPin, target.PickupVerifiedAt); err != nil {
+		return err
+	}
+
+	if err := logRideEvent(ctx, tx, rideID, rideEventStatus, rideStatusPayload{Status: status}); err != nil {
+		return err
+	}
+	// メモリ上の状態とSSEで待っているユーザー・椅子への通知は、コミットしてから更新する
+	// ロールバックしたら何も変わらないので、リトライしても元のステータスから進め直せる
+	enrouteAt := time.Now()
+	afterCommit(tx, func() {
+		rideStatusCache.Store(rideID, status)
+		chairAvailability.OnRideStatus(rideID, status)
+		if status == "ENROUTE" {
+			matchLatency.Enroute(rideID, enrouteAt)
+		}
+		notifications.Publish(userNotificationKey(target.UserID), rideID, target.ChairID.String, status)
+		if target.ChairID.Valid {
+			notifications.Publish(chairNotificationKey(target.ChairID.String), rideID, target.ChairID.String, status)
+		}
+	})
+	// updated_atはライドの割り当てと完了の日時なので、ステータスの更新では変えない
+	// 終了したら椅子を次のライドに割り当てられるようにする
+	if isTerminalRideStatus(status) {
+		if _, err := tx.ExecContext(ctx, `UPDATE rides SET latest_status = ?, active_chair_id = NULL, updated_at = updated_at WHERE id = ?`, status, rideID); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, `UPDATE rides SET latest_status = ?, updated_at = updated_at WHERE id = ?`, status, rideID); err != nil {
+			return err
+		}
+	}
+	if rideStatusWriter != nil {
+		row := rideStatusRow{
+			ID:        ulid.Make().String(),
+			RideID:    rideID,
+			Status:    status,
+			CreatedAt: time.Now(),
+		}
+		afterCommit(tx, func() { rideStatusWriter.enqueue(row) })
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`, ulid.Make().String(), rideID, status); err != nil {
+		return err
+	}
+	return nil
+}
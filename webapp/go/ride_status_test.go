@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestRideStatusBatchWriterRetriesFailedFlush(t *testing.T) {
+	mock := setupMockDB(t)
+	w := newRideStatusBatchWriter(time.Second, 10, 2)
+	w.enqueue(
+		rideStatusRow{ID: "s1", RideID: "r1", Status: "MATCHING", CreatedAt: time.Now()},
+		rideStatusRow{ID: "s2", RideID: "r1", Status: "ENROUTE", CreatedAt: time.Now()},
+	)
+
+	mock.ExpectExec(`INSERT INTO ride_statuses`).WillReturnError(errors.New("connection reset"))
+	w.flush(context.Background())
+	if stats := w.Stats(); stats.Pending != 2 || stats.RetriedRows != 2 || stats.FlushedRows != 0 {
+		t.Fatalf("stats after failure = %+v", stats)
+	}
+
+	// 書き直す行は後から積まれた行より先に書く
+	w.enqueue(rideStatusRow{ID: "s3", RideID: "r1", Status: "PICKUP", CreatedAt: time.Now()})
+	mock.ExpectExec(`INSERT INTO ride_statuses`).
+		WithArgs("s1", "r1", "MATCHING", sqlmock.AnyArg(), "s2", "r1", "ENROUTE", sqlmock.AnyArg(), "s3", "r1", "PICKUP", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	w.flush(context.Background())
+	if stats := w.Stats(); stats.Pending != 0 || stats.FlushedRows != 3 || stats.DroppedRows != 0 {
+		t.Fatalf("stats after retry = %+v", stats)
+	}
+}
+
+func TestRideStatusBatchWriterDropsAfterMaxAttempts(t *testing.T) {
+	mock := setupMockDB(t)
+	w := newRideStatusBatchWriter(time.Second, 10, 2)
+	w.enqueue(rideStatusRow{ID: "s1", RideID: "r1", Status: "MATCHING", CreatedAt: time.Now()})
+
+	mock.ExpectExec(`INSERT INTO ride_statuses`).WillReturnError(errors.New("connection reset"))
+	mock.ExpectExec(`INSERT INTO ride_statuses`).WillReturnError(errors.New("connection reset"))
+	w.flush(context.Background())
+	w.flush(context.Background())
+	if stats := w.Stats(); stats.Pending != 0 || stats.DroppedRows != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+// 前回実は書けていた行を書き直すときも、同じ文で送る新しい行は失われない
+func TestRideStatusBatchWriterRetriesWrittenRowWithNewRows(t *testing.T) {
+	mock := setupMockDB(t)
+	w := newRideStatusBatchWriter(time.Second, 10, 3)
+	w.enqueue(rideStatusRow{ID: "s1", RideID: "r1", Status: "MATCHING", CreatedAt: time.Now()})
+
+	// s1は書けたが応答が返らなかった
+	mock.ExpectExec(`INSERT INTO ride_statuses`).WillReturnError(errors.New("connection reset"))
+	w.flush(context.Background())
+
+	w.enqueue(rideStatusRow{ID: "s2", RideID: "r2", Status: "MATCHING", CreatedAt: time.Now()})
+	mock.ExpectExec(`INSERT INTO ride_statuses \(id, ride_id, status, created_at\) VALUES \(\?, \?, \?, \?\),\(\?, \?, \?, \?\) ON DUPLICATE KEY UPDATE id = id`).
+		WithArgs("s1", "r1", "MATCHING", sqlmock.AnyArg(), "s2", "r2", "MATCHING", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	w.flush(context.Background())
+	if stats := w.Stats(); stats.Pending != 0 || stats.FlushedRows != 2 || stats.DroppedRows != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+// 重複以外も含めて失敗はすべて書き直す。書けたことにはしない
+func TestRideStatusBatchWriterRetriesDuplicateError(t *testing.T) {
+	mock := setupMockDB(t)
+	w := newRideStatusBatchWriter(time.Second, 10, 2)
+	w.enqueue(rideStatusRow{ID: "s1", RideID: "r1", Status: "MATCHING", CreatedAt: time.Now()})
+
+	mock.ExpectExec(`INSERT INTO ride_statuses`).WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	w.flush(context.Background())
+	if stats := w.Stats(); stats.Pending != 1 || stats.FlushedRows != 0 || stats.RetriedRows != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
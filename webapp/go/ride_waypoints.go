@@ -0,0 +1,122 @@
+// webapp/go/ride_waypoints.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 経由地つきのライド
+// 経由地はride_waypointsに順番に持ち、ridesには経由地を含めた経路の距離(route_distance)を入れておく
+// route_distanceがNULLなら経由地はないので、運賃の計算や通知でride_waypointsを読まない
+// 乗せた後(CARRYING)に椅子が次の経由地に着いたらarrived_atを入れ、すべて回るまでは目的地に着いてもARRIVEDにしない
+var maxRideWaypoints = getEnvInt("ISUCON_RIDE_MAX_WAYPOINTS", 5)
+
+// 配車位置から経由地を順に回って目的地に着くまでの距離
+func routeDistance(pickup Coordinate, waypoints []Coordinate, destination Coordinate) int {
+	distance := 0
+	from := pickup
+	for _, to := range waypoints {
+		distance += calculateDistance(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+		from = to
+	}
+	return distance + calculateDistance(from.Latitude, from.Longitude, destination.Latitude, destination.Longitude)
+}
+
+// ライドの運賃を求める距離
+func rideDistance(ride *Ride) int {
+	if ride.RouteDistance != nil {
+		return *ride.RouteDistance
+	}
+	return calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+}
+
+func validateWaypoints(waypoints []Coordinate) error {
+	if len(waypoints) > maxRideWaypoints {
+		return fmt.Errorf("too many waypoints (max %d)", maxRideWaypoints)
+	}
+	for i := range waypoints {
+		if err := validateCoordinate(&waypoints[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertRideWaypoints(ctx context.Context, tx *sqlx.Tx, rideID string, waypoints []Coordinate) error {
+	rows := make([]RideWaypoint, len(waypoints))
+	for i, w := range waypoints {
+		rows[i] = RideWaypoint{RideID: rideID, Seq: i, Latitude: w.Latitude, Longitude: w.Longitude}
+	}
+	_, err := tx.NamedExecContext(ctx, `INSERT INTO ride_waypoints (ride_id, seq, latitude, longitude) VALUES (:ride_id, :seq, :latitude, :longitude)`, rows)
+	return err
+}
+
+// 通知に載せる経路の進み具合
+type rideRouteProgress struct {
+	Waypoints []rideWaypointProgress `json:"waypoints"`
+	// 走っている区間。0なら配車位置から最初の経由地、len(waypoints)なら最後の経由地から目的地
+	CurrentLeg int `json:"current_leg"`
+}
+
+type rideWaypointProgress struct {
+	Coordinate Coordinate `json:"coordinate"`
+	// UNIXミリ秒。まだ着いていなければ省略する
+	ArrivedAt *int64 `json:"arrived_at,omitempty"`
+}
+
+// 経由地のないライドならnilを返す
+func getRideRouteProgress(ctx context.Context, tx *sqlx.Tx, ride *Ride) (*rideRouteProgress, error) {
+	if ride.RouteDistance == nil {
+		return nil, nil
+	}
+	waypoints := []RideWaypoint{}
+	if err := tx.SelectContext(ctx, &waypoints, `SELECT * FROM ride_waypoints WHERE ride_id = ? ORDER BY seq`, ride.ID); err != nil {
+		return nil, err
+	}
+	progress := &rideRouteProgress{Waypoints: make([]rideWaypointProgress, len(waypoints))}
+	for i, w := range waypoints {
+		progress.Waypoints[i].Coordinate = Coordinate{Latitude: w.Latitude, Longitude: w.Longitude}
+		if w.ArrivedAt != nil {
+			arrivedAt := w.ArrivedAt.UnixMilli()
+			progress.Waypoints[i].ArrivedAt = &arrivedAt
+			progress.CurrentLeg = i + 1
+		}
+	}
+	return progress, nil
+}
+
+// 通知のバージョンに使う状態。経由地に着くたびに変わるよう、乗せた後は回った経由地の数を付ける
+// 最初の区間ではステータスそのものにして、ステータスの追加でPublishした状態と揃える
+func notificationProgress(status string, route *rideRouteProgress) string {
+	if route == nil || route.CurrentLeg == 0 || status != "CARRYING" {
+		return status
+	}
+	return fmt.Sprintf("%s#%d", status, route.CurrentLeg)
+}
+
+// 椅子の位置が次の経由地ならそこに着いたことにする。着いたら更新した進み具合を返す
+// まだ回っていない経由地が残っているかも返す
+func arriveAtWaypoint(ctx context.Context, tx *sqlx.Tx, ride *Ride, at *Coordinate, now time.Time) (*rideRouteProgress, bool, error) {
+	route, err := getRideRouteProgress(ctx, tx, ride)
+	if err != nil || route == nil {
+		return nil, false, err
+	}
+	if route.CurrentLeg >= len(route.Waypoints) {
+		return nil, false, nil
+	}
+	next := &route.Waypoints[route.CurrentLeg]
+	if next.Coordinate != *at {
+		return nil, true, nil
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE ride_waypoints SET arrived_at = ? WHERE ride_id = ? AND seq = ?`, now, ride.ID, route.CurrentLeg); err != nil {
+		return nil, false, err
+	}
+	arrivedAt := now.UnixMilli()
+	next.ArrivedAt = &arrivedAt
+	route.CurrentLeg++
+	return route, route.CurrentLeg < len(route.Waypoints), nil
+}
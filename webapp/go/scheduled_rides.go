@@ -0,0 +1,164 @@
+// webapp/go/scheduled_rides.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// 日時を指定したライドの予約
+// 予約はscheduled_ridesに置いておき、予約日時のlead前になったらスケジューラがライドを作ってマッチングに回す
+// 作ったライドはユーザーの最新のライドになるので、椅子の割り当ては通常のライドと同じく通知で届く
+// その時点で進行中のライドがあれば、終わるまで次の実行に持ち越す
+type rideScheduler struct {
+	lead      time.Duration
+	interval  time.Duration
+	batchSize int
+}
+
+// 受け付ける予約日時の上限(今からの時間)
+var scheduledRideMaxAhead = getEnvDuration("ISUCON_SCHEDULED_RIDE_MAX_AHEAD", 7*24*time.Hour)
+
+func newRideScheduler() *rideScheduler {
+	return &rideScheduler{
+		lead:      getEnvDuration("ISUCON_SCHEDULED_RIDE_LEAD", time.Minute),
+		interval:  getEnvDuration("ISUCON_SCHEDULED_RIDE_INTERVAL", time.Second),
+		batchSize: getEnvInt("ISUCON_SCHEDULED_RIDE_BATCH_SIZE", 100),
+	}
+}
+
+func (s *rideScheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.dispatch(ctx, time.Now()); err != nil {
+			slog.Error("failed to dispatch scheduled rides", "error", err)
+		}
+	}
+}
+
+func (s *rideScheduler) dispatch(ctx context.Context, now time.Time) error {
+	due := []string{}
+	if err := db.SelectContext(
+		ctx,
+		&due,
+		`SELECT id FROM scheduled_rides WHERE ride_id IS NULL AND scheduled_at <= ? ORDER BY scheduled_at LIMIT ?`,
+		now.Add(s.lead), s.batchSize,
+	); err != nil {
+		return err
+	}
+
+	for _, id := range due {
+		ride, err := s.start(ctx, id)
+		if err != nil {
+			if errorCode(err) == errCodeRideAlreadyExists {
+				continue
+			}
+			return err
+		}
+		if ride != nil {
+			slog.Info("started scheduled ride", "scheduled_ride_id", id, "ride_id", ride.ID)
+		}
+	}
+	return nil
+}
+
+// 予約からライドを作る。他のサーバーが先に作っていたらnilを返す
+func (s *rideScheduler) start(ctx context.Context, id string) (*Ride, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer rollbackTx(tx)
+
+	scheduled := ScheduledRide{}
+	if err := tx.GetContext(ctx, &scheduled, `SELECT * FROM scheduled_rides WHERE id = ? FOR UPDATE`, id); err != nil {
+		return nil, err
+	}
+	if scheduled.RideID.Valid {
+		return nil, nil
+	}
+
+	ride, _, err := insertRide(
+		ctx, tx, ulid.Make().String(), scheduled.UserID,
+		Coordinate{Latitude: scheduled.PickupLatitude, Longitude: scheduled.PickupLongitude},
+		Coordinate{Latitude: scheduled.DestinationLatitude, Longitude: scheduled.DestinationLongitude},
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE scheduled_rides SET ride_id = ? WHERE id = ?`, ride.ID, id); err != nil {
+		return nil, err
+	}
+	if err := commitTx(tx); err != nil {
+		return nil, err
+	}
+	addPendingRide(ride)
+	return ride, nil
+}
+
+type appPostScheduledRidesRequest struct {
+	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// UNIXミリ秒
+	ScheduledAt int64 `json:"scheduled_at"`
+}
+
+type appPostScheduledRidesResponse struct {
+	ScheduledRideID string `json:"scheduled_ride_id"`
+	ScheduledAt     int64  `json:"scheduled_at"`
+	// 割引前の見積もり。クーポンはライドを作るときに紐づける
+	Fare int `json:"fare"`
+}
+
+func appPostScheduledRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPostScheduledRidesRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.PickupCoordinate == nil || req.DestinationCoordinate == nil {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
+		return
+	}
+	now := time.Now()
+	scheduledAt := time.UnixMilli(req.ScheduledAt)
+	if !scheduledAt.After(now) {
+		writeError(w, http.StatusBadRequest, errors.New("scheduled_at must be in the future"))
+		return
+	}
+	if scheduledAt.Sub(now) > scheduledRideMaxAhead {
+		writeError(w, http.StatusBadRequest, errors.New("scheduled_at is too far in the future"))
+		return
+	}
+
+	user := ctx.Value("user").(*User)
+	id := ulid.Make().String()
+	if _, err := db.ExecContext(
+		ctx,
+		`INSERT INTO scheduled_rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, scheduled_at)
+				  VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		id, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, scheduledAt,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, &appPostScheduledRidesResponse{
+		ScheduledRideID: id,
+		ScheduledAt:     scheduledAt.UnixMilli(),
+		Fare:            calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude),
+	})
+}
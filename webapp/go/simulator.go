@@ -0,0 +1,99 @@
+// webapp/go/simulator.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// ローカル開発用: 環境変数で椅子シミュレーターをプロセス内で動かす
+// 椅子はモデルの速度で配車位置・目的地へ移動してステータスを進め、マッチングも一定間隔で回すので、
+// ノートPC上でフロントエンドからライドを頼むだけでエンドツーエンドで動作を確認できる
+type devSimulatorConfig struct {
+	Chairs           int
+	PollInterval     time.Duration
+	MatchingInterval time.Duration
+	CoordinateMax    int
+}
+
+func loadDevSimulatorConfig() devSimulatorConfig {
+	return devSimulatorConfig{
+		Chairs:           getEnvInt("ISUCON_DEV_SIMULATOR_CHAIRS", 0),
+		PollInterval:     getEnvDuration("ISUCON_DEV_SIMULATOR_POLL_INTERVAL", 100*time.Millisecond),
+		MatchingInterval: getEnvDuration("ISUCON_DEV_SIMULATOR_MATCHING_INTERVAL", 500*time.Millisecond),
+		CoordinateMax:    getEnvInt("ISUCON_DEV_SIMULATOR_COORDINATE_MAX", 100),
+	}
+}
+
+func startDevSimulator(ctx context.Context, c devSimulatorConfig) {
+	baseURL := getEnv("ISUCON_LOADGEN_BASE_URL", "http://127.0.0.1"+config.ListenAddr)
+	if err := waitForServer(ctx, baseURL); err != nil {
+		slog.Error("simulator: server did not start", "error", err)
+		return
+	}
+
+	owner := newSyntheticClient(baseURL)
+	registerToken, err := owner.registerOwner(ctx)
+	if err != nil {
+		slog.Error("simulator: failed to register owner", "error", err)
+		return
+	}
+	models := []string{}
+	if err := db.SelectContext(ctx, &models, "SELECT name FROM chair_models"); err != nil || len(models) == 0 {
+		slog.Error("simulator: failed to load chair models", "error", err)
+		return
+	}
+
+	for i := 0; i < c.Chairs; i++ {
+		chair := &syntheticChair{
+			client:       newSyntheticClient(baseURL),
+			pollInterval: c.PollInterval,
+			position:     randomCoordinate(c.CoordinateMax),
+		}
+		if err := chair.register(ctx, registerToken, models[rand.IntN(len(models))]); err != nil {
+			slog.Error("simulator: failed to register chair", "error", err)
+			continue
+		}
+		go chair.run(ctx, c.CoordinateMax, func(err error) {
+			slog.Warn("simulator: chair step failed", "error", err)
+		})
+	}
+	slog.Info("simulator: chairs started", "chairs", c.Chairs)
+
+	if c.MatchingInterval > 0 {
+		go runMatchingLoop(ctx, owner, c.MatchingInterval)
+	}
+}
+
+// 本番ではインスタンス内のスクリプトが叩くマッチングAPIを一定間隔で叩く
+func runMatchingLoop(ctx context.Context, client *syntheticClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := client.do(ctx, http.MethodGet, "/api/internal/matching", nil, nil); err != nil && ctx.Err() == nil {
+			slog.Warn("simulator: matching failed", "error", err)
+		}
+	}
+}
+
+func waitForServer(ctx context.Context, baseURL string) error {
+	client := newSyntheticClient(baseURL)
+	for {
+		if err := client.do(ctx, http.MethodGet, "/health", nil, nil); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
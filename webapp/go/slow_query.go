@@ -0,0 +1,224 @@
+// webapp/go/slow_query.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// thresholdより遅かったクエリをSQL・引数・所要時間付きでログに出し、遅い順に上位limit件を覚えておく
+// ドライバを包んで測るので、db/tx/レプリカのどこから投げたクエリも対象になる
+// 所要時間はクエリを投げてから結果(SELECTなら最初の行)が返るまで
+const slowQueryDriverName = "mysql-slowlog"
+
+type slowQueryEntry struct {
+	Query      string    `json:"query"`
+	Args       []any     `json:"args"`
+	DurationMs float64   `json:"duration_ms"`
+	At         time.Time `json:"at"`
+}
+
+type slowQueryLog struct {
+	enabled   bool
+	threshold time.Duration
+	limit     int
+
+	mu sync.Mutex
+	// 遅い順
+	entries []slowQueryEntry
+}
+
+var slowQueries = &slowQueryLog{
+	enabled:   getEnvBool("ISUCON_SLOW_QUERY_LOG", false),
+	threshold: getEnvDuration("ISUCON_SLOW_QUERY_THRESHOLD", 100*time.Millisecond),
+	limit:     getEnvInt("ISUCON_SLOW_QUERY_TOP", 50),
+}
+
+func init() {
+	sql.Register(slowQueryDriverName, slowQueryDriver{})
+	sqlx.BindDriver(slowQueryDriverName, sqlx.QUESTION)
+}
+
+// openDBで使うドライバ名
+func dbDriverName() string {
+	if slowQueries.enabled {
+		return slowQueryDriverName
+	}
+	return "mysql"
+}
+
+func (l *slowQueryLog) observe(query string, args []driver.NamedValue, elapsed time.Duration) {
+	if elapsed < l.threshold {
+		return
+	}
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	slog.Warn("slow query", "query", query, "args", values, "duration", elapsed)
+
+	entry := slowQueryEntry{
+		Query:      query,
+		Args:       values,
+		DurationMs: float64(elapsed) / float64(time.Millisecond),
+		At:         time.Now(),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit <= 0 || len(l.entries) >= l.limit && l.entries[len(l.entries)-1].DurationMs >= entry.DurationMs {
+		return
+	}
+	i := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].DurationMs < entry.DurationMs })
+	l.entries = append(l.entries, slowQueryEntry{})
+	copy(l.entries[i+1:], l.entries[i:])
+	l.entries[i] = entry
+	if len(l.entries) > l.limit {
+		l.entries = l.entries[:l.limit]
+	}
+}
+
+func (l *slowQueryLog) Top() []slowQueryEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]slowQueryEntry{}, l.entries...)
+}
+
+func (l *slowQueryLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = nil
+}
+
+type internalGetSlowQueriesResponse struct {
+	Enabled     bool             `json:"enabled"`
+	ThresholdMs float64          `json:"threshold_ms"`
+	Queries     []slowQueryEntry `json:"queries"`
+}
+
+func internalGetSlowQueries(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &internalGetSlowQueriesResponse{
+		Enabled:     slowQueries.enabled,
+		ThresholdMs: float64(slowQueries.threshold) / float64(time.Millisecond),
+		Queries:     slowQueries.Top(),
+	})
+}
+
+type slowQueryDriver struct{}
+
+func (slowQueryDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := mysql.MySQLDriver{}.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &slowQueryConn{Conn: conn}, nil
+}
+
+// mysqlの接続が実装しているインターフェースはそのまま委ねる
+type slowQueryConn struct {
+	driver.Conn
+}
+
+func (c *slowQueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	res, err := execer.ExecContext(ctx, query, args)
+	// ErrSkipならプリペアドステートメントで投げ直されるので、そちらで測る
+	if err != driver.ErrSkip {
+		slowQueries.observe(query, args, time.Since(start))
+	}
+	return res, err
+}
+
+func (c *slowQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		slowQueries.observe(query, args, time.Since(start))
+	}
+	return rows, err
+}
+
+func (c *slowQueryConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &slowQueryStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c *slowQueryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *slowQueryConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *slowQueryConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *slowQueryConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *slowQueryConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// mysqlのステートメントはcontext付きのExec/Queryを実装している
+type slowQueryStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *slowQueryStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	slowQueries.observe(s.query, args, time.Since(start))
+	return res, err
+}
+
+func (s *slowQueryStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	slowQueries.observe(s.query, args, time.Since(start))
+	return rows, err
+}
@@ -0,0 +1,52 @@
+// webapp/go/sse.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 通知APIはAccept: text/event-streamならServer-Sent Eventsで変化を送り続ける
+// サーバーのWriteTimeoutは外し、30秒のリクエストタイムアウトで切れたらクライアントにはすぐに繋ぎ直させる
+var (
+	sseRetry = getEnvDuration("ISUCON_SSE_RETRY", 100*time.Millisecond)
+	// コミット前に知らせを受けて変化を読み損ねたときや、ステータスの書き込みがバッファリングで遅れたときのために定期的にも読み直す
+	sseFallbackInterval = getEnvDuration("ISUCON_SSE_FALLBACK_INTERVAL", time.Second)
+)
+
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func startEventStream(w http.ResponseWriter) (*eventStream, error) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	s := &eventStream{w: w, rc: http.NewResponseController(w)}
+	// 外せないResponseWriterでは、WriteTimeoutで切れてから繋ぎ直させる
+	_ = s.rc.SetWriteDeadline(time.Time{})
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds()); err != nil {
+		return nil, err
+	}
+	return s, s.rc.Flush()
+}
+
+func (s *eventStream) Send(event string, data any) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, buf); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
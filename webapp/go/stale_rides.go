@@ -0,0 +1,126 @@
+// webapp/go/stale_rides.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// 椅子を割り当てたのにMATCHING/ENROUTEのまま進まないライドを見つけて、マッチングからやり直させる
+// 最後のステータスからも椅子の最後の位置送信からもtimeout以上経っていたら、椅子が応答しなくなったとみなす
+// 椅子は割り当てを外して稼働を止め(再開するにはactivityを送り直す)、ライドにはMATCHINGを積んで待ち行列に戻す
+type staleRideReassigner struct {
+	timeout  time.Duration
+	interval time.Duration
+}
+
+func newStaleRideReassigner() *staleRideReassigner {
+	return &staleRideReassigner{
+		timeout:  getEnvDuration("ISUCON_STALE_RIDE_TIMEOUT", 0),
+		interval: getEnvDuration("ISUCON_STALE_RIDE_INTERVAL", 5*time.Second),
+	}
+}
+
+func (s *staleRideReassigner) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.reassign(ctx, time.Now()); err != nil {
+			slog.Error("failed to reassign stale rides", "error", err)
+		}
+	}
+}
+
+type staleRide struct {
+	ID      string `db:"id"`
+	ChairID string `db:"chair_id"`
+}
+
+func (s *staleRideReassigner) reassign(ctx context.Context, now time.Time) error {
+	cutoff := now.Add(-s.timeout)
+	candidates := []staleRide{}
+	if err := db.SelectContext(
+		ctx,
+		&candidates,
+		`SELECT id, chair_id FROM rides
+WHERE active_chair_id IS NOT NULL
+  AND NOT EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = rides.id AND (rs.status NOT IN ('MATCHING', 'ENROUTE') OR rs.created_at >= ?))`,
+		cutoff,
+	); err != nil {
+		return err
+	}
+
+	for _, ride := range candidates {
+		if chair, ok := chairAvailability.LastLocation(ride.ChairID); ok && chair.LocatedAt.After(cutoff) {
+			continue
+		}
+		if err := s.unassign(ctx, ride); err != nil {
+			return err
+		}
+		slog.Warn("reassigned stale ride", "ride_id", ride.ID, "chair_id", ride.ChairID)
+	}
+	return nil
+}
+
+func (s *staleRideReassigner) unassign(ctx context.Context, stale staleRide) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer rollbackTx(tx)
+
+	// ステータスを確かめている間に椅子が進めていたら何もしない
+	status, err := getLatestRideStatus(ctx, tx, stale.ID)
+	if err != nil {
+		return err
+	}
+	if status != "MATCHING" && status != "ENROUTE" {
+		return nil
+	}
+	result, err := tx.ExecContext(ctx, `UPDATE rides SET chair_id = NULL, active_chair_id = NULL, pickup_eta_ms = NULL WHERE id = ? AND chair_id = ?`, stale.ID, stale.ChairID)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE chairs SET is_active = FALSE WHERE id = ?`, stale.ChairID); err != nil {
+		return err
+	}
+	chair, err := reposFrom(ctx).Chairs.With(tx).Get(ctx, stale.ChairID)
+	if err != nil {
+		return err
+	}
+	if err := enqueueChairDeactivatedWebhook(ctx, reposFrom(ctx).Webhooks.With(tx), chair, "timed_out"); err != nil {
+		return err
+	}
+	if err := logRideEvent(ctx, tx, stale.ID, rideEventUnassigned, rideUnassignedPayload{ChairID: stale.ChairID, Reason: "chair timed out"}); err != nil {
+		return err
+	}
+	if err := updateRideStatus(ctx, tx, stale.ID, "MATCHING"); err != nil {
+		return err
+	}
+	ride, err := reposFrom(ctx).Rides.With(tx).Get(ctx, stale.ID)
+	if err != nil {
+		return err
+	}
+	if err := commitTx(tx); err != nil {
+		return err
+	}
+
+	// 椅子の最新のライドが割り当てを外したライドではなくなる
+	notifications.Forget(chairNotificationKey(stale.ChairID))
+	chairAvailability.SetActive(stale.ChairID, false)
+	chairCache.Refresh(ctx, stale.ChairID)
+	chairAvailability.Release(stale.ChairID, stale.ID)
+	pendingRides.Add(ride)
+	return nil
+}
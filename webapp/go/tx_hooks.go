@@ -0,0 +1,49 @@
+// webapp/go/tx_hooks.go
+package main
+
+import (
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// コミットしてから行う処理(メモリ上のキャッシュや通知の更新)をトランザクションごとに積んでおく
+// ロールバックしたら捨てるので、コミットされなかった変更がキャッシュや通知に漏れない
+// afterCommitを使うトランザクションは、commitTxでコミットし、defer rollbackTxで後始末する
+var txHooks sync.Map // map[*sqlx.Tx]*txHookList
+
+type txHookList struct {
+	mu  sync.Mutex
+	fns []func()
+}
+
+func afterCommit(tx *sqlx.Tx, fn func()) {
+	v, _ := txHooks.LoadOrStore(tx, &txHookList{})
+	hooks := v.(*txHookList)
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	hooks.fns = append(hooks.fns, fn)
+}
+
+// コミットに成功したら、積んだ処理を積んだ順に行う
+func commitTx(tx *sqlx.Tx) error {
+	v, ok := txHooks.LoadAndDelete(tx)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if ok {
+		hooks := v.(*txHookList)
+		hooks.mu.Lock()
+		defer hooks.mu.Unlock()
+		for _, fn := range hooks.fns {
+			fn()
+		}
+	}
+	return nil
+}
+
+// ロールバックして積んだ処理を捨てる。コミット済みなら何もしない
+func rollbackTx(tx *sqlx.Tx) {
+	txHooks.Delete(tx)
+	tx.Rollback()
+}
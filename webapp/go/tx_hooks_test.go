@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAfterCommitRunsOnlyOnCommit(t *testing.T) {
+	mock := setupMockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rolledBack := false
+	afterCommit(tx, func() { rolledBack = true })
+	rollbackTx(tx)
+	if rolledBack {
+		t.Error("hook ran after rollback")
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+	tx, err = db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := []int{}
+	afterCommit(tx, func() { order = append(order, 1) })
+	afterCommit(tx, func() { order = append(order, 2) })
+	if len(order) != 0 {
+		t.Fatal("hook ran before commit")
+	}
+	if err := commitTx(tx); err != nil {
+		t.Fatal(err)
+	}
+	// コミット後のdefer rollbackTxでは何もしない
+	rollbackTx(tx)
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Errorf("hooks ran as %v, want [1 2]", order)
+	}
+}
@@ -0,0 +1,262 @@
+// webapp/go/websocket.go
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 椅子との双方向の通信に使う最小限のWebSocket(RFC 6455)のサーバー側の実装
+// テキストメッセージ、ping/pong、closeだけを扱い、拡張やサブプロトコルには対応しない
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+const (
+	wsCloseNormal      = 1000
+	wsCloseGoingAway   = 1001
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooBig      = 1009
+)
+
+var (
+	wsMaxMessageSize = getEnvInt("ISUCON_WS_MAX_MESSAGE_SIZE", 64<<10)
+	wsWriteTimeout   = getEnvDuration("ISUCON_WS_WRITE_TIMEOUT", 5*time.Second)
+)
+
+var (
+	errWebSocketClosed  = errors.New("websocket closed")
+	errWebSocketTooBig  = errors.New("websocket message too big")
+	errWebSocketInvalid = errors.New("websocket protocol error")
+)
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") && headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// 書き込みは通知を送るgoroutineと受信への応答が並行して行う
+	mu     sync.Mutex
+	closed bool
+}
+
+// HTTPの接続をWebSocketに切り替える。失敗したらエラーレスポンスを書いてから返す
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet || !isWebSocketUpgrade(r) {
+		err := errors.New("websocket upgrade required")
+		w.Header().Set("Upgrade", "websocket")
+		writeError(w, http.StatusUpgradeRequired, err)
+		return nil, err
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		err := errors.New("unsupported websocket version")
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, http.StatusBadRequest, err)
+		return nil, err
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		err := errors.New("Sec-WebSocket-Key is required")
+		writeError(w, http.StatusBadRequest, err)
+		return nil, err
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, err
+	}
+	// Hijackするとサーバーが設定した期限は外れる
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: rw.Reader}, nil
+}
+
+// 次のテキストかバイナリのメッセージを読む。pingには応答し、closeを受けたらerrWebSocketClosedを返す
+func (c *wsConn) ReadMessage() (int, []byte, error) {
+	opcode := -1
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.Close(wsCloseNormal)
+			return 0, nil, errWebSocketClosed
+		case wsOpText, wsOpBinary:
+			if opcode != -1 {
+				return 0, nil, c.fail(wsCloseProtocol, errWebSocketInvalid)
+			}
+			opcode = op
+		case wsOpContinuation:
+			if opcode == -1 {
+				return 0, nil, c.fail(wsCloseProtocol, errWebSocketInvalid)
+			}
+		default:
+			return 0, nil, c.fail(wsCloseProtocol, errWebSocketInvalid)
+		}
+
+		if len(message)+len(payload) > wsMaxMessageSize {
+			return 0, nil, c.fail(wsCloseTooBig, errWebSocketTooBig)
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (bool, int, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	op := int(head[0] & 0x0f)
+	masked := head[1]&0x80 != 0
+	// クライアントからのフレームは必ずマスクされる。拡張は使わないのでRSVも立たない
+	if head[0]&0x70 != 0 || !masked {
+		return false, 0, nil, c.fail(wsCloseProtocol, errWebSocketInvalid)
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (!fin || length > 125) {
+		return false, 0, nil, c.fail(wsCloseProtocol, errWebSocketInvalid)
+	}
+	if length > uint64(wsMaxMessageSize) {
+		return false, 0, nil, c.fail(wsCloseTooBig, errWebSocketTooBig)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+func (c *wsConn) writeFrame(op int, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errWebSocketClosed
+	}
+
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|byte(op))
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) WriteJSON(v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsOpText, buf)
+}
+
+// closeフレームを送って接続を閉じる。何度呼んでもよい
+func (c *wsConn) Close(code int) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	err := c.writeFrame(wsOpClose, payload)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *wsConn) fail(code int, err error) error {
+	c.Close(code)
+	return err
+}
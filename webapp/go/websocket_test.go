@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type wsTestFrame struct {
+	fin     bool
+	op      int
+	payload []byte
+}
+
+// クライアントとしてフレームを組み立てる。クライアントからのフレームはマスクする
+func wsClientFrame(fin bool, op int, payload []byte) []byte {
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// サーバーからのフレームを読む。サーバーからのフレームはマスクしない
+func readServerFrame(br *bufio.Reader) (wsTestFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return wsTestFrame{}, err
+	}
+	if head[1]&0x80 != 0 {
+		return wsTestFrame{}, errors.New("server frame is masked")
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(br, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(br, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return wsTestFrame{}, err
+	}
+	return wsTestFrame{fin: head[0]&0x80 != 0, op: int(head[0] & 0x0f), payload: payload}, nil
+}
+
+// net.Pipeでつないだサーバー側のwsConnを作り、clientから送ったバイト列を読ませる
+// サーバーが送ったフレームは、接続が閉じたらframes()で受け取れる
+func newTestWebSocket(t *testing.T, send ...[]byte) (*wsConn, func() []wsTestFrame) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close(); client.Close() })
+
+	go func() {
+		for _, b := range send {
+			if _, err := client.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	done := make(chan []wsTestFrame)
+	go func() {
+		frames := []wsTestFrame{}
+		br := bufio.NewReader(client)
+		for {
+			f, err := readServerFrame(br)
+			if err != nil {
+				done <- frames
+				return
+			}
+			frames = append(frames, f)
+		}
+	}()
+	c := &wsConn{conn: server, br: bufio.NewReader(server)}
+	return c, func() []wsTestFrame {
+		c.Close(wsCloseNormal)
+		return <-done
+	}
+}
+
+func closeCode(f wsTestFrame) int {
+	if f.op != wsOpClose || len(f.payload) < 2 {
+		return -1
+	}
+	return int(binary.BigEndian.Uint16(f.payload))
+}
+
+func TestWebSocketUnmasksFrame(t *testing.T) {
+	// RFC 6455 5.7のマスクした"Hello"
+	c, _ := newTestWebSocket(t, []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58})
+	op, msg, err := c.ReadMessage()
+	if err != nil || op != wsOpText || string(msg) != "Hello" {
+		t.Fatalf("op = %d, msg = %q, err = %v", op, msg, err)
+	}
+}
+
+func TestWebSocketExtendedPayloadLength(t *testing.T) {
+	prev := wsMaxMessageSize
+	wsMaxMessageSize = 1 << 20
+	t.Cleanup(func() { wsMaxMessageSize = prev })
+
+	for _, n := range []int{125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte("x"), n)
+		c, _ := newTestWebSocket(t, wsClientFrame(true, wsOpBinary, payload))
+		op, msg, err := c.ReadMessage()
+		if err != nil || op != wsOpBinary || !bytes.Equal(msg, payload) {
+			t.Fatalf("%d bytes: op = %d, len = %d, err = %v", n, op, len(msg), err)
+		}
+	}
+}
+
+// 分割したメッセージをつなげる。間に挟まったpingにはpongを返す
+func TestWebSocketReassemblesFragments(t *testing.T) {
+	c, frames := newTestWebSocket(t,
+		wsClientFrame(false, wsOpText, []byte("Hel")),
+		wsClientFrame(true, wsOpPing, []byte("ping")),
+		wsClientFrame(false, wsOpContinuation, []byte("lo, ")),
+		wsClientFrame(true, wsOpContinuation, []byte("world")),
+	)
+	op, msg, err := c.ReadMessage()
+	if err != nil || op != wsOpText || string(msg) != "Hello, world" {
+		t.Fatalf("op = %d, msg = %q, err = %v", op, msg, err)
+	}
+	got := frames()
+	if len(got) != 2 || got[0].op != wsOpPong || string(got[0].payload) != "ping" || closeCode(got[1]) != wsCloseNormal {
+		t.Fatalf("server sent %+v", got)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	unmasked := wsClientFrame(true, wsOpText, []byte("hi"))
+	unmasked[1] &^= 0x80
+	rsv := wsClientFrame(true, wsOpText, []byte("hi"))
+	rsv[0] |= 0x40
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+		err    error
+		code   int
+	}{
+		{"unmasked", [][]byte{unmasked}, errWebSocketInvalid, wsCloseProtocol},
+		{"rsv", [][]byte{rsv}, errWebSocketInvalid, wsCloseProtocol},
+		{"unknown opcode", [][]byte{wsClientFrame(true, 0x3, nil)}, errWebSocketInvalid, wsCloseProtocol},
+		{"continuation first", [][]byte{wsClientFrame(true, wsOpContinuation, []byte("x"))}, errWebSocketInvalid, wsCloseProtocol},
+		{"new message inside fragments", [][]byte{
+			wsClientFrame(false, wsOpText, []byte("a")),
+			wsClientFrame(true, wsOpText, []byte("b")),
+		}, errWebSocketInvalid, wsCloseProtocol},
+		{"fragmented ping", [][]byte{wsClientFrame(false, wsOpPing, nil)}, errWebSocketInvalid, wsCloseProtocol},
+		{"long ping", [][]byte{wsClientFrame(true, wsOpPing, bytes.Repeat([]byte("x"), 126))}, errWebSocketInvalid, wsCloseProtocol},
+		{"too big frame", [][]byte{wsClientFrame(true, wsOpText, bytes.Repeat([]byte("x"), wsMaxMessageSize+1))}, errWebSocketTooBig, wsCloseTooBig},
+		{"too big message", [][]byte{
+			wsClientFrame(false, wsOpText, bytes.Repeat([]byte("x"), wsMaxMessageSize)),
+			wsClientFrame(true, wsOpContinuation, []byte("x")),
+		}, errWebSocketTooBig, wsCloseTooBig},
+		{"close", [][]byte{wsClientFrame(true, wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseGoingAway))}, errWebSocketClosed, wsCloseNormal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, frames := newTestWebSocket(t, tt.frames...)
+			if _, _, err := c.ReadMessage(); err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			got := frames()
+			if len(got) != 1 || closeCode(got[0]) != tt.code {
+				t.Fatalf("server sent %+v, want close %d", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestWebSocketWriteFrame(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte("y"), n)
+		c, frames := newTestWebSocket(t)
+		if err := c.writeFrame(wsOpText, payload); err != nil {
+			t.Fatal(err)
+		}
+		got := frames()
+		if len(got) != 2 || !got[0].fin || got[0].op != wsOpText || !bytes.Equal(got[0].payload, payload) {
+			t.Fatalf("%d bytes: server sent %d frames", n, len(got))
+		}
+	}
+}
+
+func TestWebSocketCloseIsIdempotent(t *testing.T) {
+	c, frames := newTestWebSocket(t)
+	if err := c.Close(wsCloseGoingAway); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(wsCloseNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteJSON(map[string]string{}); err != errWebSocketClosed {
+		t.Fatalf("err = %v", err)
+	}
+	got := frames()
+	if len(got) != 1 || closeCode(got[0]) != wsCloseGoingAway {
+		t.Fatalf("server sent %+v", got)
+	}
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.writeFrame(wsOpText, msg)
+		c.Close(wsCloseNormal)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"not upgrade", map[string]string{}, http.StatusUpgradeRequired},
+		{"old version", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, http.StatusBadRequest},
+		{"no key", map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+	} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, res.StatusCode, tt.want)
+		}
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 6455 1.3の例
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("status = %d, header = %v", res.StatusCode, res.Header)
+	}
+	conn.Write(wsClientFrame(true, wsOpText, []byte("echo")))
+	if f, err := readServerFrame(br); err != nil || f.op != wsOpText || string(f.payload) != "echo" {
+		t.Fatalf("frame = %+v, err = %v", f, err)
+	}
+	if f, err := readServerFrame(br); err != nil || closeCode(f) != wsCloseNormal {
+		t.Fatalf("frame = %+v, err = %v", f, err)
+	}
+}
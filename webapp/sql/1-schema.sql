@@ -3,6 +3,9 @@ SET CHARACTER_SET_CONNECTION = utf8mb4;
 
 USE isuride;
 
+-- テーブルを作り直すので、適用済みのマイグレーションの記録も消す
+DROP TABLE IF EXISTS schema_migrations;
+
 DROP TABLE IF EXISTS settings;
 CREATE TABLE settings
 (
@@ -15,8 +18,9 @@ CREATE TABLE settings
 DROP TABLE IF EXISTS chair_models;
 CREATE TABLE chair_models
 (
-  name  VARCHAR(50) NOT NULL COMMENT '椅子モデル名',
-  speed INTEGER     NOT NULL COMMENT '移動速度',
+  name      VARCHAR(50) NOT NULL COMMENT '椅子モデル名',
+  speed     INTEGER     NOT NULL COMMENT '移動速度',
+  fare_rate INTEGER     NOT NULL DEFAULT 100 COMMENT '距離運賃の倍率(%)',
   PRIMARY KEY (name)
 )
   COMMENT = '椅子モデルテーブル';
@@ -152,3 +156,54 @@ CREATE TABLE coupons
   INDEX idx_coupons_user_created (user_id, created_at)
 )
   COMMENT 'クーポンテーブル';
+
+DROP TABLE IF EXISTS ride_event_outbox;
+CREATE TABLE ride_event_outbox
+(
+  id           VARCHAR(26) NOT NULL,
+  ride_id      VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  chair_id     VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  event        VARCHAR(30) NOT NULL COMMENT 'イベント種別',
+  created_at   DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  published_at DATETIME(6) NULL COMMENT '配信日時',
+  PRIMARY KEY (id),
+  INDEX idx_ride_event_outbox_published_at (published_at)
+)
+  COMMENT = 'ライドイベントの配信待ちテーブル';
+
+DROP TABLE IF EXISTS organizations;
+CREATE TABLE organizations
+(
+  id           VARCHAR(26)  NOT NULL COMMENT '組織ID',
+  name         VARCHAR(30)  NOT NULL COMMENT '組織名',
+  invite_token VARCHAR(255) NOT NULL COMMENT 'オーナーを参加させるためのトークン',
+  created_at   DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at   DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE (invite_token)
+)
+  COMMENT = '複数のオーナーをまとめる組織テーブル';
+
+DROP TABLE IF EXISTS organization_owners;
+CREATE TABLE organization_owners
+(
+  owner_id        VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  organization_id VARCHAR(26) NOT NULL COMMENT '組織ID',
+  created_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '参加日時',
+  PRIMARY KEY (owner_id),
+  INDEX idx_organization_owners_organization_id (organization_id)
+)
+  COMMENT = '組織に所属するオーナーテーブル';
+
+DROP TABLE IF EXISTS ride_event_log;
+CREATE TABLE ride_event_log
+(
+  id         VARCHAR(26) NOT NULL,
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  event      VARCHAR(30) NOT NULL COMMENT 'イベント種別',
+  payload    JSON        NOT NULL COMMENT 'イベントの内容',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発生日時',
+  PRIMARY KEY (id),
+  INDEX idx_ride_event_log_ride_id (ride_id, id)
+)
+  COMMENT = 'ライドのライフサイクルイベントの記録テーブル';